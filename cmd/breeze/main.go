@@ -12,6 +12,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
@@ -26,6 +27,11 @@ var (
 	serverURL    string
 	nodeID       string
 	peers        []string
+
+	rebalanceInterval time.Duration
+	diskWeight        float64
+	shardWeight       float64
+	requestTimeout    time.Duration
 )
 
 func main() {
@@ -45,6 +51,10 @@ func main() {
 	startCmd.Flags().StringVar(&publicAddr, "public-addr", "127.0.0.1:8080", "Public address for discovery")
 	startCmd.Flags().StringVarP(&nodeID, "node-id", "i", "node1", "Unique node ID")
 	startCmd.Flags().StringSliceVar(&peers, "peers", []string{}, "Cluster peers (format: id=host:port)")
+	startCmd.Flags().DurationVar(&rebalanceInterval, "rebalance-interval", shard.DefaultRebalanceInterval, "How often the first peer moves shards to the nodes they belong on (0 disables)")
+	startCmd.Flags().Float64Var(&diskWeight, "placement-disk-weight", 0, "How much shards avoid nodes using more disk space than the others")
+	startCmd.Flags().Float64Var(&shardWeight, "placement-shard-weight", 0, "How much shards avoid nodes holding more shards than the others")
+	startCmd.Flags().DurationVar(&requestTimeout, "request-timeout", shard.DefaultRequestTimeout, "How long a request to another node may take, except for shard copies")
 
 	var indexCmd = &cobra.Command{
 		Use:   "index [id] [json]",
@@ -79,17 +89,22 @@ func main() {
 
 func runServer() {
 	c := cluster.NewCluster(nodeID, peers)
+	c.Placement = cluster.RendezvousPlacement{DiskWeight: diskWeight, ShardWeight: shardWeight}
 	manager, err := shard.NewManager(dbPath, numShards, c)
 	if err != nil {
 		log.Fatalf("Failed to initialize manager: %v", err)
 	}
 	defer manager.Close()
+	manager.Forwarder.Timeout = requestTimeout
 
 	// Start cluster server for internal lightweight communication
 	clusterServer := shard.NewClusterServer(manager, fmt.Sprintf(":%d", internalPort))
 	if err := clusterServer.Start(); err != nil {
 		log.Fatalf("Failed to start cluster server: %v", err)
 	}
+	if rebalanceInterval > 0 {
+		manager.StartRebalancer(rebalanceInterval)
+	}
 
 	gqlService := graphql.NewService(manager)
 	esService := elasticsearch.NewService(manager, publicAddr)
@@ -0,0 +1,62 @@
+package elasticsearch
+
+import (
+	"breeze/internal/shard"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CatShards lists the copies of the shards of the open indices and the
+// nodes holding them, as recorded in their allocation tables. A copy that
+// is being moved is RELOCATING and names the node it moves to; a new copy
+// that is still being filled is INITIALIZING.
+func (s *Service) CatShards(c *gin.Context) {
+	names := s.manager.ListIndices()
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		idx := s.manager.GetIndex(name)
+		if idx == nil || idx.Meta().State == shard.IndexStateClose {
+			continue
+		}
+		for sID, alloc := range idx.Allocation() {
+			for i, node := range alloc.Nodes {
+				prirep := "r"
+				if i == 0 {
+					prirep = "p"
+				}
+				if node == alloc.RelocatingFrom {
+					sb.WriteString(fmt.Sprintf("%s %d %s RELOCATING %s -> %s\n", name, sID, prirep, node, alloc.RelocatingTo))
+				} else {
+					sb.WriteString(fmt.Sprintf("%s %d %s STARTED %s\n", name, sID, prirep, node))
+				}
+			}
+			if alloc.RelocatingTo != "" && alloc.RelocatingFrom == "" {
+				sb.WriteString(fmt.Sprintf("%s %d r INITIALIZING %s\n", name, sID, alloc.RelocatingTo))
+			}
+		}
+	}
+	c.String(http.StatusOK, sb.String())
+}
+
+// Reroute moves the shards that are not on the nodes the cluster places
+// them on right away, instead of waiting for the next periodic rebalance.
+// Only the first node of the cluster allocates shards.
+func (s *Service) Reroute(c *gin.Context) {
+	moves, err := s.manager.Rebalance()
+	if err != nil {
+		writeError(c, err, "")
+		return
+	}
+	if moves == nil {
+		moves = []shard.ShardMove{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"acknowledged": true,
+		"moves":        moves,
+	})
+}
@@ -0,0 +1,253 @@
+package elasticsearch
+
+import (
+	"breeze/internal/shard"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultChangesLimit = 1000
+	defaultPollInterval = time.Second
+)
+
+// parseCheckpoints reads the since parameter of the changes feed, which is
+// either one checkpoint for every shard or a list of shard:checkpoint pairs
+// as returned in checkpoint events, where each checkpoint may be followed by
+// :history, the history of the shard copy it was taken on.
+func parseCheckpoints(raw string, numShards int) (map[int]uint64, map[int]string, error) {
+	since := make(map[int]uint64)
+	histories := make(map[int]string)
+	if raw == "" {
+		return since, histories, nil
+	}
+	if cp, err := strconv.ParseUint(raw, 10, 64); err == nil {
+		for i := 0; i < numShards; i++ {
+			since[i] = cp
+		}
+		return since, histories, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		sID, cp, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		n, err := strconv.Atoi(sID)
+		if !ok || err != nil || n < 0 || n >= numShards {
+			return nil, nil, fmt.Errorf("failed to parse checkpoint [%s]", pair)
+		}
+		cp, history, hasHistory := strings.Cut(cp, ":")
+		if hasHistory {
+			if history == "" {
+				return nil, nil, fmt.Errorf("failed to parse checkpoint [%s]", pair)
+			}
+			histories[n] = history
+		}
+		if since[n], err = strconv.ParseUint(cp, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse checkpoint [%s]", pair)
+		}
+	}
+	return since, histories, nil
+}
+
+func formatCheckpoints(since map[int]uint64, histories map[int]string) string {
+	shards := make([]int, 0, len(since))
+	for sID := range since {
+		shards = append(shards, sID)
+	}
+	sort.Ints(shards)
+	pairs := make([]string, len(shards))
+	for i, sID := range shards {
+		pairs[i] = fmt.Sprintf("%d:%d", sID, since[sID])
+		if history := histories[sID]; history != "" {
+			pairs[i] += ":" + history
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Changes streams the document operations of an index as NDJSON, shard by
+// shard in WAL order, followed by a checkpoint event whose value can be
+// passed as since to resume. With follow=true the stream stays open and new
+// operations are sent as they are applied, each round followed by a
+// checkpoint event.
+func (s *Service) Changes(c *gin.Context) {
+	name := c.Param("index")
+	idx := s.manager.GetIndex(name)
+	if idx == nil {
+		esError(c, http.StatusNotFound, "index_not_found_exception", "no such index ["+name+"]", name)
+		return
+	}
+
+	since, histories, err := parseCheckpoints(c.Query("since"), idx.Settings().NumberOfShards)
+	if err != nil {
+		esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+		return
+	}
+	limit := defaultChangesLimit
+	if raw := c.Query("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+			esError(c, http.StatusBadRequest, "illegal_argument_exception", "failed to parse limit ["+raw+"]", name)
+			return
+		}
+	}
+	interval := defaultPollInterval
+	if raw := c.Query("poll_interval"); raw != "" {
+		if interval, err = time.ParseDuration(raw); err != nil || interval <= 0 {
+			esError(c, http.StatusBadRequest, "illegal_argument_exception", "failed to parse poll_interval ["+raw+"]", name)
+			return
+		}
+	}
+	follow := c.Query("follow") == "true"
+
+	changes, err := readChanges(idx, since, histories, limit)
+	if err != nil {
+		writeError(c, err, name)
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	n := writeChanges(enc, name, changes, since, histories)
+	writeCheckpoint(enc, since, histories)
+	c.Writer.Flush()
+	if !follow {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Read again right away after a round with changes, as shards may
+		// have more than limit records pending.
+		if n == 0 {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+		changes, err := readChanges(idx, since, histories, limit)
+		if err != nil {
+			status, errType := errorStatus(err)
+			enc.Encode(gin.H{"op": "error", "status": status, "error": gin.H{"type": errType, "reason": err.Error()}})
+			c.Writer.Flush()
+			return
+		}
+		n = writeChanges(enc, name, changes, since, histories)
+		if n > 0 {
+			writeCheckpoint(enc, since, histories)
+			c.Writer.Flush()
+		}
+		if c.Request.Context().Err() != nil {
+			return
+		}
+	}
+}
+
+// Recover rebuilds an index as it was at a point in time into a new index,
+// from the WAL history of its shards. The body selects the point with
+// "as_of" (RFC 3339 or Unix milliseconds) or "checkpoint", a checkpoint as
+// accepted by the changes feed.
+func (s *Service) Recover(c *gin.Context) {
+	name := c.Param("index")
+	target := c.Param("target")
+	idx := s.manager.GetIndex(name)
+	if idx == nil {
+		esError(c, http.StatusNotFound, "index_not_found_exception", "no such index ["+name+"]", name)
+		return
+	}
+
+	var body struct {
+		AsOf       string `json:"as_of"`
+		Checkpoint string `json:"checkpoint"`
+	}
+	if err := readBody(c, &body); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), name)
+		return
+	}
+	req := shard.RecoverRequest{Dest: target}
+	var err error
+	if body.AsOf != "" {
+		if req.AsOf, err = parseTime(body.AsOf); err != nil {
+			esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+			return
+		}
+	}
+	if body.Checkpoint != "" {
+		if req.Checkpoints, req.Histories, err = parseCheckpoints(body.Checkpoint, idx.Settings().NumberOfShards); err != nil {
+			esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+			return
+		}
+	}
+
+	res, err := s.manager.RecoverIndex(name, req)
+	if err != nil {
+		writeError(c, err, target)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"acknowledged": true,
+		"index":        res.Index,
+		"docs":         res.Docs,
+	})
+}
+
+// readChanges reads the changes of every shard, failing if any shard fails
+// so that no shard is skipped silently, or if a shard was read from another
+// copy than the one its checkpoint in since was taken on.
+func readChanges(idx *shard.Index, since map[int]uint64, histories map[int]string, limit int) (map[int]shard.ShardChanges, error) {
+	changes, errs := idx.Changes(since, limit)
+	if err := shard.FirstError(errs); err != nil {
+		return nil, err
+	}
+	if err := shard.CheckHistory(changes, histories); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// writeChanges writes one event per operation, advances since and the
+// histories of the checkpoints in it, and returns the number of operations
+// written.
+func writeChanges(enc *json.Encoder, index string, changes map[int]shard.ShardChanges, since map[int]uint64, histories map[int]string) int {
+	shards := make([]int, 0, len(changes))
+	for sID := range changes {
+		shards = append(shards, sID)
+	}
+	sort.Ints(shards)
+
+	n := 0
+	for _, sID := range shards {
+		sc := changes[sID]
+		for _, ch := range sc.Changes {
+			event := gin.H{
+				"op":            strings.ToLower(string(ch.Op)),
+				"_index":        index,
+				"_shard":        sID,
+				"_checkpoint":   ch.Checkpoint,
+				"_id":           ch.ID,
+				"_version":      ch.Version,
+				"_seq_no":       ch.SeqNo,
+				"_primary_term": ch.PrimaryTerm,
+			}
+			if ch.Source != nil {
+				event["_source"] = ch.Source
+			}
+			enc.Encode(event)
+			n++
+		}
+		since[sID] = sc.Checkpoint
+		histories[sID] = sc.History
+	}
+	return n
+}
+
+func writeCheckpoint(enc *json.Encoder, since map[int]uint64, histories map[int]string) {
+	enc.Encode(gin.H{"op": "checkpoint", "checkpoint": formatCheckpoints(since, histories)})
+}
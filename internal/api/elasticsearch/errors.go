@@ -0,0 +1,88 @@
+package elasticsearch
+
+import (
+	"breeze/internal/script"
+	"breeze/internal/shard"
+	"breeze/internal/snapshot"
+	"breeze/internal/store"
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// esError writes an Elasticsearch style error body.
+func esError(c *gin.Context, status int, errType, reason, index string) {
+	cause := gin.H{
+		"type":   errType,
+		"reason": reason,
+	}
+	if index != "" {
+		cause["index"] = index
+	}
+	body := gin.H{
+		"root_cause": []gin.H{cause},
+	}
+	for k, v := range cause {
+		body[k] = v
+	}
+	c.JSON(status, gin.H{
+		"error":  body,
+		"status": status,
+	})
+}
+
+// errorStatus maps an error returned by the storage layer to an HTTP status
+// and Elasticsearch error type.
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, store.ErrVersionConflict):
+		return http.StatusConflict, "version_conflict_engine_exception"
+	case errors.Is(err, store.ErrDocumentMissing):
+		return http.StatusNotFound, "document_missing_exception"
+	case errors.Is(err, script.ErrScript):
+		return http.StatusBadRequest, "script_exception"
+	case errors.Is(err, shard.ErrIndexNotFound):
+		return http.StatusNotFound, "index_not_found_exception"
+	case errors.Is(err, snapshot.ErrRepositoryMissing):
+		return http.StatusNotFound, "repository_missing_exception"
+	case errors.Is(err, snapshot.ErrSnapshotNotFound):
+		return http.StatusNotFound, "snapshot_missing_exception"
+	case errors.Is(err, shard.ErrInvalidIndexName):
+		return http.StatusBadRequest, "invalid_index_name_exception"
+	case errors.Is(err, shard.ErrIndexClosed):
+		return http.StatusBadRequest, "index_closed_exception"
+	case errors.Is(err, shard.ErrIndexBlocked):
+		return http.StatusForbidden, "cluster_block_exception"
+	case errors.Is(err, shard.ErrInvalidShardCount):
+		return http.StatusBadRequest, "illegal_argument_exception"
+	case errors.Is(err, shard.ErrRoutingMissing):
+		return http.StatusBadRequest, "routing_missing_exception"
+	case errors.Is(err, shard.ErrUnavailableShards):
+		return http.StatusServiceUnavailable, "unavailable_shards_exception"
+	case errors.Is(err, shard.ErrNodeUnavailable):
+		return http.StatusServiceUnavailable, "node_not_connected_exception"
+	case errors.Is(err, shard.ErrShardRelocating):
+		return http.StatusServiceUnavailable, "shard_not_in_primary_mode_exception"
+	case errors.Is(err, shard.ErrNotCoordinator):
+		return http.StatusServiceUnavailable, "not_master_exception"
+	case errors.Is(err, shard.ErrIndexExists):
+		return http.StatusBadRequest, "resource_already_exists_exception"
+	case errors.Is(err, store.ErrChangesTruncated):
+		return http.StatusNotFound, "resource_not_found_exception"
+	case errors.Is(err, snapshot.ErrSnapshotExists):
+		return http.StatusBadRequest, "invalid_snapshot_name_exception"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout_exception"
+	case errors.Is(err, context.Canceled):
+		return http.StatusBadRequest, "task_cancelled_exception"
+	}
+	return http.StatusInternalServerError, "exception"
+}
+
+// writeError reports an error returned by the storage layer.
+func writeError(c *gin.Context, err error, index string) {
+	status, errType := errorStatus(err)
+	esError(c, status, errType, err.Error(), index)
+}
@@ -0,0 +1,128 @@
+package elasticsearch
+
+import (
+	"breeze/internal/shard"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CloseIndex closes an index on every node. Its data is kept, but every
+// operation on it fails until it is opened again.
+func (s *Service) CloseIndex(c *gin.Context) {
+	name := c.Param("index")
+	if err := s.manager.CloseIndex(name); err != nil {
+		writeError(c, err, name)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"acknowledged":        true,
+		"shards_acknowledged": true,
+		"indices":             gin.H{name: gin.H{"closed": true}},
+	})
+}
+
+// OpenIndex reopens a closed index.
+func (s *Service) OpenIndex(c *gin.Context) {
+	name := c.Param("index")
+	if err := s.manager.ReopenIndex(name); err != nil {
+		writeError(c, err, name)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"acknowledged": true, "shards_acknowledged": true})
+}
+
+// GetSettings returns the settings of an index.
+func (s *Service) GetSettings(c *gin.Context) {
+	name := c.Param("index")
+	idx := s.manager.GetIndex(name)
+	if idx == nil {
+		writeError(c, fmt.Errorf("%w [%s]", shard.ErrIndexNotFound, name), name)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{name: gin.H{"settings": gin.H{"index": indexSettings(name, idx.Meta())}}})
+}
+
+// PutSettings changes the dynamic settings of an index, which are its
+// blocks.
+func (s *Service) PutSettings(c *gin.Context) {
+	name := c.Param("index")
+	var body map[string]interface{}
+	if err := readBody(c, &body); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), name)
+		return
+	}
+	update, err := parseSettingsUpdate(body)
+	if err != nil {
+		esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+		return
+	}
+	if err := s.manager.UpdateBlocks(name, update); err != nil {
+		writeError(c, err, name)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"acknowledged": true})
+}
+
+// resizeBody is the body of a split or shrink request.
+type resizeBody struct {
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// Split copies an index into a new index with a multiple of its shards.
+func (s *Service) Split(c *gin.Context) {
+	s.resize(c, s.manager.SplitIndex)
+}
+
+// Shrink copies an index into a new index with a factor of its shards, one
+// shard by default.
+func (s *Service) Shrink(c *gin.Context) {
+	s.resize(c, s.manager.ShrinkIndex)
+}
+
+// resize runs a split or shrink. The source stays online while it is copied;
+// with swap=true the target then replaces it under its name.
+func (s *Service) resize(c *gin.Context, run func(string, shard.ResizeRequest) (shard.ResizeResult, error)) {
+	name := c.Param("index")
+	req := shard.ResizeRequest{Target: c.Param("target"), Swap: c.Query("swap") == "true"}
+	if strings.HasSuffix(c.FullPath(), "_shrink/:target") {
+		req.NumberOfShards = 1
+	}
+
+	var body resizeBody
+	if err := readBody(c, &body); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), name)
+		return
+	}
+	flat := make(map[string]interface{})
+	flattenSettings("", body.Settings, flat)
+	for key, v := range flat {
+		if key != "number_of_shards" {
+			esError(c, http.StatusBadRequest, "illegal_argument_exception",
+				fmt.Sprintf("setting [index.%s] cannot be changed by a resize", key), name)
+			return
+		}
+		n, err := settingInt(key, v)
+		if err != nil {
+			esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+			return
+		}
+		req.NumberOfShards = n
+	}
+
+	res, err := run(name, req)
+	if err != nil {
+		writeError(c, err, name)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"acknowledged":        true,
+		"shards_acknowledged": true,
+		"index":               res.Index,
+		"swapped":             res.Swapped,
+		"docs":                res.Docs,
+		"changes":             res.Changes,
+	})
+}
@@ -0,0 +1,154 @@
+package elasticsearch
+
+import (
+	"breeze/internal/store"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseWriteOptions reads the concurrency control and TTL parameters of a
+// write from lookup, which returns the raw value of a parameter and whether it is set.
+func parseWriteOptions(lookup func(string) (string, bool)) (store.WriteOptions, error) {
+	var opts store.WriteOptions
+	parse := func(name string) (*uint64, error) {
+		raw, ok := lookup(name)
+		if !ok || raw == "" {
+			return nil, nil
+		}
+		v, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse [%s] with value [%s]", name, raw)
+		}
+		return &v, nil
+	}
+
+	var err error
+	if opts.IfSeqNo, err = parse("if_seq_no"); err != nil {
+		return opts, err
+	}
+	if opts.IfPrimaryTerm, err = parse("if_primary_term"); err != nil {
+		return opts, err
+	}
+	if (opts.IfSeqNo == nil) != (opts.IfPrimaryTerm == nil) {
+		return opts, fmt.Errorf("if_seq_no and if_primary_term must be used together")
+	}
+	if opts.Version, err = parse("version"); err != nil {
+		return opts, err
+	}
+	vt, _ := lookup("version_type")
+	if opts.VersionType, err = store.ParseVersionType(vt); err != nil {
+		return opts, err
+	}
+	if opType, _ := lookup("op_type"); opType == "create" {
+		opts.Create = true
+	}
+	opts.Routing, _ = lookup("routing")
+	if wait, ok := lookup("wait_for_active_shards"); ok && wait != "" {
+		if opts.WaitForActiveShards, err = parseActiveShards(wait); err != nil {
+			return opts, err
+		}
+	}
+	if ttl, ok := lookup("ttl"); ok && ttl != "" {
+		if opts.TTL, err = store.ParseTTL(ttl); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// requestTimeout bounds a request by its timeout parameter, if it has one.
+// Handlers pass the context of the request on to the index, so the work of
+// a request stops, on every node, when the time is up or the client goes
+// away.
+func requestTimeout(c *gin.Context) {
+	raw := c.Query("timeout")
+	if raw == "" {
+		c.Next()
+		return
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil || timeout <= 0 {
+		esError(c, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("failed to parse [timeout] with value [%s]", raw), c.Param("index"))
+		c.Abort()
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// parseTime accepts a time as RFC 3339 or as Unix milliseconds.
+func parseTime(raw string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return t, fmt.Errorf("failed to parse time [%s]", raw)
+	}
+	return t, nil
+}
+
+// splitRouting parses a comma separated routing parameter. An empty value
+// yields nil, searching every shard.
+func splitRouting(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	return strings.Split(raw, ",")
+}
+
+func queryWriteOptions(c *gin.Context) (store.WriteOptions, error) {
+	return parseWriteOptions(c.GetQuery)
+}
+
+// bulkWriteOptions reads the concurrency control parameters of a bulk action
+// metadata line.
+func bulkWriteOptions(meta map[string]interface{}) (store.WriteOptions, error) {
+	return parseWriteOptions(func(name string) (string, bool) {
+		v, ok := meta[name]
+		if !ok || v == nil {
+			return "", false
+		}
+		return settingString(v), true
+	})
+}
+
+// writeResponse is the body returned for a document write.
+func writeResponse(index string, res store.WriteResult) gin.H {
+	return gin.H{
+		"_index":        index,
+		"_id":           res.ID,
+		"_version":      res.Version,
+		"result":        res.Result,
+		"_seq_no":       res.SeqNo,
+		"_primary_term": res.PrimaryTerm,
+		"_shards":       shardsResponse(res.Shards),
+	}
+}
+
+// shardsResponse reports the copies of the shard a write reached; a write
+// that was not counted went to the primary alone.
+func shardsResponse(info store.ShardInfo) gin.H {
+	if info.Total == 0 {
+		info = store.ShardInfo{Total: 1, Successful: 1}
+	}
+	return gin.H{"total": info.Total, "successful": info.Successful, "failed": info.Failed}
+}
+
+func writeStatus(res store.WriteResult) int {
+	switch res.Result {
+	case store.ResultCreated:
+		return 201
+	case store.ResultNotFound:
+		return 404
+	}
+	return 200
+}
@@ -3,10 +3,15 @@ package elasticsearch
 import (
 	"breeze/internal/cluster"
 	"breeze/internal/shard"
+	"breeze/internal/store"
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/blevesearch/bleve/v2"
@@ -30,6 +35,7 @@ func (s *Service) RegisterHandlers(r *gin.Engine) {
 		c.Header("X-Elastic-Product", "Elasticsearch")
 		c.Next()
 	})
+	r.Use(requestTimeout)
 
 	r.GET("/", s.Info)
 	r.GET("/_cluster/health", s.Health)
@@ -41,19 +47,44 @@ func (s *Service) RegisterHandlers(r *gin.Engine) {
 	r.GET("/_license", s.License)
 	r.GET("/_xpack", s.XPack)
 	r.GET("/_cat/indices", s.CatIndices)
+	r.GET("/_cat/shards", s.CatShards)
+	r.POST("/_cluster/reroute", s.Reroute)
 	r.GET("/_mapping", s.Mapping)
 	r.GET("/:index/_mapping", s.Mapping)
+	r.GET("/_stats", s.Stats)
+	r.GET("/_snapshot", s.GetRepository)
+	r.GET("/_snapshot/:repo", s.GetRepository)
+	r.PUT("/_snapshot/:repo", s.PutRepository)
+	r.POST("/_snapshot/:repo", s.PutRepository)
+	r.GET("/_snapshot/:repo/:snapshot", s.GetSnapshot)
+	r.PUT("/_snapshot/:repo/:snapshot", s.CreateSnapshot)
+	r.POST("/_snapshot/:repo/:snapshot", s.CreateSnapshot)
+	r.DELETE("/_snapshot/:repo/:snapshot", s.DeleteSnapshot)
+	r.POST("/_snapshot/:repo/:snapshot/_restore", s.RestoreSnapshot)
+	r.GET("/:index/_stats", s.Stats)
+	r.POST("/:index/_close", s.CloseIndex)
+	r.POST("/:index/_open", s.OpenIndex)
+	r.GET("/:index/_settings", s.GetSettings)
+	r.PUT("/:index/_settings", s.PutSettings)
+	r.PUT("/:index/_split/:target", s.Split)
+	r.POST("/:index/_split/:target", s.Split)
+	r.PUT("/:index/_shrink/:target", s.Shrink)
+	r.POST("/:index/_shrink/:target", s.Shrink)
+	r.GET("/:index/_changes", s.Changes)
+	r.POST("/:index/_recover/:target", s.Recover)
 	r.GET("/_template", s.Empty)
 	r.GET("/_template/*name", s.Empty)
 
 	r.PUT("/:index", s.CreateIndex)
 	r.GET("/:index", s.GetIndexInfo)
 	r.HEAD("/:index", s.HeadIndex)
+	r.DELETE("/:index", s.DeleteIndex)
 	r.PUT("/:index/_doc/:id", s.Index)
 	r.POST("/:index/_doc/:id", s.Index)
 	r.PUT("/:index/_create/:id", s.Index)
 	r.POST("/:index/_create/:id", s.Index)
 	r.GET("/:index/_doc/:id", s.Get)
+	r.POST("/:index/_update/:id", s.Update)
 	r.DELETE("/:index/_doc/:id", s.Delete)
 	r.POST("/:index/_search", s.Search)
 	r.GET("/:index/_search", s.Search)
@@ -80,30 +111,19 @@ func (s *Service) Aliases(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"acknowledged": true})
 }
 
-func (s *Service) UpdateByQuery(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"took":                   0,
-		"timed_out":              false,
-		"total":                  0,
-		"updated":                0,
-		"deleted":                0,
-		"batches":                0,
-		"version_conflicts":      0,
-		"noops":                  0,
-		"retries":                gin.H{"bulk": 0, "search": 0},
-		"throttled_millis":       0,
-		"requests_per_second":    -1.0,
-		"throttled_until_millis": 0,
-		"failures":               []interface{}{},
-	})
-}
-
 func (s *Service) getOrCreateIndex(name string) (*shard.Index, error) {
 	idx := s.manager.GetIndex(name)
 	if idx != nil {
 		return idx, nil
 	}
-	return s.manager.CreateIndex(name, 0, true)
+	idx, err := s.manager.CreateIndex(name, shard.Settings{}, true)
+	if errors.Is(err, shard.ErrIndexExists) {
+		// Another request created it meanwhile.
+		if idx := s.manager.GetIndex(name); idx != nil {
+			return idx, nil
+		}
+	}
+	return idx, err
 }
 
 func (s *Service) Info(c *gin.Context) {
@@ -177,7 +197,11 @@ func (s *Service) CatIndices(c *gin.Context) {
 	indices := s.manager.ListIndices()
 	var sb strings.Builder
 	for _, name := range indices {
-		sb.WriteString(fmt.Sprintf("green open %s uuid 1 0 0 0 0b 0b\n", name))
+		state := shard.IndexStateOpen
+		if idx := s.manager.GetIndex(name); idx != nil && idx.Meta().State == shard.IndexStateClose {
+			state = shard.IndexStateClose
+		}
+		sb.WriteString(fmt.Sprintf("green %s %s uuid 1 0 0 0 0b 0b\n", state, name))
 	}
 	c.String(http.StatusOK, sb.String())
 }
@@ -208,17 +232,9 @@ func (s *Service) GetIndexInfo(c *gin.Context) {
 			foundAny = true
 			result[n] = gin.H{
 				"settings": gin.H{
-					"index": gin.H{
-						"number_of_shards":   "1",
-						"number_of_replicas": "0",
-						"version": gin.H{
-							"created": "8100299",
-						},
-					},
-				},
-				"mappings": gin.H{
-					"properties": s.convertMapping(idx),
+					"index": indexSettings(n, idx.Meta()),
 				},
+				"mappings": s.mappings(idx),
 			}
 		}
 	}
@@ -245,6 +261,45 @@ func (s *Service) GetIndexInfo(c *gin.Context) {
 	c.JSON(http.StatusOK, result)
 }
 
+// indexSettings renders the settings of an index the way Elasticsearch
+// reports them, with every value as a string.
+func indexSettings(name string, meta shard.IndexMeta) gin.H {
+	settings := gin.H{
+		"number_of_shards":   strconv.Itoa(meta.NumberOfShards),
+		"number_of_replicas": strconv.Itoa(meta.Settings.NumberOfReplicas),
+		"uuid":               meta.UUID,
+		"creation_date":      strconv.FormatInt(meta.CreationDate, 10),
+		"provided_name":      name,
+		"version": gin.H{
+			"created": "8100299",
+		},
+	}
+	blocks := gin.H{}
+	if meta.Settings.Blocks.Write {
+		blocks["write"] = "true"
+	}
+	if meta.Settings.Blocks.ReadOnly {
+		blocks["read_only"] = "true"
+	}
+	if meta.Settings.Blocks.Read {
+		blocks["read"] = "true"
+	}
+	if len(blocks) > 0 {
+		settings["blocks"] = blocks
+	}
+	if wait := meta.Settings.WaitForActiveShards; wait != 0 {
+		v := strconv.Itoa(wait)
+		if wait == store.ActiveShardsAll {
+			v = "all"
+		}
+		settings["write"] = gin.H{"wait_for_active_shards": v}
+	}
+	if meta.State == shard.IndexStateClose {
+		settings["verified_before_close"] = "true"
+	}
+	return settings
+}
+
 func (s *Service) Mapping(c *gin.Context) {
 	name := c.Param("index")
 	if name == "" {
@@ -253,7 +308,7 @@ func (s *Service) Mapping(c *gin.Context) {
 		for _, n := range indices {
 			idx := s.manager.GetIndex(n)
 			if idx != nil {
-				result[n] = gin.H{"mappings": gin.H{"properties": s.convertMapping(idx)}}
+				result[n] = gin.H{"mappings": s.mappings(idx)}
 			}
 		}
 		c.JSON(http.StatusOK, result)
@@ -266,7 +321,7 @@ func (s *Service) Mapping(c *gin.Context) {
 		n = strings.TrimSpace(n)
 		idx := s.manager.GetIndex(n)
 		if idx != nil {
-			result[n] = gin.H{"mappings": gin.H{"properties": s.convertMapping(idx)}}
+			result[n] = gin.H{"mappings": s.mappings(idx)}
 		}
 	}
 
@@ -278,6 +333,15 @@ func (s *Service) Mapping(c *gin.Context) {
 	c.JSON(http.StatusOK, result)
 }
 
+// mappings is the mappings object reported for idx.
+func (s *Service) mappings(idx *shard.Index) gin.H {
+	m := gin.H{"properties": s.convertMapping(idx)}
+	if idx.Settings().RoutingRequired {
+		m["_routing"] = gin.H{"required": true}
+	}
+	return m
+}
+
 func (s *Service) convertMapping(idx *shard.Index) map[string]interface{} {
 	props := make(map[string]interface{})
 	idx.Mapping.Mu.RLock()
@@ -296,6 +360,12 @@ func (s *Service) convertMapping(idx *shard.Index) map[string]interface{} {
 		}
 		props[k] = gin.H{"type": esType}
 	}
+	// Explicit mappings are reported as they were given.
+	if def := idx.Settings().Mapping; def != nil {
+		for k, prop := range def.Properties {
+			props[k] = prop
+		}
+	}
 	return props
 }
 
@@ -304,22 +374,158 @@ func (s *Service) Health(c *gin.Context) {
 	if numNodes == 0 {
 		numNodes = 1
 	}
-	c.JSON(http.StatusOK, gin.H{
+
+	names := s.manager.ListIndices()
+	if name := c.Param("index"); name != "" {
+		names = strings.Split(name, ",")
+	}
+	level := c.Query("level")
+
+	status := store.HealthGreen
+	activeShards, unassignedShards, relocatingShards := 0, 0, 0
+	indices := gin.H{}
+	for _, n := range names {
+		idx := s.manager.GetIndex(strings.TrimSpace(n))
+		if idx == nil {
+			continue
+		}
+		idxStatus := store.HealthGreen
+		idxActive, idxUnassigned := 0, 0
+		shards := gin.H{}
+		for sID, h := range idx.Health() {
+			if h.Status.Worse(idxStatus) {
+				idxStatus = h.Status
+			}
+			if h.Status == store.HealthRed {
+				idxUnassigned++
+			} else {
+				idxActive++
+			}
+			shards[strconv.Itoa(sID)] = h
+		}
+		if idxStatus.Worse(status) {
+			status = idxStatus
+		}
+		activeShards += idxActive
+		unassignedShards += idxUnassigned
+		idxRelocating := 0
+		for _, alloc := range idx.Allocation() {
+			if alloc.RelocatingTo != "" {
+				idxRelocating++
+			}
+		}
+		relocatingShards += idxRelocating
+
+		indexHealth := gin.H{
+			"status":                idxStatus,
+			"number_of_shards":      idx.Settings().NumberOfShards,
+			"number_of_replicas":    idx.Settings().NumberOfReplicas,
+			"active_primary_shards": idxActive,
+			"active_shards":         idxActive,
+			"relocating_shards":     idxRelocating,
+			"unassigned_shards":     idxUnassigned,
+		}
+		if level == "shards" {
+			indexHealth["shards"] = shards
+		}
+		indices[idx.Name] = indexHealth
+	}
+
+	activePercent := 100.0
+	if total := activeShards + unassignedShards; total > 0 {
+		activePercent = float64(activeShards) * 100 / float64(total)
+	}
+
+	resp := gin.H{
 		"cluster_name":                     "breeze-cluster",
-		"status":                           "green",
+		"status":                           status,
 		"timed_out":                        false,
 		"number_of_nodes":                  numNodes,
 		"number_of_data_nodes":             numNodes,
-		"active_primary_shards":            1,
-		"active_shards":                    1,
-		"relocating_shards":                0,
+		"active_primary_shards":            activeShards,
+		"active_shards":                    activeShards,
+		"relocating_shards":                relocatingShards,
 		"initializing_shards":              0,
-		"unassigned_shards":                0,
+		"unassigned_shards":                unassignedShards,
 		"delayed_unassigned_shards":        0,
 		"number_of_pending_tasks":          0,
 		"number_of_in_flight_fetch":        0,
 		"task_max_waiting_in_queue_millis": 0,
-		"active_shards_percent_as_number":  100.0,
+		"active_shards_percent_as_number":  activePercent,
+	}
+	if level == "indices" || level == "shards" {
+		resp["indices"] = indices
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// indexStats sums shard stats into the "primaries" section of an index
+// stats response. The "source" section is specific to Breeze and compares
+// the raw size of the stored sources with their compressed size.
+func indexStats(shards []store.Stats) gin.H {
+	var total store.Stats
+	for _, st := range shards {
+		total.Docs += st.Docs
+		total.SourceBytes += st.SourceBytes
+		total.StoredBytes += st.StoredBytes
+		total.StoreBytes += st.StoreBytes
+		total.WALBytes += st.WALBytes
+	}
+	source := gin.H{
+		"size_in_bytes":            total.SourceBytes,
+		"compressed_size_in_bytes": total.StoredBytes,
+	}
+	for i, st := range shards {
+		if i > 0 && st.Compression != shards[0].Compression {
+			delete(source, "compression")
+			break
+		}
+		source["compression"] = st.Compression.String()
+	}
+	return gin.H{
+		"docs":     gin.H{"count": total.Docs, "deleted": 0},
+		"store":    gin.H{"size_in_bytes": total.StoreBytes},
+		"translog": gin.H{"size_in_bytes": total.WALBytes},
+		"source":   source,
+	}
+}
+
+func (s *Service) Stats(c *gin.Context) {
+	names := s.manager.ListIndices()
+	if name := c.Param("index"); name != "" {
+		names = strings.Split(name, ",")
+	}
+
+	totalShards, okShards := 0, 0
+	var all []store.Stats
+	indices := gin.H{}
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		idx := s.manager.GetIndex(n)
+		if idx == nil {
+			esError(c, http.StatusNotFound, "index_not_found_exception", "no such index ["+n+"]", n)
+			return
+		}
+		var shards []store.Stats
+		for _, st := range idx.Stats() {
+			shards = append(shards, st)
+		}
+		totalShards += idx.Settings().NumberOfShards
+		okShards += len(shards)
+		all = append(all, shards...)
+		section := indexStats(shards)
+		indices[idx.Name] = gin.H{"primaries": section, "total": section}
+	}
+
+	section := indexStats(all)
+	c.JSON(http.StatusOK, gin.H{
+		"_shards": gin.H{
+			"total":      totalShards,
+			"successful": okShards,
+			"failed":     totalShards - okShards,
+		},
+		"_all":    gin.H{"primaries": section, "total": section},
+		"indices": indices,
 	})
 }
 
@@ -409,32 +615,63 @@ func (s *Service) NodeStats(c *gin.Context) {
 func (s *Service) CreateIndex(c *gin.Context) {
 	name := c.Param("index")
 	forward := c.Query("forward") != "false"
-	shards := 0
-	fmt.Sscanf(c.Query("shards"), "%d", &shards)
 
-	_, err := s.manager.CreateIndex(name, shards, forward)
+	var body struct {
+		Settings map[string]interface{} `json:"settings"`
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	raw, err := io.ReadAll(c.Request.Body)
+	if err == nil && len(bytes.TrimSpace(raw)) > 0 {
+		err = json.Unmarshal(raw, &body)
+	}
+	if err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), name)
+		return
+	}
 
+	settings, err := parseIndexSettings(body.Settings, body.Mappings)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": gin.H{
-				"root_cause": []gin.H{
-					{
-						"type":   "resource_already_exists_exception",
-						"reason": "index already exists",
-						"index":  name,
-					},
-				},
-				"type":   "resource_already_exists_exception",
-				"reason": "index already exists",
-				"index":  name,
-			},
-			"status": 400,
-		})
+		esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+		return
+	}
+	if shards := c.Query("shards"); shards != "" {
+		fmt.Sscanf(shards, "%d", &settings.NumberOfShards)
+	}
+
+	if _, err := s.manager.CreateIndex(name, settings, forward); err != nil {
+		writeError(c, err, name)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"acknowledged": true, "shards_acknowledged": true, "index": name})
 }
 
+// DeleteIndex deletes an index on every node. Deleting an index that does
+// not exist is acknowledged, so a delete that failed on some nodes can be
+// retried; acknowledged is false until every node has deleted its copy.
+func (s *Service) DeleteIndex(c *gin.Context) {
+	name := c.Param("index")
+	forward := c.Query("forward") != "false"
+
+	res, err := s.manager.DeleteIndex(name, forward)
+	if err != nil && len(res.Failed) == 0 {
+		writeError(c, err, name)
+		return
+	}
+	failed := make(map[string]string, len(res.Failed))
+	for node, err := range res.Failed {
+		failed[node] = err.Error()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"acknowledged": len(res.Failed) == 0,
+		"index":        name,
+		"found":        res.Found,
+		"nodes": gin.H{
+			"acknowledged": res.Acknowledged,
+			"failed":       failed,
+		},
+	})
+}
+
 func (s *Service) Index(c *gin.Context) {
 	name := c.Param("index")
 	id := c.Param("id")
@@ -444,45 +681,94 @@ func (s *Service) Index(c *gin.Context) {
 		return
 	}
 
+	opts, err := queryWriteOptions(c)
+	if err != nil {
+		esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+		return
+	}
+	if strings.Contains(c.FullPath(), "/_create/") {
+		opts.Create = true
+	}
+
 	idx, err := s.getOrCreateIndex(name)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	var res store.WriteResult
 	if c.Query("forward") == "false" {
-		shardID := idx.GetShardID(id)
-		if s, ok := idx.Shards[shardID]; ok {
-			s.Index(id, data)
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "shard not local"})
-			return
-		}
+		res, err = idx.LocalIndex(id, data, opts)
 	} else {
-		if err := idx.Index(id, data); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+		res, err = idx.Index(c.Request.Context(), id, data, opts)
+	}
+	if err != nil {
+		writeError(c, err, name)
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"_index":   name,
-		"_id":      id,
-		"result":   "created",
-		"_version": 1,
-	})
+	c.JSON(writeStatus(res), writeResponse(name, res))
 }
 
 func (s *Service) Bulk(c *gin.Context) {
+	// wait_for_active_shards of the request applies to every action that
+	// does not set its own.
+	var wait int
+	if raw := c.Query("wait_for_active_shards"); raw != "" {
+		var err error
+		if wait, err = parseActiveShards(raw); err != nil {
+			esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), "")
+			return
+		}
+	}
 	scanner := bufio.NewScanner(c.Request.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	// item is one action of the request. Items are answered in request
+	// order.
+	type item struct {
+		action string
+		index  string
+		id     string
+		res    store.WriteResult
+		err    error
+	}
+	// Index and create actions are batched per index. Batches are written
+	// before an update, so that the update sees the documents indexed
+	// before it in the same request.
 	type batch struct {
-		ids  []string
-		docs []map[string]interface{}
+		items []*item
+		docs  []map[string]interface{}
+		opts  []store.WriteOptions
 	}
 	batches := make(map[string]*batch)
+	var items []*item
 
-	var lastIndex string
-	var lastId string
+	flush := func() {
+		for name, b := range batches {
+			ids := make([]string, len(b.items))
+			for i, it := range b.items {
+				ids[i] = it.id
+			}
+			var results []store.WriteResult
+			idx, err := s.getOrCreateIndex(name)
+			switch {
+			case err != nil:
+				results = make([]store.WriteResult, len(ids))
+				for i := range results {
+					results[i] = store.WriteResult{ID: ids[i], Err: err}
+				}
+			case c.Query("forward") == "false":
+				results = idx.LocalBatchIndex(ids, b.docs, b.opts)
+			default:
+				results = idx.BatchIndex(c.Request.Context(), ids, b.docs, b.opts)
+			}
+			for i, it := range b.items {
+				it.res = results[i]
+			}
+		}
+		batches = make(map[string]*batch)
+	}
 
 	for scanner.Scan() {
 		line := scanner.Bytes()
@@ -495,68 +781,127 @@ func (s *Service) Bulk(c *gin.Context) {
 			continue
 		}
 
-		if meta, ok := action["index"]; ok {
-			lastIndex, _ = meta["_index"].(string)
-			if lastIndex == "" {
-				lastIndex = c.Param("index")
-			}
-			lastId, _ = meta["_id"].(string)
-			if scanner.Scan() {
-				var doc map[string]interface{}
-				if err := json.Unmarshal(scanner.Bytes(), &doc); err == nil {
-					if lastIndex == "" {
-						continue
-					}
-					b, ok := batches[lastIndex]
-					if !ok {
-						b = &batch{}
-						batches[lastIndex] = b
-					}
-					b.ids = append(b.ids, lastId)
-					b.docs = append(b.docs, doc)
-				}
+		for name, meta := range action {
+			if name != "index" && name != "create" && name != "update" {
+				continue
 			}
-		}
-	}
-
-	var responseItems []interface{}
-	for name, b := range batches {
-		idx, err := s.getOrCreateIndex(name)
-		if err != nil {
-			continue
-		}
+			it := &item{action: name}
+			it.index, _ = meta["_index"].(string)
+			if it.index == "" {
+				it.index = c.Param("index")
+			}
+			it.id, _ = meta["_id"].(string)
+			if !scanner.Scan() {
+				break
+			}
+			items = append(items, it)
 
-		if c.Query("forward") == "false" {
-			shardGroupsIds := make(map[int][]string)
-			shardGroupsData := make(map[int][]map[string]interface{})
-			for j, id := range b.ids {
-				sID := idx.GetShardID(id)
-				if _, ok := idx.Shards[sID]; ok {
-					shardGroupsIds[sID] = append(shardGroupsIds[sID], id)
-					shardGroupsData[sID] = append(shardGroupsData[sID], b.docs[j])
+			if name == "update" {
+				var body updateBody
+				if err := json.Unmarshal(scanner.Bytes(), &body); err != nil {
+					it.err = fmt.Errorf("failed to parse update: %w", err)
+					continue
 				}
+				if it.index == "" || it.id == "" {
+					it.err = fmt.Errorf("index and id are required for update")
+					continue
+				}
+				req, err := body.request()
+				if err != nil {
+					it.res.Err = err
+					continue
+				}
+				opts, err := bulkWriteOptions(meta)
+				if err != nil {
+					it.err = err
+					continue
+				}
+				if opts.WaitForActiveShards == 0 {
+					opts.WaitForActiveShards = wait
+				}
+				flush()
+				idx, err := s.getOrCreateIndex(it.index)
+				if err != nil {
+					it.res.Err = err
+					continue
+				}
+				res, err := idx.Update(c.Request.Context(), it.id, req, opts)
+				res.Err = err
+				it.res = res
+				continue
 			}
-			for sID, sIds := range shardGroupsIds {
-				idx.Shards[sID].BatchIndex(sIds, shardGroupsData[sID])
+
+			var doc map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				it.err = fmt.Errorf("failed to parse document: %w", err)
+				continue
 			}
-		} else {
-			idx.BatchIndex(b.ids, b.docs)
+			if it.index == "" {
+				it.err = fmt.Errorf("index is missing")
+				continue
+			}
+			opts, err := bulkWriteOptions(meta)
+			if err != nil {
+				it.err = err
+				continue
+			}
+			if opts.WaitForActiveShards == 0 {
+				opts.WaitForActiveShards = wait
+			}
+			opts.Create = opts.Create || name == "create"
+			b, ok := batches[it.index]
+			if !ok {
+				b = &batch{}
+				batches[it.index] = b
+			}
+			b.items = append(b.items, it)
+			b.docs = append(b.docs, doc)
+			b.opts = append(b.opts, opts)
 		}
-
-		for _, id := range b.ids {
-			responseItems = append(responseItems, gin.H{
-				"index": gin.H{
-					"_index": name,
-					"_id":    id,
-					"status": 201,
+	}
+	if err := scanner.Err(); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), "")
+		return
+	}
+	flush()
+
+	hasErrors := false
+	responseItems := make([]interface{}, 0, len(items))
+	for _, it := range items {
+		var result gin.H
+		if it.err != nil {
+			hasErrors = true
+			result = gin.H{
+				"_index": it.index,
+				"_id":    it.id,
+				"status": http.StatusBadRequest,
+				"error": gin.H{
+					"type":   "mapper_parsing_exception",
+					"reason": it.err.Error(),
 				},
-			})
+			}
+		} else if res := it.res; res.Err != nil {
+			hasErrors = true
+			status, errType := errorStatus(res.Err)
+			result = gin.H{
+				"_index": it.index,
+				"_id":    it.id,
+				"status": status,
+				"error": gin.H{
+					"type":   errType,
+					"reason": res.Err.Error(),
+				},
+			}
+		} else {
+			result = writeResponse(it.index, res)
+			result["status"] = writeStatus(res)
 		}
+		responseItems = append(responseItems, gin.H{it.action: result})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"took":   0,
-		"errors": false,
+		"errors": hasErrors,
 		"items":  responseItems,
 	})
 }
@@ -564,8 +909,9 @@ func (s *Service) Bulk(c *gin.Context) {
 func (s *Service) MGet(c *gin.Context) {
 	var req struct {
 		Docs []struct {
-			Index string `json:"_index"`
-			ID    string `json:"_id"`
+			Index   string `json:"_index"`
+			ID      string `json:"_id"`
+			Routing string `json:"routing"`
 		} `json:"docs"`
 		IDs []string `json:"ids"`
 	}
@@ -585,9 +931,9 @@ func (s *Service) MGet(c *gin.Context) {
 				results = append(results, gin.H{"found": false})
 				continue
 			}
-			doc, _ := idx.Get(id)
+			doc, _ := idx.Get(c.Request.Context(), id, c.Query("routing"))
 			if doc != nil {
-				results = append(results, gin.H{"_index": indexName, "_id": id, "found": true, "_source": doc})
+				results = append(results, getResponse(indexName, doc))
 			} else {
 				results = append(results, gin.H{"_index": indexName, "_id": id, "found": false})
 			}
@@ -603,9 +949,9 @@ func (s *Service) MGet(c *gin.Context) {
 				results = append(results, gin.H{"found": false})
 				continue
 			}
-			doc, _ := idx.Get(d.ID)
+			doc, _ := idx.Get(c.Request.Context(), d.ID, d.Routing)
 			if doc != nil {
-				results = append(results, gin.H{"_index": n, "_id": d.ID, "found": true, "_source": doc})
+				results = append(results, getResponse(n, doc))
 			} else {
 				results = append(results, gin.H{"_index": n, "_id": d.ID, "found": false})
 			}
@@ -623,6 +969,7 @@ func (s *Service) MSearch(c *gin.Context) {
 		var header map[string]interface{}
 		json.Unmarshal(scanner.Bytes(), &header)
 		indexName, _ := header["index"].(string)
+		routing, _ := header["routing"].(string)
 		if indexName == "" {
 			indexName = c.Param("index")
 		}
@@ -648,14 +995,14 @@ func (s *Service) MSearch(c *gin.Context) {
 
 		q := bleve.NewQueryStringQuery(queryStr)
 		req := bleve.NewSearchRequest(q)
-		req.Fields = []string{"_source"}
-		res, _ := idx.Search(req)
+		req.Fields = []string{store.SourceField}
+		res, _ := idx.Search(c.Request.Context(), req, splitRouting(routing))
 
 		hits := []gin.H{}
 		if res != nil {
 			for _, hit := range res.Hits {
 				source := make(map[string]interface{})
-				if s, ok := hit.Fields["_source"].(string); ok {
+				if s, ok := hit.Fields[store.SourceField].(string); ok {
 					json.Unmarshal([]byte(s), &source)
 				}
 				hits = append(hits, gin.H{
@@ -679,6 +1026,22 @@ func (s *Service) MSearch(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"responses": responses})
 }
 
+func getResponse(index string, doc *store.Document) gin.H {
+	res := gin.H{
+		"_index":        index,
+		"_id":           doc.ID,
+		"_version":      doc.Version,
+		"_seq_no":       doc.SeqNo,
+		"_primary_term": doc.PrimaryTerm,
+		"found":         true,
+		"_source":       doc.Source,
+	}
+	if doc.Routing != "" {
+		res["_routing"] = doc.Routing
+	}
+	return res
+}
+
 func (s *Service) Get(c *gin.Context) {
 	name := c.Param("index")
 	id := c.Param("id")
@@ -689,23 +1052,29 @@ func (s *Service) Get(c *gin.Context) {
 		return
 	}
 
-	doc, err := idx.Get(id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var doc *store.Document
+	var err error
+	if raw, ok := c.GetQuery("as_of"); ok {
+		asOf, err := parseTime(raw)
+		if err != nil {
+			esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+			return
+		}
+		if doc, err = idx.GetAsOf(c.Request.Context(), id, c.Query("routing"), asOf); err != nil {
+			writeError(c, err, name)
+			return
+		}
+	} else if doc, err = idx.Get(c.Request.Context(), id, c.Query("routing")); err != nil {
+		writeError(c, err, name)
 		return
 	}
 
 	if doc == nil {
-		c.JSON(http.StatusNotFound, gin.H{"found": false})
+		c.JSON(http.StatusNotFound, gin.H{"_index": name, "_id": id, "found": false})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"_index":  name,
-		"_id":     id,
-		"found":   true,
-		"_source": doc,
-	})
+	c.JSON(http.StatusOK, getResponse(name, doc))
 }
 
 func (s *Service) Delete(c *gin.Context) {
@@ -718,16 +1087,55 @@ func (s *Service) Delete(c *gin.Context) {
 		return
 	}
 
-	if err := idx.Delete(id); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	opts, err := queryWriteOptions(c)
+	if err != nil {
+		esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"_index": name,
-		"_id":    id,
-		"result": "deleted",
-	})
+	res, err := idx.Delete(c.Request.Context(), id, opts)
+	if err != nil {
+		writeError(c, err, name)
+		return
+	}
+
+	c.JSON(writeStatus(res), writeResponse(name, res))
+}
+
+// queryString translates the supported subset of the query DSL, match_all,
+// query_string, term and match, into a Bleve query string. It returns ""
+// for anything else.
+func queryString(q map[string]interface{}) string {
+	if m, ok := q["match_all"].(map[string]interface{}); ok && len(m) == 0 {
+		return "*"
+	}
+	if query, ok := q["query_string"].(map[string]interface{}); ok {
+		qs, _ := query["query"].(string)
+		return qs
+	}
+	for _, kind := range []string{"term", "match"} {
+		fields, ok := q[kind].(map[string]interface{})
+		if !ok || len(fields) != 1 {
+			continue
+		}
+		for field, v := range fields {
+			// Both forms {"field": value} and {"field": {"query": value}}
+			// are accepted, term using "value" instead of "query".
+			if opts, ok := v.(map[string]interface{}); ok {
+				if v, ok = opts["query"]; !ok {
+					v = opts["value"]
+				}
+			}
+			switch v := v.(type) {
+			case float64:
+				n := settingString(v)
+				return "+" + field + ":>=" + n + " +" + field + ":<=" + n
+			case string, bool:
+				return field + `:"` + strings.ReplaceAll(settingString(v), `"`, `\"`) + `"`
+			}
+		}
+	}
+	return ""
 }
 
 func (s *Service) Search(c *gin.Context) {
@@ -739,13 +1147,7 @@ func (s *Service) Search(c *gin.Context) {
 		var req map[string]interface{}
 		if err := c.BindJSON(&req); err != nil {
 			if q, ok := req["query"].(map[string]interface{}); ok {
-				if m, ok := q["match_all"].(map[string]interface{}); ok && len(m) == 0 {
-					queryStr = "*"
-				} else if query, ok := q["query_string"].(map[string]interface{}); ok {
-					if qs, ok := query["query"].(string); ok {
-						queryStr = qs
-					}
-				}
+				queryStr = queryString(q)
 			}
 		}
 	}
@@ -770,16 +1172,16 @@ func (s *Service) Search(c *gin.Context) {
 	var err error
 
 	if c.Query("local") == "true" {
-		res, err = idx.LocalSearch(bleve.NewSearchRequest(bleve.NewQueryStringQuery(queryStr)))
+		res, err = idx.LocalSearch(c.Request.Context(), bleve.NewSearchRequest(bleve.NewQueryStringQuery(queryStr)), nil)
 	} else {
 		q := bleve.NewQueryStringQuery(queryStr)
 		req := bleve.NewSearchRequest(q)
-		req.Fields = []string{"_source"}
-		res, err = idx.Search(req)
+		req.Fields = []string{store.SourceField, store.RoutingField}
+		res, err = idx.Search(c.Request.Context(), req, splitRouting(c.Query("routing")))
 	}
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeError(c, err, name)
 		return
 	}
 
@@ -787,15 +1189,19 @@ func (s *Service) Search(c *gin.Context) {
 	if res != nil {
 		for _, hit := range res.Hits {
 			source := make(map[string]interface{})
-			if s, ok := hit.Fields["_source"].(string); ok {
+			if s, ok := hit.Fields[store.SourceField].(string); ok {
 				json.Unmarshal([]byte(s), &source)
 			}
-			hits = append(hits, gin.H{
+			h := gin.H{
 				"_index":  name,
 				"_id":     hit.ID,
 				"_score":  hit.Score,
 				"_source": source,
-			})
+			}
+			if routing, ok := hit.Fields[store.RoutingField].(string); ok {
+				h["_routing"] = routing
+			}
+			hits = append(hits, h)
 		}
 	}
 
@@ -4,10 +4,16 @@ import (
 	"breeze/internal/cluster"
 	"breeze/internal/shard"
 	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -46,13 +52,965 @@ func TestBulk(t *testing.T) {
 		t.Fatalf("index testindex not created")
 	}
 
-	doc, _ := idx.Get("1")
-	if doc["name"] != "test1" {
-		t.Errorf("expected test1, got %v", doc["name"])
+	doc, _ := idx.Get(context.Background(), "1", "")
+	if doc == nil || doc.Source["name"] != "test1" {
+		t.Errorf("expected test1, got %v", doc)
 	}
 
-	doc2, _ := idx.Get("2")
-	if doc2["name"] != "test2" {
-		t.Errorf("expected test2, got %v", doc2["name"])
+	doc2, _ := idx.Get(context.Background(), "2", "")
+	if doc2 == nil || doc2.Source["name"] != "test2" {
+		t.Errorf("expected test2, got %v", doc2)
+	}
+}
+
+func TestBulkReportsErrors(t *testing.T) {
+	path := "test_bulk_errors"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 1, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/_bulk", service.Bulk)
+
+	bulkData := `{"index":{"_index":"testindex","_id":"1"}}
+{"name":"test1"}
+{"index":{"_index":"testindex","_id":"2"}}
+{"name":
+`
+	req, _ := http.NewRequest("POST", "/_bulk", bytes.NewBufferString(bulkData))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string                 `json:"_id"`
+			Status int                    `json:"status"`
+			Error  map[string]interface{} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if !resp.Errors {
+		t.Errorf("expected errors to be reported")
+	}
+	if len(resp.Items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(resp.Items))
+	}
+	if it := resp.Items[0]["index"]; it.ID != "1" || it.Status != http.StatusCreated {
+		t.Errorf("unexpected first item: %+v", it)
+	}
+	if it := resp.Items[1]["index"]; it.ID != "2" || it.Status != http.StatusBadRequest || it.Error == nil {
+		t.Errorf("unexpected second item: %+v", it)
+	}
+}
+
+func TestIndexVersionConflict(t *testing.T) {
+	path := "test_version_conflict"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 1, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	service.RegisterHandlers(r)
+
+	put := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", "/testindex/_doc/1"+query, bytes.NewBufferString(`{"name":"test"}`))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := put("")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Version     uint64 `json:"_version"`
+		SeqNo       uint64 `json:"_seq_no"`
+		PrimaryTerm uint64 `json:"_primary_term"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Version != 1 || created.PrimaryTerm != 1 {
+		t.Errorf("unexpected write response: %s", w.Body.String())
+	}
+
+	if w := put("?if_seq_no=0&if_primary_term=1"); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for stale if_seq_no, got %d", w.Code)
+	}
+	if w := put("?if_seq_no=1&if_primary_term=1"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for current if_seq_no, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	path := "test_snapshot_data"
+	repoPath := "test_snapshot_repo"
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(repoPath)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	do("PUT", "/logs", "")
+	for _, id := range []string{"1", "2", "3"} {
+		if w := do("PUT", "/logs/_doc/"+id, `{"msg":"hello"}`); w.Code != http.StatusCreated {
+			t.Fatalf("failed to index doc %s: %d %s", id, w.Code, w.Body.String())
+		}
+	}
+
+	if w := do("PUT", "/_snapshot/backup", `{"type":"fs","settings":{"location":"`+repoPath+`"}}`); w.Code != http.StatusOK {
+		t.Fatalf("failed to register repository: %d %s", w.Code, w.Body.String())
+	}
+	w := do("PUT", "/_snapshot/backup/snap1", `{"indices":"logs"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to create snapshot: %d %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Snapshot struct {
+			State  string `json:"state"`
+			Shards struct {
+				Successful int `json:"successful"`
+			} `json:"shards"`
+		} `json:"snapshot"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Snapshot.State != "SUCCESS" || created.Snapshot.Shards.Successful != 2 {
+		t.Errorf("unexpected snapshot result %s", w.Body.String())
+	}
+	if w := do("PUT", "/_snapshot/backup/snap1", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected duplicate snapshot to fail, got %d", w.Code)
+	}
+
+	do("DELETE", "/logs/_doc/1", "")
+	do("PUT", "/logs/_doc/4", `{"msg":"later"}`)
+
+	// Restore into a new index and over the existing one.
+	w = do("POST", "/_snapshot/backup/snap1/_restore", `{"indices":"logs","rename_pattern":"(.+)","rename_replacement":"$1_restored"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to restore snapshot: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/_snapshot/backup/snap1/_restore", ""); w.Code != http.StatusOK {
+		t.Fatalf("failed to restore snapshot in place: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, name := range []string{"logs_restored", "logs"} {
+		idx := manager.GetIndex(name)
+		if idx == nil {
+			t.Fatalf("index %s missing after restore", name)
+		}
+		for id, want := range map[string]bool{"1": true, "3": true, "4": false} {
+			doc, err := idx.Get(context.Background(), id, "")
+			if err != nil || (doc != nil) != want {
+				t.Errorf("%s: doc %s present=%v, want %v (%v)", name, id, doc != nil, want, err)
+			}
+		}
+	}
+
+	if w := do("GET", "/_snapshot/backup/_all", ""); !bytes.Contains(w.Body.Bytes(), []byte(`"snap1"`)) {
+		t.Errorf("snapshot not listed: %s", w.Body.String())
+	}
+	if w := do("DELETE", "/_snapshot/backup/snap1", ""); w.Code != http.StatusOK {
+		t.Errorf("failed to delete snapshot: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/_snapshot/backup/snap1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected deleted snapshot to be missing, got %d", w.Code)
+	}
+}
+
+func TestCreateIndexMappings(t *testing.T) {
+	path := "test_mappings"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("PUT", "/articles", `{
+		"settings": {"analysis": {
+			"analyzer": {"my_english": {"type": "custom", "tokenizer": "standard", "filter": ["lowercase", "english_stemmer"]}},
+			"filter": {"english_stemmer": {"type": "stemmer", "language": "english"}}
+		}},
+		"mappings": {"properties": {
+			"title": {"type": "text", "analyzer": "my_english", "fields": {"raw": {"type": "keyword"}}},
+			"tag": {"type": "keyword"},
+			"secret": {"type": "text", "index": false}
+		}}
+	}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to create index: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/broken", `{"mappings": {"properties": {"f": {"type": "text", "analyzer": "missing"}}}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected unknown analyzer to be rejected, got %d", w.Code)
+	}
+
+	do("PUT", "/articles/_doc/1", `{"title": "Running Dogs", "tag": "Pets Daily", "secret": "hidden"}`)
+
+	for q, want := range map[string]int{
+		"title:run":                1,
+		`tag:"Pets Daily"`:         1,
+		"tag:pets":                 0,
+		"secret:hidden":            0,
+		`title.raw:"Running Dogs"`: 1,
+		`title.raw:"running"`:      0,
+	} {
+		w := do("GET", "/articles/_search?q="+url.QueryEscape(q), "")
+		var res struct {
+			Hits struct {
+				Total struct {
+					Value int `json:"value"`
+				} `json:"total"`
+			} `json:"hits"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if res.Hits.Total.Value != want {
+			t.Errorf("query %s: expected %d hits, got %d", q, want, res.Hits.Total.Value)
+		}
+	}
+
+	w = do("GET", "/articles/_mapping", "")
+	if !bytes.Contains(w.Body.Bytes(), []byte(`"analyzer":"my_english"`)) {
+		t.Errorf("explicit mapping not reported: %s", w.Body.String())
+	}
+}
+
+func TestChanges(t *testing.T) {
+	path := "test_changes_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	type event struct {
+		Op         string          `json:"op"`
+		ID         string          `json:"_id"`
+		Source     json.RawMessage `json:"_source"`
+		Checkpoint string          `json:"checkpoint"`
+	}
+	changes := func(url string) []event {
+		w := do("GET", url, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("failed to read changes: %d %s", w.Code, w.Body.String())
+		}
+		var events []event
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			var e event
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("invalid event %q: %v", line, err)
+			}
+			events = append(events, e)
+		}
+		return events
+	}
+
+	do("PUT", "/logs", "")
+	do("PUT", "/logs/_doc/1", `{"msg":"one"}`)
+	do("PUT", "/logs/_doc/2", `{"msg":"two"}`)
+	do("DELETE", "/logs/_doc/1", "")
+
+	events := changes("/logs/_changes")
+	if len(events) != 4 || events[3].Op != "checkpoint" {
+		t.Fatalf("expected 3 operations and a checkpoint, got %+v", events)
+	}
+	ops := make(map[string]int)
+	for _, e := range events[:3] {
+		ops[e.Op+" "+e.ID]++
+	}
+	if ops["index 1"] != 1 || ops["index 2"] != 1 || ops["delete 1"] != 1 {
+		t.Errorf("unexpected operations %v", ops)
+	}
+
+	do("PUT", "/logs/_doc/3", `{"msg":"three"}`)
+	events = changes("/logs/_changes?since=" + url.QueryEscape(events[3].Checkpoint))
+	if len(events) != 2 || events[0].ID != "3" || string(events[0].Source) != `{"msg":"three"}` {
+		t.Errorf("expected only doc 3 after the checkpoint, got %+v", events)
+	}
+
+	if w := do("GET", "/logs/_changes?since=x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid checkpoint to fail, got %d", w.Code)
+	}
+
+	// A checkpoint taken on another copy of a shard is not resumed from.
+	pairs := strings.Split(events[1].Checkpoint, ",")
+	if len(pairs) != 2 || strings.Count(pairs[0], ":") != 2 {
+		t.Fatalf("expected a checkpoint with the history of each shard, got %q", events[1].Checkpoint)
+	}
+	pairs[0] = pairs[0][:strings.LastIndex(pairs[0], ":")] + ":elsewhere"
+	w := do("GET", "/logs/_changes?since="+url.QueryEscape(strings.Join(pairs, ",")), "")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "was copied since the checkpoint") {
+		t.Errorf("expected a checkpoint of another copy to fail, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/logs/_changes?since=0:1:", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an empty history to fail, got %d", w.Code)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	path := "test_recover_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	do("PUT", "/logs", "")
+	for _, id := range []string{"1", "2", "3"} {
+		do("PUT", "/logs/_doc/"+id, `{"msg":"good"}`)
+	}
+	time.Sleep(5 * time.Millisecond)
+	asOf := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	time.Sleep(5 * time.Millisecond)
+
+	// A bad load overwrites one document, deletes another and adds a third.
+	do("PUT", "/logs/_doc/1", `{"msg":"bad"}`)
+	do("DELETE", "/logs/_doc/2", "")
+	do("PUT", "/logs/_doc/4", `{"msg":"bad"}`)
+
+	w := do("GET", "/logs/_doc/1?as_of="+asOf, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"good"`) {
+		t.Errorf("expected the old version of doc 1, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/logs/_doc/4?as_of="+asOf, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected doc 4 not to exist yet, got %d", w.Code)
+	}
+
+	w = do("POST", "/logs/_recover/logs_fixed", `{"as_of":"`+asOf+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to recover index: %d %s", w.Code, w.Body.String())
+	}
+	for id, want := range map[string]int{"1": http.StatusOK, "2": http.StatusOK, "3": http.StatusOK, "4": http.StatusNotFound} {
+		w := do("GET", "/logs_fixed/_doc/"+id, "")
+		if w.Code != want {
+			t.Errorf("doc %s: expected %d, got %d %s", id, want, w.Code, w.Body.String())
+		} else if want == http.StatusOK && !strings.Contains(w.Body.String(), `"good"`) {
+			t.Errorf("doc %s: expected the recovered version, got %s", id, w.Body.String())
+		}
+	}
+
+	if w := do("POST", "/logs/_recover/logs_fixed", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected recovering into an existing index to fail, got %d", w.Code)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	path := "test_update_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	result := func(w *httptest.ResponseRecorder) string {
+		var res struct {
+			Result string `json:"result"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res.Result
+	}
+
+	if w := do("POST", "/users/_update/1", `{"doc":{"name":"ann"}}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected updating a missing doc to fail, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/users/_update/1", `{"doc":{"name":"ann"},"doc_as_upsert":true}`); w.Code != http.StatusCreated {
+		t.Errorf("expected doc_as_upsert to create the doc, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/users/_update/1", `{"doc":{"age":30}}`); w.Code != http.StatusOK || result(w) != "updated" {
+		t.Errorf("expected the doc to be updated, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/users/_update/1", `{"doc":{"age":30}}`); result(w) != "noop" {
+		t.Errorf("expected a noop, got %s", w.Body.String())
+	}
+	if w := do("POST", "/users/_update/1", `{"doc":{"age":30},"detect_noop":false}`); result(w) != "updated" {
+		t.Errorf("expected detect_noop=false to write, got %s", w.Body.String())
+	}
+
+	w := do("GET", "/users/_doc/1", "")
+	if !strings.Contains(w.Body.String(), `"_source":{"age":30,"name":"ann"}`) || !strings.Contains(w.Body.String(), `"_version":3`) {
+		t.Errorf("unexpected doc %s", w.Body.String())
+	}
+}
+
+func TestScriptedUpdate(t *testing.T) {
+	path := "test_scripted_update_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// A bulk update sees the documents indexed before it in the request.
+	bulk := `{"index":{"_index":"posts","_id":"1"}}
+{"title":"a","likes":1,"tags":["x"]}
+{"update":{"_index":"posts","_id":"1"}}
+{"script":{"source":"ctx._source.likes += params.n; ctx._source.tags.add('y')","params":{"n":2}}}
+{"index":{"_index":"posts","_id":"2"}}
+{"title":"b","likes":5,"tags":[]}
+{"update":{"_index":"posts","_id":"3"}}
+{"script":"ctx._source.likes++"}
+`
+	w := do("POST", "/_bulk", bulk)
+	var bulkRes struct {
+		Errors bool                                `json:"errors"`
+		Items  []map[string]map[string]interface{} `json:"items"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &bulkRes)
+	if len(bulkRes.Items) != 4 || bulkRes.Items[1]["update"]["result"] != "updated" || bulkRes.Items[3]["update"]["status"] != 404.0 {
+		t.Fatalf("unexpected bulk response %s", w.Body.String())
+	}
+	w = do("GET", "/posts/_doc/1", "")
+	if !strings.Contains(w.Body.String(), `"_source":{"likes":3,"tags":["x","y"],"title":"a"}`) {
+		t.Errorf("unexpected doc after bulk update %s", w.Body.String())
+	}
+
+	if w := do("POST", "/posts/_update/1", `{"script":"ctx._source.likes +="}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "script_exception") {
+		t.Errorf("expected a script_exception, got %d %s", w.Code, w.Body.String())
+	}
+	script := `{"script":{"source":"if (ctx._source.likes < params.min) { ctx.op = 'delete' } else { ctx._source.popular = true }","params":{"min":4}}}`
+	if w := do("POST", "/posts/_update_by_query", script); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `"total":2`) || !strings.Contains(w.Body.String(), `"deleted":1`) || !strings.Contains(w.Body.String(), `"updated":1`) {
+		t.Fatalf("unexpected update_by_query response %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/posts/_doc/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected doc 1 to be deleted, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/posts/_doc/2", ""); !strings.Contains(w.Body.String(), `"popular":true`) {
+		t.Errorf("expected doc 2 to be updated, got %s", w.Body.String())
+	}
+
+	query := `{"query":{"term":{"title":"b"}},"script":{"source":"ctx._source.likes += 1"}}`
+	if w := do("POST", "/posts/_update_by_query", query); !strings.Contains(w.Body.String(), `"updated":1`) {
+		t.Errorf("unexpected update_by_query response %s", w.Body.String())
+	}
+	if w := do("GET", "/posts/_doc/2", ""); !strings.Contains(w.Body.String(), `"likes":6`) {
+		t.Errorf("expected doc 2 to have 6 likes, got %s", w.Body.String())
+	}
+	if w := do("POST", "/posts/_update_by_query?conflicts=retry", query); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid conflicts value to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteIndex(t *testing.T) {
+	path := "test_delete_index_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("PUT", "/users/_doc/1", `{"name":"ann"}`); w.Code != http.StatusCreated {
+		t.Fatalf("failed to index doc: %d %s", w.Code, w.Body.String())
+	}
+	w := do("DELETE", "/users", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"acknowledged":true`) || !strings.Contains(w.Body.String(), `"found":true`) {
+		t.Fatalf("unexpected delete response %d %s", w.Code, w.Body.String())
+	}
+	if w := do("HEAD", "/users", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the index to be gone, got %d", w.Code)
+	}
+	if w := do("DELETE", "/users", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"found":false`) {
+		t.Errorf("expected deleting again to be acknowledged, got %d %s", w.Code, w.Body.String())
+	}
+
+	// The index can be created again from scratch.
+	do("PUT", "/users/_doc/2", `{"name":"bob"}`)
+	if w := do("GET", "/users/_doc/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the old document to be gone, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestIndexLifecycle(t *testing.T) {
+	path := "test_index_lifecycle_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("PUT", "/users/_doc/1", `{"name":"ann"}`); w.Code != http.StatusCreated {
+		t.Fatalf("failed to index doc: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do("PUT", "/users/_settings", `{"index": {"blocks": {"write": true}}}`); w.Code != http.StatusOK {
+		t.Fatalf("failed to set write block: %d %s", w.Code, w.Body.String())
+	}
+	w := do("PUT", "/users/_doc/2", `{"name":"bob"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "cluster_block_exception") {
+		t.Errorf("expected a cluster block, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users/_settings", ""); !strings.Contains(w.Body.String(), `"blocks":{"write":"true"}`) {
+		t.Errorf("expected the write block in the settings, got %s", w.Body.String())
+	}
+	if w := do("PUT", "/users/_settings", `{"index.blocks.write": "false"}`); w.Code != http.StatusOK {
+		t.Fatalf("failed to clear write block: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/users/_settings", `{"index.number_of_shards": 4}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a static setting to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do("POST", "/users/_close", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"closed":true`) {
+		t.Fatalf("unexpected close response %d %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/users/_doc/1", "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "index_closed_exception") {
+		t.Errorf("expected index_closed_exception, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/_cat/indices", ""); !strings.Contains(w.Body.String(), "close users") {
+		t.Errorf("expected the index to be listed as closed, got %s", w.Body.String())
+	}
+
+	if w := do("POST", "/users/_open", ""); w.Code != http.StatusOK {
+		t.Fatalf("unexpected open response %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users/_doc/1", ""); w.Code != http.StatusOK {
+		t.Errorf("expected the document after reopening, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/missing/_close", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected closing a missing index to fail, got %d", w.Code)
+	}
+}
+
+func TestResize(t *testing.T) {
+	path := "test_resize_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 20; i++ {
+		if w := do("PUT", "/users/_doc/"+strconv.Itoa(i), `{"name":"ann"}`); w.Code != http.StatusCreated {
+			t.Fatalf("failed to index doc: %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	if w := do("POST", "/users/_split/users_3", `{"settings": {"index.number_of_shards": 3}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected splitting into 3 shards to fail, got %d %s", w.Code, w.Body.String())
+	}
+	w := do("POST", "/users/_split/users_4", `{"settings": {"index": {"number_of_shards": 4}}}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"index":"users_4"`) {
+		t.Fatalf("unexpected split response %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users_4/_settings", ""); !strings.Contains(w.Body.String(), `"number_of_shards":"4"`) {
+		t.Errorf("expected 4 shards, got %s", w.Body.String())
+	}
+	if w := do("GET", "/users_4/_doc/13", ""); w.Code != http.StatusOK {
+		t.Errorf("expected the document in the split index, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = do("POST", "/users/_shrink/users_1?swap=true", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"index":"users"`) || !strings.Contains(w.Body.String(), `"swapped":true`) {
+		t.Fatalf("unexpected shrink response %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users/_settings", ""); !strings.Contains(w.Body.String(), `"number_of_shards":"1"`) {
+		t.Errorf("expected the shrunk index under the old name, got %s", w.Body.String())
+	}
+	if w := do("HEAD", "/users_1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the shrink target to be renamed, got %d", w.Code)
+	}
+	if w := do("GET", "/users/_doc/13", ""); w.Code != http.StatusOK {
+		t.Errorf("expected the document after the swap, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRouting(t *testing.T) {
+	path := "test_routing_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	body := `{"settings":{"number_of_shards":4},"mappings":{"_routing":{"required":true},"properties":{"name":{"type":"keyword"}}}}`
+	if w := do("PUT", "/users", body); w.Code != http.StatusOK {
+		t.Fatalf("failed to create index: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users/_mapping", ""); !strings.Contains(w.Body.String(), `"_routing":{"required":true}`) {
+		t.Errorf("expected _routing in the mapping, got %s", w.Body.String())
+	}
+	if w := do("PUT", "/users", body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "resource_already_exists_exception") {
+		t.Errorf("expected resource_already_exists_exception, got %d %s", w.Code, w.Body.String())
+	}
+
+	w := do("PUT", "/users/_doc/1", `{"name":"ann"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "routing_missing_exception") {
+		t.Errorf("expected routing_missing_exception, got %d %s", w.Code, w.Body.String())
+	}
+	// A request another node forwarded here is checked the same way.
+	w = do("PUT", "/users/_doc/1?forward=false", `{"name":"ann"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "routing_missing_exception") {
+		t.Errorf("expected routing_missing_exception for a forwarded doc, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/users/_doc/1?routing=acme&forward=false", `{"name":"ann"}`); w.Code != http.StatusCreated {
+		t.Fatalf("failed to index doc: %d %s", w.Code, w.Body.String())
+	}
+	bulk := `{"index":{"_index":"users","_id":"2","routing":"acme"}}
+{"name":"bob"}
+{"index":{"_index":"users","_id":"3"}}
+{"name":"cid"}
+`
+	w = do("POST", "/_bulk", bulk)
+	if !strings.Contains(w.Body.String(), `"errors":true`) || !strings.Contains(w.Body.String(), "routing_missing_exception") {
+		t.Errorf("expected the unrouted bulk item to fail, got %s", w.Body.String())
+	}
+
+	if w := do("GET", "/users/_doc/2?routing=acme", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"_routing":"acme"`) {
+		t.Errorf("expected doc 2 with its routing, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/users/_doc/2", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a get without routing to fail, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = do("GET", "/users/_search?routing=acme", "")
+	if !strings.Contains(w.Body.String(), `"total":{"value":2}`) || !strings.Contains(w.Body.String(), `"_routing":"acme"`) {
+		t.Errorf("unexpected routed search %s", w.Body.String())
+	}
+
+	// _update_by_query finds the routing of each document it updates.
+	w = do("POST", "/users/_update_by_query", `{"script":"ctx._source.active = true"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"updated":2`) {
+		t.Errorf("unexpected update by query response %d %s", w.Code, w.Body.String())
+	}
+	if w := do("DELETE", "/users/_doc/1?routing=acme", ""); w.Code != http.StatusOK {
+		t.Errorf("failed to delete doc: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReplicaSettings(t *testing.T) {
+	path := "test_replica_settings_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("PUT", "/logs", `{"settings":{"number_of_replicas":-1}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a negative number of replicas to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+	body := `{"settings":{"number_of_replicas":1,"write.wait_for_active_shards":"all"}}`
+	if w := do("PUT", "/logs", body); w.Code != http.StatusOK {
+		t.Fatalf("failed to create index: %d %s", w.Code, w.Body.String())
+	}
+	w := do("GET", "/logs/_settings", "")
+	if !strings.Contains(w.Body.String(), `"number_of_replicas":"1"`) || !strings.Contains(w.Body.String(), `"wait_for_active_shards":"all"`) {
+		t.Errorf("unexpected settings %s", w.Body.String())
+	}
+
+	// With a single node the replicas cannot be placed, so every shard has
+	// one copy and waiting for all of them waits for the primary only.
+	w = do("PUT", "/logs/_doc/1", `{"msg":"a"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"_shards":{"failed":0,"successful":1,"total":1}`) {
+		t.Errorf("unexpected write response %d %s", w.Code, w.Body.String())
+	}
+	w = do("PUT", "/logs/_doc/2?wait_for_active_shards=2", `{"msg":"b"}`)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "unavailable_shards_exception") {
+		t.Errorf("expected unavailable_shards_exception, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/logs/_doc/2?wait_for_active_shards=some", `{"msg":"b"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid wait_for_active_shards to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+
+	bulk := `{"index":{"_index":"logs","_id":"3"}}
+{"msg":"c"}
+`
+	w = do("POST", "/_bulk?wait_for_active_shards=2", bulk)
+	if !strings.Contains(w.Body.String(), `"errors":true`) || !strings.Contains(w.Body.String(), "unavailable_shards_exception") {
+		t.Errorf("expected the bulk item to wait for two copies, got %s", w.Body.String())
+	}
+	if w := do("GET", "/logs/_doc/3", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected doc 3 not to be written, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReroute(t *testing.T) {
+	path := "test_reroute_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("PUT", "/logs", ""); w.Code != http.StatusOK {
+		t.Fatalf("failed to create index: %d %s", w.Code, w.Body.String())
+	}
+	w := do("GET", "/_cat/shards", "")
+	if want := "logs 0 p STARTED node1\nlogs 1 p STARTED node1\n"; w.Body.String() != want {
+		t.Errorf("expected shards %q, got %q", want, w.Body.String())
+	}
+	w = do("POST", "/_cluster/reroute", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"moves":[]`) {
+		t.Errorf("expected no moves, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/_cluster/health", ""); !strings.Contains(w.Body.String(), `"relocating_shards":0`) {
+		t.Errorf("unexpected health %s", w.Body.String())
+	}
+
+	// Only the first node of the cluster allocates shards.
+	other, err := shard.NewManager(path+"_2", 2, cluster.NewCluster("node2", []string{"node1=localhost:1", "node2=localhost:2"}))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer os.RemoveAll(path + "_2")
+	defer other.Close()
+	r2 := gin.New()
+	NewService(other, "localhost:8080").RegisterHandlers(r2)
+	req, _ := http.NewRequest("POST", "/_cluster/reroute", nil)
+	w = httptest.NewRecorder()
+	r2.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "not_master_exception") {
+		t.Errorf("expected not_master_exception, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	path := "test_request_timeout_data"
+	defer os.RemoveAll(path)
+
+	c := cluster.NewCluster("node1", []string{"node1=localhost:8080"})
+	manager, err := shard.NewManager(path, 2, c)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer manager.Close()
+
+	service := NewService(manager, "localhost:8080")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	service.RegisterHandlers(r)
+
+	do := func(ctx context.Context, method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequestWithContext(ctx, method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	ctx := context.Background()
+	if w := do(ctx, "PUT", "/logs/_doc/1?timeout=5s", `{"msg":"hello"}`); w.Code != http.StatusCreated {
+		t.Fatalf("failed to index doc: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(ctx, "GET", "/logs/_search?q=hello&timeout=5s", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"value":1`) {
+		t.Errorf("expected 1 hit, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(ctx, "GET", "/logs/_search?q=hello&timeout=soon", ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "illegal_argument_exception") {
+		t.Errorf("expected an invalid timeout, got %d %s", w.Code, w.Body.String())
+	}
+
+	// A search whose client went away is given up.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if w := do(canceled, "GET", "/logs/_search?q=hello", ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "task_cancelled_exception") {
+		t.Errorf("expected the search to be cancelled, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCodecSettings(t *testing.T) {
+	for codec, want := range map[string]string{
+		"default":          "",
+		"best_compression": "snappy",
+		"snappy":           "snappy",
+		"none":             "none",
+	} {
+		st, err := parseIndexSettings(map[string]interface{}{"index": map[string]interface{}{"codec": codec}}, nil)
+		if err != nil || st.Compression != want {
+			t.Errorf("codec %s: got compression %q, %v, want %q", codec, st.Compression, err, want)
+		}
+	}
+	if _, err := parseIndexSettings(map[string]interface{}{"codec": "lz4"}, nil); err == nil {
+		t.Errorf("expected an unknown codec to be rejected")
 	}
 }
@@ -0,0 +1,227 @@
+package elasticsearch
+
+import (
+	"breeze/internal/mapping"
+	"breeze/internal/shard"
+	"breeze/internal/store"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// flattenSettings turns nested settings objects into dotted keys and drops
+// the optional "index." prefix, so {"index":{"number_of_shards":3}},
+// {"index.number_of_shards":"3"} and {"number_of_shards":3} are equivalent.
+func flattenSettings(prefix string, in map[string]interface{}, out map[string]interface{}) {
+	for k, v := range in {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenSettings(key, nested, out)
+			continue
+		}
+		out[strings.TrimPrefix(key, "index.")] = v
+	}
+}
+
+func settingString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func settingInt(key string, v interface{}) (int, error) {
+	n, err := strconv.Atoi(settingString(v))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse value [%v] for setting [index.%s]", v, key)
+	}
+	return n, nil
+}
+
+// parseActiveShards reads a wait_for_active_shards value: "all" or a number
+// of copies. Waiting for no copy is the same as waiting for the primary.
+func parseActiveShards(v interface{}) (int, error) {
+	raw := settingString(v)
+	if strings.ToLower(raw) == "all" {
+		return store.ActiveShardsAll, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("failed to parse value [%v] for wait_for_active_shards, must be [all] or a non-negative number", v)
+	}
+	if n == 0 {
+		n = 1
+	}
+	return n, nil
+}
+
+// parseCodec maps an index.codec setting to the compression of the document
+// sources. The codecs of Elasticsearch are accepted along with the names of
+// the compressions: best_compression compresses with snappy, and default
+// leaves the sources as they are.
+func parseCodec(codec string) string {
+	switch codec = strings.ToLower(codec); codec {
+	case "best_compression":
+		return "snappy"
+	case "default":
+		return ""
+	}
+	return codec
+}
+
+// analysisSettings returns the "analysis" object of the settings, which is
+// kept nested because it is compiled together with the mappings.
+func analysisSettings(raw map[string]interface{}) map[string]interface{} {
+	if analysis, ok := raw["analysis"].(map[string]interface{}); ok {
+		return analysis
+	}
+	if index, ok := raw["index"].(map[string]interface{}); ok {
+		if analysis, ok := index["analysis"].(map[string]interface{}); ok {
+			return analysis
+		}
+	}
+	return nil
+}
+
+// settingBool reads a boolean setting given as a JSON boolean or as the
+// string "true" or "false"; null is false.
+func settingBool(key string, v interface{}) (bool, error) {
+	switch t := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return t, nil
+	case string:
+		if b, err := strconv.ParseBool(t); err == nil {
+			return b, nil
+		}
+	}
+	return false, fmt.Errorf("failed to parse value [%v] for setting [index.%s], must be [true] or [false]", v, key)
+}
+
+// parseSettingsUpdate reads the body of an update settings request. Only
+// the blocks can be changed once an index exists.
+func parseSettingsUpdate(raw map[string]interface{}) (shard.BlocksUpdate, error) {
+	var update shard.BlocksUpdate
+	flat := make(map[string]interface{})
+	if settings, ok := raw["settings"].(map[string]interface{}); ok && len(raw) == 1 {
+		raw = settings
+	}
+	flattenSettings("", raw, flat)
+	if len(flat) == 0 {
+		return update, fmt.Errorf("no settings to update")
+	}
+	for key, v := range flat {
+		b, err := settingBool(key, v)
+		switch key {
+		case "blocks.write":
+			update.Write = &b
+		case "blocks.read_only":
+			update.ReadOnly = &b
+		case "blocks.read":
+			update.Read = &b
+		default:
+			return update, fmt.Errorf("can't update non dynamic setting [index.%s]", key)
+		}
+		if err != nil {
+			return update, err
+		}
+	}
+	return update, nil
+}
+
+// parseIndexSettings reads the "settings" and "mappings" objects of a
+// create index body.
+func parseIndexSettings(raw, mappings map[string]interface{}) (shard.Settings, error) {
+	var st shard.Settings
+	flat := make(map[string]interface{})
+	flattenSettings("", raw, flat)
+
+	// _routing is a setting of the index rather than of any field, so it is
+	// taken out before the field mappings are compiled.
+	if routing, ok := mappings["_routing"].(map[string]interface{}); ok {
+		required, err := settingBool("mapping._routing.required", routing["required"])
+		if err != nil {
+			return st, err
+		}
+		st.RoutingRequired = required
+		rest := make(map[string]interface{}, len(mappings))
+		for k, v := range mappings {
+			if k != "_routing" {
+				rest[k] = v
+			}
+		}
+		if mappings = rest; len(mappings) == 0 {
+			mappings = nil
+		}
+	}
+
+	if analysis := analysisSettings(raw); mappings != nil || analysis != nil {
+		def, err := mapping.ParseDefinition(mappings, analysis)
+		if err != nil {
+			return st, err
+		}
+		st.Mapping = def
+	}
+
+	for key, v := range flat {
+		switch key {
+		case "number_of_shards":
+			n, err := settingInt(key, v)
+			if err != nil {
+				return st, err
+			}
+			st.NumberOfShards = n
+		case "number_of_replicas":
+			n, err := settingInt(key, v)
+			if err != nil {
+				return st, err
+			}
+			st.NumberOfReplicas = n
+		case "write.wait_for_active_shards":
+			n, err := parseActiveShards(v)
+			if err != nil {
+				return st, err
+			}
+			st.WaitForActiveShards = n
+		case "translog.durability":
+			st.Durability = strings.ToLower(settingString(v))
+		case "translog.sync_interval":
+			st.SyncInterval = settingString(v)
+		case "translog.on_corruption":
+			st.OnCorruption = strings.ToLower(settingString(v))
+		case "codec":
+			st.Compression = parseCodec(settingString(v))
+		case "default_ttl":
+			st.DefaultTTL = settingString(v)
+		case "blocks.write", "blocks.read_only", "blocks.read":
+			b, err := settingBool(key, v)
+			if err != nil {
+				return st, err
+			}
+			switch key {
+			case "blocks.write":
+				st.Blocks.Write = b
+			case "blocks.read_only":
+				st.Blocks.ReadOnly = b
+			default:
+				st.Blocks.Read = b
+			}
+		case "soft_deletes.retention.operations":
+			n, err := settingInt(key, v)
+			if err != nil || n < 0 {
+				return st, fmt.Errorf("failed to parse value [%v] for setting [index.%s]", v, key)
+			}
+			st.RetainOperations = uint64(n)
+		}
+	}
+	return st, st.Validate()
+}
@@ -0,0 +1,207 @@
+package elasticsearch
+
+import (
+	"breeze/internal/shard"
+	"breeze/internal/snapshot"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var groupRef = regexp.MustCompile(`\$(\d+)`)
+
+// readBody decodes an optional JSON request body into v.
+func readBody(c *gin.Context, v interface{}) error {
+	raw, err := io.ReadAll(c.Request.Body)
+	if err != nil || len(bytes.TrimSpace(raw)) == 0 {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// indexList accepts the "indices" of a snapshot request either as a comma
+// separated string or as an array.
+func indexList(v interface{}) []string {
+	var names []string
+	switch t := v.(type) {
+	case string:
+		names = strings.Split(t, ",")
+	case []interface{}:
+		for _, n := range t {
+			if s, ok := n.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	var out []string
+	for _, n := range names {
+		if n = strings.TrimSpace(n); n != "" && n != "_all" && n != "*" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func (s *Service) PutRepository(c *gin.Context) {
+	name := c.Param("repo")
+	var body struct {
+		Type     string `json:"type"`
+		Settings struct {
+			Location string `json:"location"`
+		} `json:"settings"`
+	}
+	if err := readBody(c, &body); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), "")
+		return
+	}
+	cfg := shard.RepositoryConfig{Type: body.Type, Location: body.Settings.Location}
+	if err := s.manager.PutRepository(name, cfg, c.Query("forward") != "false"); err != nil {
+		esError(c, http.StatusInternalServerError, "repository_exception", "["+name+"] "+err.Error(), "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"acknowledged": true})
+}
+
+func (s *Service) GetRepository(c *gin.Context) {
+	repos := s.manager.Repositories()
+	resp := gin.H{}
+	for name, cfg := range repos {
+		resp[name] = gin.H{"type": cfg.Type, "settings": gin.H{"location": cfg.Location}}
+	}
+	if name := c.Param("repo"); name != "" && name != "_all" && name != "*" {
+		cfg, ok := repos[name]
+		if !ok {
+			esError(c, http.StatusNotFound, "repository_missing_exception", "["+name+"] missing", "")
+			return
+		}
+		resp = gin.H{name: gin.H{"type": cfg.Type, "settings": gin.H{"location": cfg.Location}}}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func snapshotResponse(repo string, info snapshot.SnapshotInfo) gin.H {
+	indices := make([]string, 0, len(info.Indices))
+	for name := range info.Indices {
+		indices = append(indices, name)
+	}
+	sort.Strings(indices)
+	failures := info.Failures
+	if failures == nil {
+		failures = []snapshot.ShardFailure{}
+	}
+	return gin.H{
+		"snapshot":             info.Snapshot,
+		"repository":           repo,
+		"indices":              indices,
+		"state":                info.State,
+		"start_time":           info.StartTime,
+		"start_time_in_millis": info.StartTime.UnixMilli(),
+		"end_time":             info.EndTime,
+		"end_time_in_millis":   info.EndTime.UnixMilli(),
+		"duration_in_millis":   info.EndTime.Sub(info.StartTime).Milliseconds(),
+		"failures":             failures,
+		"shards":               info.Shards,
+	}
+}
+
+// CreateSnapshot always waits for the snapshot to complete, as if
+// wait_for_completion were set.
+func (s *Service) CreateSnapshot(c *gin.Context) {
+	repo, snap := c.Param("repo"), c.Param("snapshot")
+	var body struct {
+		Indices interface{} `json:"indices"`
+	}
+	if err := readBody(c, &body); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), "")
+		return
+	}
+	info, err := s.manager.CreateSnapshot(repo, snap, indexList(body.Indices))
+	if err != nil {
+		writeError(c, err, "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"snapshot": snapshotResponse(repo, info)})
+}
+
+func (s *Service) GetSnapshot(c *gin.Context) {
+	repoName, snap := c.Param("repo"), c.Param("snapshot")
+	repo, err := s.manager.Repository(repoName)
+	if err != nil {
+		writeError(c, err, "")
+		return
+	}
+
+	var infos []snapshot.SnapshotInfo
+	if snap == "_all" || snap == "*" {
+		infos, err = repo.Snapshots()
+	} else {
+		for _, name := range strings.Split(snap, ",") {
+			var info snapshot.SnapshotInfo
+			if info, err = repo.Snapshot(strings.TrimSpace(name)); err != nil {
+				break
+			}
+			infos = append(infos, info)
+		}
+	}
+	if err != nil {
+		writeError(c, err, "")
+		return
+	}
+
+	snapshots := make([]gin.H, 0, len(infos))
+	for _, info := range infos {
+		snapshots = append(snapshots, snapshotResponse(repoName, info))
+	}
+	c.JSON(http.StatusOK, gin.H{"snapshots": snapshots, "total": len(snapshots), "remaining": 0})
+}
+
+func (s *Service) DeleteSnapshot(c *gin.Context) {
+	if err := s.manager.DeleteSnapshot(c.Param("repo"), c.Param("snapshot")); err != nil {
+		writeError(c, err, "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"acknowledged": true})
+}
+
+func (s *Service) RestoreSnapshot(c *gin.Context) {
+	repo, snap := c.Param("repo"), c.Param("snapshot")
+	var body struct {
+		Indices           interface{} `json:"indices"`
+		RenamePattern     string      `json:"rename_pattern"`
+		RenameReplacement string      `json:"rename_replacement"`
+	}
+	if err := readBody(c, &body); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), "")
+		return
+	}
+
+	// Go would read "$1_copy" as a group named "1_copy", so numbered
+	// references are braced as Elasticsearch means them.
+	result, err := s.manager.RestoreSnapshot(repo, snap, shard.RestoreRequest{
+		Indices:           indexList(body.Indices),
+		RenamePattern:     body.RenamePattern,
+		RenameReplacement: groupRef.ReplaceAllString(body.RenameReplacement, "$${${1}}"),
+	})
+	if err != nil {
+		writeError(c, err, "")
+		return
+	}
+	failures := result.Failures
+	if failures == nil {
+		failures = []snapshot.ShardFailure{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"snapshot": gin.H{
+			"snapshot": snap,
+			"indices":  result.Indices,
+			"shards":   result.Shards,
+			"failures": failures,
+		},
+	})
+}
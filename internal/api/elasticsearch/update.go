@@ -0,0 +1,252 @@
+package elasticsearch
+
+import (
+	"breeze/internal/script"
+	"breeze/internal/shard"
+	"breeze/internal/store"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// updateBody is the body of an update request.
+type updateBody struct {
+	Doc            map[string]interface{} `json:"doc"`
+	Script         interface{}            `json:"script"`
+	Upsert         map[string]interface{} `json:"upsert"`
+	DocAsUpsert    bool                   `json:"doc_as_upsert"`
+	ScriptedUpsert bool                   `json:"scripted_upsert"`
+	DetectNoop     *bool                  `json:"detect_noop"`
+}
+
+func (b updateBody) request() (store.UpdateRequest, error) {
+	sc, err := parseScript(b.Script)
+	if err != nil {
+		return store.UpdateRequest{}, err
+	}
+	return store.UpdateRequest{
+		Doc:            b.Doc,
+		Script:         sc,
+		Upsert:         b.Upsert,
+		DocAsUpsert:    b.DocAsUpsert,
+		ScriptedUpsert: b.ScriptedUpsert,
+		DetectNoop:     b.DetectNoop == nil || *b.DetectNoop,
+	}, nil
+}
+
+// parseScript reads a script given either as its source or as an object
+// with source (or inline) and params. The source is compiled once, so that
+// syntax errors are reported before any document is touched and the
+// script is not compiled again for every document a request updates.
+func parseScript(v interface{}) (*store.Script, error) {
+	var sc store.Script
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		sc.Source = v
+	case map[string]interface{}:
+		if lang, ok := v["lang"].(string); ok && lang != "painless" {
+			return nil, fmt.Errorf("%w: unsupported script language [%s]", script.ErrScript, lang)
+		}
+		if _, ok := v["id"]; ok {
+			return nil, fmt.Errorf("%w: stored scripts are not supported", script.ErrScript)
+		}
+		sc.Source, _ = v["source"].(string)
+		if sc.Source == "" {
+			sc.Source, _ = v["inline"].(string)
+		}
+		if params, ok := v["params"]; ok {
+			if sc.Params, ok = params.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("%w: script params must be an object", script.ErrScript)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: script must be a string or an object", script.ErrScript)
+	}
+	if err := sc.Compile(); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// Update merges a partial document into an existing one, or upserts it.
+func (s *Service) Update(c *gin.Context) {
+	name := c.Param("index")
+	id := c.Param("id")
+
+	var body updateBody
+	if err := readBody(c, &body); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), name)
+		return
+	}
+	req, err := body.request()
+	if err != nil {
+		writeError(c, err, name)
+		return
+	}
+	opts, err := queryWriteOptions(c)
+	if err != nil {
+		esError(c, http.StatusBadRequest, "illegal_argument_exception", err.Error(), name)
+		return
+	}
+
+	idx, err := s.getOrCreateIndex(name)
+	if err != nil {
+		writeError(c, err, name)
+		return
+	}
+	res, err := idx.Update(c.Request.Context(), id, req, opts)
+	if err != nil {
+		writeError(c, err, name)
+		return
+	}
+	c.JSON(writeStatus(res), writeResponse(name, res))
+}
+
+// updateByQueryPage is the number of matching IDs read per search.
+const updateByQueryPage = 1000
+
+// UpdateByQuery runs a script on every document matching the query, or
+// rewrites them unchanged if there is no script. The matching IDs are
+// collected before the first update, so a script that changes whether a
+// document matches neither skips documents nor visits them twice. Every
+// update runs on the owner of the document's shard.
+func (s *Service) UpdateByQuery(c *gin.Context) {
+	start := time.Now()
+	name := c.Param("index")
+
+	var body struct {
+		Query     map[string]interface{} `json:"query"`
+		Script    interface{}            `json:"script"`
+		Conflicts string                 `json:"conflicts"`
+	}
+	if err := readBody(c, &body); err != nil {
+		esError(c, http.StatusBadRequest, "parse_exception", err.Error(), name)
+		return
+	}
+	sc, err := parseScript(body.Script)
+	if err != nil {
+		writeError(c, err, name)
+		return
+	}
+	req := store.UpdateRequest{Script: sc}
+	if sc == nil {
+		req.Doc = map[string]interface{}{}
+	}
+	conflictsMode := c.DefaultQuery("conflicts", body.Conflicts)
+	if conflictsMode != "" && conflictsMode != "proceed" && conflictsMode != "abort" {
+		esError(c, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("conflicts may only be \"proceed\" or \"abort\" but was [%s]", conflictsMode), name)
+		return
+	}
+	proceed := conflictsMode == "proceed"
+	queryStr := "*"
+	if body.Query != nil {
+		if queryStr = queryString(body.Query); queryStr == "" {
+			esError(c, http.StatusBadRequest, "parsing_exception", "unsupported query", name)
+			return
+		}
+	}
+
+	idx := s.manager.GetIndex(name)
+	if idx == nil {
+		writeError(c, fmt.Errorf("%w [%s]", shard.ErrIndexNotFound, name), name)
+		return
+	}
+
+	ctx := c.Request.Context()
+	// Each document is updated only if it is still at the sequence number
+	// and primary term it was found at.
+	type target struct {
+		id, routing string
+		seqNo, term *uint64
+	}
+	var targets []target
+	batches := 0
+	for from := 0; ; from += updateByQueryPage {
+		sreq := bleve.NewSearchRequestOptions(bleve.NewQueryStringQuery(queryStr), updateByQueryPage, from, false)
+		sreq.SortBy([]string{"_id"})
+		sreq.Fields = []string{store.RoutingField, store.SeqNoField, store.PrimaryTermField}
+		res, err := idx.Search(ctx, sreq, nil)
+		if err != nil {
+			writeError(c, err, name)
+			return
+		}
+		if len(res.Hits) == 0 {
+			break
+		}
+		for _, hit := range res.Hits {
+			t := target{id: hit.ID}
+			t.routing, _ = hit.Fields[store.RoutingField].(string)
+			if seqNo, ok := hit.Fields[store.SeqNoField].(float64); ok {
+				n := uint64(seqNo)
+				t.seqNo = &n
+			}
+			if term, ok := hit.Fields[store.PrimaryTermField].(float64); ok {
+				n := uint64(term)
+				t.term = &n
+			}
+			targets = append(targets, t)
+		}
+		batches++
+	}
+
+	var updated, deleted, noops, conflicts int
+	failures := []gin.H{}
+	status := http.StatusOK
+	for _, t := range targets {
+		id := t.id
+		res, err := idx.Update(ctx, id, req, store.WriteOptions{Routing: t.routing, IfSeqNo: t.seqNo, IfPrimaryTerm: t.term})
+		if err != nil {
+			// A document deleted since the search conflicts like one
+			// changed since.
+			conflict := errors.Is(err, store.ErrVersionConflict) || errors.Is(err, store.ErrDocumentMissing)
+			if conflict {
+				conflicts++
+				if proceed {
+					continue
+				}
+			}
+			code, errType := errorStatus(err)
+			if conflict {
+				code, errType = http.StatusConflict, "version_conflict_engine_exception"
+			}
+			failures = append(failures, gin.H{
+				"index":  name,
+				"id":     id,
+				"status": code,
+				"cause":  gin.H{"type": errType, "reason": err.Error(), "index": name},
+			})
+			status = code
+			break
+		}
+		switch res.Result {
+		case store.ResultDeleted:
+			deleted++
+		case store.ResultNoop:
+			noops++
+		default:
+			updated++
+		}
+	}
+
+	c.JSON(status, gin.H{
+		"took":                   time.Since(start).Milliseconds(),
+		"timed_out":              false,
+		"total":                  len(targets),
+		"updated":                updated,
+		"deleted":                deleted,
+		"batches":                batches,
+		"version_conflicts":      conflicts,
+		"noops":                  noops,
+		"retries":                gin.H{"bulk": 0, "search": 0},
+		"throttled_millis":       0,
+		"requests_per_second":    -1.0,
+		"throttled_until_millis": 0,
+		"failures":               failures,
+	})
+}
@@ -2,6 +2,7 @@ package graphql
 
 import (
 	"breeze/internal/shard"
+	"breeze/internal/store"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -18,6 +19,7 @@ type IndexService struct {
 	schema      graphql.Schema
 	mu          sync.RWMutex
 	lastMapping int
+	stop        chan struct{}
 }
 
 type Service struct {
@@ -38,6 +40,7 @@ func NewService(m *shard.Manager) *Service {
 func (s *Service) watchIndices() {
 	for {
 		time.Sleep(5 * time.Second)
+		s.dropDeleted()
 		names := s.manager.ListIndices()
 		for _, name := range names {
 			s.mu.RLock()
@@ -47,21 +50,51 @@ func (s *Service) watchIndices() {
 			if !ok {
 				idx := s.manager.GetIndex(name)
 				if idx != nil {
-					is := &IndexService{index: idx}
-					is.rebuildSchema()
-					s.mu.Lock()
-					s.indexServices[name] = is
-					s.mu.Unlock()
-					go is.watchMapping()
+					s.addIndex(name, idx)
 				}
 			}
 		}
 	}
 }
 
+func (s *Service) addIndex(name string, idx *shard.Index) *IndexService {
+	is := &IndexService{index: idx, stop: make(chan struct{})}
+	is.rebuildSchema()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.indexServices[name]; ok && cur.index == idx {
+		return cur
+	}
+	if cur, ok := s.indexServices[name]; ok {
+		close(cur.stop)
+	}
+	s.indexServices[name] = is
+	go is.watchMapping()
+	return is
+}
+
+// dropDeleted removes the services of indices that were deleted, or
+// deleted and created again, since their service was built.
+func (s *Service) dropDeleted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, is := range s.indexServices {
+		if s.manager.GetIndex(name) != is.index {
+			close(is.stop)
+			delete(s.indexServices, name)
+		}
+	}
+}
+
 func (is *IndexService) watchMapping() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 	for {
-		time.Sleep(5 * time.Second)
+		select {
+		case <-is.stop:
+			return
+		case <-ticker.C:
+		}
 		is.index.Mapping.Mu.RLock()
 		currentFields := len(is.index.Mapping.Fields)
 		is.index.Mapping.Mu.RUnlock()
@@ -90,7 +123,11 @@ func (is *IndexService) rebuildSchema() error {
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 					id := p.Args["id"].(string)
-					return is.index.Get(id)
+					doc, err := is.index.Get(p.Context, id, "")
+					if err != nil || doc == nil {
+						return nil, err
+					}
+					return doc.Source, nil
 				},
 			},
 			"search": &graphql.Field{
@@ -102,8 +139,8 @@ func (is *IndexService) rebuildSchema() error {
 					queryString := p.Args["query"].(string)
 					q := bleve.NewQueryStringQuery(queryString)
 					req := bleve.NewSearchRequest(q)
-					req.Fields = []string{"_source"}
-					res, err := is.index.Search(req)
+					req.Fields = []string{store.SourceField}
+					res, err := is.index.Search(p.Context, req, nil)
 					if err != nil {
 						return nil, err
 					}
@@ -111,7 +148,7 @@ func (is *IndexService) rebuildSchema() error {
 					var results []map[string]interface{}
 					for _, hit := range res.Hits {
 						source := make(map[string]interface{})
-						if s, ok := hit.Fields["_source"].(string); ok {
+						if s, ok := hit.Fields[store.SourceField].(string); ok {
 							json.Unmarshal([]byte(s), &source)
 						}
 						source["id"] = hit.ID
@@ -139,7 +176,7 @@ func (is *IndexService) rebuildSchema() error {
 					if err := json.Unmarshal([]byte(jsonStr), &data); err != nil {
 						return nil, err
 					}
-					if err := is.index.Index(id, data); err != nil {
+					if _, err := is.index.Index(p.Context, id, data, store.WriteOptions{}); err != nil {
 						return nil, err
 					}
 					return "ok", nil
@@ -152,7 +189,7 @@ func (is *IndexService) rebuildSchema() error {
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 					id := p.Args["id"].(string)
-					if err := is.index.Delete(id); err != nil {
+					if _, err := is.index.Delete(p.Context, id, store.WriteOptions{}); err != nil {
 						return nil, err
 					}
 					return "ok", nil
@@ -185,29 +222,20 @@ func (s *Service) Handler() gin.HandlerFunc {
 			name = "default"
 		}
 
+		s.dropDeleted()
 		s.mu.RLock()
 		is, ok := s.indexServices[name]
 		s.mu.RUnlock()
 
 		if !ok {
-			// Try to open it if it exists in manager but not in service
+			// Indices on disk are opened when the manager starts, so an
+			// index that is not loaded does not exist, or was deleted.
 			idx := s.manager.GetIndex(name)
 			if idx == nil {
-				// Try to create it/open it? For GraphQL we usually expect it to exist
-				// but let's try OpenIndex just in case it's on disk
-				var err error
-				idx, err = s.manager.OpenIndex(name)
-				if err != nil || idx == nil {
-					c.JSON(http.StatusNotFound, gin.H{"error": "index not found"})
-					return
-				}
+				c.JSON(http.StatusNotFound, gin.H{"error": "index not found"})
+				return
 			}
-			is = &IndexService{index: idx}
-			is.rebuildSchema()
-			s.mu.Lock()
-			s.indexServices[name] = is
-			s.mu.Unlock()
-			go is.watchMapping()
+			is = s.addIndex(name, idx)
 		}
 
 		var request struct {
@@ -230,6 +258,7 @@ func (s *Service) Handler() gin.HandlerFunc {
 			RequestString:  request.Query,
 			VariableValues: request.Variables,
 			OperationName:  request.OperationName,
+			Context:        c.Request.Context(),
 		})
 
 		c.JSON(http.StatusOK, result)
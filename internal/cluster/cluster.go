@@ -2,7 +2,9 @@ package cluster
 
 import (
 	"fmt"
+	"maps"
 	"strings"
+	"sync"
 )
 
 type Node struct {
@@ -13,12 +15,19 @@ type Node struct {
 type Cluster struct {
 	SelfID string
 	Nodes  []Node
+	// Placement decides where the shards of new indices go and where the
+	// rebalancer moves them; nil is a RendezvousPlacement ignoring load.
+	Placement Placement
+
+	mu    sync.RWMutex
+	loads map[string]NodeLoad
 }
 
 func NewCluster(selfID string, peers []string) *Cluster {
 	c := &Cluster{
 		SelfID: selfID,
 		Nodes:  []Node{},
+		loads:  make(map[string]NodeLoad),
 	}
 
 	for _, p := range peers {
@@ -30,10 +39,45 @@ func NewCluster(selfID string, peers []string) *Cluster {
 	return c
 }
 
+// ShardPlacement returns the placement of the cluster.
+func (c *Cluster) ShardPlacement() Placement {
+	if c.Placement == nil {
+		return RendezvousPlacement{}
+	}
+	return c.Placement
+}
+
+// SetLoad records the load last reported by a node.
+func (c *Cluster) SetLoad(id string, load NodeLoad) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loads == nil {
+		c.loads = make(map[string]NodeLoad)
+	}
+	c.loads[id] = load
+}
+
+// Loads returns the load last reported by each node.
+func (c *Cluster) Loads() map[string]NodeLoad {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return maps.Clone(c.loads)
+}
+
 func (c *Cluster) GetShardOwner(indexName string, shardID int, totalShards int) Node {
-	// Deterministic mapping: shardID % numNodes
-	nodeIdx := shardID % len(c.Nodes)
-	return c.Nodes[nodeIdx]
+	copies := c.GetShardCopies(indexName, shardID, totalShards, 0)
+	if len(copies) == 0 {
+		return Node{}
+	}
+	return copies[0]
+}
+
+// GetShardCopies returns the nodes holding a copy of a shard, its owner
+// first, as placed by the placement of the cluster. There is at most one
+// copy per node, so fewer replicas than asked for are placed on a small
+// cluster.
+func (c *Cluster) GetShardCopies(indexName string, shardID int, totalShards int, replicas int) []Node {
+	return c.ShardPlacement().Place(indexName, shardID, totalShards, c.Nodes, c.Loads(), replicas+1)
 }
 
 func (c *Cluster) IsLocal(node Node) bool {
@@ -0,0 +1,116 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// NodeLoad is what a node reports about its use, for placements that weigh
+// nodes by it.
+type NodeLoad struct {
+	// DiskBytes is the disk space used by the data of the node.
+	DiskBytes int64 `json:"disk_bytes"`
+	// Shards is the number of shard copies the node holds.
+	Shards int `json:"shards"`
+}
+
+// Placement decides which nodes hold the copies of a shard.
+type Placement interface {
+	// Place returns the nodes holding the copies of a shard, the primary
+	// first, at most copies of them and each node at most once. loads has
+	// the last load reported by each node, and misses the nodes that have
+	// not reported any.
+	Place(indexName string, shardID int, totalShards int, nodes []Node, loads map[string]NodeLoad, copies int) []Node
+}
+
+// RoundRobinPlacement places the primary of shard N on node N modulo the
+// number of nodes, and its replicas on the nodes that follow it, whatever
+// the index. It is how shards were placed before placements could be chosen.
+type RoundRobinPlacement struct{}
+
+func (RoundRobinPlacement) Place(indexName string, shardID int, totalShards int, nodes []Node, loads map[string]NodeLoad, copies int) []Node {
+	copies = min(copies, len(nodes))
+	placed := make([]Node, 0, copies)
+	for i := 0; i < copies; i++ {
+		placed = append(placed, nodes[(shardID+i)%len(nodes)])
+	}
+	return placed
+}
+
+// RendezvousPlacement places the copies of a shard on the nodes that score
+// highest for it, the score being a hash of the index, the shard and the
+// node. Shards of different indices land on different nodes, and when a
+// node joins or leaves only the shards it gains or loses move.
+//
+// DiskWeight and ShardWeight lower the score of the nodes using more disk
+// space, or holding more shards, than the average of the nodes that reported
+// their load, in proportion to how much more they use. Zero ignores the
+// load, which keeps the placement of a shard fixed while the nodes are;
+// otherwise shards follow the load as it changes, so small weights are best.
+type RendezvousPlacement struct {
+	DiskWeight  float64
+	ShardWeight float64
+}
+
+func (p RendezvousPlacement) Place(indexName string, shardID int, totalShards int, nodes []Node, loads map[string]NodeLoad, copies int) []Node {
+	copies = min(copies, len(nodes))
+	var meanDisk, meanShards float64
+	if len(loads) > 0 {
+		for _, load := range loads {
+			meanDisk += float64(load.DiskBytes)
+			meanShards += float64(load.Shards)
+		}
+		meanDisk /= float64(len(loads))
+		meanShards /= float64(len(loads))
+	}
+
+	key := indexName + "\x00" + strconv.Itoa(shardID) + "\x00"
+	scores := make(map[string]float64, len(nodes))
+	for _, node := range nodes {
+		// Nodes without a reported load count as average.
+		penalty := p.DiskWeight + p.ShardWeight
+		if load, ok := loads[node.ID]; ok {
+			penalty = p.DiskWeight*relative(float64(load.DiskBytes), meanDisk) +
+				p.ShardWeight*relative(float64(load.Shards), meanShards)
+		}
+		// Weighted rendezvous hashing: the node with the highest
+		// weight / -ln(hash) wins, the hash being uniform in (0, 1), so
+		// each node gets its weight's share of the shards.
+		weight := 1 / (1 + penalty)
+		scores[node.ID] = weight / -math.Log(unitHash(key+node.ID))
+	}
+
+	placed := append([]Node(nil), nodes...)
+	sort.SliceStable(placed, func(i, j int) bool {
+		if si, sj := scores[placed[i].ID], scores[placed[j].ID]; si != sj {
+			return si > sj
+		}
+		return placed[i].ID < placed[j].ID
+	})
+	return placed[:copies]
+}
+
+// relative returns v as a share of mean, 0 if mean is.
+func relative(v, mean float64) float64 {
+	if mean <= 0 {
+		return 0
+	}
+	return v / mean
+}
+
+// unitHash hashes s to a number in (0, 1).
+func unitHash(s string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV-1a barely mixes its last bytes, so the hash is finished with
+	// the splitmix64 finalizer.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
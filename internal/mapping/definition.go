@@ -0,0 +1,652 @@
+package mapping
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/token/porter"
+	"github.com/blevesearch/bleve/v2/analysis/tokenmap"
+	bmapping "github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/registry"
+)
+
+// Definition is the explicit mapping of an index in Elasticsearch form: the
+// "analysis" part of the index settings and the "mappings" body. Compile
+// turns it into a Bleve index mapping.
+type Definition struct {
+	Analysis   Analysis             `json:"analysis,omitempty"`
+	Dynamic    interface{}          `json:"dynamic,omitempty"`
+	Properties map[string]*Property `json:"properties,omitempty"`
+}
+
+// Analysis holds custom analysis components keyed by name. Each component
+// is the raw Elasticsearch object, e.g. {"type": "stop", "stopwords": [...]}.
+type Analysis struct {
+	Analyzer   map[string]map[string]interface{} `json:"analyzer,omitempty"`
+	Tokenizer  map[string]map[string]interface{} `json:"tokenizer,omitempty"`
+	Filter     map[string]map[string]interface{} `json:"filter,omitempty"`
+	CharFilter map[string]map[string]interface{} `json:"char_filter,omitempty"`
+}
+
+// Property is the mapping of one field.
+type Property struct {
+	Type       string               `json:"type,omitempty"`
+	Analyzer   string               `json:"analyzer,omitempty"`
+	Index      *bool                `json:"index,omitempty"`
+	Store      *bool                `json:"store,omitempty"`
+	DocValues  *bool                `json:"doc_values,omitempty"`
+	Enabled    *bool                `json:"enabled,omitempty"`
+	Format     string               `json:"format,omitempty"`
+	Fields     map[string]*Property `json:"fields,omitempty"`
+	Properties map[string]*Property `json:"properties,omitempty"`
+}
+
+// languages maps Elasticsearch language names to the codes Bleve registers
+// its language analyzers, stop words and stemmers under.
+var languages = map[string]string{
+	"arabic": "ar", "bulgarian": "bg", "catalan": "ca", "cjk": "cjk",
+	"sorani": "ckb", "czech": "cs", "danish": "da", "german": "de",
+	"greek": "el", "english": "en", "spanish": "es", "basque": "eu",
+	"persian": "fa", "finnish": "fi", "french": "fr", "irish": "ga",
+	"galician": "gl", "hindi": "hi", "croatian": "hr", "hungarian": "hu",
+	"armenian": "hy", "indonesian": "id", "italian": "it", "dutch": "nl",
+	"norwegian": "no", "polish": "pl", "portuguese": "pt", "romanian": "ro",
+	"russian": "ru", "swedish": "sv", "turkish": "tr",
+}
+
+// Built-in Elasticsearch components with a direct Bleve equivalent.
+var (
+	builtinAnalyzers = map[string]string{
+		"standard": "standard",
+		"simple":   "simple",
+		"keyword":  "keyword",
+	}
+	// predefinedAnalyzers are Elasticsearch analyzers Bleve lacks, given
+	// as custom analyzer definitions.
+	predefinedAnalyzers = map[string]map[string]interface{}{
+		"whitespace": {"tokenizer": "whitespace"},
+		"stop":       {"tokenizer": "letter", "filter": []interface{}{"lowercase", "stop"}},
+	}
+	builtinTokenizers = map[string]string{
+		"standard":      "unicode",
+		"classic":       "unicode",
+		"whitespace":    "whitespace",
+		"keyword":       "single",
+		"letter":        "letter",
+		"uax_url_email": "web",
+	}
+	builtinFilters = map[string]string{
+		"lowercase":   "to_lower",
+		"stop":        "stop_en",
+		"porter_stem": porter.Name,
+		"unique":      "unique",
+		"reverse":     "reverse",
+		"apostrophe":  "apostrophe",
+	}
+	builtinCharFilters = map[string]string{
+		"html_strip": "html",
+	}
+)
+
+// compiler resolves Elasticsearch component names while a mapping is built.
+type compiler struct {
+	im   *bmapping.IndexMappingImpl
+	def  *Definition
+	seen map[string]string
+}
+
+// Compile builds the Bleve index mapping for the definition.
+func (d *Definition) Compile() (bmapping.IndexMapping, error) {
+	c := &compiler{im: bleve.NewIndexMapping(), def: d, seen: make(map[string]string)}
+
+	if _, ok := d.Analysis.Analyzer["default"]; ok {
+		name, err := c.analyzer("default")
+		if err != nil {
+			return nil, err
+		}
+		c.im.DefaultAnalyzer = name
+	}
+
+	dm, err := c.document(d.Properties)
+	if err != nil {
+		return nil, err
+	}
+	switch v := d.Dynamic.(type) {
+	case bool:
+		dm.Dynamic = v
+	case string:
+		// Bleve cannot reject unmapped fields, so "strict" only stops
+		// them from being indexed, like false.
+		dm.Dynamic = v == "true"
+	}
+	c.im.DefaultMapping = dm
+
+	if err := c.im.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid mapping: %w", err)
+	}
+	return c.im, nil
+}
+
+func (c *compiler) document(props map[string]*Property) (*bmapping.DocumentMapping, error) {
+	dm := bleve.NewDocumentMapping()
+	for _, name := range sortedKeys(props) {
+		prop := props[name]
+		if prop.Type == "" && prop.Properties != nil || prop.Type == "object" || prop.Type == "nested" {
+			sub, err := c.document(prop.Properties)
+			if err != nil {
+				return nil, err
+			}
+			if prop.Enabled != nil && !*prop.Enabled {
+				sub.Enabled = false
+			}
+			dm.AddSubDocumentMapping(name, sub)
+			continue
+		}
+
+		fm, err := c.field(name, prop)
+		if err != nil {
+			return nil, err
+		}
+		dm.AddFieldMappingsAt(name, fm)
+		for _, subName := range sortedKeys(prop.Fields) {
+			sub, err := c.field(name+"."+subName, prop.Fields[subName])
+			if err != nil {
+				return nil, err
+			}
+			// Multi-fields are indexed as "<field>.<name>" from the same
+			// value. Bleve finds the analyzer of a dotted path through
+			// sub-documents only, so the field is also registered under a
+			// sub-document, which a string value never reaches.
+			lookup := bleve.NewDocumentMapping()
+			copied := *sub
+			lookup.AddFieldMapping(&copied)
+			sub.Name = name + "." + subName
+
+			propMapping := dm.Properties[name]
+			propMapping.AddFieldMapping(sub)
+			propMapping.AddSubDocumentMapping(subName, lookup)
+		}
+	}
+	return dm, nil
+}
+
+func (c *compiler) field(path string, prop *Property) (*bmapping.FieldMapping, error) {
+	var fm *bmapping.FieldMapping
+	switch prop.Type {
+	case "text", "match_only_text", "":
+		fm = bleve.NewTextFieldMapping()
+		if prop.Analyzer != "" {
+			name, err := c.analyzer(prop.Analyzer)
+			if err != nil {
+				return nil, fmt.Errorf("field [%s]: %w", path, err)
+			}
+			fm.Analyzer = name
+		}
+	case "keyword", "constant_keyword", "wildcard":
+		fm = bleve.NewKeywordFieldMapping()
+	case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float", "unsigned_long":
+		fm = bleve.NewNumericFieldMapping()
+	case "boolean":
+		fm = bleve.NewBooleanFieldMapping()
+	case "date":
+		fm = bleve.NewDateTimeFieldMapping()
+		fm.DateFormat = dateFormat(prop.Format)
+	case "geo_point":
+		fm = bleve.NewGeoPointFieldMapping()
+	case "ip":
+		fm = bleve.NewIPFieldMapping()
+	default:
+		return nil, fmt.Errorf("field [%s]: unsupported type [%s]", path, prop.Type)
+	}
+	// Like Elasticsearch, fields are not stored unless asked for; sources
+	// come from the document store.
+	fm.Store = false
+	if prop.Index != nil {
+		fm.Index = *prop.Index
+	}
+	if prop.Store != nil {
+		fm.Store = *prop.Store
+	}
+	if prop.DocValues != nil {
+		fm.DocValues = *prop.DocValues
+	}
+	return fm, nil
+}
+
+// dateFormat picks the Bleve parser for the first Elasticsearch format it
+// knows; anything else is parsed as an optional-time ISO date.
+func dateFormat(format string) string {
+	for _, f := range strings.Split(format, "||") {
+		switch strings.TrimSpace(f) {
+		case "epoch_millis":
+			return "unix_milli"
+		case "epoch_second":
+			return "unix_sec"
+		}
+	}
+	return ""
+}
+
+// analyzer returns the Bleve name of an Elasticsearch analyzer, registering
+// a custom analyzer when the index defines one.
+func (c *compiler) analyzer(name string) (string, error) {
+	if resolved, ok := c.seen["analyzer:"+name]; ok {
+		return resolved, nil
+	}
+	cfg, ok := c.def.Analysis.Analyzer[name]
+	if !ok {
+		if cfg, ok = predefinedAnalyzers[name]; !ok {
+			resolved, err := builtinAnalyzer(name)
+			c.seen["analyzer:"+name] = resolved
+			return resolved, err
+		}
+	}
+
+	typ, _ := cfg["type"].(string)
+	if pre, ok := predefinedAnalyzers[typ]; ok {
+		cfg, typ = pre, ""
+	}
+	if typ != "" && typ != "custom" {
+		if _, hasStop := cfg["stopwords"]; !hasStop || typ != "standard" {
+			resolved, err := builtinAnalyzer(typ)
+			if err != nil {
+				return "", fmt.Errorf("analyzer [%s]: %w", name, err)
+			}
+			c.seen["analyzer:"+name] = resolved
+			return resolved, nil
+		}
+		// A standard analyzer with stop words.
+		stop, err := c.stopFilter(name+"_stop", cfg["stopwords"])
+		if err != nil {
+			return "", fmt.Errorf("analyzer [%s]: %w", name, err)
+		}
+		cfg = map[string]interface{}{"tokenizer": "standard", "filter": []interface{}{"lowercase", stop}}
+	}
+
+	tokenizerName, _ := cfg["tokenizer"].(string)
+	if tokenizerName == "" {
+		return "", fmt.Errorf("analyzer [%s] must specify a tokenizer", name)
+	}
+	tokenizer, err := c.tokenizer(tokenizerName)
+	if err != nil {
+		return "", fmt.Errorf("analyzer [%s]: %w", name, err)
+	}
+	filters, err := c.resolveAll(cfg["filter"], c.tokenFilter)
+	if err != nil {
+		return "", fmt.Errorf("analyzer [%s]: %w", name, err)
+	}
+	charFilters, err := c.resolveAll(cfg["char_filter"], c.charFilter)
+	if err != nil {
+		return "", fmt.Errorf("analyzer [%s]: %w", name, err)
+	}
+
+	err = c.im.AddCustomAnalyzer(name, map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     tokenizer,
+		"token_filters": filters,
+		"char_filters":  charFilters,
+	})
+	if err != nil {
+		return "", fmt.Errorf("analyzer [%s]: %w", name, err)
+	}
+	c.seen["analyzer:"+name] = name
+	return name, nil
+}
+
+func builtinAnalyzer(name string) (string, error) {
+	if resolved, ok := builtinAnalyzers[name]; ok {
+		return resolved, nil
+	}
+	if code, ok := languages[name]; ok && registered(registry.AnalyzerTypesAndInstances, code) {
+		return code, nil
+	}
+	return "", fmt.Errorf("unsupported analyzer [%s]", name)
+}
+
+// resolveAll resolves a single name or a list of names.
+func (c *compiler) resolveAll(v interface{}, resolve func(string) (string, error)) ([]interface{}, error) {
+	var names []string
+	switch t := v.(type) {
+	case nil:
+	case string:
+		names = []string{t}
+	case []interface{}:
+		for _, n := range t {
+			s, ok := n.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid component name %v", n)
+			}
+			names = append(names, s)
+		}
+	default:
+		return nil, fmt.Errorf("invalid component list %v", v)
+	}
+	out := make([]interface{}, 0, len(names))
+	for _, n := range names {
+		resolved, err := resolve(n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, resolved)
+	}
+	return out, nil
+}
+
+func (c *compiler) tokenizer(name string) (string, error) {
+	if resolved, ok := c.seen["tokenizer:"+name]; ok {
+		return resolved, nil
+	}
+	cfg, ok := c.def.Analysis.Tokenizer[name]
+	if !ok {
+		if resolved, ok := builtinTokenizers[name]; ok {
+			return resolved, nil
+		}
+		return "", fmt.Errorf("unsupported tokenizer [%s]", name)
+	}
+
+	typ, _ := cfg["type"].(string)
+	var err error
+	switch typ {
+	case "simple_pattern":
+		// Like Bleve's regexp tokenizer, simple_pattern emits the matches.
+		err = c.im.AddCustomTokenizer(name, map[string]interface{}{
+			"type":   "regexp",
+			"regexp": cfg["pattern"],
+		})
+	default:
+		resolved, ok := builtinTokenizers[typ]
+		if !ok {
+			return "", fmt.Errorf("unsupported tokenizer type [%s]", typ)
+		}
+		c.seen["tokenizer:"+name] = resolved
+		return resolved, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("tokenizer [%s]: %w", name, err)
+	}
+	c.seen["tokenizer:"+name] = name
+	return name, nil
+}
+
+func (c *compiler) tokenFilter(name string) (string, error) {
+	if resolved, ok := c.seen["filter:"+name]; ok {
+		return resolved, nil
+	}
+	cfg, ok := c.def.Analysis.Filter[name]
+	if !ok {
+		// Built-in filters that take parameters are used with their
+		// Elasticsearch defaults.
+		switch name {
+		case "shingle", "edge_ngram", "ngram", "truncate", "length":
+			cfg = map[string]interface{}{"type": name}
+		default:
+			if resolved, ok := builtinFilters[name]; ok {
+				return resolved, nil
+			}
+			return "", fmt.Errorf("unsupported token filter [%s]", name)
+		}
+	}
+
+	typ, _ := cfg["type"].(string)
+	var bleveCfg map[string]interface{}
+	switch typ {
+	case "stop":
+		resolved, err := c.stopFilter(name, cfg["stopwords"])
+		if err != nil {
+			return "", fmt.Errorf("token filter [%s]: %w", name, err)
+		}
+		c.seen["filter:"+name] = resolved
+		return resolved, nil
+	case "stemmer", "snowball":
+		lang, _ := cfg["language"].(string)
+		if lang == "" {
+			lang, _ = cfg["name"].(string)
+		}
+		resolved, err := stemmer(typ, lang)
+		if err != nil {
+			return "", fmt.Errorf("token filter [%s]: %w", name, err)
+		}
+		c.seen["filter:"+name] = resolved
+		return resolved, nil
+	case "length":
+		bleveCfg = map[string]interface{}{
+			"type": "length",
+			"min":  number(cfg["min"], 0),
+			"max":  number(cfg["max"], float64(1<<31-1)),
+		}
+	case "edge_ngram", "edgeNGram":
+		bleveCfg = map[string]interface{}{
+			"type": "edge_ngram",
+			"back": cfg["side"] == "back",
+			"min":  number(cfg["min_gram"], 1),
+			"max":  number(cfg["max_gram"], 2),
+		}
+	case "ngram", "nGram":
+		bleveCfg = map[string]interface{}{
+			"type": "ngram",
+			"min":  number(cfg["min_gram"], 1),
+			"max":  number(cfg["max_gram"], 2),
+		}
+	case "shingle":
+		sep, ok := cfg["token_separator"].(string)
+		if !ok {
+			sep = " "
+		}
+		unigrams, ok := cfg["output_unigrams"].(bool)
+		if !ok {
+			unigrams = true
+		}
+		bleveCfg = map[string]interface{}{
+			"type":            "shingle",
+			"min":             number(cfg["min_shingle_size"], 2),
+			"max":             number(cfg["max_shingle_size"], 2),
+			"output_original": unigrams,
+			"separator":       sep,
+			"filler":          "_",
+		}
+	case "truncate":
+		bleveCfg = map[string]interface{}{
+			"type":   "truncate_token",
+			"length": number(cfg["length"], 10),
+		}
+	default:
+		resolved, ok := builtinFilters[typ]
+		if !ok {
+			return "", fmt.Errorf("unsupported token filter type [%s]", typ)
+		}
+		c.seen["filter:"+name] = resolved
+		return resolved, nil
+	}
+
+	if err := c.im.AddCustomTokenFilter(name, bleveCfg); err != nil {
+		return "", fmt.Errorf("token filter [%s]: %w", name, err)
+	}
+	c.seen["filter:"+name] = name
+	return name, nil
+}
+
+// stopFilter resolves Elasticsearch stop words: a predefined list such as
+// "_english_" or an explicit array, which gets its own token map.
+func (c *compiler) stopFilter(name string, stopwords interface{}) (string, error) {
+	switch t := stopwords.(type) {
+	case nil:
+		return "stop_en", nil
+	case string:
+		lang := strings.Trim(t, "_")
+		if code, ok := languages[lang]; ok && registered(registry.TokenFilterTypesAndInstances, "stop_"+code) {
+			return "stop_" + code, nil
+		}
+		return "", fmt.Errorf("unsupported stop words [%s]", t)
+	case []interface{}:
+		mapName := name + "_words"
+		err := c.im.AddCustomTokenMap(mapName, map[string]interface{}{
+			"type":   tokenmap.Name,
+			"tokens": t,
+		})
+		if err != nil {
+			return "", err
+		}
+		err = c.im.AddCustomTokenFilter(name, map[string]interface{}{
+			"type":           "stop_tokens",
+			"stop_token_map": mapName,
+		})
+		return name, err
+	}
+	return "", fmt.Errorf("invalid stop words %v", stopwords)
+}
+
+// stemmer maps an Elasticsearch stemmer language to a Bleve stemmer,
+// preferring snowball stemmers.
+func stemmer(typ, lang string) (string, error) {
+	lang = strings.ToLower(lang)
+	switch lang {
+	case "", "english", "porter":
+		if typ == "snowball" && lang != "porter" {
+			return "stemmer_en_snowball", nil
+		}
+		return porter.Name, nil
+	case "light_english", "minimal_english":
+		return "stemmer_en_plural", nil
+	case "possessive_english":
+		return "possessive_en", nil
+	}
+	lang = strings.TrimPrefix(strings.TrimPrefix(lang, "light_"), "minimal_")
+	code, ok := languages[lang]
+	if ok {
+		for _, candidate := range []string{"stemmer_" + code + "_snowball", "stemmer_" + code + "_light", "stemmer_" + code} {
+			if registered(registry.TokenFilterTypesAndInstances, candidate) {
+				return candidate, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unsupported stemmer language [%s]", lang)
+}
+
+func (c *compiler) charFilter(name string) (string, error) {
+	if resolved, ok := c.seen["char_filter:"+name]; ok {
+		return resolved, nil
+	}
+	cfg, ok := c.def.Analysis.CharFilter[name]
+	if !ok {
+		if resolved, ok := builtinCharFilters[name]; ok {
+			return resolved, nil
+		}
+		return "", fmt.Errorf("unsupported char filter [%s]", name)
+	}
+
+	typ, _ := cfg["type"].(string)
+	switch typ {
+	case "pattern_replace":
+		replacement, _ := cfg["replacement"].(string)
+		err := c.im.AddCustomCharFilter(name, map[string]interface{}{
+			"type":    "regexp",
+			"regexp":  cfg["pattern"],
+			"replace": replacement,
+		})
+		if err != nil {
+			return "", fmt.Errorf("char filter [%s]: %w", name, err)
+		}
+		c.seen["char_filter:"+name] = name
+		return name, nil
+	}
+	resolved, ok := builtinCharFilters[typ]
+	if !ok {
+		return "", fmt.Errorf("unsupported char filter type [%s]", typ)
+	}
+	c.seen["char_filter:"+name] = resolved
+	return resolved, nil
+}
+
+func registered(list func() ([]string, []string), name string) bool {
+	types, instances := list()
+	for _, n := range append(types, instances...) {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// number reads a numeric setting, which Elasticsearch also accepts as a
+// string. Bleve expects float64 values.
+func number(v interface{}, def float64) float64 {
+	switch t := v.(type) {
+	case float64:
+		return t
+	case string:
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func sortedKeys(m map[string]*Property) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FieldTypes returns the sniffing type of every top-level field, so GraphQL
+// and the mapping API see explicit fields before any document is indexed.
+func (d *Definition) FieldTypes() map[string]FieldType {
+	types := make(map[string]FieldType, len(d.Properties))
+	for name, prop := range d.Properties {
+		switch prop.Type {
+		case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float", "unsigned_long":
+			types[name] = TypeNumber
+		case "boolean":
+			types[name] = TypeBoolean
+		case "object", "nested":
+			types[name] = TypeObject
+		case "":
+			if prop.Properties != nil {
+				types[name] = TypeObject
+			} else {
+				types[name] = TypeString
+			}
+		default:
+			types[name] = TypeString
+		}
+	}
+	return types
+}
+
+// ParseDefinition decodes the Elasticsearch "mappings" object together with
+// the "analysis" settings. A mappings object wrapped in a type name, as in
+// Elasticsearch 6, is unwrapped.
+func ParseDefinition(mappings map[string]interface{}, analysis map[string]interface{}) (*Definition, error) {
+	if _, ok := mappings["properties"]; !ok && len(mappings) == 1 {
+		for _, v := range mappings {
+			if inner, ok := v.(map[string]interface{}); ok {
+				if _, ok := inner["properties"]; ok {
+					mappings = inner
+				}
+			}
+		}
+	}
+	raw := make(map[string]interface{}, len(mappings)+1)
+	for k, v := range mappings {
+		raw[k] = v
+	}
+	if analysis != nil {
+		raw["analysis"] = analysis
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var def Definition
+	if err := json.Unmarshal(data, &def); err != nil {
+		return nil, fmt.Errorf("failed to parse mapping: %w", err)
+	}
+	return &def, nil
+}
@@ -32,7 +32,7 @@ func (m *Mapping) Sniff(data map[string]interface{}) bool {
 
 	changed := false
 	for k, v := range data {
-		if k == "_source" {
+		if k == "_source" || k == "_ttl" {
 			continue
 		}
 		var detected FieldType
@@ -0,0 +1,843 @@
+package script
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Script is a compiled script. It is safe to run concurrently with different
+// variables.
+type Script struct {
+	source string
+	stmts  []stmt
+}
+
+// Compile parses a script.
+func Compile(source string) (*Script, error) {
+	toks, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	stmts, err := p.statements("")
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected("a statement")
+	}
+	return &Script{source: source, stmts: stmts}, nil
+}
+
+// String returns the source of the script.
+func (s *Script) String() string { return s.source }
+
+// Run executes the script. vars holds the variables the script can read and
+// modify, typically ctx and params; their values are the ones produced by
+// encoding/json and are changed in place.
+func (s *Script) Run(vars map[string]interface{}) error {
+	for k, v := range vars {
+		vars[k] = wrap(v)
+	}
+	e := &env{vars: vars, locals: make(map[string]interface{})}
+	err := e.exec(s.stmts)
+	for k, v := range vars {
+		vars[k] = unwrap(v)
+	}
+	if errors.Is(err, errReturn) {
+		return nil
+	}
+	return err
+}
+
+// list is the representation of a JSON array while a script runs, so that
+// every variable referring to it sees elements added by another.
+type list struct{ items []interface{} }
+
+// Limits of a run, so that a script cannot exhaust the memory or the time of
+// the node it runs on. A script exceeding one fails with ErrScript.
+const (
+	// maxStatements is the number of statements a run executes.
+	maxStatements = 10000
+	// maxCollectionSize is the number of elements of a list or a map.
+	maxCollectionSize = 10000
+	// maxStringLength is the length in bytes of a string a script builds.
+	maxStringLength = 1 << 20
+	// maxCopied is the number of values a run copies, see copyValue.
+	maxCopied = 1 << 20
+)
+
+func wrap(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		l := &list{items: make([]interface{}, len(v))}
+		for i, item := range v {
+			l.items[i] = wrap(item)
+		}
+		return l
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = wrap(item)
+		}
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return v
+}
+
+func unwrap(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *list:
+		items := make([]interface{}, len(v.items))
+		for i, item := range v.items {
+			items[i] = unwrap(item)
+		}
+		return items
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = unwrap(item)
+		}
+		return v
+	}
+	return v
+}
+
+// errReturn stops a script at a return statement.
+var errReturn = errors.New("return")
+
+type env struct {
+	vars   map[string]interface{}
+	locals map[string]interface{}
+	// steps and copied count the statements executed and the values
+	// copied so far, against maxStatements and maxCopied.
+	steps, copied int
+}
+
+func (e *env) exec(stmts []stmt) error {
+	for _, s := range stmts {
+		if e.steps++; e.steps > maxStatements {
+			return errorf("script executes more than %d statements", maxStatements)
+		}
+		if err := e.stmt(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *env) stmt(s stmt) error {
+	switch s := s.(type) {
+	case *exprStmt:
+		_, err := e.eval(s.x)
+		return err
+	case *declare:
+		v, err := e.eval(s.value)
+		if err != nil {
+			return err
+		}
+		e.locals[s.name] = v
+		return nil
+	case *assign:
+		v, err := e.eval(s.value)
+		if err != nil {
+			return err
+		}
+		if s.op != "" {
+			cur, err := e.eval(s.target)
+			if err != nil {
+				return err
+			}
+			if v, err = e.arith(s.op, cur, v); err != nil {
+				return err
+			}
+		}
+		return e.set(s.target, v)
+	case *ifStmt:
+		cond, err := e.eval(s.cond)
+		if err != nil {
+			return err
+		}
+		b, ok := cond.(bool)
+		if !ok {
+			return errorf("condition is a %s, not a boolean", typeName(cond))
+		}
+		if b {
+			return e.exec(s.then)
+		}
+		return e.exec(s.els)
+	case *returnStmt:
+		return errReturn
+	}
+	return errorf("unknown statement %T", s)
+}
+
+// copyValue returns a deep copy of v. Lists and maps are copied when they
+// are stored in another list or map, so that no value ever contains itself
+// and a value stored twice does not grow twice as fast as it is changed.
+func (e *env) copyValue(v interface{}) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case *list:
+		if e.copied += len(v.items); e.copied > maxCopied {
+			return nil, errorf("script copies more than %d values", maxCopied)
+		}
+		l := &list{items: make([]interface{}, len(v.items))}
+		for i, item := range v.items {
+			if l.items[i], err = e.copyValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	case map[string]interface{}:
+		if e.copied += len(v); e.copied > maxCopied {
+			return nil, errorf("script copies more than %d values", maxCopied)
+		}
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			if m[k], err = e.copyValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return v, nil
+}
+
+// grow checks that a list or map of n elements may get another one.
+func grow(n int) error {
+	if n >= maxCollectionSize {
+		return errorf("lists and maps hold at most %d elements", maxCollectionSize)
+	}
+	return nil
+}
+
+func (e *env) set(target expr, v interface{}) error {
+	if _, ok := target.(*ident); !ok {
+		var err error
+		if v, err = e.copyValue(v); err != nil {
+			return err
+		}
+	}
+	switch t := target.(type) {
+	case *ident:
+		if _, ok := e.locals[t.name]; ok {
+			e.locals[t.name] = v
+			return nil
+		}
+		if _, ok := e.vars[t.name]; ok {
+			return errorf("cannot assign to [%s]", t.name)
+		}
+		return errorf("variable [%s] is not defined", t.name)
+	case *member:
+		x, err := e.eval(t.x)
+		if err != nil {
+			return err
+		}
+		m, ok := x.(map[string]interface{})
+		if !ok {
+			return errorf("cannot set field [%s] of a %s", t.name, typeName(x))
+		}
+		if _, ok := m[t.name]; !ok {
+			if err := grow(len(m)); err != nil {
+				return err
+			}
+		}
+		m[t.name] = v
+		return nil
+	case *index:
+		x, err := e.eval(t.x)
+		if err != nil {
+			return err
+		}
+		key, err := e.eval(t.key)
+		if err != nil {
+			return err
+		}
+		switch c := x.(type) {
+		case map[string]interface{}:
+			k, ok := key.(string)
+			if !ok {
+				return errorf("map keys must be strings, not %s", typeName(key))
+			}
+			if _, ok := c[k]; !ok {
+				if err := grow(len(c)); err != nil {
+					return err
+				}
+			}
+			c[k] = v
+			return nil
+		case *list:
+			i, err := position(key, len(c.items))
+			if err != nil {
+				return err
+			}
+			c.items[i] = v
+			return nil
+		}
+		return errorf("cannot index a %s", typeName(x))
+	}
+	return errorf("cannot assign to %T", target)
+}
+
+func (e *env) eval(x expr) (interface{}, error) {
+	switch x := x.(type) {
+	case *literal:
+		return x.value, nil
+	case *ident:
+		if v, ok := e.locals[x.name]; ok {
+			return v, nil
+		}
+		if v, ok := e.vars[x.name]; ok {
+			return v, nil
+		}
+		return nil, errorf("variable [%s] is not defined", x.name)
+	case *member:
+		v, err := e.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil && x.nullSafe {
+			return nil, nil
+		}
+		switch c := v.(type) {
+		case map[string]interface{}:
+			return c[x.name], nil
+		case *list:
+			if x.name == "length" {
+				return float64(len(c.items)), nil
+			}
+		}
+		return nil, errorf("cannot access field [%s] of a %s", x.name, typeName(v))
+	case *index:
+		v, err := e.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		key, err := e.eval(x.key)
+		if err != nil {
+			return nil, err
+		}
+		switch c := v.(type) {
+		case map[string]interface{}:
+			k, ok := key.(string)
+			if !ok {
+				return nil, errorf("map keys must be strings, not %s", typeName(key))
+			}
+			return c[k], nil
+		case *list:
+			i, err := position(key, len(c.items))
+			if err != nil {
+				return nil, err
+			}
+			return c.items[i], nil
+		}
+		return nil, errorf("cannot index a %s", typeName(v))
+	case *call:
+		recv, err := e.eval(x.recv)
+		if err != nil {
+			return nil, err
+		}
+		if recv == nil && x.nullSafe {
+			return nil, nil
+		}
+		args := make([]interface{}, len(x.args))
+		for i, a := range x.args {
+			if args[i], err = e.eval(a); err != nil {
+				return nil, err
+			}
+		}
+		return e.invoke(recv, x.method, args)
+	case *unary:
+		v, err := e.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		if x.op == "!" {
+			b, ok := v.(bool)
+			if !ok {
+				return nil, errorf("cannot negate a %s", typeName(v))
+			}
+			return !b, nil
+		}
+		n, ok := v.(float64)
+		if !ok {
+			return nil, errorf("cannot negate a %s", typeName(v))
+		}
+		return -n, nil
+	case *binary:
+		return e.binary(x)
+	case *conditional:
+		cond, err := e.eval(x.cond)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := cond.(bool)
+		if !ok {
+			return nil, errorf("condition is a %s, not a boolean", typeName(cond))
+		}
+		if b {
+			return e.eval(x.then)
+		}
+		return e.eval(x.els)
+	case *listLit:
+		l := &list{items: make([]interface{}, len(x.items))}
+		for i, item := range x.items {
+			v, err := e.eval(item)
+			if err != nil {
+				return nil, err
+			}
+			l.items[i] = v
+		}
+		return l, nil
+	case *mapLit:
+		m := make(map[string]interface{}, len(x.keys))
+		for i := range x.keys {
+			k, err := e.eval(x.keys[i])
+			if err != nil {
+				return nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, errorf("map keys must be strings, not %s", typeName(k))
+			}
+			if m[ks], err = e.eval(x.values[i]); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, errorf("unknown expression %T", x)
+}
+
+func (e *env) binary(x *binary) (interface{}, error) {
+	l, err := e.eval(x.l)
+	if err != nil {
+		return nil, err
+	}
+	if x.op == "&&" || x.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, errorf("operand of %s is a %s, not a boolean", x.op, typeName(l))
+		}
+		if lb == (x.op == "||") {
+			return lb, nil
+		}
+		r, err := e.eval(x.r)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, errorf("operand of %s is a %s, not a boolean", x.op, typeName(r))
+		}
+		return rb, nil
+	}
+	r, err := e.eval(x.r)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "<", "<=", ">", ">=":
+		c, err := compare(l, r)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}
+	return e.arith(x.op, l, r)
+}
+
+func (e *env) arith(op string, l, r interface{}) (interface{}, error) {
+	if op == "+" {
+		_, ls := l.(string)
+		_, rs := r.(string)
+		if ls || rs {
+			str := format(l) + format(r)
+			if len(str) > maxStringLength {
+				return nil, errorf("strings are at most %d bytes long", maxStringLength)
+			}
+			return str, nil
+		}
+	}
+	a, aok := l.(float64)
+	b, bok := r.(float64)
+	if !aok || !bok {
+		return nil, errorf("cannot apply %s to a %s and a %s", op, typeName(l), typeName(r))
+	}
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errorf("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, errorf("division by zero")
+		}
+		return math.Mod(a, b), nil
+	}
+	return nil, errorf("unknown operator %s", op)
+}
+
+// equal compares values like reflect.DeepEqual, without converting the
+// lists in them as unwrap does.
+func equal(l, r interface{}) bool {
+	switch a := l.(type) {
+	case *list:
+		b, ok := r.(*list)
+		if !ok || len(a.items) != len(b.items) {
+			return false
+		}
+		for i := range a.items {
+			if !equal(a.items[i], b.items[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := r.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return l == r
+}
+
+func compare(l, r interface{}) (int, error) {
+	switch a := l.(type) {
+	case float64:
+		if b, ok := r.(float64); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if b, ok := r.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	}
+	return 0, errorf("cannot compare a %s and a %s", typeName(l), typeName(r))
+}
+
+// position checks that key is a valid index into a list of length n.
+func position(key interface{}, n int) (int, error) {
+	f, ok := key.(float64)
+	if !ok || f != math.Trunc(f) {
+		return 0, errorf("list index must be an integer, not %s", typeName(key))
+	}
+	i := int(f)
+	if i < 0 || i >= n {
+		return 0, errorf("index %d out of bounds for length %d", i, n)
+	}
+	return i, nil
+}
+
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case *list:
+		parts := make([]string, len(v.items))
+		for i, item := range v.items {
+			parts[i] = format(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = k + "=" + format(v[k])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return "?"
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case *list:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return reflect.TypeOf(v).String()
+}
+
+func (e *env) invoke(recv interface{}, method string, args []interface{}) (interface{}, error) {
+	arity := func(n int) error {
+		if len(args) != n {
+			return errorf("%s.%s takes %d arguments, got %d", typeName(recv), method, n, len(args))
+		}
+		return nil
+	}
+	switch r := recv.(type) {
+	case *list:
+		switch method {
+		case "add":
+			if err := grow(len(r.items)); err != nil {
+				return nil, err
+			}
+			if len(args) == 2 {
+				i, err := position(args[0], len(r.items)+1)
+				if err != nil {
+					return nil, err
+				}
+				v, err := e.copyValue(args[1])
+				if err != nil {
+					return nil, err
+				}
+				r.items = append(r.items, nil)
+				copy(r.items[i+1:], r.items[i:])
+				r.items[i] = v
+				return nil, nil
+			}
+			if err := arity(1); err != nil {
+				return nil, err
+			}
+			v, err := e.copyValue(args[0])
+			if err != nil {
+				return nil, err
+			}
+			r.items = append(r.items, v)
+			return true, nil
+		case "addAll":
+			if err := arity(1); err != nil {
+				return nil, err
+			}
+			other, ok := args[0].(*list)
+			if !ok {
+				return nil, errorf("list.addAll takes a list, not a %s", typeName(args[0]))
+			}
+			if err := grow(len(r.items) + len(other.items) - 1); err != nil {
+				return nil, err
+			}
+			added, err := e.copyValue(other)
+			if err != nil {
+				return nil, err
+			}
+			r.items = append(r.items, added.(*list).items...)
+			return len(other.items) > 0, nil
+		case "get":
+			if err := arity(1); err != nil {
+				return nil, err
+			}
+			i, err := position(args[0], len(r.items))
+			if err != nil {
+				return nil, err
+			}
+			return r.items[i], nil
+		case "remove":
+			// As in Java, a number removes the element at that index.
+			if err := arity(1); err != nil {
+				return nil, err
+			}
+			i, err := position(args[0], len(r.items))
+			if err != nil {
+				return nil, err
+			}
+			v := r.items[i]
+			r.items = append(r.items[:i], r.items[i+1:]...)
+			return v, nil
+		case "contains":
+			if err := arity(1); err != nil {
+				return nil, err
+			}
+			return indexOf(r.items, args[0]) >= 0, nil
+		case "indexOf":
+			if err := arity(1); err != nil {
+				return nil, err
+			}
+			return float64(indexOf(r.items, args[0])), nil
+		case "size":
+			return float64(len(r.items)), arity(0)
+		case "isEmpty":
+			return len(r.items) == 0, arity(0)
+		case "clear":
+			r.items = r.items[:0]
+			return nil, arity(0)
+		}
+	case map[string]interface{}:
+		key := func() (string, error) {
+			if len(args) == 0 {
+				return "", arity(1)
+			}
+			k, ok := args[0].(string)
+			if !ok {
+				return "", errorf("map keys must be strings, not %s", typeName(args[0]))
+			}
+			return k, nil
+		}
+		switch method {
+		case "containsKey":
+			k, err := key()
+			if err != nil {
+				return nil, err
+			}
+			_, ok := r[k]
+			return ok, arity(1)
+		case "get":
+			k, err := key()
+			if err != nil {
+				return nil, err
+			}
+			return r[k], arity(1)
+		case "getOrDefault":
+			k, err := key()
+			if err != nil {
+				return nil, err
+			}
+			if err := arity(2); err != nil {
+				return nil, err
+			}
+			if v, ok := r[k]; ok {
+				return v, nil
+			}
+			return args[1], nil
+		case "put":
+			k, err := key()
+			if err != nil {
+				return nil, err
+			}
+			if err := arity(2); err != nil {
+				return nil, err
+			}
+			old, ok := r[k]
+			if !ok {
+				if err := grow(len(r)); err != nil {
+					return nil, err
+				}
+			}
+			v, err := e.copyValue(args[1])
+			if err != nil {
+				return nil, err
+			}
+			r[k] = v
+			return old, nil
+		case "remove":
+			k, err := key()
+			if err != nil {
+				return nil, err
+			}
+			old := r[k]
+			delete(r, k)
+			return old, arity(1)
+		case "size":
+			return float64(len(r)), arity(0)
+		case "isEmpty":
+			return len(r) == 0, arity(0)
+		case "keySet":
+			keys := make([]string, 0, len(r))
+			for k := range r {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			l := &list{items: make([]interface{}, len(keys))}
+			for i, k := range keys {
+				l.items[i] = k
+			}
+			return l, arity(0)
+		}
+	case string:
+		str := func() (string, error) {
+			if err := arity(1); err != nil {
+				return "", err
+			}
+			s, ok := args[0].(string)
+			if !ok {
+				return "", errorf("string.%s takes a string, not a %s", method, typeName(args[0]))
+			}
+			return s, nil
+		}
+		switch method {
+		case "length":
+			return float64(len(r)), arity(0)
+		case "isEmpty":
+			return len(r) == 0, arity(0)
+		case "toLowerCase":
+			return strings.ToLower(r), arity(0)
+		case "toUpperCase":
+			return strings.ToUpper(r), arity(0)
+		case "trim":
+			return strings.TrimSpace(r), arity(0)
+		case "contains", "startsWith", "endsWith", "indexOf":
+			s, err := str()
+			if err != nil {
+				return nil, err
+			}
+			switch method {
+			case "contains":
+				return strings.Contains(r, s), nil
+			case "startsWith":
+				return strings.HasPrefix(r, s), nil
+			case "endsWith":
+				return strings.HasSuffix(r, s), nil
+			}
+			return float64(strings.Index(r, s)), nil
+		}
+	case nil:
+		return nil, errorf("cannot call %s on null", method)
+	}
+	return nil, errorf("unknown method %s.%s", typeName(recv), method)
+}
+
+func indexOf(items []interface{}, v interface{}) int {
+	for i, item := range items {
+		if equal(item, v) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,592 @@
+// Package script implements the subset of Painless used by update scripts:
+// field access on ctx and params, null safe with ?., assignments,
+// arithmetic, comparisons, if/else, local variables declared with def, and
+// a fixed set of list, map and string methods. There are no loops, no user
+// functions and no access to anything but the variables a script is run
+// with, so a script always terminates and cannot reach outside the document
+// it updates. Limits on the statements it runs and the values it builds
+// keep it from exhausting the node, see maxStatements.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrScript is wrapped by every compile and runtime error of a script.
+var ErrScript = errors.New("script error")
+
+func errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrScript, fmt.Sprintf(format, args...))
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+// punctuation lists the operators, longest first so that they are matched
+// greedily.
+var punctuation = []string{
+	"+=", "-=", "*=", "/=", "%=", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "?.",
+	"+", "-", "*", "/", "%", "<", ">", "=", "!", "?", ":", ".", ",", ";", "(", ")", "[", "]", "{", "}",
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, errorf("unterminated comment at %d", i)
+			}
+			i += end + 4
+		case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '$' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[start:i], pos: start})
+		case unicode.IsDigit(rune(c)):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				// A dot followed by a letter is a method call, as in 1.toString().
+				if src[i] == '.' && (i+1 >= len(src) || !unicode.IsDigit(rune(src[i+1]))) {
+					break
+				}
+				i++
+			}
+			// Java number suffixes are accepted and ignored.
+			if i < len(src) && strings.ContainsRune("lLfFdD", rune(src[i])) {
+				i++
+			}
+			text := strings.TrimRight(src[start:i], "lLfFdD")
+			n, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, errorf("invalid number %q at %d", text, start)
+			}
+			toks = append(toks, token{kind: tokNumber, num: n, text: text, pos: start})
+		case c == '\'' || c == '"':
+			start := i
+			var sb strings.Builder
+			i++
+			for ; i < len(src) && src[i] != c; i++ {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					switch src[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[i])
+					}
+					continue
+				}
+				sb.WriteByte(src[i])
+			}
+			if i >= len(src) {
+				return nil, errorf("unterminated string at %d", start)
+			}
+			i++
+			toks = append(toks, token{kind: tokString, text: sb.String(), pos: start})
+		default:
+			matched := false
+			for _, p := range punctuation {
+				if strings.HasPrefix(src[i:], p) {
+					toks = append(toks, token{kind: tokPunct, text: p, pos: i})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// Expressions.
+type (
+	expr interface{}
+
+	literal struct{ value interface{} }
+	ident   struct{ name string }
+	// member and call are null safe when written with ?., which makes
+	// them null if x is.
+	member struct {
+		x        expr
+		name     string
+		nullSafe bool
+	}
+	index struct {
+		x, key expr
+	}
+	call struct {
+		recv     expr
+		method   string
+		args     []expr
+		nullSafe bool
+	}
+	unary struct {
+		op string
+		x  expr
+	}
+	binary struct {
+		op   string
+		l, r expr
+	}
+	conditional struct {
+		cond, then, els expr
+	}
+	listLit struct{ items []expr }
+	mapLit  struct{ keys, values []expr }
+)
+
+// Statements.
+type (
+	stmt interface{}
+
+	exprStmt struct{ x expr }
+	assign   struct {
+		target expr
+		op     string
+		value  expr
+	}
+	declare struct {
+		name  string
+		value expr
+	}
+	ifStmt struct {
+		cond expr
+		then []stmt
+		els  []stmt
+	}
+	returnStmt struct{}
+)
+
+// maxNesting bounds how deeply expressions and blocks nest, so that parsing
+// and running a script cannot exhaust the stack.
+const maxNesting = 100
+
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+// nest enters a nested expression or block; the caller calls p.depth--
+// when it leaves it.
+func (p *parser) nest() error {
+	if p.depth++; p.depth > maxNesting {
+		return errorf("expressions and blocks nest more than %d deep at %d", maxNesting, p.peek().pos)
+	}
+	return nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokPunct || t.kind == tokIdent) && t.text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected("'" + text + "'")
+	}
+	return nil
+}
+
+func (p *parser) unexpected(want string) error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return errorf("expected %s at end of script", want)
+	}
+	return errorf("expected %s at %d, found %q", want, t.pos, t.text)
+}
+
+func (p *parser) statements(end string) ([]stmt, error) {
+	var stmts []stmt
+	for !p.is(end) && p.peek().kind != tokEOF {
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts, nil
+}
+
+func (p *parser) block() ([]stmt, error) {
+	defer func() { p.depth-- }()
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	if !p.accept("{") {
+		s, err := p.statement()
+		if err != nil || s == nil {
+			return nil, err
+		}
+		return []stmt{s}, nil
+	}
+	stmts, err := p.statements("}")
+	if err != nil {
+		return nil, err
+	}
+	return stmts, p.expect("}")
+}
+
+func (p *parser) statement() (stmt, error) {
+	switch {
+	case p.accept(";"):
+		return nil, nil
+	case p.is("{"):
+		stmts, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &ifStmt{cond: &literal{true}, then: stmts}, nil
+	case p.accept("if"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		s := &ifStmt{cond: cond}
+		if s.then, err = p.block(); err != nil {
+			return nil, err
+		}
+		if p.accept("else") {
+			if s.els, err = p.block(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case p.accept("return"):
+		if !p.is(";") && !p.is("}") && p.peek().kind != tokEOF {
+			if _, err := p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		p.accept(";")
+		return &returnStmt{}, nil
+	case p.is("def") || p.is("var"):
+		p.next()
+		name := p.next()
+		if name.kind != tokIdent {
+			return nil, errorf("expected a variable name at %d", name.pos)
+		}
+		s := &declare{name: name.text, value: &literal{nil}}
+		if p.accept("=") {
+			var err error
+			if s.value, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		return s, p.end()
+	}
+
+	x, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind == tokPunct {
+		switch t.text {
+		case "=", "+=", "-=", "*=", "/=", "%=":
+			p.next()
+			value, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if !assignable(x) {
+				return nil, errorf("cannot assign to the expression at %d", t.pos)
+			}
+			return &assign{target: x, op: strings.TrimSuffix(t.text, "="), value: value}, p.end()
+		case "++", "--":
+			p.next()
+			if !assignable(x) {
+				return nil, errorf("cannot assign to the expression at %d", t.pos)
+			}
+			return &assign{target: x, op: t.text[:1], value: &literal{1.0}}, p.end()
+		}
+	}
+	return &exprStmt{x: x}, p.end()
+}
+
+// end consumes the semicolon of a statement, which may be left out before a
+// closing brace or the end of the script.
+func (p *parser) end() error {
+	if p.accept(";") || p.is("}") || p.peek().kind == tokEOF {
+		return nil
+	}
+	return p.unexpected("';'")
+}
+
+func assignable(x expr) bool {
+	switch x.(type) {
+	case *ident, *member, *index:
+		return true
+	}
+	return false
+}
+
+func (p *parser) expr() (expr, error) {
+	defer func() { p.depth-- }()
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	then, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &conditional{cond: cond, then: then, els: els}, nil
+}
+
+// precedence lists the binary operators from the loosest binding.
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) (expr, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	l, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		matched := false
+		if t.kind == tokPunct {
+			for _, op := range precedence[level] {
+				if t.text == op {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return l, nil
+		}
+		p.next()
+		r, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = &binary{op: t.text, l: l, r: r}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	if t := p.peek(); t.kind == tokPunct && (t.text == "!" || t.text == "-") {
+		p.next()
+		defer func() { p.depth-- }()
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: t.text, x: x}, nil
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (expr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.is(".") || p.is("?."):
+			nullSafe := p.next().text == "?."
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, errorf("expected a field or method name at %d", name.pos)
+			}
+			if !p.accept("(") {
+				x = &member{x: x, name: name.text, nullSafe: nullSafe}
+				continue
+			}
+			c := &call{recv: x, method: name.text, nullSafe: nullSafe}
+			for !p.accept(")") {
+				if len(c.args) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				c.args = append(c.args, arg)
+			}
+			x = c
+		case p.accept("["):
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &index{x: x, key: key}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (expr, error) {
+	start := p.pos
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &literal{t.num}, nil
+	case tokString:
+		return &literal{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literal{true}, nil
+		case "false":
+			return &literal{false}, nil
+		case "null":
+			return &literal{nil}, nil
+		}
+		return &ident{name: t.text}, nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			return p.collection()
+		}
+	}
+	p.pos = start
+	return nil, p.unexpected("an expression")
+}
+
+// collection parses a list literal [a, b] or a map literal [k: v] or [:],
+// after the opening bracket.
+func (p *parser) collection() (expr, error) {
+	if p.accept(":") {
+		return &mapLit{}, p.expect("]")
+	}
+	if p.accept("]") {
+		return &listLit{}, nil
+	}
+	first, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept(":") {
+		l := &listLit{items: []expr{first}}
+		for !p.accept("]") {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			item, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			l.items = append(l.items, item)
+		}
+		return l, nil
+	}
+	m := &mapLit{}
+	key := first
+	for {
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		m.keys = append(m.keys, key)
+		m.values = append(m.values, value)
+		if p.accept("]") {
+			return m, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		if key, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+	}
+}
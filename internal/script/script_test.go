@@ -0,0 +1,189 @@
+package script
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"ctx._source.n += 1", []string{"ctx", ".", "_source", ".", "n", "+=", "1"}},
+		{"a?.b ?: c", []string{"a", "?.", "b", "?", ":", "c"}},
+		{"x == 'it''s'", []string{"x", "==", "it", "s"}},
+		{`"a\"b\n"`, []string{"a\"b\n"}},
+		{"1.5 + 2L // comment\n- 3", []string{"1.5", "+", "2", "-", "3"}},
+		{"1.size() /* comment */", []string{"1", ".", "size", "(", ")"}},
+		{"a<=b&&!c", []string{"a", "<=", "b", "&&", "!", "c"}},
+	}
+	for _, tt := range tests {
+		toks, err := lex(tt.src)
+		if err != nil {
+			t.Errorf("lex(%q) failed: %v", tt.src, err)
+			continue
+		}
+		var got []string
+		for _, tok := range toks {
+			if tok.kind != tokEOF {
+				got = append(got, tok.text)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lex(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+
+	for _, src := range []string{"'open", "/* open", "a # b"} {
+		if _, err := lex(src); !errors.Is(err, ErrScript) {
+			t.Errorf("expected a script error lexing %q, got %v", src, err)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"ctx._source.x = ", "expected an expression at end of script"},
+		{"ctx._source.x = 1 2", "expected ';'"},
+		{"1 = 2", "cannot assign"},
+		{"ctx.f() = 1", "cannot assign"},
+		{"if ctx.a { }", "expected '('"},
+		{"if (true) { ctx.a = 1", "expected '}'"},
+		{"def = 1", "expected a variable name"},
+		{"[1, 2", "expected ','"},
+		{"[a: 1, b]", "expected ':'"},
+		{"ctx.", "expected a field or method name"},
+		{"while (true) {}", "expected ';'"},
+		{strings.Repeat("(", 200) + "1" + strings.Repeat(")", 200), "nest more than"},
+		{strings.Repeat("!", 200) + "true", "nest more than"},
+		{strings.Repeat("{", 200) + strings.Repeat("}", 200), "nest more than"},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.src)
+		if !errors.Is(err, ErrScript) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Compile(%.40q) = %v, want an error containing %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+// run runs src with ctx and params decoded from JSON, and returns ctx and
+// params as the script left them.
+func run(t *testing.T, src, ctx, params string) (map[string]interface{}, map[string]interface{}, error) {
+	t.Helper()
+	s, err := Compile(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	var c, p map[string]interface{}
+	if err := json.Unmarshal([]byte(ctx), &c); err != nil {
+		t.Fatalf("invalid ctx %s: %v", ctx, err)
+	}
+	if err := json.Unmarshal([]byte(params), &p); err != nil {
+		t.Fatalf("invalid params %s: %v", params, err)
+	}
+	vars := map[string]interface{}{"ctx": c, "params": p}
+	err = s.Run(vars)
+	return vars["ctx"].(map[string]interface{}), vars["params"].(map[string]interface{}), err
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		ctx    string
+		params string
+		// want is ctx after the script, as JSON.
+		want string
+	}{
+		{"precedence", "ctx.r = 1 + 2 * 3 - 8 / 4 % 3", `{}`, `{}`, `{"r":5}`},
+		{"parentheses", "ctx.r = (1 + 2) * 3", `{}`, `{}`, `{"r":9}`},
+		{"comparison binds tighter than &&", "ctx.r = 1 < 2 && 3 >= 3 || false", `{}`, `{}`, `{"r":true}`},
+		{"&& binds tighter than ||", "ctx.r = true || false && false", `{}`, `{}`, `{"r":true}`},
+		{"unary minus", "ctx.r = -2 * -3", `{}`, `{}`, `{"r":6}`},
+		{"short circuit", "ctx.r = false && ctx.missing.field", `{}`, `{}`, `{"r":false}`},
+		{"conditional", "ctx.r = ctx.n > 1 ? 'big' : 'small'", `{"n":2}`, `{}`, `{"n":2,"r":"big"}`},
+		{"string concatenation", "ctx.r = 'n=' + ctx.n + ', ' + true + ' ' + null", `{"n":1.5}`, `{}`, `{"n":1.5,"r":"n=1.5, true null"}`},
+		{"compound assignment", "ctx.n += 2; ctx.n *= 3; ctx.n--", `{"n":1}`, `{}`, `{"n":8}`},
+		{"locals", "def a = ctx.n; a += 1; ctx.r = a", `{"n":1}`, `{}`, `{"n":1,"r":2}`},
+		{"if else", "if (ctx.n == 1) { ctx.r = 'one' } else if (ctx.n == 2) { ctx.r = 'two' } else ctx.r = 'many'", `{"n":2}`, `{}`, `{"n":2,"r":"two"}`},
+		{"return", "ctx.a = 1; return; ctx.b = 2", `{}`, `{}`, `{"a":1}`},
+		{"null safe field", "ctx.r = ctx.missing?.field", `{}`, `{}`, `{"r":null}`},
+		{"null safe method", "ctx.r = ctx.missing?.size()", `{}`, `{}`, `{"r":null}`},
+		{"null safe chain", "ctx.r = ctx.a?.b?.c", `{"a":{"b":{"c":1}}}`, `{}`, `{"a":{"b":{"c":1}},"r":1}`},
+		{"list methods", "ctx.l.add(3); ctx.l.add(0, 0); ctx.l.remove(1); ctx.r = [ctx.l.size(), ctx.l.contains(3), ctx.l.indexOf(2)]", `{"l":[1,2]}`, `{}`, `{"l":[0,2,3],"r":[3,true,1]}`},
+		{"list index", "ctx.l[0] = ctx.l[1] + ctx.l.length", `{"l":[1,2]}`, `{}`, `{"l":[4,2]}`},
+		{"map methods", "ctx.m.put('b', 2); ctx.m.remove('a'); ctx.r = [ctx.m.containsKey('b'), ctx.m.getOrDefault('c', 3), ctx.m.keySet()]", `{"m":{"a":1}}`, `{}`, `{"m":{"b":2},"r":[true,3,["b"]]}`},
+		{"map literal", "ctx.m = ['a': [1, 2], 'b': [:]]", `{}`, `{}`, `{"m":{"a":[1,2],"b":{}}}`},
+		{"string methods", "ctx.r = [ctx.s.toUpperCase(), ctx.s.trim().length(), ctx.s.contains('b'), ctx.s.indexOf('c')]", `{"s":" abc "}`, `{}`, `{"r":[" ABC ",3,true,3],"s":" abc "}`},
+		{"equality of collections", "ctx.r = ctx.l == [1, ['a': 2]] && ctx.l != [1]", `{"l":[1,{"a":2}]}`, `{}`, `{"l":[1,{"a":2}],"r":true}`},
+		{"equality keeps lists", "if (ctx.m == params.m) { ctx.m.l.add(2) }", `{"m":{"l":[1]}}`, `{"m":{"l":[1]}}`, `{"m":{"l":[1,2]}}`},
+		{"params", "ctx.tags.add(params.tag); ctx.n += params.n", `{"tags":[],"n":1}`, `{"tag":"t","n":2}`, `{"n":3,"tags":["t"]}`},
+		{"ctx.op", "if (ctx._source.n > params.max) { ctx.op = 'delete' } else { ctx.op = 'none' }", `{"_source":{"n":5},"op":"index"}`, `{"max":3}`, `{"_source":{"n":5},"op":"delete"}`},
+		{"values are copied when stored", "def l = [1]; ctx.a = l; l.add(2); ctx.b = l", `{}`, `{}`, `{"a":[1],"b":[1,2]}`},
+		{"a value stored in itself is a copy", "ctx._source.self = ctx._source", `{"_source":{"n":1}}`, `{}`, `{"_source":{"n":1,"self":{"n":1}}}`},
+		{"a list added to itself is a copy", "ctx.l.add(ctx.l); ctx.l.addAll(ctx.l)", `{"l":[1]}`, `{}`, `{"l":[1,[1],1,[1]]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, _, err := run(t, tt.src, tt.ctx, tt.params)
+			if err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			var want map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatalf("invalid want %s: %v", tt.want, err)
+			}
+			if !reflect.DeepEqual(ctx, want) {
+				got, _ := json.Marshal(ctx)
+				t.Errorf("got ctx %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		ctx  string
+		want string
+	}{
+		{"undefined variable", "ctx.a = missing", `{}`, "variable [missing] is not defined"},
+		{"assign to a variable", "ctx = 1", `{}`, "cannot assign to [ctx]"},
+		{"assign to params", "params = [:]", `{}`, "cannot assign to [params]"},
+		{"add a string and a number", "ctx.a = ctx.n - 'x'", `{"n":1}`, "cannot apply - to a number and a string"},
+		{"negate a string", "ctx.a = -'x'", `{}`, "cannot negate a string"},
+		{"not a boolean condition", "if (ctx.n) {}", `{"n":1}`, "condition is a number, not a boolean"},
+		{"not a boolean operand", "ctx.a = ctx.n && true", `{"n":1}`, "operand of && is a number"},
+		{"compare a number and a string", "ctx.a = 1 < 'x'", `{}`, "cannot compare a number and a string"},
+		{"field of null", "ctx.a = ctx.missing.field", `{}`, "cannot access field [field] of a null"},
+		{"method of null", "ctx.missing.size()", `{}`, "cannot call size on null"},
+		{"field of a number", "ctx.n.x = 1", `{"n":1}`, "cannot set field [x] of a number"},
+		{"unknown method", "ctx.l.push(1)", `{"l":[]}`, "unknown method list.push"},
+		{"wrong arity", "ctx.l.get()", `{"l":[]}`, "list.get takes 1 arguments, got 0"},
+		{"index out of bounds", "ctx.a = ctx.l[2]", `{"l":[1]}`, "index 2 out of bounds for length 1"},
+		{"fractional index", "ctx.a = ctx.l[0.5]", `{"l":[1]}`, "list index must be an integer"},
+		{"non string key", "ctx.m[1] = 1", `{"m":{}}`, "map keys must be strings"},
+		{"division by zero", "ctx.a = 1 / 0", `{}`, "division by zero"},
+		{"list too large", "def l = [1]; " + strings.Repeat("l.addAll(l); ", 24), `{}`, "at most 10000 elements"},
+		{"map too large", strings.Repeat("ctx.m = ['a': ctx.m, 'b': ctx.m]; ", 30), `{"m":{}}`, "copies more than"},
+		{"nested copies", strings.Repeat("ctx.l.add(ctx.l); ", 30), `{"l":[1]}`, "copies more than"},
+		{"string too long", "def s = 'xxxxxxxxxxxxxxxx'; " + strings.Repeat("s = s + s; ", 20), `{}`, "strings are at most"},
+		{"too many statements", strings.Repeat("ctx.n++; ", maxStatements+1), `{"n":0}`, "more than 10000 statements"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := run(t, tt.src, tt.ctx, `{}`)
+			if !errors.Is(err, ErrScript) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package shard
+
+import (
+	"breeze/internal/cluster"
+	"breeze/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ShardAllocation records the nodes holding the copies of a shard. The
+// allocation table of an index, one entry per shard, is part of its
+// metadata, so every node sends requests to the nodes that have the data
+// whatever its own list of peers says.
+type ShardAllocation struct {
+	// Nodes are the IDs of the nodes holding a copy, the primary first.
+	Nodes []string `json:"nodes"`
+	// RelocatingTo is a node receiving a copy of the shard. It is sent the
+	// writes like a replica, and takes the place of the copy on
+	// RelocatingFrom, or is added if that is empty, once it has caught up.
+	RelocatingTo   string `json:"relocating_to,omitempty"`
+	RelocatingFrom string `json:"relocating_from,omitempty"`
+	// PrimaryTerm is raised each time another copy becomes the primary, so
+	// that the writes of each primary are told apart. Zero is the first
+	// term, 1.
+	PrimaryTerm uint64 `json:"primary_term,omitempty"`
+}
+
+// term returns the primary term of the shard.
+func (a ShardAllocation) term() uint64 {
+	return max(a.PrimaryTerm, 1)
+}
+
+// primary returns the ID of the node holding the primary of the shard.
+func (a ShardAllocation) primary() string {
+	if len(a.Nodes) == 0 {
+		return ""
+	}
+	return a.Nodes[0]
+}
+
+// copies returns the nodes that receive the writes to the shard: the nodes
+// holding it and the node it is relocating to.
+func (a ShardAllocation) copies() []string {
+	if a.RelocatingTo == "" {
+		return a.Nodes
+	}
+	return append(append([]string(nil), a.Nodes...), a.RelocatingTo)
+}
+
+// defaultAllocation places the shards of a new index on the nodes of the
+// cluster with placement p.
+func defaultAllocation(p cluster.Placement, c *cluster.Cluster, name string, numShards, replicas int) []ShardAllocation {
+	alloc := make([]ShardAllocation, numShards)
+	for sID := range alloc {
+		for _, node := range p.Place(name, sID, numShards, c.Nodes, c.Loads(), replicas+1) {
+			alloc[sID].Nodes = append(alloc[sID].Nodes, node.ID)
+		}
+	}
+	return alloc
+}
+
+// allocation returns the allocation of a shard.
+func (idx *Index) allocation(sID int) ShardAllocation {
+	meta := idx.Meta()
+	if sID < 0 || sID >= len(meta.Allocation) {
+		return ShardAllocation{}
+	}
+	return meta.Allocation[sID]
+}
+
+// Allocation returns the allocation table of the index.
+func (idx *Index) Allocation() []ShardAllocation {
+	return idx.Meta().Allocation
+}
+
+// node returns the node with the given ID. A node that is not part of the
+// cluster has no address, so requests to it fail with ErrNodeUnavailable.
+func (idx *Index) node(id string) cluster.Node {
+	if node, err := idx.Cluster.GetNodeByID(id); err == nil {
+		return node
+	}
+	return cluster.Node{ID: id}
+}
+
+func (idx *Index) nodes(ids []string) []cluster.Node {
+	nodes := make([]cluster.Node, len(ids))
+	for i, id := range ids {
+		nodes[i] = idx.node(id)
+	}
+	return nodes
+}
+
+// shardOwner returns the node holding the primary of a shard.
+func (idx *Index) shardOwner(sID int) cluster.Node {
+	primary := idx.allocation(sID).primary()
+	if primary == "" {
+		return cluster.Node{}
+	}
+	return idx.node(primary)
+}
+
+// shardCopies returns the nodes holding a copy of the shard, its primary
+// first.
+func (idx *Index) shardCopies(sID int) []cluster.Node {
+	return idx.nodes(idx.allocation(sID).Nodes)
+}
+
+// allocateShards opens, moves and closes the local stores of the index so
+// that Shards holds the primaries meta allocates to this node and Replicas
+// its replicas, including the copies relocating to it. The data of a copy
+// that was moved to another node is deleted. The caller must hold idx.mu.
+func (idx *Index) allocateShards(meta IndexMeta, opts store.Options) error {
+	self := idx.Cluster.SelfID
+	for sID := 0; sID < idx.numShards; sID++ {
+		var alloc ShardAllocation
+		if sID < len(meta.Allocation) {
+			alloc = meta.Allocation[sID]
+		}
+		primary, replica := false, false
+		for i, id := range alloc.copies() {
+			if id == self {
+				primary, replica = i == 0, i > 0
+			}
+		}
+
+		s, wasPrimary := idx.Shards[sID]
+		if !wasPrimary {
+			s = idx.Replicas[sID]
+		}
+		if !primary {
+			delete(idx.handoffs, sID)
+		}
+		if primary != wasPrimary {
+			// The replicas known to the old primary are of no use to
+			// the new one.
+			idx.forgetReplicas(sID, nil)
+		} else if primary {
+			idx.forgetReplicas(sID, alloc.copies())
+		}
+
+		shardPath := filepath.Join(idx.path, fmt.Sprintf("shard_%d", sID))
+		switch {
+		case !primary && !replica:
+			if s == nil {
+				continue
+			}
+			delete(idx.Shards, sID)
+			delete(idx.Replicas, sID)
+			if err := s.Close(); err != nil && !errors.Is(err, store.ErrClosed) {
+				return fmt.Errorf("failed to close shard %d: %w", sID, err)
+			}
+			if err := os.RemoveAll(shardPath); err != nil {
+				return err
+			}
+			continue
+		case s == nil:
+			// Only the primary deletes expired documents; its replicas
+			// get the deletes along with its other changes.
+			o := opts
+			o.DisableReaper = !primary
+			var err error
+			if s, err = store.Open(shardPath, o); err != nil {
+				return err
+			}
+		}
+		delete(idx.Shards, sID)
+		delete(idx.Replicas, sID)
+		s.SetReaper(primary)
+		if primary {
+			if err := s.SetPrimaryTerm(alloc.term()); err != nil {
+				return fmt.Errorf("failed to set the primary term of shard %d: %w", sID, err)
+			}
+			idx.Shards[sID] = s
+		} else {
+			idx.Replicas[sID] = s
+		}
+	}
+	return nil
+}
+
+// handingOff fails with ErrShardRelocating while the local primary of a
+// shard hands it off to another node, see LocalRelocate. The caller must
+// hold idx.mu.
+func (idx *Index) handingOff(sID int) error {
+	if until, ok := idx.handoffs[sID]; ok && time.Now().Before(until) {
+		return fmt.Errorf("%w: shard %d of index %s is handed off to another node", ErrShardRelocating, sID, idx.Name)
+	}
+	return nil
+}
+
+// movedAway turns err, reported for a write to a shard that is not local,
+// into ErrShardRelocating if the shard moved to another node since the write
+// was routed here, so that it is routed again.
+func (idx *Index) movedAway(sID int, err error) error {
+	if idx.checkOpen() != nil || idx.Cluster.IsLocal(idx.shardOwner(sID)) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrShardRelocating, err)
+}
+
+// retryRelocating runs write again while the shard it writes to is handed
+// off to another node, until the write reaches the new primary,
+// relocateHandoffTimeout has passed or ctx is done.
+func retryRelocating(ctx context.Context, write func() error) error {
+	deadline := time.Now().Add(relocateHandoffTimeout)
+	for {
+		err := write()
+		if !errors.Is(err, ErrShardRelocating) || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(relocateRetryDelay):
+		}
+	}
+}
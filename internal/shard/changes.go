@@ -0,0 +1,122 @@
+package shard
+
+import (
+	"breeze/internal/store"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ShardChanges are the changes of one shard after the checkpoint they were
+// requested from, and the checkpoint to request the next ones from. History
+// is the history of the copy of the shard they were read from, see
+// store.Store.History.
+type ShardChanges struct {
+	Changes    []store.Change `json:"changes,omitempty"`
+	Checkpoint uint64         `json:"checkpoint"`
+	History    string         `json:"history,omitempty"`
+}
+
+// CheckHistory fails with store.ErrChangesTruncated if a shard in changes
+// was read from another copy than the history its checkpoint was taken on,
+// given by histories. The checkpoint then means nothing to the copy, whose
+// changes have to be read from the start again.
+func CheckHistory(changes map[int]ShardChanges, histories map[int]string) error {
+	for sID, want := range histories {
+		if sc, ok := changes[sID]; ok && sc.History != want {
+			return fmt.Errorf("%w: shard %d was copied since the checkpoint was taken, history [%s] is now [%s]",
+				store.ErrChangesTruncated, sID, want, sc.History)
+		}
+	}
+	return nil
+}
+
+// LocalChanges reads the changes of the shards on this node after their
+// checkpoint in since; shards missing from since are read from the start.
+func (idx *Index) LocalChanges(since map[int]uint64, limit int) (map[int]ShardChanges, map[int]error) {
+	if err := idx.checkRead(); err != nil {
+		errs := make(map[int]error)
+		for _, sID := range idx.ownedShards()[idx.Cluster.SelfID] {
+			errs[sID] = err
+		}
+		return nil, errs
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	changes := make(map[int]ShardChanges, len(idx.Shards))
+	errs := make(map[int]error)
+	for sID, s := range idx.Shards {
+		c, cp, err := s.Changes(since[sID], limit)
+		if err != nil {
+			errs[sID] = fmt.Errorf("shard %d: %w", sID, err)
+			continue
+		}
+		changes[sID] = ShardChanges{Changes: c, Checkpoint: cp, History: s.History()}
+	}
+	return changes, errs
+}
+
+// FirstError returns the error of the lowest numbered shard in errs, or nil
+// if there is none.
+func FirstError(errs map[int]error) error {
+	first := -1
+	for sID, err := range errs {
+		if err != nil && (first < 0 || sID < first) {
+			first = sID
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	return errs[first]
+}
+
+// Changes reads the changes of every shard of the index after their
+// checkpoint in since, at most limit WAL records per shard.
+func (idx *Index) Changes(since map[int]uint64, limit int) (map[int]ShardChanges, map[int]error) {
+	if err := idx.checkRead(); err != nil {
+		errs := make(map[int]error, idx.numShards)
+		for sID := 0; sID < idx.numShards; sID++ {
+			errs[sID] = err
+		}
+		return nil, errs
+	}
+	owned := idx.ownedShards()
+	changes := make(map[int]ShardChanges, idx.numShards)
+	errs := make(map[int]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for nodeID := range owned {
+		node := idx.node(nodeID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var res map[int]ShardChanges
+			var failed map[int]error
+			var err error
+			if idx.Cluster.IsLocal(node) {
+				res, failed = idx.LocalChanges(since, limit)
+			} else {
+				res, failed, err = idx.Forwarder.ForwardChanges(context.Background(), node, idx.Name, since, limit)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				for _, sID := range owned[node.ID] {
+					errs[sID] = err
+				}
+				return
+			}
+			for sID, c := range res {
+				changes[sID] = c
+			}
+			for sID, err := range failed {
+				if err != nil {
+					errs[sID] = err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return changes, errs
+}
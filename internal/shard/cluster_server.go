@@ -1,22 +1,42 @@
 package shard
 
 import (
-	"encoding/json"
+	"breeze/internal/store"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 )
 
 type ClusterServer struct {
 	manager *Manager
 	addr    string
+	// minVersion and maxVersion are the protocol versions accepted from
+	// the other nodes.
+	minVersion, maxVersion uint16
+	// handle answers a request; ctx is done when the request times out, is
+	// cancelled by the node that sent it or its connection closes.
+	handle func(ctx context.Context, req InternalRequest) InternalResponse
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
 }
 
 func NewClusterServer(manager *Manager, addr string) *ClusterServer {
-	return &ClusterServer{
-		manager: manager,
-		addr:    addr,
+	s := &ClusterServer{
+		manager:    manager,
+		addr:       addr,
+		minVersion: minProtocol,
+		maxVersion: maxProtocol,
+		conns:      make(map[net.Conn]struct{}),
 	}
+	s.handle = s.handleRequest
+	return s
 }
 
 func (s *ClusterServer) Start() error {
@@ -25,88 +45,331 @@ func (s *ClusterServer) Start() error {
 		return err
 	}
 	fmt.Printf("Cluster server listening on %s\n", s.addr)
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
 
 	go func() {
 		for {
 			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				continue
 			}
+			s.mu.Lock()
+			if s.ln != ln {
+				s.mu.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
 			go s.handleConn(conn)
 		}
 	}()
 	return nil
 }
 
+// Close stops accepting connections and closes the open ones, so that the
+// other nodes see this node as unreachable.
+func (s *ClusterServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+		s.ln = nil
+	}
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	return err
+}
+
+// handleConn settles on a protocol version with the node that opened the
+// connection, then reads its requests and handles them
+// concurrently, at most maxInFlightPerConn at a time, writing each response
+// with the ID of its request as soon as it is ready. Requests are handled
+// until their timeout is up, they are cancelled or the connection closes.
 func (s *ClusterServer) handleConn(conn net.Conn) {
-	defer conn.Close()
-	decoder := json.NewDecoder(conn)
-	encoder := json.NewEncoder(conn)
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	ctx, cancelAll := context.WithCancel(context.Background())
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		cancelAll()
+		wg.Wait()
+	}()
+	r := bufio.NewReader(conn)
+	version, err := serverHandshake(struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, s.minVersion, s.maxVersion)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			fmt.Printf("Cluster server handshake error: %v\n", err)
+		}
+		return
+	}
+	wire := codecFor(version)
 
+	respond := func(id uint64, resp InternalResponse) {
+		data, err := wire.encode(resp)
+		if err != nil {
+			data, _ = wire.encode(InternalResponse{Err: fmt.Sprintf("failed to encode response: %v", err)})
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := writeFrame(conn, id, data); err != nil {
+			fmt.Printf("Cluster server write error: %v\n", err)
+			conn.Close()
+		}
+	}
+
+	var cancelMu sync.Mutex
+	cancels := make(map[uint64]context.CancelFunc)
+
+	inFlight := make(chan struct{}, maxInFlightPerConn)
 	for {
-		var req InternalRequest
-		if err := decoder.Decode(&req); err != nil {
-			if err != io.EOF {
-				fmt.Printf("Cluster server decode error: %v\n", err)
+		id, payload, err := readFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Cluster server read error: %v\n", err)
 			}
 			break
 		}
+		var req InternalRequest
+		if err := wire.decode(payload, &req); err != nil {
+			respond(id, InternalResponse{Err: fmt.Sprintf("failed to decode request: %v", err)})
+			continue
+		}
 
-		resp := s.handleRequest(req)
-		if err := encoder.Encode(resp); err != nil {
-			fmt.Printf("Cluster server encode error: %v\n", err)
-			break
+		if req.Type == ReqCancel {
+			cancelMu.Lock()
+			if cancel, ok := cancels[id]; ok {
+				cancel()
+			}
+			cancelMu.Unlock()
+			continue
+		}
+
+		var reqCtx context.Context
+		var cancel context.CancelFunc
+		if req.Timeout > 0 {
+			reqCtx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Millisecond)
+		} else {
+			reqCtx, cancel = context.WithCancel(ctx)
 		}
+		cancelMu.Lock()
+		cancels[id] = cancel
+		cancelMu.Unlock()
+
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				cancelMu.Lock()
+				delete(cancels, id)
+				cancelMu.Unlock()
+				cancel()
+				<-inFlight
+				wg.Done()
+			}()
+			respond(id, s.handle(reqCtx, req))
+		}()
 	}
 }
 
-func (s *ClusterServer) handleRequest(req InternalRequest) InternalResponse {
+func (s *ClusterServer) handleRequest(ctx context.Context, req InternalRequest) InternalResponse {
 	var resp InternalResponse
 
+	if req.Type == ReqPutRepository {
+		if req.Repository == nil {
+			resp.Err = "missing repository"
+		} else if err := s.manager.PutRepository(req.RepositoryName, *req.Repository, false); err != nil {
+			resp.Err = err.Error()
+		}
+		return resp
+	}
+
+	// Deleting must not open, and so recreate, an index that is not loaded.
+	if req.Type == ReqDeleteIndex {
+		res, err := s.manager.DeleteIndex(req.IndexName, false)
+		if err != nil {
+			resp.Err, resp.ErrKind = encodeError(err)
+		}
+		resp.Found = res.Found
+		return resp
+	}
+
+	if req.Type == ReqSwapIndex {
+		if err := s.manager.swapLocalIndex(req.IndexName, req.Target); err != nil {
+			resp.Err, resp.ErrKind = encodeError(err)
+		}
+		return resp
+	}
+
+	if req.Type == ReqNodeLoad {
+		load, err := s.manager.LocalLoad()
+		if err != nil {
+			resp.Err = err.Error()
+		} else {
+			resp.Load = &load
+		}
+		return resp
+	}
+
+	// Answered from this node only, so that nodes missing an index never
+	// ask each other in circles.
+	if req.Type == ReqIndexMeta {
+		if idx := s.manager.GetIndex(req.IndexName); idx != nil {
+			meta := idx.Meta()
+			resp.Meta = &meta
+		}
+		return resp
+	}
+
 	idx := s.manager.GetIndex(req.IndexName)
 	if idx == nil && req.Type != ReqCreateIndex {
 		var err error
 		idx, err = s.manager.OpenIndex(req.IndexName)
+		if errors.Is(err, ErrIndexNotFound) {
+			idx, err = s.manager.syncIndex(req.IndexName)
+		}
 		if err != nil {
-			resp.Err = err.Error()
+			resp.Err, resp.ErrKind = encodeError(err)
 			return resp
 		}
 	}
 
+	var opts store.WriteOptions
+	if req.Options != nil {
+		opts = *req.Options
+	}
+
 	switch req.Type {
 	case ReqIndex:
-		err := idx.Index(req.ID, req.Data)
+		res, err := idx.index(ctx, req.ID, req.Data, opts)
 		if err != nil {
-			resp.Err = err.Error()
+			resp.Err, resp.ErrKind = encodeError(err)
+		} else {
+			resp.Result = &res
 		}
 	case ReqBatchIndex:
-		err := idx.BatchIndex(req.BatchIDs, req.BatchDocs)
+		resp.BatchResults = idx.batchIndex(ctx, req.BatchIDs, req.BatchDocs, req.BatchOpts)
+		resp.BatchErrs = make([]string, len(resp.BatchResults))
+		resp.BatchKinds = make([]string, len(resp.BatchResults))
+		for i, r := range resp.BatchResults {
+			resp.BatchErrs[i], resp.BatchKinds[i] = encodeError(r.Err)
+		}
+	case ReqUpdate:
+		if req.Update == nil {
+			resp.Err = "missing update"
+			break
+		}
+		res, err := idx.update(ctx, req.ID, *req.Update, opts)
 		if err != nil {
-			resp.Err = err.Error()
+			resp.Err, resp.ErrKind = encodeError(err)
+		} else {
+			resp.Result = &res
 		}
 	case ReqGet:
-		data, err := idx.Get(req.ID)
+		var doc *store.Document
+		var err error
+		if req.AsOf != 0 {
+			doc, err = idx.GetAsOf(ctx, req.ID, req.Routing, time.UnixMilli(req.AsOf))
+		} else {
+			doc, err = idx.Get(ctx, req.ID, req.Routing)
+		}
 		if err != nil {
-			resp.Err = err.Error()
+			resp.Err, resp.ErrKind = encodeError(err)
 		} else {
-			resp.Data = data
+			resp.Doc = doc
 		}
 	case ReqDelete:
-		err := idx.Delete(req.ID)
+		res, err := idx.delete(ctx, req.ID, opts)
 		if err != nil {
-			resp.Err = err.Error()
+			resp.Err, resp.ErrKind = encodeError(err)
+		} else {
+			resp.Result = &res
 		}
 	case ReqSearch:
-		res, err := idx.LocalSearch(req.SearchReq)
+		res, err := idx.LocalSearch(ctx, req.SearchReq, req.Shards)
 		if err != nil {
-			resp.Err = err.Error()
+			resp.Err, resp.ErrKind = encodeError(err)
 		} else {
 			resp.SearchResult = res
 		}
-	case ReqCreateIndex:
-		_, err := s.manager.CreateIndex(req.IndexName, req.NumShards, false)
+	case ReqHealth:
+		resp.Health = idx.LocalHealth()
+	case ReqStats:
+		stats, err := idx.LocalStats()
 		if err != nil {
 			resp.Err = err.Error()
+		} else {
+			resp.Stats = stats
+		}
+	case ReqSnapshotShards, ReqRestoreShards:
+		repo, err := s.manager.Repository(req.RepositoryName)
+		if err != nil {
+			resp.Err = err.Error()
+			break
+		}
+		var results map[int]error
+		if req.Type == ReqSnapshotShards {
+			results = idx.SnapshotShards(repo, req.Snapshot)
+		} else {
+			results = idx.RestoreShards(repo, req.Snapshot, req.SourceIndex)
+		}
+		resp.ShardErrs, resp.ShardKinds = encodeShardErrors(results)
+	case ReqChanges:
+		var errs map[int]error
+		resp.Changes, errs = idx.LocalChanges(req.Since, req.Limit)
+		resp.ShardErrs, resp.ShardKinds = encodeShardErrors(errs)
+	case ReqScan:
+		res, err := idx.LocalScan(req.Shard, req.After, req.Limit, req.Hold)
+		if err != nil {
+			resp.Err, resp.ErrKind = encodeError(err)
+		} else {
+			resp.Changes = map[int]ShardChanges{req.Shard: res}
+		}
+	case ReqReleaseChanges:
+		idx.LocalReleaseChanges(req.Hold)
+	case ReqReplicate:
+		if err := idx.LocalReplicate(req.Shard, req.Changes, req.Reset); err != nil {
+			resp.Err, resp.ErrKind = encodeError(err)
+		}
+	case ReqRelocate:
+		if err := idx.LocalRelocate(req.Shard, req.Target); err != nil {
+			resp.Err, resp.ErrKind = encodeError(err)
+		}
+	case ReqUpdateMeta:
+		if req.Meta == nil {
+			resp.Err = "missing metadata"
+			break
+		}
+		if err := idx.applyMeta(*req.Meta); err != nil {
+			resp.Err, resp.ErrKind = encodeError(err)
+		}
+	case ReqCreateIndex:
+		var err error
+		if req.Meta != nil {
+			_, err = s.manager.createIndex(req.IndexName, *req.Meta)
+		} else {
+			var settings Settings
+			if req.Settings != nil {
+				settings = *req.Settings
+			}
+			_, err = s.manager.CreateIndex(req.IndexName, settings, false)
+		}
+		if err != nil {
+			resp.Err, resp.ErrKind = encodeError(err)
 		}
 	}
 
@@ -0,0 +1,107 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DeleteIndexResult reports which nodes deleted their copy of an index.
+type DeleteIndexResult struct {
+	// Found is set if any node still held the index.
+	Found bool
+	// Acknowledged lists the IDs of the nodes that deleted the index or no
+	// longer had it, sorted.
+	Acknowledged []string
+	// Failed holds the error of every node that could not be reached or
+	// failed to delete the index.
+	Failed map[string]error
+}
+
+// DeleteIndex closes every shard of the index on this node and removes its
+// directory, including its settings and mapping. When forward is set, every
+// other node is asked to do the same. Deleting an index that does not exist
+// is not an error, so a delete that failed on some nodes can be retried.
+func (m *Manager) DeleteIndex(name string, forward bool) (DeleteIndexResult, error) {
+	result := DeleteIndexResult{Acknowledged: []string{}, Failed: make(map[string]error)}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return result, fmt.Errorf("%w [%s]", ErrInvalidIndexName, name)
+	}
+
+	// Only the node the delete was sent to checks the block, the others
+	// follow its decision.
+	if idx := m.GetIndex(name); idx != nil && forward {
+		if err := idx.checkMetadataWrite(); err != nil {
+			return result, err
+		}
+	}
+
+	found, err := m.deleteLocalIndex(name)
+	if err != nil {
+		result.Failed[m.Cluster.SelfID] = err
+	} else {
+		result.Acknowledged = append(result.Acknowledged, m.Cluster.SelfID)
+		result.Found = found
+	}
+	if !forward {
+		return result, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range m.Cluster.Nodes {
+		if m.Cluster.IsLocal(node) {
+			continue
+		}
+		node := node
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := m.Forwarder.ForwardDeleteIndex(context.Background(), node, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Failed[node.ID] = fmt.Errorf("node %s: %w", node.ID, err)
+				return
+			}
+			result.Acknowledged = append(result.Acknowledged, node.ID)
+			result.Found = result.Found || found
+		}()
+	}
+	wg.Wait()
+	sort.Strings(result.Acknowledged)
+	return result, nil
+}
+
+// deleteLocalIndex deletes the copy of the index held by this node and
+// reports whether there was one.
+func (m *Manager) deleteLocalIndex(name string) (bool, error) {
+	m.mu.Lock()
+	idx, open := m.indices[name]
+	delete(m.indices, name)
+	m.mu.Unlock()
+
+	var closeErr error
+	if open {
+		idx.mu.Lock()
+		closeErr = idx.closeShards()
+		idx.mu.Unlock()
+	}
+
+	indexPath := filepath.Join(m.basePath, name)
+	info, err := os.Stat(indexPath)
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return open, closeErr
+	}
+	if err != nil {
+		return open, err
+	}
+	if err := os.RemoveAll(indexPath); err != nil {
+		return true, err
+	}
+	return true, closeErr
+}
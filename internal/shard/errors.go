@@ -0,0 +1,113 @@
+package shard
+
+import (
+	"breeze/internal/script"
+	"breeze/internal/store"
+	"context"
+	"errors"
+)
+
+// ErrIndexNotFound is returned for operations on an index that does not
+// exist.
+var ErrIndexNotFound = errors.New("no such index")
+
+// ErrIndexExists is returned when an index that must be new already exists.
+var ErrIndexExists = errors.New("index already exists")
+
+// ErrIndexClosed is returned for operations on a closed index.
+var ErrIndexClosed = errors.New("index closed")
+
+// ErrIndexBlocked is returned for operations that a block of the index
+// forbids.
+var ErrIndexBlocked = errors.New("index blocked")
+
+// ErrInvalidIndexName is returned for index names that cannot be used as a
+// directory name.
+var ErrInvalidIndexName = errors.New("invalid index name")
+
+// ErrInvalidShardCount is returned when an index cannot be split or shrunk
+// to the requested number of shards.
+var ErrInvalidShardCount = errors.New("invalid number of shards")
+
+// ErrRoutingMissing is returned when an index requires a routing key and a
+// request has none.
+var ErrRoutingMissing = errors.New("routing is required")
+
+// ErrUnavailableShards is returned when fewer copies of a shard are active
+// than a write waits for.
+var ErrUnavailableShards = errors.New("not enough active copies")
+
+// ErrShardRelocating is returned for writes to a primary that is handed off
+// to another node. They are retried until they reach the new primary.
+var ErrShardRelocating = errors.New("shard is relocating")
+
+// ErrNotCoordinator is returned when shards are rebalanced on a node other
+// than the one coordinating the allocation.
+var ErrNotCoordinator = errors.New("node does not coordinate the allocation of shards")
+
+// ErrNodeUnavailable is returned when another node cannot be reached. It is
+// not sent over the wire: a node that cannot reach a third one is itself
+// reachable.
+var ErrNodeUnavailable = errors.New("node is unavailable")
+
+// errorKinds lists the sentinel errors that keep their identity when they
+// are returned by a remote node, keyed by their name on the wire.
+var errorKinds = map[string]error{
+	"version_conflict":   store.ErrVersionConflict,
+	"index_not_found":    ErrIndexNotFound,
+	"changes_truncated":  store.ErrChangesTruncated,
+	"index_exists":       ErrIndexExists,
+	"invalid_name":       ErrInvalidIndexName,
+	"index_closed":       ErrIndexClosed,
+	"index_blocked":      ErrIndexBlocked,
+	"shard_count":        ErrInvalidShardCount,
+	"routing_missing":    ErrRoutingMissing,
+	"unavailable_shards": ErrUnavailableShards,
+	"shard_relocating":   ErrShardRelocating,
+	"not_coordinator":    ErrNotCoordinator,
+	"document_missing":   store.ErrDocumentMissing,
+	"script":             script.ErrScript,
+	"deadline_exceeded":  context.DeadlineExceeded,
+	"canceled":           context.Canceled,
+}
+
+// remoteError is an error reported by another node. It unwraps to the
+// sentinel error of its kind, if any, so errors.Is works across the wire.
+type remoteError struct {
+	msg  string
+	kind error
+}
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.kind }
+
+// encodeError splits err into the message and kind sent over the wire.
+func encodeError(err error) (msg, kind string) {
+	if err == nil {
+		return "", ""
+	}
+	for name, sentinel := range errorKinds {
+		if errors.Is(err, sentinel) {
+			return err.Error(), name
+		}
+	}
+	return err.Error(), ""
+}
+
+// encodeShardErrors encodes per-shard errors for the wire.
+func encodeShardErrors(errs map[int]error) (msgs, kinds map[int]string) {
+	msgs = make(map[int]string, len(errs))
+	kinds = make(map[int]string, len(errs))
+	for sID, err := range errs {
+		msgs[sID], kinds[sID] = encodeError(err)
+	}
+	return msgs, kinds
+}
+
+// decodeError rebuilds an error received from another node.
+func decodeError(msg, kind string) error {
+	if msg == "" {
+		return nil
+	}
+	return &remoteError{msg: msg, kind: errorKinds[kind]}
+}
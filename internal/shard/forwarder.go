@@ -2,10 +2,12 @@ package shard
 
 import (
 	"breeze/internal/cluster"
-	"encoding/json"
+	"breeze/internal/store"
+	"context"
+	"errors"
 	"fmt"
-	"net"
 	"sync"
+	"time"
 
 	"github.com/blevesearch/bleve/v2"
 )
@@ -19,6 +21,25 @@ const (
 	ReqDelete
 	ReqSearch
 	ReqCreateIndex
+	ReqHealth
+	ReqStats
+	ReqPutRepository
+	ReqSnapshotShards
+	ReqRestoreShards
+	ReqChanges
+	ReqUpdate
+	ReqDeleteIndex
+	ReqIndexMeta
+	ReqUpdateMeta
+	ReqScan
+	ReqReleaseChanges
+	ReqSwapIndex
+	ReqReplicate
+	ReqRelocate
+	ReqNodeLoad
+	// ReqCancel cancels the request with the ID of its frame. It is not
+	// answered.
+	ReqCancel
 )
 
 type InternalRequest struct {
@@ -29,132 +50,535 @@ type InternalRequest struct {
 	BatchIDs  []string                 `json:"batch_ids,omitempty"`
 	BatchDocs []map[string]interface{} `json:"batch_docs,omitempty"`
 	SearchReq *bleve.SearchRequest     `json:"search_req,omitempty"`
-	NumShards int                      `json:"num_shards,omitempty"`
+	Options   *store.WriteOptions      `json:"options,omitempty"`
+	Update    *store.UpdateRequest     `json:"update,omitempty"`
+	BatchOpts []store.WriteOptions     `json:"batch_opts,omitempty"`
+	Settings  *Settings                `json:"settings,omitempty"`
+	Meta      *IndexMeta               `json:"meta,omitempty"`
+
+	RepositoryName string            `json:"repository_name,omitempty"`
+	Repository     *RepositoryConfig `json:"repository,omitempty"`
+	Snapshot       string            `json:"snapshot,omitempty"`
+	SourceIndex    string            `json:"source_index,omitempty"`
+
+	Since map[int]uint64 `json:"since,omitempty"`
+	Limit int            `json:"limit,omitempty"`
+	// AsOf asks ReqGet for the document at this time, in Unix milliseconds.
+	AsOf int64 `json:"as_of,omitempty"`
+	// Routing is the routing key of the document of ReqGet.
+	Routing string `json:"routing,omitempty"`
+	// Shards limits ReqSearch to these shards.
+	Shards []int `json:"shards,omitempty"`
+
+	// Shard, After and Hold select the page of documents ReqScan returns
+	// and the hold it places on the WAL; ReqReleaseChanges releases Hold.
+	Shard int    `json:"shard,omitempty"`
+	After string `json:"after,omitempty"`
+	Hold  string `json:"hold,omitempty"`
+	// Target is the index ReqSwapIndex moves to IndexName, or the node
+	// ReqRelocate relocates Shard to.
+	Target string `json:"target,omitempty"`
+	// Changes are applied by ReqReplicate to the replica of Shard, after
+	// emptying it if Reset is set.
+	Changes []store.Change `json:"changes,omitempty"`
+	Reset   bool           `json:"reset,omitempty"`
+	// Timeout is the time left to handle the request, in milliseconds,
+	// after which the node gives up on it.
+	Timeout int64 `json:"timeout,omitempty"`
 }
 
 type InternalResponse struct {
-	Data         map[string]interface{} `json:"data,omitempty"`
-	SearchResult *bleve.SearchResult     `json:"search_result,omitempty"`
-	Err          string                 `json:"err,omitempty"`
+	Doc          *store.Document      `json:"doc,omitempty"`
+	Result       *store.WriteResult   `json:"result,omitempty"`
+	SearchResult *bleve.SearchResult  `json:"search_result,omitempty"`
+	BatchResults []store.WriteResult  `json:"batch_results,omitempty"`
+	BatchErrs    []string             `json:"batch_errs,omitempty"`
+	BatchKinds   []string             `json:"batch_kinds,omitempty"`
+	Health       map[int]store.Health `json:"health,omitempty"`
+	Stats        map[int]store.Stats  `json:"stats,omitempty"`
+	ShardErrs    map[int]string       `json:"shard_errs,omitempty"`
+	ShardKinds   map[int]string       `json:"shard_kinds,omitempty"`
+	Changes      map[int]ShardChanges `json:"changes,omitempty"`
+	Err          string               `json:"err,omitempty"`
+	ErrKind      string               `json:"err_kind,omitempty"`
+	// Found reports whether ReqDeleteIndex found the index.
+	Found bool       `json:"found,omitempty"`
+	Meta  *IndexMeta `json:"meta,omitempty"`
+	// Load is the load of the node answering ReqNodeLoad.
+	Load *cluster.NodeLoad `json:"load,omitempty"`
 }
 
+const (
+	// DefaultRequestTimeout is how long a request to another node may take
+	// by default.
+	DefaultRequestTimeout = 30 * time.Second
+	// ShardCopyTimeout is how long the requests that copy whole shards,
+	// snapshots, restores and relocations, may take by default.
+	ShardCopyTimeout = time.Hour
+
+	// readRetries is how many times a read is sent again when the
+	// connection it was sent on breaks, after retryBackoff and then twice
+	// as long each time.
+	readRetries  = 2
+	retryBackoff = 50 * time.Millisecond
+)
+
+// Forwarder sends internal requests to the other nodes, over a pool of
+// connections per node that concurrent requests share, see rpcConn.
 type Forwarder struct {
+	// Timeout bounds the time a request to another node may take, unless
+	// Timeouts has one for its type. The node is told how long it has and
+	// gives up on the request when the time is up.
+	Timeout  time.Duration
+	Timeouts map[RequestType]time.Duration
+
 	mu    sync.Mutex
-	conns map[string]net.Conn
+	pools map[string]*nodePool
+	// minVersion and maxVersion are the protocol versions offered to the
+	// other nodes.
+	minVersion, maxVersion uint16
 }
 
 func NewForwarder() *Forwarder {
 	return &Forwarder{
-		conns: make(map[string]net.Conn),
+		Timeout: DefaultRequestTimeout,
+		Timeouts: map[RequestType]time.Duration{
+			ReqSnapshotShards: ShardCopyTimeout,
+			ReqRestoreShards:  ShardCopyTimeout,
+			ReqRelocate:       ShardCopyTimeout,
+		},
+		pools:      make(map[string]*nodePool),
+		minVersion: minProtocol,
+		maxVersion: maxProtocol,
 	}
 }
 
-func (f *Forwarder) getConn(node cluster.Node) (net.Conn, error) {
+func (f *Forwarder) pool(node cluster.Node) *nodePool {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	p, ok := f.pools[node.ID]
+	if !ok {
+		p = &nodePool{minVersion: f.minVersion, maxVersion: f.maxVersion}
+		f.pools[node.ID] = p
+	}
+	return p
+}
 
-	if conn, ok := f.conns[node.ID]; ok {
-		return conn, nil
+// Close closes the connections to the other nodes; requests still waiting
+// for a response fail.
+func (f *Forwarder) Close() {
+	f.mu.Lock()
+	pools := f.pools
+	f.pools = make(map[string]*nodePool)
+	f.mu.Unlock()
+	for _, p := range pools {
+		p.close()
 	}
+}
 
-	conn, err := net.Dial("tcp", node.Addr)
-	if err != nil {
-		return nil, err
+// timeout returns how long a request of type t may take.
+func (f *Forwarder) timeout(t RequestType) time.Duration {
+	if d, ok := f.Timeouts[t]; ok {
+		return d
 	}
-	f.conns[node.ID] = conn
-	return conn, nil
+	return f.Timeout
 }
 
-func (f *Forwarder) call(node cluster.Node, req InternalRequest) (*InternalResponse, error) {
-	conn, err := f.getConn(node)
-	if err != nil {
-		return nil, err
+// idempotent reports whether requests of type t only read, so that sending
+// them again is harmless.
+func idempotent(t RequestType) bool {
+	switch t {
+	case ReqGet, ReqSearch, ReqHealth, ReqStats, ReqChanges, ReqIndexMeta, ReqNodeLoad:
+		return true
 	}
+	return false
+}
 
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
+// call sends req to node and returns its response. It gives up when ctx is
+// done, returning the error of ctx, or when the timeout of the request is
+// up, returning ErrNodeUnavailable so that reads fail over to other copies.
+// Reads are sent again, with backoff, when the connection they were sent on
+// breaks before they are answered.
+func (f *Forwarder) call(ctx context.Context, node cluster.Node, req InternalRequest) (*InternalResponse, error) {
+	backoff := retryBackoff
+	for retries := 0; ; retries++ {
+		resp, retry, err := f.try(ctx, node, req)
+		if !retry || retries == readRetries || !idempotent(req.Type) {
+			return resp, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
 
-	if err := encoder.Encode(req); err != nil {
-		f.mu.Lock()
-		delete(f.conns, node.ID)
-		f.mu.Unlock()
-		conn.Close()
-		return nil, err
+// try sends req to node once. It reports whether the request may be sent
+// again, which is when the connection broke after sending it.
+func (f *Forwarder) try(ctx context.Context, node cluster.Node, req InternalRequest) (*InternalResponse, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, fmt.Errorf("request to node %s: %w", node.ID, err)
+	}
+	timeout := f.timeout(req.Type)
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	deadline, _ := tctx.Deadline()
+	// failed tells apart the caller giving up, or its deadline passing,
+	// from the request timing out or the node failing. The node may give up
+	// on the request a moment before this node does, so its deadline
+	// errors count as well.
+	parentDeadline, ok := ctx.Deadline()
+	callerBound := ok && !parentDeadline.After(deadline)
+	failed := func(err error) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("request to node %s: %w", node.ID, ctx.Err())
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			if callerBound {
+				return fmt.Errorf("request to node %s: %w", node.ID, err)
+			}
+			err = fmt.Errorf("request timed out after %s: %w", timeout, err)
+		}
+		return fmt.Errorf("%w [%s]: %w", ErrNodeUnavailable, node.ID, err)
 	}
 
+	rc, err := f.pool(node).get(tctx, node.Addr)
+	if err != nil {
+		return nil, false, failed(err)
+	}
+	req.Timeout = max(time.Until(deadline).Milliseconds(), 1)
+	payload, err := rc.codec.encode(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode request: %w", err)
+	}
+	data, err := rc.call(tctx, payload)
+	if err != nil {
+		return nil, tctx.Err() == nil, failed(err)
+	}
 	var resp InternalResponse
-	if err := decoder.Decode(&resp); err != nil {
-		f.mu.Lock()
-		delete(f.conns, node.ID)
-		f.mu.Unlock()
-		conn.Close()
-		return nil, err
+	if err := rc.codec.decode(data, &resp); err != nil {
+		return nil, false, fmt.Errorf("failed to decode response of node %s: %w", node.ID, err)
 	}
 
 	if resp.Err != "" {
-		return nil, fmt.Errorf("%s", resp.Err)
+		err := decodeError(resp.Err, resp.ErrKind)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = failed(err)
+		}
+		return nil, false, err
 	}
-	return &resp, nil
+	return &resp, false, nil
 }
 
-func (f *Forwarder) ForwardIndex(node cluster.Node, indexName, id string, data map[string]interface{}) error {
-	_, err := f.call(node, InternalRequest{
+// writeResult returns the result of a forwarded write, which a node that
+// does not know the request type leaves out.
+func writeResult(node cluster.Node, resp *InternalResponse) (store.WriteResult, error) {
+	if resp.Result == nil {
+		return store.WriteResult{}, fmt.Errorf("node %s returned no write result", node.ID)
+	}
+	return *resp.Result, nil
+}
+
+func (f *Forwarder) ForwardIndex(ctx context.Context, node cluster.Node, indexName, id string, data map[string]interface{}, opts store.WriteOptions) (store.WriteResult, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
 		Type:      ReqIndex,
 		IndexName: indexName,
 		ID:        id,
 		Data:      data,
+		Options:   &opts,
 	})
-	return err
+	if err != nil {
+		return store.WriteResult{}, err
+	}
+	return writeResult(node, resp)
 }
 
-func (f *Forwarder) ForwardBatchIndex(node cluster.Node, indexName string, ids []string, data []map[string]interface{}) error {
-	_, err := f.call(node, InternalRequest{
+// ForwardBatchIndex returns one result per document as reported by the
+// remote node, or a single error if the request itself failed.
+func (f *Forwarder) ForwardBatchIndex(ctx context.Context, node cluster.Node, indexName string, ids []string, data []map[string]interface{}, opts []store.WriteOptions) ([]store.WriteResult, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
 		Type:      ReqBatchIndex,
 		IndexName: indexName,
 		BatchIDs:  ids,
 		BatchDocs: data,
+		BatchOpts: opts,
 	})
-	return err
+	if err != nil {
+		return nil, err
+	}
+	results := resp.BatchResults
+	for i := range results {
+		if i < len(resp.BatchErrs) {
+			var kind string
+			if i < len(resp.BatchKinds) {
+				kind = resp.BatchKinds[i]
+			}
+			results[i].Err = decodeError(resp.BatchErrs[i], kind)
+		}
+	}
+	return results, nil
+}
+
+func (f *Forwarder) ForwardUpdate(ctx context.Context, node cluster.Node, indexName, id string, req store.UpdateRequest, opts store.WriteOptions) (store.WriteResult, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqUpdate,
+		IndexName: indexName,
+		ID:        id,
+		Update:    &req,
+		Options:   &opts,
+	})
+	if err != nil {
+		return store.WriteResult{}, err
+	}
+	return writeResult(node, resp)
+}
+
+func (f *Forwarder) ForwardGet(ctx context.Context, node cluster.Node, indexName, id, routing string) (*store.Document, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqGet,
+		IndexName: indexName,
+		ID:        id,
+		Routing:   routing,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Doc, nil
 }
 
-func (f *Forwarder) ForwardGet(node cluster.Node, indexName, id string) (map[string]interface{}, error) {
-	resp, err := f.call(node, InternalRequest{
+func (f *Forwarder) ForwardGetAsOf(ctx context.Context, node cluster.Node, indexName, id, routing string, asOf time.Time) (*store.Document, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
 		Type:      ReqGet,
 		IndexName: indexName,
 		ID:        id,
+		Routing:   routing,
+		AsOf:      asOf.UnixMilli(),
 	})
 	if err != nil {
 		return nil, err
 	}
-	return resp.Data, nil
+	return resp.Doc, nil
 }
 
-func (f *Forwarder) ForwardDelete(node cluster.Node, indexName, id string) error {
-	_, err := f.call(node, InternalRequest{
+func (f *Forwarder) ForwardDelete(ctx context.Context, node cluster.Node, indexName, id string, opts store.WriteOptions) (store.WriteResult, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
 		Type:      ReqDelete,
 		IndexName: indexName,
 		ID:        id,
+		Options:   &opts,
 	})
-	return err
+	if err != nil {
+		return store.WriteResult{}, err
+	}
+	return writeResult(node, resp)
 }
 
-func (f *Forwarder) ForwardCreateIndex(node cluster.Node, indexName string, numShards int) error {
-	_, err := f.call(node, InternalRequest{
+func (f *Forwarder) ForwardCreateIndex(ctx context.Context, node cluster.Node, indexName string, meta IndexMeta) error {
+	_, err := f.call(ctx, node, InternalRequest{
 		Type:      ReqCreateIndex,
 		IndexName: indexName,
-		NumShards: numShards,
+		Meta:      &meta,
+	})
+	return err
+}
+
+// ForwardIndexMeta returns the metadata the node has for the index, or nil
+// if it does not have the index.
+func (f *Forwarder) ForwardIndexMeta(ctx context.Context, node cluster.Node, indexName string) (*IndexMeta, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqIndexMeta,
+		IndexName: indexName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Meta, nil
+}
+
+func (f *Forwarder) ForwardDeleteIndex(ctx context.Context, node cluster.Node, indexName string) (bool, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqDeleteIndex,
+		IndexName: indexName,
+	})
+	if err != nil {
+		return false, err
+	}
+	return resp.Found, nil
+}
+
+func (f *Forwarder) ForwardUpdateMeta(ctx context.Context, node cluster.Node, indexName string, meta IndexMeta) error {
+	_, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqUpdateMeta,
+		IndexName: indexName,
+		Meta:      &meta,
 	})
 	return err
 }
 
-func (f *Forwarder) ForwardSearch(node cluster.Node, indexName string, searchReq *bleve.SearchRequest) (*bleve.SearchResult, error) {
-	resp, err := f.call(node, InternalRequest{
+// ForwardSearch runs a search on the given shards of the node, or on all of
+// them if shards is nil.
+func (f *Forwarder) ForwardSearch(ctx context.Context, node cluster.Node, indexName string, searchReq *bleve.SearchRequest, shards []int) (*bleve.SearchResult, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
 		Type:      ReqSearch,
 		IndexName: indexName,
 		SearchReq: searchReq,
+		Shards:    shards,
 	})
 	if err != nil {
 		return nil, err
 	}
 	return resp.SearchResult, nil
 }
+
+func (f *Forwarder) ForwardHealth(ctx context.Context, node cluster.Node, indexName string) (map[int]store.Health, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqHealth,
+		IndexName: indexName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Health, nil
+}
+
+func (f *Forwarder) ForwardStats(ctx context.Context, node cluster.Node, indexName string) (map[int]store.Stats, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqStats,
+		IndexName: indexName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Stats, nil
+}
+
+func (f *Forwarder) ForwardPutRepository(ctx context.Context, node cluster.Node, name string, cfg RepositoryConfig) error {
+	_, err := f.call(ctx, node, InternalRequest{
+		Type:           ReqPutRepository,
+		RepositoryName: name,
+		Repository:     &cfg,
+	})
+	return err
+}
+
+func (f *Forwarder) ForwardSnapshotShards(ctx context.Context, node cluster.Node, indexName, repo, snap string) (map[int]error, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:           ReqSnapshotShards,
+		IndexName:      indexName,
+		RepositoryName: repo,
+		Snapshot:       snap,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shardErrors(resp.ShardErrs, resp.ShardKinds), nil
+}
+
+func (f *Forwarder) ForwardRestoreShards(ctx context.Context, node cluster.Node, indexName, repo, snap, source string) (map[int]error, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:           ReqRestoreShards,
+		IndexName:      indexName,
+		RepositoryName: repo,
+		Snapshot:       snap,
+		SourceIndex:    source,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shardErrors(resp.ShardErrs, resp.ShardKinds), nil
+}
+
+func (f *Forwarder) ForwardChanges(ctx context.Context, node cluster.Node, indexName string, since map[int]uint64, limit int) (map[int]ShardChanges, map[int]error, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqChanges,
+		IndexName: indexName,
+		Since:     since,
+		Limit:     limit,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Changes, shardErrors(resp.ShardErrs, resp.ShardKinds), nil
+}
+
+// ForwardScan returns a page of the documents of a shard, see
+// Index.LocalScan.
+func (f *Forwarder) ForwardScan(ctx context.Context, node cluster.Node, indexName string, shard int, after string, limit int, hold string) (ShardChanges, error) {
+	resp, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqScan,
+		IndexName: indexName,
+		Shard:     shard,
+		After:     after,
+		Limit:     limit,
+		Hold:      hold,
+	})
+	if err != nil {
+		return ShardChanges{}, err
+	}
+	return resp.Changes[shard], nil
+}
+
+func (f *Forwarder) ForwardReleaseChanges(ctx context.Context, node cluster.Node, indexName, hold string) error {
+	_, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqReleaseChanges,
+		IndexName: indexName,
+		Hold:      hold,
+	})
+	return err
+}
+
+func (f *Forwarder) ForwardSwapIndex(ctx context.Context, node cluster.Node, indexName, from string) error {
+	_, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqSwapIndex,
+		IndexName: indexName,
+		Target:    from,
+	})
+	return err
+}
+
+// ForwardReplicate applies changes of a primary shard to its replica on the
+// node, see Index.LocalReplicate.
+func (f *Forwarder) ForwardReplicate(ctx context.Context, node cluster.Node, indexName string, shard int, changes []store.Change, reset bool) error {
+	_, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqReplicate,
+		IndexName: indexName,
+		Shard:     shard,
+		Changes:   changes,
+		Reset:     reset,
+	})
+	return err
+}
+
+// ForwardRelocate asks the node holding the primary of a shard to bring
+// the copy relocating to the node to up to date, see Index.LocalRelocate.
+func (f *Forwarder) ForwardRelocate(ctx context.Context, node cluster.Node, indexName string, shard int, to string) error {
+	_, err := f.call(ctx, node, InternalRequest{
+		Type:      ReqRelocate,
+		IndexName: indexName,
+		Shard:     shard,
+		Target:    to,
+	})
+	return err
+}
+
+// ForwardNodeLoad asks a node for its load.
+func (f *Forwarder) ForwardNodeLoad(ctx context.Context, node cluster.Node) (cluster.NodeLoad, error) {
+	resp, err := f.call(ctx, node, InternalRequest{Type: ReqNodeLoad})
+	if err != nil {
+		return cluster.NodeLoad{}, err
+	}
+	if resp.Load == nil {
+		return cluster.NodeLoad{}, fmt.Errorf("node %s did not report its load", node.ID)
+	}
+	return *resp.Load, nil
+}
+
+func shardErrors(msgs, kinds map[int]string) map[int]error {
+	errs := make(map[int]error, len(msgs))
+	for sID, msg := range msgs {
+		errs[sID] = decodeError(msg, kinds[sID])
+	}
+	return errs
+}
@@ -0,0 +1,268 @@
+package shard
+
+import (
+	"breeze/internal/store"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Index states recorded in IndexMeta.State. An empty state is open.
+const (
+	IndexStateOpen  = "open"
+	IndexStateClose = "close"
+)
+
+// Blocks restrict the operations allowed on an index.
+type Blocks struct {
+	// Write rejects document writes.
+	Write bool `json:"write,omitempty"`
+	// ReadOnly rejects document writes and changes to the index other than
+	// its blocks, including closing and deleting it.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Read rejects gets, searches and the changes feed.
+	Read bool `json:"read,omitempty"`
+}
+
+// BlocksUpdate changes some of the blocks of an index; nil fields are left
+// as they are.
+type BlocksUpdate struct {
+	Write    *bool
+	ReadOnly *bool
+	Read     *bool
+}
+
+func (u BlocksUpdate) apply(b *Blocks) {
+	for _, f := range []struct {
+		v   *bool
+		dst *bool
+	}{{u.Write, &b.Write}, {u.ReadOnly, &b.ReadOnly}, {u.Read, &b.Read}} {
+		if f.v != nil {
+			*f.dst = *f.v
+		}
+	}
+}
+
+// closed reports whether the index is closed.
+func (meta IndexMeta) closed() bool {
+	return meta.State == IndexStateClose
+}
+
+// checkOpen fails with ErrIndexClosed if the index is closed.
+func (idx *Index) checkOpen() error {
+	if idx.Meta().closed() {
+		return fmt.Errorf("%w [%s]", ErrIndexClosed, idx.Name)
+	}
+	return nil
+}
+
+// checkRead fails if the index is closed or blocks reads.
+func (idx *Index) checkRead() error {
+	meta := idx.Meta()
+	switch {
+	case meta.closed():
+		return fmt.Errorf("%w [%s]", ErrIndexClosed, idx.Name)
+	case meta.Settings.Blocks.Read:
+		return fmt.Errorf("%w: index [%s] blocked by: [FORBIDDEN/7/index read (api)]", ErrIndexBlocked, idx.Name)
+	}
+	return nil
+}
+
+// checkWrite fails if the index is closed or blocks document writes.
+func (idx *Index) checkWrite() error {
+	meta := idx.Meta()
+	switch {
+	case meta.closed():
+		return fmt.Errorf("%w [%s]", ErrIndexClosed, idx.Name)
+	case meta.Settings.Blocks.ReadOnly:
+		return fmt.Errorf("%w: index [%s] blocked by: [FORBIDDEN/5/index read-only (api)]", ErrIndexBlocked, idx.Name)
+	case meta.Settings.Blocks.Write:
+		return fmt.Errorf("%w: index [%s] blocked by: [FORBIDDEN/8/index write (api)]", ErrIndexBlocked, idx.Name)
+	}
+	return nil
+}
+
+// checkMetadataWrite fails if the index is read-only.
+func (idx *Index) checkMetadataWrite() error {
+	if idx.Meta().Settings.Blocks.ReadOnly {
+		return fmt.Errorf("%w: index [%s] blocked by: [FORBIDDEN/5/index read-only (api)]", ErrIndexBlocked, idx.Name)
+	}
+	return nil
+}
+
+// localShard returns the local store of a shard.
+func (idx *Index) localShard(sID int) (*store.Store, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	s, ok := idx.Shards[sID]
+	if !ok {
+		if err := idx.checkOpen(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("shard %d of index %s is not local", sID, idx.Name)
+	}
+	return s, nil
+}
+
+// writeShard runs write against the local primary store of a shard if the
+// index accepts writes and enough copies of the shard are active, see
+// checkActiveShards, and then replicates it. The index lock is held while
+// writing, so applyMeta waits for the writes that passed the check before a
+// block or a close takes effect; it is released before the replicas are
+// contacted.
+func (idx *Index) writeShard(sID, wait int, write func(s *store.Store) error) (store.ShardInfo, error) {
+	s, err := idx.localShard(sID)
+	if err != nil {
+		return store.ShardInfo{}, idx.movedAway(sID, err)
+	}
+	if err := idx.checkActiveShards(s, sID, wait); err != nil {
+		return store.ShardInfo{}, err
+	}
+	if s, err = idx.writeLocked(sID, write); err != nil {
+		return store.ShardInfo{}, err
+	}
+	return idx.replicate(s, sID, false), nil
+}
+
+func (idx *Index) writeLocked(sID int, write func(s *store.Store) error) (*store.Store, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if err := idx.checkWrite(); err != nil {
+		return nil, err
+	}
+	s, ok := idx.Shards[sID]
+	if !ok {
+		return nil, idx.movedAway(sID, fmt.Errorf("shard %d of index %s is not local", sID, idx.Name))
+	}
+	if err := idx.handingOff(sID); err != nil {
+		return nil, err
+	}
+	return s, write(s)
+}
+
+// CloseIndex closes the index on every node, releasing the stores of its
+// shards. A closed index keeps its data and rejects every operation until
+// it is reopened.
+func (m *Manager) CloseIndex(name string) error {
+	return m.updateMeta(name, func(idx *Index, meta *IndexMeta) error {
+		if err := idx.checkMetadataWrite(); err != nil {
+			return err
+		}
+		meta.State = IndexStateClose
+		return nil
+	})
+}
+
+// ReopenIndex opens a closed index again on every node.
+func (m *Manager) ReopenIndex(name string) error {
+	return m.updateMeta(name, func(idx *Index, meta *IndexMeta) error {
+		meta.State = IndexStateOpen
+		return nil
+	})
+}
+
+// UpdateBlocks changes the blocks of the index on every node.
+func (m *Manager) UpdateBlocks(name string, update BlocksUpdate) error {
+	return m.updateMeta(name, func(idx *Index, meta *IndexMeta) error {
+		update.apply(&meta.Settings.Blocks)
+		return nil
+	})
+}
+
+// updateMeta changes the metadata of the index with fn and applies the
+// result on this node and then on every other node. Nodes that cannot be
+// reached are reported in the error; they apply the change when it is
+// retried.
+func (m *Manager) updateMeta(name string, fn func(idx *Index, meta *IndexMeta) error) error {
+	idx := m.GetIndex(name)
+	if idx == nil {
+		return fmt.Errorf("%w [%s]", ErrIndexNotFound, name)
+	}
+	meta := idx.Meta()
+	if err := fn(idx, &meta); err != nil {
+		return err
+	}
+	if err := idx.applyMeta(meta); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+	for _, node := range m.Cluster.Nodes {
+		if m.Cluster.IsLocal(node) {
+			continue
+		}
+		node := node
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.Forwarder.ForwardUpdateMeta(context.Background(), node, name, meta); err != nil {
+				mu.Lock()
+				failed = fmt.Errorf("failed to update index [%s] on node %s: %w", name, node.ID, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// applyMeta stores new metadata of the index, closing or opening its local
+// shards when its state or their allocation changes. Metadata with another
+// UUID belongs to an index of the same name that was deleted and created
+// again, and is rejected.
+func (idx *Index) applyMeta(meta IndexMeta) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.metaMu.Lock()
+	defer idx.metaMu.Unlock()
+
+	if meta.UUID != idx.meta.UUID {
+		return fmt.Errorf("%w [%s] with uuid %s", ErrIndexExists, idx.Name, idx.meta.UUID)
+	}
+	// The mapping version is counted by each node on its own.
+	meta.MappingVersion = idx.meta.MappingVersion
+	// An older allocation table, sent along with another change, does not
+	// replace a newer one.
+	if meta.AllocationVersion < idx.meta.AllocationVersion {
+		meta.Allocation, meta.AllocationVersion = idx.meta.Allocation, idx.meta.AllocationVersion
+	}
+
+	switch {
+	case meta.closed() && !idx.meta.closed():
+		if err := idx.closeShards(); err != nil {
+			return err
+		}
+	case !meta.closed():
+		opts, err := meta.Settings.storeOptions()
+		if err != nil {
+			return err
+		}
+		if err := idx.allocateShards(meta, opts); err != nil {
+			return err
+		}
+	}
+
+	if err := saveIndexMeta(idx.path, meta); err != nil {
+		return err
+	}
+	idx.meta = meta
+	return nil
+}
+
+// closeShards closes the local stores of the index, primaries and replicas,
+// and forgets them. The caller must hold idx.mu.
+func (idx *Index) closeShards() error {
+	var closeErr error
+	for _, stores := range []map[int]*store.Store{idx.Shards, idx.Replicas} {
+		for sID, s := range stores {
+			if err := s.Close(); err != nil && closeErr == nil {
+				closeErr = fmt.Errorf("failed to close shard %d: %w", sID, err)
+			}
+		}
+	}
+	idx.Shards = make(map[int]*store.Store)
+	idx.Replicas = make(map[int]*store.Store)
+	return closeErr
+}
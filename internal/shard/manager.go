@@ -3,26 +3,42 @@ package shard
 import (
 	"breeze/internal/cluster"
 	"breeze/internal/mapping"
+	"breeze/internal/snapshot"
 	"breeze/internal/store"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/blevesearch/bleve/v2"
 )
 
 type Index struct {
-	Name      string
-	Shards    map[int]*store.Store
+	Name   string
+	Shards map[int]*store.Store
+	// Replicas are the stores of the shards this node holds a replica of.
+	Replicas  map[int]*store.Store
 	numShards int
+	meta      IndexMeta
+	metaMu    sync.Mutex
 	path      string
 	Mapping   *mapping.Mapping
 	Cluster   *cluster.Cluster
 	Forwarder *Forwarder
 	mu        sync.RWMutex
+
+	// replicaStates tracks the replicas of the local primaries.
+	replicaMu     sync.Mutex
+	replicaStates map[replicaKey]*replicaState
+	// handoffs holds, until when, the local primaries whose writes are
+	// rejected while they are handed off to another node. It is guarded by
+	// mu.
+	handoffs map[int]time.Time
 }
 
 type Manager struct {
@@ -31,7 +47,14 @@ type Manager struct {
 	defaultNumShards int
 	Cluster          *cluster.Cluster
 	Forwarder        *Forwarder
+	repos            map[string]*snapshot.Repository
+	repoConfigs      map[string]RepositoryConfig
 	mu               sync.RWMutex
+
+	// rebalanceMu is held while shards are rebalanced, and done is closed
+	// when the manager is, to stop the rebalancer.
+	rebalanceMu sync.Mutex
+	done        chan struct{}
 }
 
 func NewManager(basePath string, defaultNumShards int, c *cluster.Cluster) (*Manager, error) {
@@ -45,6 +68,12 @@ func NewManager(basePath string, defaultNumShards int, c *cluster.Cluster) (*Man
 		defaultNumShards: defaultNumShards,
 		Cluster:          c,
 		Forwarder:        NewForwarder(),
+		repos:            make(map[string]*snapshot.Repository),
+		repoConfigs:      make(map[string]RepositoryConfig),
+		done:             make(chan struct{}),
+	}
+	if err := m.loadRepositories(); err != nil {
+		return nil, fmt.Errorf("failed to load snapshot repositories: %w", err)
 	}
 
 	// Load existing indices
@@ -56,7 +85,7 @@ func NewManager(basePath string, defaultNumShards int, c *cluster.Cluster) (*Man
 	for _, entry := range entries {
 		if entry.IsDir() {
 			_, err := m.OpenIndex(entry.Name())
-			if err != nil {
+			if err != nil && !errors.Is(err, ErrIndexNotFound) {
 				fmt.Printf("Failed to open index %s: %v\n", entry.Name(), err)
 			}
 		}
@@ -65,6 +94,9 @@ func NewManager(basePath string, defaultNumShards int, c *cluster.Cluster) (*Man
 	return m, nil
 }
 
+// OpenIndex loads an index from its directory. Indices without metadata
+// are reported as ErrIndexNotFound, except for indices written before
+// index.json existed, whose metadata is derived from their directory.
 func (m *Manager) OpenIndex(name string) (*Index, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -75,31 +107,54 @@ func (m *Manager) OpenIndex(name string) (*Index, error) {
 
 	indexPath := filepath.Join(m.basePath, name)
 
-	numShards := m.defaultNumShards
-	// Simple discovery of shard count by looking for existing shard directories
-	// (Even if we don't own them all, they might exist if a node was repurposed)
-	maxShardFound := -1
-	entries, _ := os.ReadDir(indexPath)
-	for _, entry := range entries {
-		var sID int
-		if n, _ := fmt.Sscanf(entry.Name(), "shard_%d", &sID); n == 1 {
-			if sID > maxShardFound {
-				maxShardFound = sID
-			}
+	meta, found, err := loadIndexMeta(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata for index %s: %w", name, err)
+	}
+	if !found {
+		meta, found, err = legacyIndexMeta(indexPath, m.defaultNumShards)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load settings for index %s: %w", name, err)
+		}
+		if !found {
+			return nil, fmt.Errorf("%w [%s]", ErrIndexNotFound, name)
+		}
+		if err := saveIndexMeta(indexPath, meta); err != nil {
+			return nil, err
 		}
 	}
-	if maxShardFound >= 0 {
-		numShards = maxShardFound + 1
+	return m.openIndex(name, meta)
+}
+
+// openIndex opens the shards of an index allocated to this node. The caller
+// must hold m.mu.
+func (m *Manager) openIndex(name string, meta IndexMeta) (*Index, error) {
+	indexPath := filepath.Join(m.basePath, name)
+	storeOpts, err := meta.Settings.storeOptions()
+	if err != nil {
+		return nil, fmt.Errorf("invalid settings for index %s: %w", name, err)
+	}
+	numShards := meta.NumberOfShards
+	// Indices written before the allocation table was kept are allocated
+	// where shards were placed then; the rebalancer moves them later.
+	if len(meta.Allocation) != numShards {
+		meta.Allocation = defaultAllocation(cluster.RoundRobinPlacement{}, m.Cluster, name, numShards, meta.Settings.NumberOfReplicas)
+		if err := saveIndexMeta(indexPath, meta); err != nil {
+			return nil, err
+		}
 	}
 
 	idx := &Index{
 		Name:      name,
 		numShards: numShards,
+		meta:      meta,
 		path:      indexPath,
 		Shards:    make(map[int]*store.Store),
+		Replicas:  make(map[int]*store.Store),
 		Mapping:   mapping.NewMapping(),
 		Cluster:   m.Cluster,
 		Forwarder: m.Forwarder,
+		handoffs:  make(map[int]time.Time),
 	}
 
 	// Load mapping if exists
@@ -107,17 +162,17 @@ func (m *Manager) OpenIndex(name string) (*Index, error) {
 	if data, err := os.ReadFile(mappingPath); err == nil {
 		json.Unmarshal(data, &idx.Mapping.Fields)
 	}
+	if meta.Settings.Mapping != nil {
+		for field, t := range meta.Settings.Mapping.FieldTypes() {
+			idx.Mapping.Fields[field] = t
+		}
+	}
 
-	// Only open shards owned by this node
-	for i := 0; i < numShards; i++ {
-		owner := m.Cluster.GetShardOwner(name, i, numShards)
-		if m.Cluster.IsLocal(owner) {
-			shardPath := filepath.Join(indexPath, fmt.Sprintf("shard_%d", i))
-			s, err := store.Open(shardPath, true)
-			if err != nil {
-				return nil, err
-			}
-			idx.Shards[i] = s
+	// Only open shards allocated to this node, and none of a closed index.
+	if !meta.closed() {
+		if err := idx.allocateShards(meta, storeOpts); err != nil {
+			idx.closeShards()
+			return nil, err
 		}
 	}
 
@@ -125,32 +180,38 @@ func (m *Manager) OpenIndex(name string) (*Index, error) {
 	return idx, nil
 }
 
-func (m *Manager) CreateIndex(name string, numShards int, forward bool) (*Index, error) {
-	m.mu.Lock()
-	if _, ok := m.indices[name]; ok {
-		m.mu.Unlock()
-		return m.indices[name], nil
+// CreateIndex creates an index with new metadata and, when forward is set,
+// sends that metadata to every other node. It fails with ErrIndexExists if
+// the index already exists.
+func (m *Manager) CreateIndex(name string, settings Settings, forward bool) (*Index, error) {
+	if idx := m.GetIndex(name); idx != nil {
+		return nil, fmt.Errorf("%w [%s]", ErrIndexExists, name)
 	}
-	m.mu.Unlock()
 
-	if numShards <= 0 {
-		numShards = m.defaultNumShards
+	if settings.NumberOfShards <= 0 {
+		settings.NumberOfShards = m.defaultNumShards
 	}
-
-	indexPath := filepath.Join(m.basePath, name)
-	if err := os.MkdirAll(indexPath, 0755); err != nil {
+	if err := settings.Validate(); err != nil {
 		return nil, err
 	}
+	meta, err := newIndexMeta(settings)
+	if err != nil {
+		return nil, err
+	}
+	meta.Allocation = defaultAllocation(m.Cluster.ShardPlacement(), m.Cluster, name, settings.NumberOfShards, settings.NumberOfReplicas)
 
-	idx, err := m.OpenIndex(name)
+	idx, err := m.createIndex(name, meta)
 	if err != nil {
 		return nil, err
 	}
 
 	if forward {
+		meta := idx.Meta()
 		for _, node := range m.Cluster.Nodes {
 			if !m.Cluster.IsLocal(node) {
-				m.Forwarder.ForwardCreateIndex(node, name, numShards)
+				if err := m.Forwarder.ForwardCreateIndex(context.Background(), node, name, meta); err != nil {
+					fmt.Printf("Failed to create index %s on node %s: %v\n", name, node.ID, err)
+				}
 			}
 		}
 	}
@@ -158,6 +219,51 @@ func (m *Manager) CreateIndex(name string, numShards int, forward bool) (*Index,
 	return idx, nil
 }
 
+// createIndex creates the index with the given metadata, unless this node
+// already has metadata for it, which then wins. An index that is loaded
+// with another UUID is reported as ErrIndexExists.
+func (m *Manager) createIndex(name string, meta IndexMeta) (*Index, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if idx, ok := m.indices[name]; ok {
+		if idx.Meta().UUID != meta.UUID {
+			return nil, fmt.Errorf("%w [%s] with uuid %s", ErrIndexExists, name, idx.Meta().UUID)
+		}
+		return idx, nil
+	}
+
+	indexPath := filepath.Join(m.basePath, name)
+	if err := os.MkdirAll(indexPath, 0755); err != nil {
+		return nil, err
+	}
+	existing, found, err := loadIndexMeta(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		meta = existing
+	} else if err := saveIndexMeta(indexPath, meta); err != nil {
+		return nil, err
+	}
+	return m.openIndex(name, meta)
+}
+
+// syncIndex creates an index that this node does not have from the metadata
+// of the first other node that has it, for nodes that missed its creation.
+func (m *Manager) syncIndex(name string) (*Index, error) {
+	for _, node := range m.Cluster.Nodes {
+		if m.Cluster.IsLocal(node) {
+			continue
+		}
+		meta, err := m.Forwarder.ForwardIndexMeta(context.Background(), node, name)
+		if err != nil || meta == nil {
+			continue
+		}
+		return m.createIndex(name, *meta)
+	}
+	return nil, fmt.Errorf("%w [%s]", ErrIndexNotFound, name)
+}
+
 func (m *Manager) GetIndex(name string) *Index {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -184,125 +290,413 @@ func (idx *Index) saveMapping() {
 	os.WriteFile(mappingPath, data, 0644)
 }
 
+// Settings returns the settings the index was created with.
+func (idx *Index) Settings() Settings {
+	return idx.Meta().Settings
+}
+
+// GetShardID returns the shard of a document placed by its ID.
 func (idx *Index) GetShardID(id string) int {
-	hash := crc32.ChecksumIEEE([]byte(id))
+	return idx.ShardID(id, "")
+}
+
+// ShardID returns the shard of a document: the hash of its routing key, or
+// of its ID if it has none.
+func (idx *Index) ShardID(id, routing string) int {
+	key := id
+	if routing != "" {
+		key = routing
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
 	return int(hash % uint32(idx.numShards))
 }
 
-func (idx *Index) Index(id string, data map[string]interface{}) error {
+// Index writes the document on the primary of its shard. A write that
+// reaches the primary while it hands the shard off to another node is
+// retried until it reaches the new primary. When ctx is done before the
+// primary answers, the write may or may not have been made.
+func (idx *Index) Index(ctx context.Context, id string, data map[string]interface{}, opts store.WriteOptions) (store.WriteResult, error) {
+	var res store.WriteResult
+	err := retryRelocating(ctx, func() (err error) {
+		res, err = idx.index(ctx, id, data, opts)
+		return err
+	})
+	return res, err
+}
+
+// index writes the document once, see Index.
+func (idx *Index) index(ctx context.Context, id string, data map[string]interface{}, opts store.WriteOptions) (store.WriteResult, error) {
+	if err := idx.checkWrite(); err != nil {
+		return store.WriteResult{ID: id}, err
+	}
+	if err := idx.checkRouting(id, opts.Routing); err != nil {
+		return store.WriteResult{ID: id}, err
+	}
 	if idx.Mapping.Sniff(data) {
-		idx.saveMapping()
+		idx.mappingChanged()
 	}
-	shardID := idx.GetShardID(id)
-	owner := idx.Cluster.GetShardOwner(idx.Name, shardID, idx.numShards)
+	shardID := idx.ShardID(id, opts.Routing)
+	owner := idx.shardOwner(shardID)
 
 	if idx.Cluster.IsLocal(owner) {
-		return idx.Shards[shardID].Index(id, data)
+		return idx.localIndex(shardID, id, data, opts)
 	}
-	return idx.Forwarder.ForwardIndex(owner, idx.Name, id, data)
+	return idx.Forwarder.ForwardIndex(ctx, owner, idx.Name, id, data, opts)
 }
 
-func (idx *Index) BatchIndex(ids []string, data []map[string]interface{}) error {
-	// Split batch into local vs remote groups
-	nodeGroupsIds := make(map[string][]string)
-	nodeGroupsData := make(map[string][]map[string]interface{})
+// localIndex writes the document on the local primary of shard sID.
+func (idx *Index) localIndex(sID int, id string, data map[string]interface{}, opts store.WriteOptions) (store.WriteResult, error) {
+	var res store.WriteResult
+	shards, err := idx.writeShard(sID, opts.WaitForActiveShards, func(s *store.Store) (err error) {
+		res, err = s.Index(id, data, opts)
+		return err
+	})
+	if err != nil {
+		res.ID = id
+	}
+	res.Shards = shards
+	return res, err
+}
 
-	for i, id := range ids {
-		d := data[i]
-		if idx.Mapping.Sniff(d) {
-			idx.saveMapping()
+// LocalIndex writes the document like Index if this node holds the primary
+// of its shard, and fails otherwise instead of forwarding it.
+func (idx *Index) LocalIndex(id string, data map[string]interface{}, opts store.WriteOptions) (store.WriteResult, error) {
+	if err := idx.checkWrite(); err != nil {
+		return store.WriteResult{ID: id}, err
+	}
+	if err := idx.checkRouting(id, opts.Routing); err != nil {
+		return store.WriteResult{ID: id}, err
+	}
+	if idx.Mapping.Sniff(data) {
+		idx.mappingChanged()
+	}
+	return idx.localIndex(idx.ShardID(id, opts.Routing), id, data, opts)
+}
+
+// BatchIndex indexes the documents and returns one result per document;
+// failures are reported through WriteResult.Err. opts may be nil or hold one
+// entry per document. Documents that belong to the same shard and pass their
+// version checks are committed atomically, so they succeed or fail together.
+// Documents of a shard that is handed off to another node are retried as
+// Index does.
+func (idx *Index) BatchIndex(ctx context.Context, ids []string, data []map[string]interface{}, opts []store.WriteOptions) []store.WriteResult {
+	results := idx.batchIndex(ctx, ids, data, opts)
+	retryRelocating(ctx, func() error {
+		var retry []int
+		for i, res := range results {
+			if errors.Is(res.Err, ErrShardRelocating) {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 {
+			return nil
+		}
+		rIds, rData, rOpts := batchSubset(ids, data, opts, retry)
+		for j, res := range idx.batchIndex(ctx, rIds, rData, rOpts) {
+			results[retry[j]] = res
+		}
+		return ErrShardRelocating
+	})
+	return results
+}
+
+// batchIndex indexes the documents once, see BatchIndex.
+func (idx *Index) batchIndex(ctx context.Context, ids []string, data []map[string]interface{}, opts []store.WriteOptions) []store.WriteResult {
+	results := make([]store.WriteResult, len(ids))
+	if len(ids) != len(data) || (opts != nil && len(opts) != len(ids)) {
+		err := fmt.Errorf("batch has %d ids, %d documents and %d options", len(ids), len(data), len(opts))
+		for i := range results {
+			results[i] = store.WriteResult{ID: ids[i], Err: err}
+		}
+		return results
+	}
+	if err := idx.checkWrite(); err != nil {
+		for i := range results {
+			results[i] = store.WriteResult{ID: ids[i], Err: err}
 		}
-		shardID := idx.GetShardID(id)
-		owner := idx.Cluster.GetShardOwner(idx.Name, shardID, idx.numShards)
+		return results
+	}
 
-		nodeGroupsIds[owner.ID] = append(nodeGroupsIds[owner.ID], id)
-		nodeGroupsData[owner.ID] = append(nodeGroupsData[owner.ID], d)
+	// Split batch into local vs remote groups, remembering each document's
+	// position so results can be reported against it.
+	nodeGroups := make(map[string][]int)
+	for i, id := range ids {
+		routing := batchRouting(opts, i)
+		if err := idx.checkRouting(id, routing); err != nil {
+			results[i] = store.WriteResult{ID: id, Err: err}
+			continue
+		}
+		if idx.Mapping.Sniff(data[i]) {
+			idx.mappingChanged()
+		}
+		shardID := idx.ShardID(id, routing)
+		owner := idx.shardOwner(shardID)
+		nodeGroups[owner.ID] = append(nodeGroups[owner.ID], i)
 	}
 
 	var wg sync.WaitGroup
-	var mu sync.Mutex
-	var finalErr error
-
-	for nodeID, gIds := range nodeGroupsIds {
+	for nodeID, positions := range nodeGroups {
 		nodeID := nodeID
-		gIds := gIds
-		gData := nodeGroupsData[nodeID]
+		positions := positions
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			var err error
-			node, _ := idx.Cluster.GetNodeByID(nodeID)
-			if idx.Cluster.IsLocal(node) {
-				// Internal batch split by shard
-				shardGroupsIds := make(map[int][]string)
-				shardGroupsData := make(map[int][]map[string]interface{})
-				for j, id := range gIds {
-					sID := idx.GetShardID(id)
-					shardGroupsIds[sID] = append(shardGroupsIds[sID], id)
-					shardGroupsData[sID] = append(shardGroupsData[sID], gData[j])
-				}
-				for sID, sIds := range shardGroupsIds {
-					err = idx.Shards[sID].BatchIndex(sIds, shardGroupsData[sID])
-					if err != nil {
-						break
-					}
+			node, err := idx.Cluster.GetNodeByID(nodeID)
+			if err != nil {
+				for _, p := range positions {
+					results[p] = store.WriteResult{ID: ids[p], Err: err}
 				}
-			} else {
-				err = idx.Forwarder.ForwardBatchIndex(node, idx.Name, gIds, gData)
+				return
 			}
 
-			if err != nil {
-				mu.Lock()
-				finalErr = err
-				mu.Unlock()
+			if idx.Cluster.IsLocal(node) {
+				idx.localBatchIndex(ids, data, opts, positions, results)
+				return
+			}
+
+			gIds, gData, gOpts := batchSubset(ids, data, opts, positions)
+			remote, err := idx.Forwarder.ForwardBatchIndex(ctx, node, idx.Name, gIds, gData, gOpts)
+			for j, p := range positions {
+				switch {
+				case err != nil:
+					results[p] = store.WriteResult{ID: ids[p], Err: err}
+				case j < len(remote):
+					results[p] = remote[j]
+				default:
+					results[p] = store.WriteResult{ID: ids[p], Err: fmt.Errorf("missing result from node %s", nodeID)}
+				}
 			}
 		}()
 	}
 	wg.Wait()
-	return finalErr
+	return results
+}
+
+// batchSubset picks the documents at positions out of a batch.
+func batchSubset(ids []string, data []map[string]interface{}, opts []store.WriteOptions, positions []int) ([]string, []map[string]interface{}, []store.WriteOptions) {
+	gIds := make([]string, len(positions))
+	gData := make([]map[string]interface{}, len(positions))
+	var gOpts []store.WriteOptions
+	if opts != nil {
+		gOpts = make([]store.WriteOptions, len(positions))
+	}
+	for j, p := range positions {
+		gIds[j] = ids[p]
+		gData[j] = data[p]
+		if opts != nil {
+			gOpts[j] = opts[p]
+		}
+	}
+	return gIds, gData, gOpts
+}
+
+// localBatchIndex commits the documents at positions, which must all belong
+// to local shards, with one store batch per shard.
+func (idx *Index) localBatchIndex(ids []string, data []map[string]interface{}, opts []store.WriteOptions, positions []int, results []store.WriteResult) {
+	shardGroups := make(map[int][]int)
+	for _, p := range positions {
+		sID := idx.ShardID(ids[p], batchRouting(opts, p))
+		shardGroups[sID] = append(shardGroups[sID], p)
+	}
+	for sID, sPositions := range shardGroups {
+		sIds, sData, sOpts := batchSubset(ids, data, opts, sPositions)
+		var res []store.WriteResult
+		shards, err := idx.writeShard(sID, batchWait(sOpts), func(s *store.Store) (err error) {
+			res, err = s.BatchIndex(sIds, sData, sOpts)
+			return err
+		})
+		for j, p := range sPositions {
+			if res == nil {
+				results[p] = store.WriteResult{ID: ids[p], Err: err}
+			} else {
+				results[p] = res[j]
+				results[p].Shards = shards
+			}
+		}
+	}
+}
+
+// batchRouting returns the routing key of document i of a batch.
+func batchRouting(opts []store.WriteOptions, i int) string {
+	if opts == nil {
+		return ""
+	}
+	return opts[i].Routing
+}
+
+// batchWait returns how many active copies a batch waits for, as asked by
+// its first document.
+func batchWait(opts []store.WriteOptions) int {
+	if len(opts) == 0 {
+		return 0
+	}
+	return opts[0].WaitForActiveShards
+}
+
+// LocalBatchIndex indexes documents into the shards held by this node only.
+// Documents whose shard is not local are reported as errors.
+func (idx *Index) LocalBatchIndex(ids []string, data []map[string]interface{}, opts []store.WriteOptions) []store.WriteResult {
+	results := make([]store.WriteResult, len(ids))
+	if err := idx.checkWrite(); err != nil {
+		for i := range results {
+			results[i] = store.WriteResult{ID: ids[i], Err: err}
+		}
+		return results
+	}
+	positions := make([]int, len(ids))
+	for i := range positions {
+		positions[i] = i
+	}
+	idx.localBatchIndex(ids, data, opts, positions, results)
+	return results
 }
 
-func (idx *Index) Get(id string) (map[string]interface{}, error) {
-	shardID := idx.GetShardID(id)
-	owner := idx.Cluster.GetShardOwner(idx.Name, shardID, idx.numShards)
+// Get returns the document with the given ID and routing key, or nil if
+// it does not exist. It is read from a replica if the primary of its shard
+// cannot be reached.
+func (idx *Index) Get(ctx context.Context, id, routing string) (*store.Document, error) {
+	if err := idx.checkRead(); err != nil {
+		return nil, err
+	}
+	if err := idx.checkRouting(id, routing); err != nil {
+		return nil, err
+	}
+	var doc *store.Document
+	err := idx.readShard(idx.ShardID(id, routing), func(s *store.Store) (err error) {
+		doc, err = s.Get(id)
+		return err
+	}, func(node cluster.Node) (err error) {
+		doc, err = idx.Forwarder.ForwardGet(ctx, node, idx.Name, id, routing)
+		return err
+	})
+	return doc, err
+}
+
+// Update applies req to the document on the node owning its shard, so the
+// read and the write are atomic. It is retried like Index.
+func (idx *Index) Update(ctx context.Context, id string, req store.UpdateRequest, opts store.WriteOptions) (store.WriteResult, error) {
+	var res store.WriteResult
+	err := retryRelocating(ctx, func() (err error) {
+		res, err = idx.update(ctx, id, req, opts)
+		return err
+	})
+	return res, err
+}
+
+// update applies req once, see Update.
+func (idx *Index) update(ctx context.Context, id string, req store.UpdateRequest, opts store.WriteOptions) (store.WriteResult, error) {
+	if err := idx.checkWrite(); err != nil {
+		return store.WriteResult{ID: id}, err
+	}
+	if err := idx.checkRouting(id, opts.Routing); err != nil {
+		return store.WriteResult{ID: id}, err
+	}
+	for _, doc := range []map[string]interface{}{req.Doc, req.Upsert} {
+		if doc != nil && idx.Mapping.Sniff(doc) {
+			idx.mappingChanged()
+		}
+	}
+	shardID := idx.ShardID(id, opts.Routing)
+	owner := idx.shardOwner(shardID)
 
 	if idx.Cluster.IsLocal(owner) {
-		return idx.Shards[shardID].Get(id)
+		var res store.WriteResult
+		shards, err := idx.writeShard(shardID, opts.WaitForActiveShards, func(s *store.Store) (err error) {
+			res, err = s.Update(id, req, opts)
+			return err
+		})
+		if err != nil {
+			res.ID = id
+		}
+		res.Shards = shards
+		return res, err
 	}
-	return idx.Forwarder.ForwardGet(owner, idx.Name, id)
+	return idx.Forwarder.ForwardUpdate(ctx, owner, idx.Name, id, req, opts)
 }
 
-func (idx *Index) Delete(id string) error {
-	shardID := idx.GetShardID(id)
-	owner := idx.Cluster.GetShardOwner(idx.Name, shardID, idx.numShards)
+// GetAsOf returns the document as it was at asOf, or nil if it did not exist
+// then.
+func (idx *Index) GetAsOf(ctx context.Context, id, routing string, asOf time.Time) (*store.Document, error) {
+	if err := idx.checkRead(); err != nil {
+		return nil, err
+	}
+	if err := idx.checkRouting(id, routing); err != nil {
+		return nil, err
+	}
+	var doc *store.Document
+	err := idx.readShard(idx.ShardID(id, routing), func(s *store.Store) (err error) {
+		doc, err = s.GetAsOf(id, asOf)
+		return err
+	}, func(node cluster.Node) (err error) {
+		doc, err = idx.Forwarder.ForwardGetAsOf(ctx, node, idx.Name, id, routing, asOf)
+		return err
+	})
+	return doc, err
+}
+
+// Delete deletes the document on the primary of its shard. It is retried
+// like Index.
+func (idx *Index) Delete(ctx context.Context, id string, opts store.WriteOptions) (store.WriteResult, error) {
+	var res store.WriteResult
+	err := retryRelocating(ctx, func() (err error) {
+		res, err = idx.delete(ctx, id, opts)
+		return err
+	})
+	return res, err
+}
+
+// delete deletes the document once, see Delete.
+func (idx *Index) delete(ctx context.Context, id string, opts store.WriteOptions) (store.WriteResult, error) {
+	if err := idx.checkWrite(); err != nil {
+		return store.WriteResult{ID: id}, err
+	}
+	if err := idx.checkRouting(id, opts.Routing); err != nil {
+		return store.WriteResult{ID: id}, err
+	}
+	shardID := idx.ShardID(id, opts.Routing)
+	owner := idx.shardOwner(shardID)
 
 	if idx.Cluster.IsLocal(owner) {
-		return idx.Shards[shardID].Delete(id)
+		var res store.WriteResult
+		shards, err := idx.writeShard(shardID, opts.WaitForActiveShards, func(s *store.Store) (err error) {
+			res, err = s.Delete(id, opts)
+			return err
+		})
+		if err != nil {
+			res.ID = id
+		}
+		res.Shards = shards
+		return res, err
 	}
-	return idx.Forwarder.ForwardDelete(owner, idx.Name, id)
+	return idx.Forwarder.ForwardDelete(ctx, owner, idx.Name, id, opts)
 }
 
-func (idx *Index) Search(req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+// Search runs req on every shard and merges the results. With routing keys
+// only the shards they route to are searched. The shards of a node that
+// cannot be reached, or does not answer in time, are searched on their
+// replicas. The search is given up when ctx is done.
+func (idx *Index) Search(ctx context.Context, req *bleve.SearchRequest, routing []string) (*bleve.SearchResult, error) {
+	if err := idx.checkRead(); err != nil {
+		return nil, err
+	}
 	// Distributed Search: Fan-out to all nodes in the cluster
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var finalResult *bleve.SearchResult
 	var finalErr error
 
-	for _, node := range idx.Cluster.Nodes {
-		node := node
+	shards := idx.routedShards(routing)
+	if shards == nil {
+		shards = idx.ownedShards()
+	}
+	for nodeID, sIDs := range shards {
+		node := idx.node(nodeID)
+		sIDs := sIDs
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			var res *bleve.SearchResult
-			var err error
-
-			if idx.Cluster.IsLocal(node) {
-				res, err = idx.LocalSearch(req)
-			} else {
-				res, err = idx.Forwarder.ForwardSearch(node, idx.Name, req)
-			}
+			res, err := idx.searchShards(ctx, req, node, sIDs, nil)
 
 			mu.Lock()
 			defer mu.Unlock()
@@ -328,22 +722,89 @@ func (idx *Index) Search(req *bleve.SearchRequest) (*bleve.SearchResult, error)
 	return finalResult, nil
 }
 
-func (idx *Index) LocalSearch(req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+// searchShards runs req on the copies of shards held by node. If node
+// cannot be reached, the shards are searched on their next copies on the
+// nodes not in failed.
+func (idx *Index) searchShards(ctx context.Context, req *bleve.SearchRequest, node cluster.Node, shards []int, failed map[string]bool) (*bleve.SearchResult, error) {
+	var res *bleve.SearchResult
+	var err error
+	if idx.Cluster.IsLocal(node) {
+		res, err = idx.LocalSearch(ctx, req, shards)
+	} else {
+		res, err = idx.Forwarder.ForwardSearch(ctx, node, idx.Name, req, shards)
+	}
+	if !errors.Is(err, ErrNodeUnavailable) {
+		return res, err
+	}
+
+	tried := map[string]bool{node.ID: true}
+	for id := range failed {
+		tried[id] = true
+	}
+	next := make(map[string][]int)
+	for _, sID := range shards {
+		found := false
+		for _, n := range idx.shardCopies(sID) {
+			if !tried[n.ID] {
+				next[n.ID] = append(next[n.ID], sID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, err
+		}
+	}
+	var merged *bleve.SearchResult
+	for nodeID, sIDs := range next {
+		res, err := idx.searchShards(ctx, req, idx.node(nodeID), sIDs, tried)
+		if err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = res
+		} else {
+			merged.Merge(res)
+		}
+	}
+	return merged, nil
+}
+
+// LocalSearch runs req on the given local shards, primaries or replicas, or
+// on all local primaries if shards is nil.
+func (idx *Index) LocalSearch(ctx context.Context, req *bleve.SearchRequest, shards []int) (*bleve.SearchResult, error) {
+	if err := idx.checkRead(); err != nil {
+		return nil, err
+	}
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
+	selected := idx.Shards
+	if shards != nil {
+		selected = make(map[int]*store.Store, len(shards))
+		for _, sID := range shards {
+			s, ok := idx.Shards[sID]
+			if !ok {
+				if s, ok = idx.Replicas[sID]; !ok {
+					return nil, fmt.Errorf("shard %d of index %s is not local", sID, idx.Name)
+				}
+			}
+			selected[sID] = s
+		}
+	}
+
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	results := make(map[int]*bleve.SearchResult)
 	errors := make(map[int]error)
 
-	for sID, s := range idx.Shards {
+	for sID, s := range selected {
 		sID := sID
 		s := s
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			res, err := s.Search(req)
+			res, err := s.SearchContext(ctx, req)
 			mu.Lock()
 			results[sID] = res
 			errors[sID] = err
@@ -372,11 +833,108 @@ func (idx *Index) LocalSearch(req *bleve.SearchRequest) (*bleve.SearchResult, er
 	return finalResult, nil
 }
 
+// LocalHealth reports the health of the shards held by this node.
+func (idx *Index) LocalHealth() map[int]store.Health {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	health := make(map[int]store.Health, len(idx.Shards))
+	for sID, s := range idx.Shards {
+		health[sID] = s.Health()
+	}
+	return health
+}
+
+// Health reports the health of every shard of the index. Shards whose owner
+// cannot be reached are reported red.
+func (idx *Index) Health() map[int]store.Health {
+	health := make(map[int]store.Health, idx.numShards)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range idx.Cluster.Nodes {
+		node := node
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var res map[int]store.Health
+			var err error
+			if idx.Cluster.IsLocal(node) {
+				res = idx.LocalHealth()
+			} else {
+				res, err = idx.Forwarder.ForwardHealth(context.Background(), node, idx.Name)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for sID, h := range res {
+				health[sID] = h
+			}
+			if err != nil {
+				for i := 0; i < idx.numShards; i++ {
+					if idx.shardOwner(i).ID == node.ID {
+						health[i] = store.Health{Status: store.HealthRed, LastError: err.Error()}
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return health
+}
+
+// LocalStats reports the size of the shards held by this node.
+func (idx *Index) LocalStats() (map[int]store.Stats, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	stats := make(map[int]store.Stats, len(idx.Shards))
+	for sID, s := range idx.Shards {
+		st, err := s.Stats()
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", sID, err)
+		}
+		stats[sID] = st
+	}
+	return stats, nil
+}
+
+// Stats collects the stats of every shard of the index. Shards that could
+// not be reached are missing from the result.
+func (idx *Index) Stats() map[int]store.Stats {
+	stats := make(map[int]store.Stats, idx.numShards)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range idx.Cluster.Nodes {
+		node := node
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var res map[int]store.Stats
+			var err error
+			if idx.Cluster.IsLocal(node) {
+				res, err = idx.LocalStats()
+			} else {
+				res, err = idx.Forwarder.ForwardStats(context.Background(), node, idx.Name)
+			}
+			if err != nil {
+				fmt.Printf("Failed to get stats of index %s from node %s: %v\n", idx.Name, node.ID, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for sID, st := range res {
+				stats[sID] = st
+			}
+		}()
+	}
+	wg.Wait()
+	return stats
+}
+
 func (idx *Index) Close() error {
 	idx.saveMapping()
-	for _, s := range idx.Shards {
-		if err := s.Close(); err != nil {
-			return err
+	for _, stores := range []map[int]*store.Store{idx.Shards, idx.Replicas} {
+		for _, s := range stores {
+			if err := s.Close(); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -385,16 +943,26 @@ func (idx *Index) Close() error {
 func (m *Manager) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
 	for _, idx := range m.indices {
 		idx.Close()
 	}
+	m.Forwarder.Close()
 	return nil
 }
 
 func (idx *Index) GetMetadata() Metadata {
+	meta := idx.Meta()
 	md := Metadata{
-		NumShards: idx.numShards,
-		Shards:    make([]string, idx.numShards),
+		UUID:           meta.UUID,
+		CreationDate:   meta.CreationDate,
+		MappingVersion: meta.MappingVersion,
+		NumShards:      idx.numShards,
+		Shards:         make([]string, idx.numShards),
 	}
 	for i := 0; i < idx.numShards; i++ {
 		md.Shards[i] = fmt.Sprintf("shard_%d", i)
@@ -403,6 +971,9 @@ func (idx *Index) GetMetadata() Metadata {
 }
 
 type Metadata struct {
-	NumShards int      `json:"num_shards"`
-	Shards    []string `json:"shards"`
+	UUID           string   `json:"uuid"`
+	CreationDate   int64    `json:"creation_date"`
+	MappingVersion uint64   `json:"mapping_version"`
+	NumShards      int      `json:"num_shards"`
+	Shards         []string `json:"shards"`
 }
@@ -2,8 +2,21 @@ package shard
 
 import (
 	"breeze/internal/cluster"
+	"breeze/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/blevesearch/bleve/v2"
 )
@@ -19,10 +32,13 @@ func TestManager(t *testing.T) {
 	}
 	defer m.Close()
 
-	idx, err := m.CreateIndex("testindex", 3, true)
+	idx, err := m.CreateIndex("testindex", Settings{NumberOfShards: 3}, true)
 	if err != nil {
 		t.Fatalf("failed to create index: %v", err)
 	}
+	if _, err := m.CreateIndex("testindex", Settings{}, true); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("expected ErrIndexExists, got %v", err)
+	}
 
 	docs := []map[string]interface{}{
 		{"id": "1", "name": "Apple"},
@@ -32,7 +48,7 @@ func TestManager(t *testing.T) {
 	}
 
 	for _, doc := range docs {
-		if err := idx.Index(doc["id"].(string), doc); err != nil {
+		if _, err := idx.Index(context.Background(), doc["id"].(string), doc, store.WriteOptions{}); err != nil {
 			t.Errorf("failed to index doc %s: %v", doc["id"], err)
 		}
 	}
@@ -40,7 +56,7 @@ func TestManager(t *testing.T) {
 	// Search
 	query := bleve.NewMatchQuery("Apple")
 	req := bleve.NewSearchRequest(query)
-	res, err := idx.Search(req)
+	res, err := idx.Search(context.Background(), req, nil)
 	if err != nil {
 		t.Fatalf("search failed: %v", err)
 	}
@@ -49,3 +65,1162 @@ func TestManager(t *testing.T) {
 		t.Errorf("expected 1 hit, got %d", res.Total)
 	}
 }
+
+func TestDeleteIndex(t *testing.T) {
+	path := "test_delete_index"
+	defer os.RemoveAll(path)
+
+	addr2 := freeAddr(t)
+	nodes := []string{"node1=127.0.0.1:1", "node2=" + addr2}
+
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	if err := NewClusterServer(m2, addr2).Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+
+	idx, err := m1.CreateIndex("logs", Settings{NumberOfShards: 2}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("%d", i)
+		if _, err := idx.Index(context.Background(), id, map[string]interface{}{"n": i}, store.WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc %s: %v", id, err)
+		}
+	}
+
+	res, err := m1.DeleteIndex("logs", true)
+	if err != nil || !res.Found || len(res.Failed) != 0 || !reflect.DeepEqual(res.Acknowledged, []string{"node1", "node2"}) {
+		t.Fatalf("unexpected delete result %+v, %v", res, err)
+	}
+	for _, m := range []*Manager{m1, m2} {
+		if m.GetIndex("logs") != nil {
+			t.Errorf("index still loaded on %s", m.Cluster.SelfID)
+		}
+		if _, err := os.Stat(filepath.Join(m.basePath, "logs")); !os.IsNotExist(err) {
+			t.Errorf("index directory still exists on %s: %v", m.Cluster.SelfID, err)
+		}
+	}
+
+	res, err = m1.DeleteIndex("logs", true)
+	if err != nil || res.Found || len(res.Acknowledged) != 2 {
+		t.Errorf("expected deleting again to be acknowledged, got %+v, %v", res, err)
+	}
+	if _, err := m1.DeleteIndex("..", true); !errors.Is(err, ErrInvalidIndexName) {
+		t.Errorf("expected ErrInvalidIndexName, got %v", err)
+	}
+}
+
+// freeAddr returns a local address that nothing listens on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to pick a port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestIndexMeta(t *testing.T) {
+	path := "test_index_meta"
+	defer os.RemoveAll(path)
+
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	nodes := []string{"node1=" + addr1, "node2=" + addr2}
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	if err := NewClusterServer(m1, addr1).Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+
+	// node2 is down while the index is created, and learns its metadata
+	// from node1 when it is first asked for one of its shards.
+	idx, err := m1.CreateIndex("logs", Settings{NumberOfShards: 4}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	if err := NewClusterServer(m2, addr2).Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		id := fmt.Sprintf("%d", i)
+		if _, err := idx.Index(context.Background(), id, map[string]interface{}{"n": i}, store.WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc %s: %v", id, err)
+		}
+	}
+	remote := m2.GetIndex("logs")
+	if remote == nil {
+		t.Fatalf("expected node2 to have created the index")
+	}
+	if got, want := remote.Meta(), idx.Meta(); got.UUID != want.UUID || got.NumberOfShards != 4 || got.CreationDate != want.CreationDate {
+		t.Errorf("node2 metadata %+v differs from node1 metadata %+v", got, want)
+	}
+	for i := 0; i < 8; i++ {
+		id := fmt.Sprintf("%d", i)
+		if doc, err := remote.Get(context.Background(), id, ""); err != nil || doc == nil {
+			t.Errorf("failed to get doc %s through node2: %v", id, err)
+		}
+	}
+	if idx.Meta().MappingVersion == 0 {
+		t.Errorf("expected the mapping version to count the new field")
+	}
+
+	// An index written before index.json existed gets its shard count
+	// from its shard directories.
+	legacy := filepath.Join(m1.basePath, "legacy")
+	for i := 0; i < 3; i++ {
+		os.MkdirAll(filepath.Join(legacy, fmt.Sprintf("shard_%d", i)), 0755)
+	}
+	old, err := m1.OpenIndex("legacy")
+	if err != nil || old.Meta().NumberOfShards != 3 {
+		t.Fatalf("expected the legacy index to open with 3 shards, got %v", err)
+	}
+	if _, found, _ := loadIndexMeta(legacy); !found {
+		t.Errorf("expected the legacy index to get an index.json")
+	}
+	if _, err := m1.OpenIndex("missing"); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("expected ErrIndexNotFound, got %v", err)
+	}
+}
+
+func TestIndexLifecycle(t *testing.T) {
+	path := "test_index_lifecycle"
+	defer os.RemoveAll(path)
+
+	addr2 := freeAddr(t)
+	nodes := []string{"node1=127.0.0.1:1", "node2=" + addr2}
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	if err := NewClusterServer(m2, addr2).Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+
+	idx, err := m1.CreateIndex("logs", Settings{NumberOfShards: 4}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("%d", i)
+		if _, err := idx.Index(context.Background(), id, map[string]interface{}{"n": i}, store.WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc %s: %v", id, err)
+		}
+	}
+
+	yes, no := true, false
+	if err := m1.UpdateBlocks("logs", BlocksUpdate{Write: &yes}); err != nil {
+		t.Fatalf("failed to set write block: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("%d", i)
+		if _, err := idx.Index(context.Background(), id, map[string]interface{}{"n": 0}, store.WriteOptions{}); !errors.Is(err, ErrIndexBlocked) {
+			t.Errorf("expected ErrIndexBlocked indexing doc %s, got %v", id, err)
+		}
+	}
+	if doc, err := idx.Get(context.Background(), "1", ""); err != nil || doc == nil {
+		t.Errorf("expected reads to pass the write block, got %v, %v", doc, err)
+	}
+	if !m2.GetIndex("logs").Meta().Settings.Blocks.Write {
+		t.Errorf("write block not applied on node2")
+	}
+
+	// A recovered copy of a blocked index takes writes.
+	res, err := m1.RecoverIndex("logs", RecoverRequest{Dest: "logs-recovered", AsOf: time.Now()})
+	if err != nil || res.Docs != 10 {
+		t.Fatalf("expected 10 docs recovered, got %+v, %v", res, err)
+	}
+	recovered := m1.GetIndex("logs-recovered")
+	if _, err := recovered.Index(context.Background(), "1", map[string]interface{}{"n": 0}, store.WriteOptions{}); err != nil {
+		t.Errorf("failed to index into the recovered index: %v", err)
+	}
+	if _, err := m1.DeleteIndex("logs-recovered", true); err != nil {
+		t.Fatalf("failed to delete recovered index: %v", err)
+	}
+
+	if err := m1.UpdateBlocks("logs", BlocksUpdate{Write: &no, ReadOnly: &yes}); err != nil {
+		t.Fatalf("failed to set read_only block: %v", err)
+	}
+	if _, err := idx.Delete(context.Background(), "1", store.WriteOptions{}); !errors.Is(err, ErrIndexBlocked) {
+		t.Errorf("expected ErrIndexBlocked deleting, got %v", err)
+	}
+	if err := m1.CloseIndex("logs"); !errors.Is(err, ErrIndexBlocked) {
+		t.Errorf("expected a read-only index to refuse closing, got %v", err)
+	}
+	if _, err := m1.DeleteIndex("logs", true); !errors.Is(err, ErrIndexBlocked) {
+		t.Errorf("expected a read-only index to refuse deleting, got %v", err)
+	}
+	if err := m1.UpdateBlocks("logs", BlocksUpdate{ReadOnly: &no}); err != nil {
+		t.Fatalf("failed to clear read_only block: %v", err)
+	}
+
+	if err := m1.CloseIndex("logs"); err != nil {
+		t.Fatalf("failed to close index: %v", err)
+	}
+	for _, m := range []*Manager{m1, m2} {
+		if n := len(m.GetIndex("logs").Shards); n != 0 {
+			t.Errorf("%d shards still open on %s", n, m.Cluster.SelfID)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("%d", i)
+		if _, err := idx.Get(context.Background(), id, ""); !errors.Is(err, ErrIndexClosed) {
+			t.Errorf("expected ErrIndexClosed getting doc %s, got %v", id, err)
+		}
+		if _, err := idx.Index(context.Background(), id, map[string]interface{}{"n": 0}, store.WriteOptions{}); !errors.Is(err, ErrIndexClosed) {
+			t.Errorf("expected ErrIndexClosed indexing doc %s, got %v", id, err)
+		}
+	}
+	if _, err := idx.Search(context.Background(), bleve.NewSearchRequest(bleve.NewMatchAllQuery()), nil); !errors.Is(err, ErrIndexClosed) {
+		t.Errorf("expected ErrIndexClosed searching, got %v", err)
+	}
+
+	// The state survives a restart.
+	m1.Close()
+	m1, err = NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", nodes))
+	if err != nil {
+		t.Fatalf("failed to reopen manager: %v", err)
+	}
+	defer m1.Close()
+	if idx = m1.GetIndex("logs"); idx == nil || len(idx.Shards) != 0 {
+		t.Fatalf("expected a closed index after restart, got %v", idx)
+	}
+
+	if err := m1.ReopenIndex("logs"); err != nil {
+		t.Fatalf("failed to open index: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("%d", i)
+		doc, err := idx.Get(context.Background(), id, "")
+		if err != nil || doc == nil {
+			t.Errorf("doc %s lost after reopening: %v, %v", id, doc, err)
+		}
+	}
+}
+
+func TestResizeIndex(t *testing.T) {
+	path := "test_resize_index"
+	defer os.RemoveAll(path)
+
+	addr2 := freeAddr(t)
+	nodes := []string{"node1=127.0.0.1:1", "node2=" + addr2}
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	if err := NewClusterServer(m2, addr2).Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+
+	idx, err := m1.CreateIndex("logs", Settings{NumberOfShards: 2}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("%d", i)
+		if _, err := idx.Index(context.Background(), id, map[string]interface{}{"n": i}, store.WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc %s: %v", id, err)
+		}
+	}
+	if _, err := idx.Delete(context.Background(), "7", store.WriteOptions{}); err != nil {
+		t.Fatalf("failed to delete doc: %v", err)
+	}
+
+	// Writes keep coming until the split blocks them.
+	done := make(chan error)
+	go func() {
+		for i := 0; ; i++ {
+			id := fmt.Sprintf("%d", i%300)
+			_, err := idx.Index(context.Background(), id, map[string]interface{}{"n": i}, store.WriteOptions{})
+			if errors.Is(err, ErrIndexBlocked) {
+				done <- nil
+				return
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	if _, err := m1.SplitIndex("logs", ResizeRequest{Target: "logs_split", NumberOfShards: 3}); !errors.Is(err, ErrInvalidShardCount) {
+		t.Errorf("expected ErrInvalidShardCount, got %v", err)
+	}
+	res, err := m1.SplitIndex("logs", ResizeRequest{Target: "logs_split", NumberOfShards: 4})
+	if err != nil {
+		t.Fatalf("failed to split index: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("concurrent write failed: %v", err)
+	}
+	if res.Index != "logs_split" || res.Docs == 0 || res.Swapped {
+		t.Errorf("unexpected split result %+v", res)
+	}
+	if idx.Meta().Settings.Blocks.Write {
+		t.Errorf("expected the source to accept writes again")
+	}
+	split := m1.GetIndex("logs_split")
+	if split == nil || split.Meta().NumberOfShards != 4 || m2.GetIndex("logs_split") == nil {
+		t.Fatalf("split index missing or with the wrong number of shards")
+	}
+	for i := 0; i < 300; i++ {
+		id := fmt.Sprintf("%d", i)
+		want, err := idx.Get(context.Background(), id, "")
+		if err != nil {
+			t.Fatalf("failed to get doc %s: %v", id, err)
+		}
+		got, err := split.Get(context.Background(), id, "")
+		if err != nil {
+			t.Fatalf("failed to get split doc %s: %v", id, err)
+		}
+		if (want == nil) != (got == nil) || (want != nil && (want.Version != got.Version || !reflect.DeepEqual(want.Source, got.Source))) {
+			t.Errorf("doc %s differs after split: %+v, %+v", id, want, got)
+		}
+	}
+
+	res, err = m1.ShrinkIndex("logs_split", ResizeRequest{Target: "logs_small", NumberOfShards: 1, Swap: true})
+	if err != nil {
+		t.Fatalf("failed to shrink index: %v", err)
+	}
+	if res.Index != "logs_split" || !res.Swapped {
+		t.Errorf("unexpected shrink result %+v", res)
+	}
+	for _, m := range []*Manager{m1, m2} {
+		if m.GetIndex("logs_small") != nil {
+			t.Errorf("shrink target still loaded on %s", m.Cluster.SelfID)
+		}
+		if idx := m.GetIndex("logs_split"); idx == nil || idx.Meta().NumberOfShards != 1 {
+			t.Errorf("expected logs_split to have 1 shard on %s", m.Cluster.SelfID)
+		}
+	}
+	shrunk := m1.GetIndex("logs_split")
+	for i := 0; i < 300; i++ {
+		id := fmt.Sprintf("%d", i)
+		want, _ := idx.Get(context.Background(), id, "")
+		got, err := shrunk.Get(context.Background(), id, "")
+		if err != nil {
+			t.Fatalf("failed to get shrunk doc %s: %v", id, err)
+		}
+		if (want == nil) != (got == nil) {
+			t.Errorf("doc %s differs after shrink: %+v, %+v", id, want, got)
+		}
+	}
+	if _, err := shrunk.Index(context.Background(), "new", map[string]interface{}{"n": 1}, store.WriteOptions{}); err != nil {
+		t.Errorf("expected the swapped index to accept writes, got %v", err)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	path := "test_routing"
+	defer os.RemoveAll(path)
+
+	addr2 := freeAddr(t)
+	nodes := []string{"node1=127.0.0.1:1", "node2=" + addr2}
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	if err := NewClusterServer(m2, addr2).Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+
+	idx, err := m1.CreateIndex("tenants", Settings{NumberOfShards: 4, RoutingRequired: true}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	if _, err := idx.Index(context.Background(), "1", map[string]interface{}{"n": 1}, store.WriteOptions{}); !errors.Is(err, ErrRoutingMissing) {
+		t.Errorf("expected ErrRoutingMissing, got %v", err)
+	}
+
+	// Two keys routing to different shards.
+	a, b := "tenant-a", ""
+	for i := 0; b == ""; i++ {
+		if k := fmt.Sprintf("tenant-%d", i); idx.ShardID("", k) != idx.ShardID("", a) {
+			b = k
+		}
+	}
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("%d", i)
+		routing := a
+		if i%3 == 0 {
+			routing = b
+		}
+		if _, err := idx.Index(context.Background(), id, map[string]interface{}{"n": i}, store.WriteOptions{Routing: routing}); err != nil {
+			t.Fatalf("failed to index doc %s: %v", id, err)
+		}
+	}
+
+	doc, err := idx.Get(context.Background(), "1", a)
+	if err != nil || doc == nil || doc.Routing != a {
+		t.Fatalf("expected doc 1 with routing %s, got %+v, %v", a, doc, err)
+	}
+	if doc, _ := idx.Get(context.Background(), "1", b); doc != nil {
+		t.Errorf("expected no doc 1 with routing %s, got %+v", b, doc)
+	}
+
+	search := func(idx *Index, routing ...string) uint64 {
+		t.Helper()
+		res, err := idx.Search(context.Background(), bleve.NewSearchRequest(bleve.NewMatchAllQuery()), routing)
+		if err != nil {
+			t.Fatalf("search failed: %v", err)
+		}
+		return res.Total
+	}
+	if n := search(idx, a); n != 20 {
+		t.Errorf("expected 20 hits routed to %s, got %d", a, n)
+	}
+	if n := search(idx, b); n != 10 {
+		t.Errorf("expected 10 hits routed to %s, got %d", b, n)
+	}
+	if n := search(idx, a, b); n != 30 {
+		t.Errorf("expected 30 hits routed to both, got %d", n)
+	}
+	if n := search(idx); n != 30 {
+		t.Errorf("expected 30 hits without routing, got %d", n)
+	}
+
+	if _, err := idx.Delete(context.Background(), "1", store.WriteOptions{}); !errors.Is(err, ErrRoutingMissing) {
+		t.Errorf("expected ErrRoutingMissing, got %v", err)
+	}
+	if _, err := idx.Delete(context.Background(), "1", store.WriteOptions{Routing: a}); err != nil {
+		t.Fatalf("failed to delete doc: %v", err)
+	}
+
+	// Routing is kept when the documents are copied to a new layout.
+	if _, err := m1.SplitIndex("tenants", ResizeRequest{Target: "tenants_split", NumberOfShards: 8}); err != nil {
+		t.Fatalf("failed to split index: %v", err)
+	}
+	split := m1.GetIndex("tenants_split")
+	if split == nil || !split.Meta().Settings.RoutingRequired {
+		t.Fatalf("expected the split index to require routing")
+	}
+	for i := 2; i < 30; i++ {
+		id := fmt.Sprintf("%d", i)
+		routing := a
+		if i%3 == 0 {
+			routing = b
+		}
+		if doc, err := split.Get(context.Background(), id, routing); err != nil || doc == nil {
+			t.Errorf("expected split doc %s with routing %s, got %+v, %v", id, routing, doc, err)
+		}
+	}
+	if n := search(split, a); n != 19 {
+		t.Errorf("expected 19 split hits routed to %s, got %d", a, n)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	path := "test_replicas"
+	defer os.RemoveAll(path)
+
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	nodes := []string{"node1=" + addr1, "node2=" + addr2}
+	// Shard 0 is owned by node1 and shard 1 by node2.
+	c1 := cluster.NewCluster("node1", nodes)
+	c1.Placement = cluster.RoundRobinPlacement{}
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, c1)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	s1 := NewClusterServer(m1, addr1)
+	if err := s1.Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+	defer s1.Close()
+	s2 := NewClusterServer(m2, addr2)
+	if err := s2.Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+
+	idx, err := m1.CreateIndex("users", Settings{NumberOfShards: 2, NumberOfReplicas: 1}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	all := store.WriteOptions{WaitForActiveShards: store.ActiveShardsAll}
+	for i := 0; i < 40; i++ {
+		id := fmt.Sprintf("%d", i)
+		res, err := idx.Index(context.Background(), id, map[string]interface{}{"n": i}, all)
+		if err != nil {
+			t.Fatalf("failed to index doc %s: %v", id, err)
+		}
+		if res.Shards != (store.ShardInfo{Total: 2, Successful: 2}) {
+			t.Errorf("expected doc %s on both copies, got %+v", id, res.Shards)
+		}
+	}
+
+	// Each node holds a replica of the shard the other one owns.
+	remote := m2.GetIndex("users")
+	for i := 0; i < 40; i++ {
+		id := fmt.Sprintf("%d", i)
+		replicas := idx.Replicas
+		if idx.GetShardID(id) == 0 {
+			replicas = remote.Replicas
+		}
+		primaries := remote.Shards
+		if idx.GetShardID(id) == 0 {
+			primaries = idx.Shards
+		}
+		primary, _ := primaries[idx.GetShardID(id)].Get(id)
+		// Replicas keep the sequence numbers the primary gave the writes.
+		if doc, err := replicas[idx.GetShardID(id)].Get(id); err != nil || doc == nil || primary == nil ||
+			doc.SeqNo != primary.SeqNo || doc.PrimaryTerm != primary.PrimaryTerm {
+			t.Errorf("expected doc %s on the replica as on the primary %+v, got %+v, %v", id, primary, doc, err)
+		}
+	}
+
+	// Without node2, its shard is read from the replica on node1.
+	s2.Close()
+	for i := 0; i < 40; i++ {
+		id := fmt.Sprintf("%d", i)
+		if doc, err := idx.Get(context.Background(), id, ""); err != nil || doc == nil {
+			t.Errorf("expected doc %s from a replica, got %+v, %v", id, doc, err)
+		}
+	}
+	res, err := idx.Search(context.Background(), bleve.NewSearchRequest(bleve.NewMatchAllQuery()), nil)
+	if err != nil || res.Total != 40 {
+		t.Errorf("expected 40 hits from the replicas, got %+v, %v", res, err)
+	}
+
+	var local, away string
+	for i := 0; local == "" || away == ""; i++ {
+		id := fmt.Sprintf("%d", i)
+		if idx.GetShardID(id) == 0 {
+			local = id
+		} else {
+			away = id
+		}
+	}
+	wres, err := idx.Index(context.Background(), local, map[string]interface{}{"n": "missed"}, store.WriteOptions{})
+	if err != nil || wres.Shards != (store.ShardInfo{Total: 2, Successful: 1, Failed: 1}) {
+		t.Errorf("expected a write to the primary only, got %+v, %v", wres, err)
+	}
+	// Until its backoff is over, writes count the replica as failed without
+	// trying it again.
+	if !idx.replica(0, "node2").skip() {
+		t.Errorf("expected writes to skip the failed replica")
+	}
+	wres, err = idx.Index(context.Background(), local, map[string]interface{}{"n": "missed"}, store.WriteOptions{})
+	if err != nil || wres.Shards != (store.ShardInfo{Total: 2, Successful: 1, Failed: 1}) {
+		t.Errorf("expected a write to the primary only, got %+v, %v", wres, err)
+	}
+	if _, err := idx.Index(context.Background(), local, map[string]interface{}{"n": 0}, all); !errors.Is(err, ErrUnavailableShards) {
+		t.Errorf("expected ErrUnavailableShards, got %v", err)
+	}
+	if _, err := idx.Index(context.Background(), away, map[string]interface{}{"n": 0}, store.WriteOptions{}); !errors.Is(err, ErrNodeUnavailable) {
+		t.Errorf("expected ErrNodeUnavailable, got %v", err)
+	}
+
+	// Once node2 is back, its replica catches up with the writes it missed.
+	s2 = NewClusterServer(m2, addr2)
+	if err := s2.Start(); err != nil {
+		t.Fatalf("failed to restart cluster server: %v", err)
+	}
+	defer s2.Close()
+	wres, err = idx.Index(context.Background(), local, map[string]interface{}{"n": "back"}, all)
+	if err != nil || wres.Shards.Successful != 2 {
+		t.Fatalf("expected a write to both copies, got %+v, %v", wres, err)
+	}
+	primary, _ := idx.Shards[0].Get(local)
+	replica, err := remote.Replicas[0].Get(local)
+	if err != nil || replica == nil || replica.Version != primary.Version || replica.Source["n"] != "back" {
+		t.Errorf("expected the replica at version %d, got %+v, %v", primary.Version, replica, err)
+	}
+}
+
+// TestApplyExpiredChanges checks that a change whose document expired since
+// deletes an older copy of the document instead of leaving it behind.
+func TestApplyExpiredChanges(t *testing.T) {
+	path := "test_apply_expired_changes"
+	defer os.RemoveAll(path)
+
+	s, err := store.Open(path, store.DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Index("1", map[string]interface{}{"n": 1}, store.WriteOptions{}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+
+	changes := []store.Change{{
+		Op:        store.OpIndex,
+		ID:        "1",
+		Version:   2,
+		ExpiresAt: time.Now().Add(-time.Second).UnixMilli(),
+		Source:    []byte(`{"n":2}`),
+	}}
+	if err := applyChanges(storeWriter{s}, changes, false); err != nil {
+		t.Fatalf("failed to apply changes: %v", err)
+	}
+	if doc, err := s.Get("1"); err != nil || doc != nil {
+		t.Errorf("expected the older copy to be deleted, got %v, %v", doc, err)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	path := "test_rebalance"
+	defer os.RemoveAll(path)
+
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", []string{"node1=" + addr1}))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	idx, err := m1.CreateIndex("logs", Settings{NumberOfShards: 4}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	for i := 0; i < 40; i++ {
+		if _, err := idx.Index(context.Background(), fmt.Sprintf("%d", i), map[string]interface{}{"n": i}, store.WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc %d: %v", i, err)
+		}
+	}
+	m1.Close()
+
+	// node2 joins. The shards stay on node1, where their data is, until
+	// they are moved.
+	nodes := []string{"node1=" + addr1, "node2=" + addr2}
+	m1, err = NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", nodes))
+	if err != nil {
+		t.Fatalf("failed to reopen manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	for _, srv := range []*ClusterServer{NewClusterServer(m1, addr1), NewClusterServer(m2, addr2)} {
+		if err := srv.Start(); err != nil {
+			t.Fatalf("failed to start cluster server: %v", err)
+		}
+		defer srv.Close()
+	}
+	idx = m1.GetIndex("logs")
+	if len(idx.Shards) != 4 {
+		t.Fatalf("expected the 4 shards on node1, got %d", len(idx.Shards))
+	}
+	for i := 0; i < 40; i++ {
+		if doc, err := idx.Get(context.Background(), fmt.Sprintf("%d", i), ""); err != nil || doc == nil {
+			t.Errorf("expected doc %d before the rebalance, got %+v, %v", i, doc, err)
+		}
+	}
+
+	// Writes go on while the shards move.
+	var written []string
+	stop := make(chan struct{})
+	writer := make(chan struct{})
+	go func() {
+		defer close(writer)
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := fmt.Sprintf("w%d", n)
+			if _, err := idx.Index(context.Background(), id, map[string]interface{}{"n": n}, store.WriteOptions{}); err != nil {
+				t.Errorf("failed to index doc %s during the rebalance: %v", id, err)
+				return
+			}
+			written = append(written, id)
+		}
+	}()
+	moves, err := m1.Rebalance()
+	close(stop)
+	<-writer
+	if err != nil {
+		t.Fatalf("failed to rebalance: %v", err)
+	}
+	var moved []int
+	for sID := 0; sID < 4; sID++ {
+		if m1.Cluster.GetShardOwner("logs", sID, 4).ID == "node2" {
+			moved = append(moved, sID)
+		}
+	}
+	if len(moved) == 0 {
+		t.Fatalf("expected the placement to give node2 some shards")
+	}
+	if len(moves) != len(moved) {
+		t.Errorf("expected %d moves, got %+v", len(moved), moves)
+	}
+	for i, move := range moves {
+		if move.Error != "" || move.From != "node1" || move.To != "node2" || i >= len(moved) || move.Shard != moved[i] {
+			t.Errorf("unexpected move %+v", move)
+		}
+	}
+
+	remote := m2.GetIndex("logs")
+	if remote == nil {
+		t.Fatalf("expected node2 to have the index")
+	}
+	for sID := 0; sID < 4; sID++ {
+		_, onNode1 := idx.Shards[sID]
+		_, onNode2 := remote.Shards[sID]
+		if onNode1 == slices.Contains(moved, sID) || onNode2 != slices.Contains(moved, sID) {
+			t.Errorf("shard %d on node1: %v, on node2: %v", sID, onNode1, onNode2)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(path, "node1", "logs", fmt.Sprintf("shard_%d", moved[0]))); !os.IsNotExist(err) {
+		t.Errorf("expected the moved shard to be deleted from node1, got %v", err)
+	}
+	if got := remote.Allocation(); !reflect.DeepEqual(got, idx.Allocation()) {
+		t.Errorf("nodes disagree on the allocation: %+v and %+v", idx.Allocation(), got)
+	}
+
+	ids := written
+	for i := 0; i < 40; i++ {
+		ids = append(ids, fmt.Sprintf("%d", i))
+	}
+	for _, id := range ids {
+		for _, index := range []*Index{idx, remote} {
+			if doc, err := index.Get(context.Background(), id, ""); err != nil || doc == nil {
+				t.Errorf("expected doc %s after the rebalance, got %+v, %v", id, doc, err)
+			}
+		}
+	}
+	res, err := remote.Search(context.Background(), bleve.NewSearchRequest(bleve.NewMatchAllQuery()), nil)
+	if err != nil || res.Total != uint64(len(ids)) {
+		t.Errorf("expected %d hits, got %+v, %v", len(ids), res, err)
+	}
+
+	// The new primaries of the moved shards write in a new term.
+	if term := idx.Allocation()[moved[0]].PrimaryTerm; term != 2 {
+		t.Errorf("expected primary term 2 for the moved shard, got %d", term)
+	}
+	var onMoved string
+	for i := 0; onMoved == ""; i++ {
+		if id := fmt.Sprintf("t%d", i); idx.GetShardID(id) == moved[0] {
+			onMoved = id
+		}
+	}
+	if res, err := idx.Index(context.Background(), onMoved, map[string]interface{}{"n": 0}, store.WriteOptions{}); err != nil || res.PrimaryTerm != 2 {
+		t.Errorf("expected a write in primary term 2, got %+v, %v", res, err)
+	}
+
+	if moves, err := m1.Rebalance(); err != nil || len(moves) != 0 {
+		t.Errorf("expected nothing left to move, got %+v, %v", moves, err)
+	}
+	if _, err := m2.Rebalance(); !errors.Is(err, ErrNotCoordinator) {
+		t.Errorf("expected ErrNotCoordinator, got %v", err)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	c := cluster.NewCluster("node1", []string{"node1=a", "node2=b", "node3=c"})
+	owners := func(c *cluster.Cluster) map[string]string {
+		placed := make(map[string]string)
+		for i := 0; i < 300; i++ {
+			name := fmt.Sprintf("index-%d", i)
+			placed[name] = c.GetShardOwner(name, 0, 1).ID
+		}
+		return placed
+	}
+
+	// Shard 0 of the indices is spread over the nodes.
+	before := owners(c)
+	count := make(map[string]int)
+	for _, node := range before {
+		count[node]++
+	}
+	for _, node := range c.Nodes {
+		if count[node.ID] < 70 {
+			t.Errorf("expected about 100 shards on %s, got %d", node.ID, count[node.ID])
+		}
+	}
+	copies := c.GetShardCopies("index-0", 0, 1, 5)
+	if len(copies) != 3 || copies[0].ID != before["index-0"] || copies[0] == copies[1] || copies[1] == copies[2] || copies[0] == copies[2] {
+		t.Errorf("expected 3 distinct copies led by the owner, got %+v", copies)
+	}
+
+	// A node that joins only takes shards, and a node that leaves only
+	// gives its own.
+	c.Nodes = append(c.Nodes, cluster.Node{ID: "node4", Addr: "d"})
+	for name, node := range owners(c) {
+		if node != before[name] && node != "node4" {
+			t.Errorf("expected %s to stay on %s or move to node4, got %s", name, before[name], node)
+		}
+	}
+	c.Nodes = c.Nodes[1:4]
+	for name, node := range owners(c) {
+		if before[name] != "node1" && node != before[name] && node != "node4" {
+			t.Errorf("expected %s to stay on %s, got %s", name, before[name], node)
+		}
+	}
+
+	// A node holding more shards than the others gets fewer new ones.
+	c = cluster.NewCluster("node1", []string{"node1=a", "node2=b", "node3=c"})
+	c.Placement = cluster.RendezvousPlacement{ShardWeight: 1}
+	c.SetLoad("node1", cluster.NodeLoad{Shards: 50})
+	c.SetLoad("node2", cluster.NodeLoad{Shards: 5})
+	c.SetLoad("node3", cluster.NodeLoad{Shards: 5})
+	count = make(map[string]int)
+	for _, node := range owners(c) {
+		count[node]++
+	}
+	if count["node1"] >= count["node2"] || count["node1"] >= count["node3"] {
+		t.Errorf("expected node1 to get the fewest shards, got %v", count)
+	}
+
+	// The round robin placement puts shard N on node N whatever the index.
+	c.Placement = cluster.RoundRobinPlacement{}
+	for sID := 0; sID < 6; sID++ {
+		if got := c.GetShardOwner(fmt.Sprintf("index-%d", sID), sID, 6); got.ID != c.Nodes[sID%3].ID {
+			t.Errorf("expected shard %d on %s, got %s", sID, c.Nodes[sID%3].ID, got.ID)
+		}
+	}
+}
+
+func TestConcurrentForwarding(t *testing.T) {
+	path := "test_concurrent_forwarding"
+	defer os.RemoveAll(path)
+
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	nodes := []string{"node1=" + addr1, "node2=" + addr2}
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, cluster.NewCluster("node1", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	srv := NewClusterServer(m2, addr2)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+	defer srv.Close()
+
+	// Shards 1 and 3 are on node2, so node1 forwards their requests.
+	m1.Cluster.Placement = cluster.RoundRobinPlacement{}
+	idx, err := m1.CreateIndex("logs", Settings{NumberOfShards: 4}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+
+	// Responses reach the request they answer, however many are in flight.
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				if _, err := idx.Index(context.Background(), id, map[string]interface{}{"id": id}, store.WriteOptions{}); err != nil {
+					t.Errorf("failed to index doc %s: %v", id, err)
+					return
+				}
+				doc, err := idx.Get(context.Background(), id, "")
+				if err != nil || doc == nil || doc.ID != id || doc.Source["id"] != id {
+					t.Errorf("expected doc %s, got %+v, %v", id, doc, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(m1.Forwarder.pool(m1.Cluster.Nodes[1]).conns); n < 1 || n > maxConnsPerNode {
+		t.Errorf("expected between 1 and %d connections to node2, got %d", maxConnsPerNode, n)
+	}
+
+	// A request that cannot be decoded is answered with an error, and the
+	// connection keeps working.
+	rc, err := dialRPC(context.Background(), addr2, minProtocol, maxProtocol)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer rc.fail(errConnClosed)
+	data, err := rc.call(context.Background(), []byte("{"))
+	var resp InternalResponse
+	if err != nil || rc.codec.decode(data, &resp) != nil || !strings.Contains(resp.Err, "failed to decode request") {
+		t.Errorf("expected a decoding error, got %s, %v", data, err)
+	}
+	payload, _ := rc.codec.encode(InternalRequest{Type: ReqIndexMeta, IndexName: "logs"})
+	data, err = rc.call(context.Background(), payload)
+	resp = InternalResponse{}
+	if err != nil || rc.codec.decode(data, &resp) != nil || resp.Meta == nil || resp.Meta.UUID != idx.Meta().UUID {
+		t.Errorf("expected the index metadata, got %s, %v", data, err)
+	}
+}
+
+func TestProtocolVersions(t *testing.T) {
+	path := "test_protocol_versions"
+	defer os.RemoveAll(path)
+
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	nodes := []string{"node1=" + addr1, "node2=" + addr2}
+	c1 := cluster.NewCluster("node1", nodes)
+	c1.Placement = cluster.RoundRobinPlacement{}
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, c1)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	// node2 runs an older release that only speaks JSON.
+	srv := NewClusterServer(m2, addr2)
+	srv.maxVersion = protocolJSON
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+	defer srv.Close()
+
+	idx, err := m1.CreateIndex("logs", Settings{NumberOfShards: 2}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := idx.Index(context.Background(), fmt.Sprintf("%d", i), map[string]interface{}{"n": i, "msg": "hello"}, store.WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc %d: %v", i, err)
+		}
+	}
+	req := bleve.NewSearchRequest(bleve.NewMatchQuery("hello"))
+	if res, err := idx.Search(context.Background(), req, nil); err != nil || res.Total != 20 {
+		t.Errorf("expected 20 hits, got %+v, %v", res, err)
+	}
+	if conns := m1.Forwarder.pool(m1.Cluster.Nodes[1]).conns; len(conns) == 0 || conns[0].codec != (jsonCodec{}) {
+		t.Errorf("expected the connection to node2 to use JSON")
+	}
+
+	// A node that no longer speaks JSON cannot talk to it.
+	f := NewForwarder()
+	f.minVersion = protocolMsgpack
+	defer f.Close()
+	if _, err := f.ForwardIndexMeta(context.Background(), m1.Cluster.Nodes[1], "logs"); !errors.Is(err, ErrNodeUnavailable) || !strings.Contains(err.Error(), "no common protocol version") {
+		t.Errorf("expected no common protocol version, got %v", err)
+	}
+
+	// Search requests and results come through MessagePack unchanged.
+	req.Fields = []string{"*"}
+	req.AddFacet("msg", bleve.NewFacetRequest("msg", 3))
+	res, err := idx.LocalSearch(context.Background(), req, nil)
+	if err != nil || len(res.Hits) == 0 {
+		t.Fatalf("failed to search: %+v, %v", res, err)
+	}
+	res.Request = req
+	for _, v := range []interface{}{
+		InternalRequest{Type: ReqSearch, IndexName: "logs", SearchReq: req, Shards: []int{0}},
+		InternalResponse{SearchResult: res},
+	} {
+		data, err := msgpackCodec{}.encode(v)
+		if err != nil {
+			t.Fatalf("failed to encode %T: %v", v, err)
+		}
+		var decoded interface{}
+		if _, ok := v.(InternalRequest); ok {
+			var req InternalRequest
+			err = msgpackCodec{}.decode(data, &req)
+			decoded = req
+		} else {
+			var resp InternalResponse
+			err = msgpackCodec{}.decode(data, &resp)
+			decoded = resp
+		}
+		want, _ := json.Marshal(v)
+		got, _ := json.Marshal(decoded)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("expected %s, got %s, %v", want, got, err)
+		}
+		if raw, _ := json.Marshal(v); len(data) >= len(raw) {
+			t.Errorf("expected %T to be smaller than its %d bytes of JSON, got %d", v, len(raw), len(data))
+		}
+	}
+}
+
+func TestRemoteDeadlines(t *testing.T) {
+	path := "test_remote_deadlines"
+	defer os.RemoveAll(path)
+
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	nodes := []string{"node1=" + addr1, "node2=" + addr2}
+	c1 := cluster.NewCluster("node1", nodes)
+	c1.Placement = cluster.RoundRobinPlacement{}
+	m1, err := NewManager(filepath.Join(path, "node1"), 2, c1)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewManager(filepath.Join(path, "node2"), 2, cluster.NewCluster("node2", nodes))
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	defer m2.Close()
+	// node2 hangs on searches once hang is set, until they are given up.
+	var hang atomic.Bool
+	started := make(chan struct{}, 1)
+	stopped := make(chan error, 1)
+	srv := NewClusterServer(m2, addr2)
+	srv.handle = func(ctx context.Context, req InternalRequest) InternalResponse {
+		if req.Type != ReqSearch || !hang.Load() {
+			return srv.handleRequest(ctx, req)
+		}
+		started <- struct{}{}
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		var resp InternalResponse
+		resp.Err, resp.ErrKind = encodeError(ctx.Err())
+		return resp
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start cluster server: %v", err)
+	}
+	defer srv.Close()
+
+	// Shard 1 is on node2.
+	idx, err := m1.CreateIndex("logs", Settings{NumberOfShards: 2}, true)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	if _, err := idx.Search(context.Background(), req, nil); err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	hang.Store(true)
+
+	// The deadline of the caller bounds the search, and node2 gives up on
+	// it too.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := idx.Search(ctx, req, nil); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrNodeUnavailable) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the search to stop at its deadline, took %s", elapsed)
+	}
+	<-started
+	if err := <-stopped; err == nil {
+		t.Errorf("expected node2 to give up on the search")
+	}
+
+	// Cancelling the caller cancels the search on node2.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := idx.Search(ctx, req, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the search to be canceled, got %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected node2 to cancel the search, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected node2 to cancel the search")
+	}
+
+	// A request that outlives its timeout reports node2 as unavailable, so
+	// that reads fail over to replicas.
+	m1.Forwarder.Timeouts[ReqSearch] = 200 * time.Millisecond
+	if _, err := idx.Search(context.Background(), req, nil); !errors.Is(err, ErrNodeUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected node2 to be unavailable, got %v", err)
+	}
+	<-started
+	<-stopped
+}
+
+func TestReadRetries(t *testing.T) {
+	// A node that drops the first connection after reading a request and
+	// answers on the next ones.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := conns.Add(1)
+			go func() {
+				defer conn.Close()
+				version, err := serverHandshake(conn, minProtocol, maxProtocol)
+				if err != nil {
+					return
+				}
+				for {
+					id, _, err := readFrame(conn)
+					if err != nil || n == 1 {
+						return
+					}
+					data, _ := codecFor(version).encode(InternalResponse{Meta: &IndexMeta{UUID: "abc"}})
+					writeFrame(conn, id, data)
+				}
+			}()
+		}
+	}()
+	node := cluster.Node{ID: "node2", Addr: ln.Addr().String()}
+	f := NewForwarder()
+	defer f.Close()
+
+	// Reads are sent again on a new connection.
+	meta, err := f.ForwardIndexMeta(context.Background(), node, "logs")
+	if err != nil || meta == nil || meta.UUID != "abc" {
+		t.Fatalf("expected the metadata, got %+v, %v", meta, err)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("expected 2 connections, got %d", n)
+	}
+
+	// Writes are not, as they may have been made.
+	conns.Store(0)
+	f.Close()
+	if err := f.ForwardUpdateMeta(context.Background(), node, "logs", IndexMeta{}); !errors.Is(err, ErrNodeUnavailable) {
+		t.Errorf("expected node2 to be unavailable, got %v", err)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+}
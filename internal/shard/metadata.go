@@ -0,0 +1,130 @@
+package shard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metaFile holds the IndexMeta of an index, in the index directory.
+const metaFile = "index.json"
+
+// IndexMeta is the metadata every node must agree on to route documents of
+// an index the same way. The node that creates an index writes it and sends
+// it to the others, which store it unchanged.
+type IndexMeta struct {
+	UUID           string `json:"uuid"`
+	NumberOfShards int    `json:"number_of_shards"`
+	// CreationDate is the creation time of the index in Unix milliseconds.
+	CreationDate int64 `json:"creation_date"`
+	// MappingVersion counts the changes of the mapping seen by this node.
+	MappingVersion uint64 `json:"mapping_version"`
+	// State is IndexStateClose for a closed index.
+	State    string   `json:"state,omitempty"`
+	Settings Settings `json:"settings"`
+	// Allocation lists the nodes holding each shard, see ShardAllocation.
+	// AllocationVersion is raised with every change to it, so that a node
+	// keeps the newest table when updates of the metadata cross.
+	Allocation        []ShardAllocation `json:"allocation,omitempty"`
+	AllocationVersion uint64            `json:"allocation_version,omitempty"`
+}
+
+func newIndexMeta(settings Settings) (IndexMeta, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return IndexMeta{}, err
+	}
+	return IndexMeta{
+		UUID:           base64.RawURLEncoding.EncodeToString(b[:]),
+		NumberOfShards: settings.NumberOfShards,
+		CreationDate:   time.Now().UnixMilli(),
+		Settings:       settings,
+	}, nil
+}
+
+func loadIndexMeta(indexPath string) (IndexMeta, bool, error) {
+	var meta IndexMeta
+	data, err := os.ReadFile(filepath.Join(indexPath, metaFile))
+	if os.IsNotExist(err) {
+		return meta, false, nil
+	}
+	if err != nil {
+		return meta, false, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, false, fmt.Errorf("invalid %s: %w", metaFile, err)
+	}
+	if meta.NumberOfShards <= 0 {
+		return meta, false, fmt.Errorf("invalid %s: number_of_shards is %d", metaFile, meta.NumberOfShards)
+	}
+	return meta, true, nil
+}
+
+// saveIndexMeta replaces the metadata file atomically, so a crash leaves
+// either the old or the new metadata.
+func saveIndexMeta(indexPath string, meta IndexMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(indexPath, metaFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(indexPath, metaFile))
+}
+
+// legacyIndexMeta builds the metadata of an index written before index.json
+// existed, from its settings.json and, failing that, the highest numbered
+// shard directory or defaultShards. It reports false for a directory that
+// holds neither.
+func legacyIndexMeta(indexPath string, defaultShards int) (IndexMeta, bool, error) {
+	settings, found, err := loadSettings(indexPath)
+	if err != nil {
+		return IndexMeta{}, false, err
+	}
+	maxShardFound := -1
+	entries, _ := os.ReadDir(indexPath)
+	for _, entry := range entries {
+		var sID int
+		if n, _ := fmt.Sscanf(entry.Name(), "shard_%d", &sID); n == 1 && entry.IsDir() {
+			if sID > maxShardFound {
+				maxShardFound = sID
+			}
+		}
+	}
+	if !found && maxShardFound < 0 {
+		return IndexMeta{}, false, nil
+	}
+	if settings.NumberOfShards <= 0 {
+		settings.NumberOfShards = defaultShards
+		if maxShardFound >= 0 {
+			settings.NumberOfShards = maxShardFound + 1
+		}
+	}
+	meta, err := newIndexMeta(settings)
+	return meta, err == nil, err
+}
+
+// Meta returns the metadata of the index.
+func (idx *Index) Meta() IndexMeta {
+	idx.metaMu.Lock()
+	defer idx.metaMu.Unlock()
+	return idx.meta
+}
+
+// mappingChanged persists the mapping after a document added fields to it
+// and bumps the mapping version.
+func (idx *Index) mappingChanged() {
+	idx.saveMapping()
+	idx.metaMu.Lock()
+	defer idx.metaMu.Unlock()
+	idx.meta.MappingVersion++
+	if err := saveIndexMeta(idx.path, idx.meta); err != nil {
+		fmt.Printf("Failed to save metadata of index %s: %v\n", idx.Name, err)
+	}
+}
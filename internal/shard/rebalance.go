@@ -0,0 +1,362 @@
+package shard
+
+import (
+	"breeze/internal/cluster"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultRebalanceInterval is how often the coordinating node checks
+	// that the shards are on the nodes the cluster places them on.
+	DefaultRebalanceInterval = 30 * time.Second
+	// relocateHandoffTimeout bounds how long a primary rejects writes while
+	// it is handed off, and how long those writes are retried, in case the
+	// node switching the allocation stops.
+	relocateHandoffTimeout = 30 * time.Second
+	// relocateRetryDelay is how long a write rejected by a primary that is
+	// handed off waits before it is routed again.
+	relocateRetryDelay = 20 * time.Millisecond
+)
+
+// ShardMove is a change to the allocation of a shard made by Rebalance.
+type ShardMove struct {
+	Index string `json:"index"`
+	Shard int    `json:"shard"`
+	// From is the node whose copy was moved or dropped, empty for a copy
+	// that was added. To is the node the copy was moved to, empty for a
+	// dropped copy.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Error reports why the move failed; the shard was left where it was.
+	Error string `json:"error,omitempty"`
+}
+
+// StartRebalancer rebalances the shards right away and then every interval
+// until the manager is closed, so that they follow the nodes that joined or
+// left the cluster. Only the coordinating node moves shards, see Rebalance.
+func (m *Manager) StartRebalancer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			moves, _ := m.Rebalance()
+			for _, move := range moves {
+				if move.Error != "" {
+					fmt.Printf("Failed to move shard %d of index %s from %q to %q: %s\n", move.Shard, move.Index, move.From, move.To, move.Error)
+				} else {
+					fmt.Printf("Moved shard %d of index %s from %q to %q\n", move.Shard, move.Index, move.From, move.To)
+				}
+			}
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Rebalance moves the copies of the shards of every open index that are
+// not on the nodes the cluster places them on, one copy at a time, see
+// relocateShard, and drops the copies on nodes that left the cluster when
+// their shard has another copy. A shard whose copies all left stays
+// allocated to them. Only the first node of the cluster coordinates the
+// allocation, so that its changes never cross; other nodes fail with
+// ErrNotCoordinator.
+func (m *Manager) Rebalance() ([]ShardMove, error) {
+	if len(m.Cluster.Nodes) == 0 || !m.Cluster.IsLocal(m.Cluster.Nodes[0]) {
+		return nil, fmt.Errorf("%w: shards are allocated by the first node of the cluster", ErrNotCoordinator)
+	}
+	m.rebalanceMu.Lock()
+	defer m.rebalanceMu.Unlock()
+	m.refreshLoads()
+
+	names := m.ListIndices()
+	sort.Strings(names)
+	var moves []ShardMove
+	for _, name := range names {
+		idx := m.GetIndex(name)
+		if idx == nil || idx.checkOpen() != nil {
+			continue
+		}
+		if err := m.refreshAllocation(idx); err != nil {
+			fmt.Printf("Failed to refresh the allocation of index %s: %v\n", name, err)
+		}
+		for sID := 0; sID < idx.numShards; sID++ {
+			// Each move brings one more copy where it belongs.
+			for i := 0; i < 2*len(m.Cluster.Nodes); i++ {
+				move, ok := idx.nextMove(sID)
+				if !ok {
+					break
+				}
+				if err := m.relocateShard(idx, move); err != nil {
+					move.Error = err.Error()
+					moves = append(moves, move)
+					break
+				}
+				moves = append(moves, move)
+			}
+		}
+	}
+	return moves, nil
+}
+
+// refreshLoads asks every node for its load, for the placement to weigh the
+// nodes by. A node that does not answer keeps the load it last reported.
+func (m *Manager) refreshLoads() {
+	for _, node := range m.Cluster.Nodes {
+		var load cluster.NodeLoad
+		var err error
+		if m.Cluster.IsLocal(node) {
+			load, err = m.LocalLoad()
+		} else {
+			load, err = m.Forwarder.ForwardNodeLoad(context.Background(), node)
+		}
+		if err == nil {
+			m.Cluster.SetLoad(node.ID, load)
+		}
+	}
+}
+
+// LocalLoad returns the disk space used by the data of this node and the
+// number of shard copies it holds.
+func (m *Manager) LocalLoad() (cluster.NodeLoad, error) {
+	var load cluster.NodeLoad
+	err := filepath.WalkDir(m.basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files come and go while shards are written.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				load.DiskBytes += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return cluster.NodeLoad{}, err
+	}
+	m.mu.RLock()
+	indices := slices.Collect(maps.Values(m.indices))
+	m.mu.RUnlock()
+	for _, idx := range indices {
+		idx.mu.RLock()
+		load.Shards += len(idx.Shards) + len(idx.Replicas)
+		idx.mu.RUnlock()
+	}
+	return load, nil
+}
+
+// refreshAllocation adopts the newest allocation table of the index found
+// on the nodes, in case it was changed by another coordinator, and sends it
+// to the nodes that missed it.
+func (m *Manager) refreshAllocation(idx *Index) error {
+	meta := idx.Meta()
+	versions := make(map[string]uint64)
+	for _, node := range m.Cluster.Nodes {
+		if m.Cluster.IsLocal(node) {
+			continue
+		}
+		remote, err := m.Forwarder.ForwardIndexMeta(context.Background(), node, idx.Name)
+		if err != nil || (remote != nil && remote.UUID != meta.UUID) {
+			continue
+		}
+		versions[node.ID] = 0
+		if remote == nil {
+			continue
+		}
+		versions[node.ID] = remote.AllocationVersion
+		if remote.AllocationVersion > meta.AllocationVersion {
+			meta.Allocation, meta.AllocationVersion = remote.Allocation, remote.AllocationVersion
+		}
+	}
+	stale := meta.AllocationVersion > idx.Meta().AllocationVersion
+	for _, v := range versions {
+		stale = stale || v < meta.AllocationVersion
+	}
+	if !stale {
+		return nil
+	}
+	return m.updateMeta(idx.Name, func(_ *Index, current *IndexMeta) error {
+		if meta.AllocationVersion > current.AllocationVersion {
+			current.Allocation, current.AllocationVersion = meta.Allocation, meta.AllocationVersion
+		}
+		return nil
+	})
+}
+
+// nextMove returns the next change that brings the copies of a shard to
+// the nodes the cluster places them on, if any. A relocation left unfinished
+// is tried again first.
+func (idx *Index) nextMove(sID int) (ShardMove, bool) {
+	alloc := idx.allocation(sID)
+	move := ShardMove{Index: idx.Name, Shard: sID}
+	if alloc.RelocatingTo != "" {
+		move.From, move.To = alloc.RelocatingFrom, alloc.RelocatingTo
+		return move, true
+	}
+
+	var known, gone []string
+	for _, id := range alloc.Nodes {
+		if _, err := idx.Cluster.GetNodeByID(id); err == nil {
+			known = append(known, id)
+		} else {
+			gone = append(gone, id)
+		}
+	}
+	if len(known) == 0 {
+		return move, false
+	}
+	if len(gone) > 0 {
+		move.From = gone[0]
+		return move, true
+	}
+
+	var want []string
+	for _, node := range idx.Cluster.GetShardCopies(idx.Name, sID, idx.numShards, idx.Meta().Settings.NumberOfReplicas) {
+		want = append(want, node.ID)
+	}
+	var missing, extra []string
+	for _, id := range want {
+		if !slices.Contains(alloc.Nodes, id) {
+			missing = append(missing, id)
+		}
+	}
+	for _, id := range alloc.Nodes {
+		if !slices.Contains(want, id) {
+			extra = append(extra, id)
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		move.To = missing[0]
+		if len(extra) > 0 {
+			move.From = extra[0]
+		}
+		return move, true
+	case len(extra) > 0 && extra[len(extra)-1] != alloc.Nodes[0]:
+		// A primary that is still reachable is only moved along with
+		// its data, never dropped.
+		move.From = extra[len(extra)-1]
+		return move, true
+	}
+	return move, false
+}
+
+// relocateShard makes one move of a shard. A dropped copy is only removed
+// from the allocation. A new copy is first added to it as the relocation
+// target, which opens an empty replica on its node; the primary copies the
+// shard to it and keeps it up to date, see LocalRelocate, and the
+// allocation then switches to it, on its node first. Writes are not
+// interrupted, except for the short handoff of a primary that moves. If the
+// copy fails the target is removed again.
+func (m *Manager) relocateShard(idx *Index, move ShardMove) error {
+	alloc := idx.allocation(move.Shard)
+	if move.To == "" {
+		alloc.Nodes = slices.DeleteFunc(slices.Clone(alloc.Nodes), func(id string) bool { return id == move.From })
+		return m.publishAllocation(idx, move.Shard, alloc, "")
+	}
+
+	if alloc.RelocatingTo != move.To {
+		alloc.RelocatingFrom, alloc.RelocatingTo = move.From, move.To
+		if err := m.publishAllocation(idx, move.Shard, alloc, ""); err != nil {
+			return err
+		}
+	}
+	primary := idx.shardOwner(move.Shard)
+	var err error
+	if m.Cluster.IsLocal(primary) {
+		err = idx.LocalRelocate(move.Shard, move.To)
+	} else {
+		err = m.Forwarder.ForwardRelocate(context.Background(), primary, idx.Name, move.Shard, move.To)
+	}
+	if err != nil {
+		alloc.RelocatingFrom, alloc.RelocatingTo = "", ""
+		if perr := m.publishAllocation(idx, move.Shard, alloc, ""); perr != nil {
+			fmt.Printf("Failed to cancel the relocation of shard %d of index %s: %v\n", move.Shard, idx.Name, perr)
+		}
+		return err
+	}
+
+	done := ShardAllocation{Nodes: slices.Clone(alloc.Nodes)}
+	if i := slices.Index(done.Nodes, move.From); move.From != "" && i >= 0 {
+		done.Nodes[i] = move.To
+	} else {
+		done.Nodes = append(done.Nodes, move.To)
+	}
+	return m.publishAllocation(idx, move.Shard, done, move.To)
+}
+
+// publishAllocation sets the allocation of a shard on every node, and on
+// the node first, if set, before the others. The primary term is raised if
+// the primary changes.
+func (m *Manager) publishAllocation(idx *Index, sID int, alloc ShardAllocation, first string) error {
+	meta := idx.Meta()
+	cur := meta.Allocation[sID]
+	alloc.PrimaryTerm = cur.PrimaryTerm
+	if alloc.primary() != cur.primary() {
+		alloc.PrimaryTerm = cur.term() + 1
+	}
+	meta.Allocation = slices.Clone(meta.Allocation)
+	meta.Allocation[sID] = alloc
+	meta.AllocationVersion++
+	if first != "" && first != m.Cluster.SelfID {
+		if err := m.Forwarder.ForwardUpdateMeta(context.Background(), idx.node(first), idx.Name, meta); err != nil {
+			return fmt.Errorf("failed to allocate shard %d of index [%s] to node %s: %w", sID, idx.Name, first, err)
+		}
+	}
+	return m.updateMeta(idx.Name, func(_ *Index, current *IndexMeta) error {
+		current.Allocation, current.AllocationVersion = meta.Allocation, meta.AllocationVersion
+		return nil
+	})
+}
+
+// LocalRelocate brings the copy of a shard relocating to the node to up to
+// date with the local primary, starting with a full copy. If the primary is
+// the copy that moves, its writes are then rejected with
+// ErrShardRelocating, so that they are retried on the new primary, and the
+// last changes are sent: the new copy holds every write the old one
+// accepted when the allocation switches to it. The rejection ends when the
+// switch reaches this node, or after relocateHandoffTimeout.
+func (idx *Index) LocalRelocate(sID int, to string) error {
+	alloc := idx.allocation(sID)
+	if alloc.RelocatingTo != to {
+		return fmt.Errorf("shard %d of index %s is not relocating to node %s", sID, idx.Name, to)
+	}
+	s, err := idx.localShard(sID)
+	if err != nil {
+		return err
+	}
+	node := idx.node(to)
+	if err := idx.syncReplica(s, sID, node, s.Checkpoint()); err != nil {
+		return err
+	}
+	if alloc.RelocatingFrom != idx.Cluster.SelfID {
+		return nil
+	}
+
+	// Taking the lock waits for the writes in flight, so after it the
+	// checkpoint covers every write the primary accepted.
+	idx.mu.Lock()
+	idx.handoffs[sID] = time.Now().Add(relocateHandoffTimeout)
+	idx.mu.Unlock()
+	if err := idx.syncReplica(s, sID, node, s.Checkpoint()); err != nil {
+		idx.mu.Lock()
+		delete(idx.handoffs, sID)
+		idx.mu.Unlock()
+		return err
+	}
+	return nil
+}
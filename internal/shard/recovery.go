@@ -0,0 +1,164 @@
+package shard
+
+import (
+	"breeze/internal/store"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recoverBatchSize bounds how many WAL records are read per shard, and how
+// many documents are written, per round of a recovery.
+const recoverBatchSize = 500
+
+// RecoverRequest selects the point in time an index is recovered to. A
+// shard listed in Checkpoints is recovered up to and including that WAL
+// index; the others up to AsOf, or in full if AsOf is zero. Histories has
+// the history the checkpoint of a shard was taken on, if known; the
+// recovery fails if the shard has another copy now, see CheckHistory.
+type RecoverRequest struct {
+	Dest        string
+	AsOf        time.Time
+	Checkpoints map[int]uint64
+	Histories   map[int]string
+}
+
+// RecoverResult reports what RecoverIndex restored.
+type RecoverResult struct {
+	Index string
+	Docs  int
+}
+
+// RecoverIndex replays the WAL of every shard of source up to the point in
+// time selected by req and writes the documents as they were then into the
+// new index req.Dest, keeping their versions. The whole history must still
+// be retained, see Settings.RetainOperations.
+func (m *Manager) RecoverIndex(source string, req RecoverRequest) (RecoverResult, error) {
+	result := RecoverResult{Index: req.Dest}
+	idx := m.GetIndex(source)
+	if idx == nil {
+		return result, fmt.Errorf("%w [%s]", ErrIndexNotFound, source)
+	}
+	if m.GetIndex(req.Dest) != nil {
+		return result, fmt.Errorf("%w [%s]", ErrIndexExists, req.Dest)
+	}
+	if _, err := os.Stat(filepath.Join(m.basePath, req.Dest)); err == nil {
+		return result, fmt.Errorf("%w [%s]", ErrIndexExists, req.Dest)
+	}
+
+	docs, err := idx.historyAt(req)
+	if err != nil {
+		return result, err
+	}
+
+	settings := idx.Settings()
+	settings.Blocks = Blocks{}
+	dest, err := m.CreateIndex(req.Dest, settings, true)
+	if err != nil {
+		return result, err
+	}
+	fail := func(err error) (RecoverResult, error) {
+		if _, derr := m.DeleteIndex(req.Dest, true); derr != nil {
+			fmt.Printf("Failed to delete index %s after a failed recovery: %v\n", req.Dest, derr)
+		}
+		return result, err
+	}
+	var ids []string
+	var data []map[string]interface{}
+	var opts []store.WriteOptions
+	flush := func() error {
+		for _, res := range dest.BatchIndex(context.Background(), ids, data, opts) {
+			if res.Err != nil {
+				return fmt.Errorf("failed to recover document [%s]: %w", res.ID, res.Err)
+			}
+		}
+		result.Docs += len(ids)
+		ids, data, opts = ids[:0], data[:0], opts[:0]
+		return nil
+	}
+	now := time.Now()
+	for id, ch := range docs {
+		o := store.WriteOptions{Version: &ch.Version, VersionType: store.VersionExternalGTE, Routing: ch.Routing}
+		if ch.ExpiresAt != 0 {
+			// Documents that expired since are left out, the others keep
+			// their original expiry time.
+			o.TTL = time.UnixMilli(ch.ExpiresAt).Sub(now)
+			if o.TTL <= 0 {
+				continue
+			}
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(ch.Source, &doc); err != nil {
+			return fail(fmt.Errorf("invalid source of document [%s]: %w", id, err))
+		}
+		ids = append(ids, id)
+		data = append(data, doc)
+		opts = append(opts, o)
+		if len(ids) >= recoverBatchSize {
+			if err := flush(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if len(ids) > 0 {
+		if err := flush(); err != nil {
+			return fail(err)
+		}
+	}
+	return result, nil
+}
+
+// historyAt reads the changes of every shard up to the point selected by
+// req and returns the last version of each document that existed then.
+func (idx *Index) historyAt(req RecoverRequest) (map[string]store.Change, error) {
+	asOf := req.AsOf.UnixMilli()
+	docs := make(map[string]store.Change)
+	since := make(map[int]uint64, idx.numShards)
+	pending := make(map[int]bool, idx.numShards)
+	for sID := 0; sID < idx.numShards; sID++ {
+		since[sID] = 0
+		pending[sID] = true
+	}
+
+	for len(pending) > 0 {
+		changes, errs := idx.Changes(since, recoverBatchSize)
+		if err := FirstError(errs); err != nil {
+			return nil, err
+		}
+		if err := CheckHistory(changes, req.Histories); err != nil {
+			return nil, err
+		}
+		for sID := range pending {
+			sc, ok := changes[sID]
+			if !ok {
+				return nil, fmt.Errorf("shard %d did not return its changes", sID)
+			}
+			cut, limited := req.Checkpoints[sID]
+			done := sc.Checkpoint == since[sID]
+			for _, ch := range sc.Changes {
+				if (limited && ch.Checkpoint > cut) || (!limited && !req.AsOf.IsZero() && ch.Timestamp > asOf) {
+					done = true
+					break
+				}
+				if ch.Op == store.OpDelete {
+					delete(docs, ch.ID)
+				} else {
+					docs[ch.ID] = ch
+				}
+			}
+			if done {
+				// Shards that are done are still asked for their changes,
+				// but have none after the last possible checkpoint.
+				since[sID] = math.MaxUint64
+				delete(pending, sID)
+			} else {
+				since[sID] = sc.Checkpoint
+			}
+		}
+	}
+	return docs, nil
+}
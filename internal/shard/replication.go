@@ -0,0 +1,369 @@
+package shard
+
+import (
+	"breeze/internal/cluster"
+	"breeze/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicaHoldTTL is how long a primary keeps the WAL records a replica
+	// has not received after it last reached it. A replica that is away for
+	// longer gets a full copy of the shard when it is back.
+	replicaHoldTTL = 10 * time.Minute
+	// replicatePage bounds how many WAL records, or documents of a full
+	// copy, are sent to a replica per request.
+	replicatePage = 512
+	// replicateTimeout bounds each request sending changes to a replica.
+	replicateTimeout = 10 * time.Second
+	// minReplicaBackoff and maxReplicaBackoff bound how long writes leave
+	// a replica that could not be reached alone before trying it again.
+	minReplicaBackoff = time.Second
+	maxReplicaBackoff = time.Minute
+)
+
+// replicaState is what the primary of a shard knows about one of its
+// replicas. mu is held while changes are sent to it, so they arrive in
+// order.
+type replicaState struct {
+	mu sync.Mutex
+	// synced is the checkpoint of the primary up to which the replica has
+	// applied every change. It is only meaningful once copied is set,
+	// after the replica got a full copy of the shard.
+	synced uint64
+	copied bool
+	// failed is set while the replica cannot be reached. backoff is how
+	// long writes skip it after it failed, doubling each time it fails
+	// again.
+	failed  bool
+	backoff time.Duration
+	// retryAt is when writes try a failed replica again, in Unix
+	// nanoseconds, and zero while it can be reached. It is read without mu,
+	// so that writes do not wait behind a request to the replica that hangs.
+	retryAt atomic.Int64
+	// copying is set while the replica gets a full copy. Writes do not
+	// wait for it: the copy is caught up with them from the WAL.
+	copying atomic.Bool
+}
+
+// skip reports whether writes leave the replica alone because it failed
+// and is not due to be tried again. Once it is due, only the first write
+// to ask tries it; the others skip it until that attempt is over.
+func (r *replicaState) skip() bool {
+	at := r.retryAt.Load()
+	if at == 0 {
+		return false
+	}
+	if time.Now().UnixNano() < at {
+		return true
+	}
+	return !r.retryAt.CompareAndSwap(at, math.MaxInt64)
+}
+
+type replicaKey struct {
+	shard int
+	node  string
+}
+
+func (idx *Index) replica(sID int, node string) *replicaState {
+	idx.replicaMu.Lock()
+	defer idx.replicaMu.Unlock()
+	if idx.replicaStates == nil {
+		idx.replicaStates = make(map[replicaKey]*replicaState)
+	}
+	key := replicaKey{sID, node}
+	r, ok := idx.replicaStates[key]
+	if !ok {
+		r = &replicaState{}
+		idx.replicaStates[key] = r
+	}
+	return r
+}
+
+// forgetReplicas drops what is known about the replicas of a shard on the
+// nodes not in keep, so that they get a full copy of it if they are
+// replicas again. All of them are forgotten when the primary was replaced.
+func (idx *Index) forgetReplicas(sID int, keep []string) {
+	idx.replicaMu.Lock()
+	defer idx.replicaMu.Unlock()
+	for key := range idx.replicaStates {
+		if key.shard == sID && !slices.Contains(keep, key.node) {
+			delete(idx.replicaStates, key)
+		}
+	}
+}
+
+// checkActiveShards fails with ErrUnavailableShards if fewer copies of the
+// shard than wait, or the index setting if wait is zero, are active. The
+// replicas that could not be reached before are tried again first, even
+// while writes skip them, so a replica that is back counts again.
+func (idx *Index) checkActiveShards(s *store.Store, sID, wait int) error {
+	if wait == 0 {
+		wait = idx.Meta().Settings.WaitForActiveShards
+	}
+	copies := len(idx.shardCopies(sID))
+	if wait == store.ActiveShardsAll {
+		wait = copies
+	}
+	if wait <= 1 {
+		return nil
+	}
+	if active := idx.replicate(s, sID, true).Successful; active < wait {
+		return fmt.Errorf("%w of shard [%s][%d] to meet wait_for_active_shards [%d]: have %d of %d",
+			ErrUnavailableShards, idx.Name, sID, wait, active, copies)
+	}
+	return nil
+}
+
+// replicate sends the changes of the local primary store s of shard sID
+// that its replicas, and the copy it relocates to, miss and waits until
+// they applied them. It reports how many copies of the shard hold every
+// change up to the current checkpoint; copies getting a full copy are
+// neither waited for nor counted as failed. Unless retry is set, the
+// replicas that failed are counted as failed without being contacted until
+// their backoff is over, so that a replica that cannot be reached does not
+// hold up every write.
+func (idx *Index) replicate(s *store.Store, sID int, retry bool) store.ShardInfo {
+	copies := idx.nodes(idx.allocation(sID).copies())
+	info := store.ShardInfo{Total: len(copies), Successful: 1}
+	if len(copies) == 0 {
+		return info
+	}
+	target := s.Checkpoint()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range copies[1:] {
+		node := node
+		r := idx.replica(sID, node.ID)
+		if r.copying.Load() {
+			continue
+		}
+		if !retry && r.skip() {
+			info.Failed++
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := idx.syncReplica(s, sID, node, target)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				info.Failed++
+			} else {
+				info.Successful++
+			}
+		}()
+	}
+	wg.Wait()
+	return info
+}
+
+// syncReplica brings the replica of shard sID on node up to the checkpoint
+// target of the primary store s.
+func (idx *Index) syncReplica(s *store.Store, sID int, node cluster.Node, target uint64) error {
+	r := idx.replica(sID, node.ID)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := idx.catchUp(r, s, sID, node, target)
+	if err != nil && !r.failed {
+		fmt.Printf("Failed to replicate shard %d of index %s to node %s: %v\n", sID, idx.Name, node.ID, err)
+	}
+	r.failed = err != nil
+	if r.failed {
+		r.backoff = min(max(2*r.backoff, minReplicaBackoff), maxReplicaBackoff)
+		r.retryAt.Store(time.Now().Add(r.backoff).UnixNano())
+	} else {
+		r.backoff = 0
+		r.retryAt.Store(0)
+	}
+	return err
+}
+
+// catchUp sends the replica the changes after the checkpoint it has,
+// starting with a full copy if it has none or the changes are gone from the
+// WAL. The caller holds r.mu.
+func (idx *Index) catchUp(r *replicaState, s *store.Store, sID int, node cluster.Node, target uint64) error {
+	hold := "replica/" + node.ID
+	for !r.copied || r.synced < target {
+		if !r.copied {
+			if err := idx.copyReplica(r, s, sID, node, hold); err != nil {
+				return err
+			}
+			continue
+		}
+		changes, next, err := s.Changes(r.synced, replicatePage)
+		if errors.Is(err, store.ErrChangesTruncated) {
+			r.copied = false
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if next <= r.synced {
+			return nil
+		}
+		if len(changes) > 0 {
+			if err := idx.sendChanges(node, sID, changes, false); err != nil {
+				return err
+			}
+		}
+		r.synced = next
+		s.MoveHold(hold, next, replicaHoldTTL)
+	}
+	return nil
+}
+
+// copyReplica replaces the replica with a copy of every document of the
+// primary. The WAL is held from the checkpoint the copy starts at, so the
+// writes made meanwhile are sent after it.
+func (idx *Index) copyReplica(r *replicaState, s *store.Store, sID int, node cluster.Node, hold string) error {
+	r.copying.Store(true)
+	defer r.copying.Store(false)
+	s.ReleaseChanges(hold)
+	cp := s.HoldChanges(hold, replicaHoldTTL)
+	after := ""
+	for first := true; ; first = false {
+		page, err := s.Scan(after, replicatePage)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 && !first {
+			break
+		}
+		if err := idx.sendChanges(node, sID, page, first); err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		after = page[len(page)-1].ID
+	}
+	r.synced, r.copied = cp, true
+	return nil
+}
+
+// sendChanges sends changes to the replica of shard sID on node, giving up
+// after replicateTimeout.
+func (idx *Index) sendChanges(node cluster.Node, sID int, changes []store.Change, reset bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), replicateTimeout)
+	defer cancel()
+	return idx.Forwarder.ForwardReplicate(ctx, node, idx.Name, sID, changes, reset)
+}
+
+// LocalReplicate applies changes sent by the primary of a shard to its
+// local replica. With reset the replica is emptied first, for a full copy.
+func (idx *Index) LocalReplicate(sID int, changes []store.Change, reset bool) error {
+	if reset {
+		if err := idx.resetReplica(sID); err != nil {
+			return err
+		}
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	s, ok := idx.Replicas[sID]
+	if !ok {
+		if err := idx.checkOpen(); err != nil {
+			return err
+		}
+		return fmt.Errorf("shard %d of index %s has no replica on this node", sID, idx.Name)
+	}
+	return applyChanges(storeWriter{s}, changes, true)
+}
+
+// resetReplica replaces the local replica of a shard with an empty store.
+func (idx *Index) resetReplica(sID int) error {
+	opts, err := idx.Settings().storeOptions()
+	if err != nil {
+		return err
+	}
+	opts.DisableReaper = true
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	old, ok := idx.Replicas[sID]
+	if !ok {
+		if err := idx.checkOpen(); err != nil {
+			return err
+		}
+		return fmt.Errorf("shard %d of index %s has no replica on this node", sID, idx.Name)
+	}
+	if err := old.Close(); err != nil && !errors.Is(err, store.ErrClosed) {
+		return err
+	}
+	shardPath := filepath.Join(idx.path, fmt.Sprintf("shard_%d", sID))
+	if err := os.RemoveAll(shardPath); err != nil {
+		return err
+	}
+	s, err := store.Open(shardPath, opts)
+	if err != nil {
+		delete(idx.Replicas, sID)
+		return err
+	}
+	idx.Replicas[sID] = s
+	return nil
+}
+
+// storeWriter writes copied changes to the store of one shard.
+type storeWriter struct {
+	s *store.Store
+}
+
+func (w storeWriter) Delete(ctx context.Context, id string, opts store.WriteOptions) (store.WriteResult, error) {
+	return w.s.Delete(id, opts)
+}
+
+func (w storeWriter) BatchIndex(ctx context.Context, ids []string, data []map[string]interface{}, opts []store.WriteOptions) []store.WriteResult {
+	results, err := w.s.BatchIndex(ids, data, opts)
+	if results == nil {
+		results = make([]store.WriteResult, len(ids))
+		for i := range results {
+			results[i] = store.WriteResult{ID: ids[i], Err: err}
+		}
+	}
+	return results
+}
+
+// localCopy returns the local store of a shard, its primary or a replica.
+func (idx *Index) localCopy(sID int) (*store.Store, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if s, ok := idx.Shards[sID]; ok {
+		return s, nil
+	}
+	if s, ok := idx.Replicas[sID]; ok {
+		return s, nil
+	}
+	if err := idx.checkOpen(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("shard %d of index %s is not local", sID, idx.Name)
+}
+
+// readShard reads a shard from its primary, or from its replicas in turn
+// while the nodes before them cannot be reached. local reads the copy held
+// by this node and remote asks another node.
+func (idx *Index) readShard(sID int, local func(s *store.Store) error, remote func(node cluster.Node) error) error {
+	var err error
+	for _, node := range idx.shardCopies(sID) {
+		if idx.Cluster.IsLocal(node) {
+			s, err := idx.localCopy(sID)
+			if err != nil {
+				return err
+			}
+			return local(s)
+		}
+		if err = remote(node); !errors.Is(err, ErrNodeUnavailable) {
+			return err
+		}
+	}
+	return err
+}
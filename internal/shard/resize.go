@@ -0,0 +1,403 @@
+package shard
+
+import (
+	"breeze/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// resizeHoldTTL is how long the shards of a source index keep their WAL
+	// for a resize that was not released, in case the node running it dies.
+	resizeHoldTTL = time.Hour
+	// resizeCatchUpRounds bounds how many rounds of changes are copied
+	// while the source still accepts writes. Whatever is left is copied
+	// after writes are blocked.
+	resizeCatchUpRounds = 10
+)
+
+// ResizeRequest describes the index a split or shrink creates.
+type ResizeRequest struct {
+	Target         string
+	NumberOfShards int
+	// Swap replaces the source with the target once the target has caught
+	// up: the source is deleted and the target takes its name. Otherwise
+	// both are kept and the source accepts writes again.
+	Swap bool
+}
+
+// ResizeResult reports what a split or shrink copied.
+type ResizeResult struct {
+	// Index is the name the resized index can be used under.
+	Index string
+	// Docs counts the documents copied from the shards of the source and
+	// Changes the operations replayed from their WAL afterwards.
+	Docs    int
+	Changes int
+	Swapped bool
+}
+
+// SplitIndex copies the index into a new index whose number of shards is a
+// multiple of its own, see resizeIndex.
+func (m *Manager) SplitIndex(name string, req ResizeRequest) (ResizeResult, error) {
+	idx := m.GetIndex(name)
+	if idx == nil {
+		return ResizeResult{}, fmt.Errorf("%w [%s]", ErrIndexNotFound, name)
+	}
+	if req.NumberOfShards <= idx.numShards || req.NumberOfShards%idx.numShards != 0 {
+		return ResizeResult{}, fmt.Errorf("%w: index [%s] with [%d] shards can only be split into a multiple of [%d], not [%d]",
+			ErrInvalidShardCount, name, idx.numShards, idx.numShards, req.NumberOfShards)
+	}
+	return m.resizeIndex(idx, req)
+}
+
+// ShrinkIndex copies the index into a new index whose number of shards is a
+// factor of its own, see resizeIndex.
+func (m *Manager) ShrinkIndex(name string, req ResizeRequest) (ResizeResult, error) {
+	idx := m.GetIndex(name)
+	if idx == nil {
+		return ResizeResult{}, fmt.Errorf("%w [%s]", ErrIndexNotFound, name)
+	}
+	if req.NumberOfShards < 1 || req.NumberOfShards >= idx.numShards || idx.numShards%req.NumberOfShards != 0 {
+		return ResizeResult{}, fmt.Errorf("%w: index [%s] with [%d] shards can only be shrunk to a factor of [%d], not [%d]",
+			ErrInvalidShardCount, name, idx.numShards, idx.numShards, req.NumberOfShards)
+	}
+	return m.resizeIndex(idx, req)
+}
+
+// resizeIndex creates req.Target with the settings of idx and the new number
+// of shards while idx stays online. The documents of every shard are copied
+// first, then the operations written meanwhile are replayed from the WAL of
+// the shards, which keep them until the resize is done. Once the target has
+// nearly caught up, writes to idx are blocked for the last round and, with
+// req.Swap, the target replaces idx on every node. Documents keep their
+// versions. On failure the target is deleted and idx accepts writes again.
+func (m *Manager) resizeIndex(idx *Index, req ResizeRequest) (ResizeResult, error) {
+	result := ResizeResult{Index: req.Target}
+	if err := idx.checkRead(); err != nil {
+		return result, err
+	}
+	if req.Swap {
+		if err := idx.checkMetadataWrite(); err != nil {
+			return result, err
+		}
+	}
+	if m.GetIndex(req.Target) != nil {
+		return result, fmt.Errorf("%w [%s]", ErrIndexExists, req.Target)
+	}
+	if _, err := os.Stat(filepath.Join(m.basePath, req.Target)); err == nil {
+		return result, fmt.Errorf("%w [%s]", ErrIndexExists, req.Target)
+	}
+
+	settings := idx.Settings()
+	settings.NumberOfShards = req.NumberOfShards
+	settings.Blocks = Blocks{}
+	dest, err := m.CreateIndex(req.Target, settings, true)
+	if err != nil {
+		return result, err
+	}
+	hold := "resize/" + req.Target
+	defer idx.releaseChanges(hold)
+	blocked := idx.Meta().Settings.Blocks.Write
+	fail := func(err error) (ResizeResult, error) {
+		if _, derr := m.DeleteIndex(req.Target, true); derr != nil {
+			fmt.Printf("Failed to delete index %s after a failed resize: %v\n", req.Target, derr)
+		}
+		if !blocked {
+			if berr := m.UpdateBlocks(idx.Name, BlocksUpdate{Write: &blocked}); berr != nil {
+				fmt.Printf("Failed to unblock writes to index %s: %v\n", idx.Name, berr)
+			}
+		}
+		return result, err
+	}
+
+	since := make(map[int]uint64, idx.numShards)
+	for sID := 0; sID < idx.numShards; sID++ {
+		n, cp, err := idx.copyShard(dest, sID, hold)
+		result.Docs += n
+		if err != nil {
+			return fail(fmt.Errorf("failed to copy shard %d: %w", sID, err))
+		}
+		since[sID] = cp
+	}
+
+	for round := 0; round < resizeCatchUpRounds; round++ {
+		n, err := idx.copyChanges(dest, since)
+		result.Changes += n
+		if err != nil {
+			return fail(err)
+		}
+		if n < recoverBatchSize {
+			break
+		}
+	}
+
+	// The block waits for the writes in flight on every node, so after it
+	// the WAL of every shard holds all the writes the source accepted.
+	if !blocked {
+		yes := true
+		if err := m.UpdateBlocks(idx.Name, BlocksUpdate{Write: &yes}); err != nil {
+			return fail(fmt.Errorf("failed to block writes: %w", err))
+		}
+	}
+	for {
+		n, err := idx.copyChanges(dest, since)
+		result.Changes += n
+		if err != nil {
+			return fail(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	if !req.Swap {
+		if !blocked {
+			if err := m.UpdateBlocks(idx.Name, BlocksUpdate{Write: &blocked}); err != nil {
+				return result, fmt.Errorf("failed to unblock writes to index [%s]: %w", idx.Name, err)
+			}
+		}
+		return result, nil
+	}
+	if err := m.swapIndex(idx.Name, req.Target); err != nil {
+		return result, err
+	}
+	result.Index = idx.Name
+	result.Swapped = true
+	return result, nil
+}
+
+// copyShard copies the documents of one shard of the index into dest and
+// returns the checkpoint of the shard the copy includes. The WAL after that
+// checkpoint is held under hold.
+func (idx *Index) copyShard(dest *Index, sID int, hold string) (int, uint64, error) {
+	var copied int
+	var cp uint64
+	after := ""
+	for first := true; ; first = false {
+		page, err := idx.scanShard(sID, after, recoverBatchSize, hold)
+		if err != nil {
+			return copied, cp, err
+		}
+		if first {
+			cp = page.Checkpoint
+		}
+		if len(page.Changes) == 0 {
+			return copied, cp, nil
+		}
+		if err := applyChanges(dest, page.Changes, false); err != nil {
+			return copied, cp, err
+		}
+		copied += len(page.Changes)
+		after = page.Changes[len(page.Changes)-1].ID
+	}
+}
+
+// copyChanges reads one round of changes of every shard after since, writes
+// them into dest and advances since. It returns the number of operations
+// read.
+func (idx *Index) copyChanges(dest *Index, since map[int]uint64) (int, error) {
+	changes, errs := idx.Changes(since, recoverBatchSize)
+	if err := FirstError(errs); err != nil {
+		return 0, err
+	}
+	n := 0
+	for sID := range since {
+		sc, ok := changes[sID]
+		if !ok {
+			return n, fmt.Errorf("shard %d did not return its changes", sID)
+		}
+		if err := applyChanges(dest, sc.Changes, false); err != nil {
+			return n, err
+		}
+		n += len(sc.Changes)
+		since[sID] = sc.Checkpoint
+	}
+	return n, nil
+}
+
+// changeWriter is where applyChanges writes: an index, which routes the
+// documents to their shards, or the store of one shard.
+type changeWriter interface {
+	Delete(ctx context.Context, id string, opts store.WriteOptions) (store.WriteResult, error)
+	BatchIndex(ctx context.Context, ids []string, data []map[string]interface{}, opts []store.WriteOptions) []store.WriteResult
+}
+
+// applyChanges writes changes into dest with their versions, and with
+// keepSeqNo with their sequence numbers and primary terms too, as a replica
+// does. Changes older than the document in dest are skipped, which makes
+// replaying them again harmless.
+func applyChanges(dest changeWriter, changes []store.Change, keepSeqNo bool) error {
+	ctx := context.Background()
+	var ids []string
+	var data []map[string]interface{}
+	var opts []store.WriteOptions
+	now := time.Now()
+	for _, ch := range changes {
+		o := store.WriteOptions{VersionType: store.VersionExternalGTE, Routing: ch.Routing}
+		if keepSeqNo {
+			o.SeqNo, o.PrimaryTerm = ch.SeqNo, ch.PrimaryTerm
+		}
+		if ch.Version > 0 {
+			v := ch.Version
+			o.Version = &v
+		}
+		// A document that expired since is deleted at its version, so that
+		// an older copy of it in dest does not outlive it.
+		expired := ch.ExpiresAt != 0 && ch.ExpiresAt <= now.UnixMilli()
+		if ch.Op == store.OpDelete || expired {
+			if _, err := dest.Delete(ctx, ch.ID, o); err != nil && !errors.Is(err, store.ErrVersionConflict) {
+				return fmt.Errorf("failed to copy delete of document [%s]: %w", ch.ID, err)
+			}
+			continue
+		}
+		if ch.ExpiresAt != 0 {
+			o.TTL = time.UnixMilli(ch.ExpiresAt).Sub(now)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(ch.Source, &doc); err != nil {
+			return fmt.Errorf("invalid source of document [%s]: %w", ch.ID, err)
+		}
+		ids = append(ids, ch.ID)
+		data = append(data, doc)
+		opts = append(opts, o)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, res := range dest.BatchIndex(ctx, ids, data, opts) {
+		if res.Err != nil && !errors.Is(res.Err, store.ErrVersionConflict) {
+			return fmt.Errorf("failed to copy document [%s]: %w", res.ID, res.Err)
+		}
+	}
+	return nil
+}
+
+// scanShard reads a page of the documents of a shard from its owner, see
+// LocalScan.
+func (idx *Index) scanShard(sID int, after string, limit int, hold string) (ShardChanges, error) {
+	owner := idx.shardOwner(sID)
+	if idx.Cluster.IsLocal(owner) {
+		return idx.LocalScan(sID, after, limit, hold)
+	}
+	return idx.Forwarder.ForwardScan(context.Background(), owner, idx.Name, sID, after, limit, hold)
+}
+
+// LocalScan returns the documents of a local shard with an ID after after,
+// at most limit of them. With hold set the shard keeps its WAL after the
+// returned checkpoint until the hold is released, and the documents include
+// at least every change up to that checkpoint.
+func (idx *Index) LocalScan(sID int, after string, limit int, hold string) (ShardChanges, error) {
+	if err := idx.checkRead(); err != nil {
+		return ShardChanges{}, err
+	}
+	s, err := idx.localShard(sID)
+	if err != nil {
+		return ShardChanges{}, err
+	}
+	res := ShardChanges{History: s.History()}
+	if hold != "" {
+		res.Checkpoint = s.HoldChanges(hold, resizeHoldTTL)
+	}
+	res.Changes, err = s.Scan(after, limit)
+	return res, err
+}
+
+// releaseChanges releases a hold on the WAL of every shard of the index.
+func (idx *Index) releaseChanges(hold string) {
+	for _, node := range idx.Cluster.Nodes {
+		if idx.Cluster.IsLocal(node) {
+			idx.LocalReleaseChanges(hold)
+		} else if err := idx.Forwarder.ForwardReleaseChanges(context.Background(), node, idx.Name, hold); err != nil {
+			fmt.Printf("Failed to release %s of index %s on node %s: %v\n", hold, idx.Name, node.ID, err)
+		}
+	}
+}
+
+// LocalReleaseChanges releases a hold on the WAL of the local shards.
+func (idx *Index) LocalReleaseChanges(hold string) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	for _, s := range idx.Shards {
+		s.ReleaseChanges(hold)
+	}
+}
+
+// swapIndex replaces the index name with the index from on every node,
+// starting with this one.
+func (m *Manager) swapIndex(name, from string) error {
+	if err := m.swapLocalIndex(name, from); err != nil {
+		return fmt.Errorf("failed to replace index [%s] with [%s]: %w", name, from, err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+	for _, node := range m.Cluster.Nodes {
+		if m.Cluster.IsLocal(node) {
+			continue
+		}
+		node := node
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.Forwarder.ForwardSwapIndex(context.Background(), node, name, from); err != nil {
+				mu.Lock()
+				failed = fmt.Errorf("failed to replace index [%s] with [%s] on node %s: %w", name, from, node.ID, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// swapLocalIndex deletes the local copy of the index name and renames the
+// index from to it. The manager lock is held throughout, so requests see
+// either the old or the new index. Swapping again after from is gone does
+// nothing, so a swap that failed on some nodes can be retried.
+func (m *Manager) swapLocalIndex(name, from string) error {
+	src, err := m.OpenIndex(from)
+	if errors.Is(err, ErrIndexNotFound) {
+		if m.GetIndex(name) != nil {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, idx := range []*Index{m.indices[name], src} {
+		if idx == nil {
+			continue
+		}
+		idx.mu.Lock()
+		err := idx.closeShards()
+		idx.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	delete(m.indices, name)
+	delete(m.indices, from)
+
+	// The old index is removed before the new one is moved in, so a crash
+	// in between leaves the data under the name of the copy.
+	indexPath := filepath.Join(m.basePath, name)
+	if err := os.RemoveAll(indexPath); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(m.basePath, from), indexPath); err != nil {
+		return err
+	}
+	_, err = m.openIndex(name, src.Meta())
+	return err
+}
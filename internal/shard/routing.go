@@ -0,0 +1,37 @@
+package shard
+
+import (
+	"fmt"
+	"sort"
+)
+
+// checkRouting fails if the index requires a routing key and none is given.
+func (idx *Index) checkRouting(id, routing string) error {
+	if routing == "" && idx.Meta().Settings.RoutingRequired {
+		return fmt.Errorf("%w for [%s]/[%s]", ErrRoutingMissing, idx.Name, id)
+	}
+	return nil
+}
+
+// routedShards lists, per node, the shards the routing keys route to, or
+// returns nil if there are no keys and every shard must be used.
+func (idx *Index) routedShards(routing []string) map[string][]int {
+	if len(routing) == 0 {
+		return nil
+	}
+	seen := make(map[int]bool)
+	shards := make(map[string][]int)
+	for _, r := range routing {
+		sID := idx.ShardID("", r)
+		if seen[sID] {
+			continue
+		}
+		seen[sID] = true
+		owner := idx.shardOwner(sID)
+		shards[owner.ID] = append(shards[owner.ID], sID)
+	}
+	for _, s := range shards {
+		sort.Ints(s)
+	}
+	return shards
+}
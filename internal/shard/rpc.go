@@ -0,0 +1,266 @@
+package shard
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Internal requests and responses travel as frames: a 4 byte length and an
+// 8 byte request ID, both big endian, followed by that many bytes of JSON.
+// A response carries the ID of its request, so a connection carries many
+// requests at once and their responses come back in any order.
+const (
+	frameHeaderSize = 12
+	// maxFrameSize bounds the frames a node accepts, so that a corrupt
+	// length does not make it allocate without limit.
+	maxFrameSize = 256 << 20
+	// maxConnsPerNode bounds the connections a node opens to another one.
+	maxConnsPerNode = 4
+	// maxInFlightPerConn bounds the requests of a connection the cluster
+	// server handles at once; it reads the next ones when one is answered.
+	maxInFlightPerConn = 64
+	// dialTimeout bounds the time to connect to a node and settle on a
+	// protocol version with it.
+	dialTimeout = 5 * time.Second
+)
+
+var errConnClosed = errors.New("connection closed")
+
+func writeFrame(w io.Writer, id uint64, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the limit of %d", len(payload), maxFrameSize)
+	}
+	buf := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	binary.BigEndian.PutUint64(buf[4:], id)
+	copy(buf[frameHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (uint64, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	id := binary.BigEndian.Uint64(header[4:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds the limit of %d", size, maxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return id, payload, nil
+}
+
+// rpcConn is a connection to a node shared by concurrent requests. Frames
+// are written whole under writeMu, and a reader goroutine hands each
+// response to the request waiting for its ID. Once the connection breaks
+// every pending and later request fails with the error that broke it.
+type rpcConn struct {
+	conn    net.Conn
+	version uint16
+	codec   wireCodec
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan []byte
+	err     error
+}
+
+// dialRPC connects to a node and settles on a protocol version between
+// minVersion and maxVersion with it, within dialTimeout or until ctx is
+// done.
+func dialRPC(ctx context.Context, addr string, minVersion, maxVersion uint16) (*rpcConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	version, err := clientHandshake(conn, minVersion, maxVersion)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	rc := &rpcConn{conn: conn, version: version, codec: codecFor(version), pending: make(map[uint64]chan []byte)}
+	go rc.readLoop()
+	return rc, nil
+}
+
+func (rc *rpcConn) readLoop() {
+	r := bufio.NewReader(rc.conn)
+	for {
+		id, payload, err := readFrame(r)
+		if err != nil {
+			rc.fail(err)
+			return
+		}
+		rc.mu.Lock()
+		ch, ok := rc.pending[id]
+		delete(rc.pending, id)
+		rc.mu.Unlock()
+		if ok {
+			ch <- payload
+		}
+	}
+}
+
+// fail breaks the connection with err, if it is not broken yet.
+func (rc *rpcConn) fail(err error) {
+	rc.mu.Lock()
+	if rc.err == nil {
+		rc.err = err
+		for id, ch := range rc.pending {
+			close(ch)
+			delete(rc.pending, id)
+		}
+	}
+	rc.mu.Unlock()
+	rc.conn.Close()
+}
+
+// broken returns the error that broke the connection, if any.
+func (rc *rpcConn) broken() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.err
+}
+
+// inFlight returns the number of requests waiting for their response.
+func (rc *rpcConn) inFlight() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.pending)
+}
+
+// call sends a request and waits for its response. It fails when the
+// connection does, or with the error of ctx when ctx is done first, in
+// which case the node is asked to cancel the request.
+func (rc *rpcConn) call(ctx context.Context, payload []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	rc.mu.Lock()
+	if rc.err != nil {
+		err := rc.err
+		rc.mu.Unlock()
+		return nil, err
+	}
+	rc.nextID++
+	id := rc.nextID
+	rc.pending[id] = ch
+	rc.mu.Unlock()
+
+	// A frame written in part leaves the connection unusable, so a write
+	// that times out breaks it.
+	rc.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	rc.conn.SetWriteDeadline(deadline)
+	err := writeFrame(rc.conn, id, payload)
+	rc.conn.SetWriteDeadline(time.Time{})
+	rc.writeMu.Unlock()
+	if err != nil {
+		rc.fail(err)
+		return nil, err
+	}
+
+	select {
+	case data, ok := <-ch:
+		if !ok {
+			return nil, rc.broken()
+		}
+		return data, nil
+	case <-ctx.Done():
+		rc.mu.Lock()
+		delete(rc.pending, id)
+		rc.mu.Unlock()
+		go rc.cancel(id)
+		return nil, ctx.Err()
+	}
+}
+
+// cancel asks the node to stop handling the request with the given ID, if
+// it speaks protocolCancel. Its response, if any, is dropped by readLoop.
+func (rc *rpcConn) cancel(id uint64) {
+	if rc.version < protocolCancel {
+		return
+	}
+	payload, err := rc.codec.encode(InternalRequest{Type: ReqCancel})
+	if err != nil {
+		return
+	}
+	rc.writeMu.Lock()
+	defer rc.writeMu.Unlock()
+	rc.conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+	defer rc.conn.SetWriteDeadline(time.Time{})
+	if err := writeFrame(rc.conn, id, payload); err != nil {
+		rc.fail(err)
+	}
+}
+
+// nodePool holds the connections to one node, at most maxConnsPerNode.
+type nodePool struct {
+	minVersion, maxVersion uint16
+
+	mu    sync.Mutex
+	conns []*rpcConn
+}
+
+// get returns the connection with the fewest requests in flight, and opens
+// another one if they all have some and the pool is not full.
+func (p *nodePool) get(ctx context.Context, addr string) (*rpcConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *rpcConn
+	live := p.conns[:0]
+	for _, rc := range p.conns {
+		if rc.broken() != nil {
+			continue
+		}
+		live = append(live, rc)
+		if best == nil || rc.inFlight() < best.inFlight() {
+			best = rc
+		}
+	}
+	clear(p.conns[len(live):])
+	p.conns = live
+	if best != nil && (best.inFlight() == 0 || len(p.conns) >= maxConnsPerNode) {
+		return best, nil
+	}
+
+	rc, err := dialRPC(ctx, addr, p.minVersion, p.maxVersion)
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	p.conns = append(p.conns, rc)
+	return rc, nil
+}
+
+func (p *nodePool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rc := range p.conns {
+		rc.fail(errConnClosed)
+	}
+	p.conns = nil
+}
@@ -0,0 +1,115 @@
+package shard
+
+import (
+	"breeze/internal/mapping"
+	"breeze/internal/store"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Settings are the per-index settings chosen when the index is created.
+type Settings struct {
+	NumberOfShards int    `json:"number_of_shards"`
+	Durability     string `json:"durability,omitempty"`
+	SyncInterval   string `json:"sync_interval,omitempty"`
+	OnCorruption   string `json:"on_corruption,omitempty"`
+	Compression    string `json:"compression,omitempty"`
+	DefaultTTL     string `json:"default_ttl,omitempty"`
+	// NumberOfReplicas is how many copies of each shard are kept on other
+	// nodes besides its primary.
+	NumberOfReplicas int `json:"number_of_replicas,omitempty"`
+	// WaitForActiveShards is how many copies of a shard must be active for
+	// a write to proceed, store.ActiveShardsAll for all of them. Zero waits
+	// for the primary only.
+	WaitForActiveShards int `json:"wait_for_active_shards,omitempty"`
+	// RetainOperations is how many applied operations each shard keeps in
+	// its WAL for the changes feed.
+	RetainOperations uint64 `json:"retain_operations,omitempty"`
+	// RoutingRequired rejects document requests without a routing key, as
+	// set by _routing.required in the mappings.
+	RoutingRequired bool `json:"routing_required,omitempty"`
+	// Blocks restrict the operations allowed on the index. Unlike the other
+	// settings they can be changed after the index is created.
+	Blocks Blocks `json:"blocks"`
+	// Mapping holds the analysis settings and field mappings the shard
+	// indices are created with; nil uses dynamic mapping only.
+	Mapping *mapping.Definition `json:"mapping,omitempty"`
+}
+
+// Validate checks the settings and that they can be turned into store
+// options.
+func (st Settings) Validate() error {
+	if st.NumberOfReplicas < 0 {
+		return fmt.Errorf("invalid number_of_replicas %d", st.NumberOfReplicas)
+	}
+	if st.WaitForActiveShards < store.ActiveShardsAll || st.WaitForActiveShards > st.NumberOfReplicas+1 {
+		return fmt.Errorf("invalid wait_for_active_shards %d for %d replicas", st.WaitForActiveShards, st.NumberOfReplicas)
+	}
+	_, err := st.storeOptions()
+	return err
+}
+
+func (st Settings) storeOptions() (store.Options, error) {
+	opts := store.DefaultOptions()
+
+	d, err := store.ParseDurability(st.Durability)
+	if err != nil {
+		return opts, err
+	}
+	opts.Durability = d
+
+	if st.SyncInterval != "" {
+		interval, err := time.ParseDuration(st.SyncInterval)
+		if err != nil {
+			return opts, fmt.Errorf("invalid sync_interval %q: %w", st.SyncInterval, err)
+		}
+		opts.SyncInterval = interval
+	}
+
+	policy, err := store.ParseCorruptionPolicy(st.OnCorruption)
+	if err != nil {
+		return opts, err
+	}
+	opts.OnCorruption = policy
+
+	c, err := store.ParseCompression(st.Compression)
+	if err != nil {
+		return opts, err
+	}
+	opts.Compression = c
+
+	opts.RetainOperations = st.RetainOperations
+
+	if st.DefaultTTL != "" {
+		if opts.DefaultTTL, err = store.ParseTTL(st.DefaultTTL); err != nil {
+			return opts, fmt.Errorf("invalid default_ttl: %w", err)
+		}
+	}
+
+	if st.Mapping != nil {
+		if opts.Mapping, err = st.Mapping.Compile(); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// loadSettings reads the settings.json of an index written before index.json
+// existed.
+func loadSettings(indexPath string) (Settings, bool, error) {
+	var st Settings
+	data, err := os.ReadFile(filepath.Join(indexPath, "settings.json"))
+	if os.IsNotExist(err) {
+		return st, false, nil
+	}
+	if err != nil {
+		return st, false, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, false, err
+	}
+	return st, true, nil
+}
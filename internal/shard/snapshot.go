@@ -0,0 +1,458 @@
+package shard
+
+import (
+	"breeze/internal/cluster"
+	"breeze/internal/mapping"
+	"breeze/internal/snapshot"
+	"breeze/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// RepositoryConfig describes a snapshot repository. Only "fs" repositories
+// are supported. The location must not be inside the data directory, where
+// every directory is taken for an index.
+type RepositoryConfig struct {
+	Type     string `json:"type"`
+	Location string `json:"location"`
+}
+
+const repositoriesFile = "_repositories.json"
+
+func (m *Manager) loadRepositories() error {
+	data, err := os.ReadFile(filepath.Join(m.basePath, repositoriesFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var configs map[string]RepositoryConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return err
+	}
+	for name, cfg := range configs {
+		if err := m.openRepository(name, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openRepository registers the repository; the caller holds m.mu or is the
+// constructor.
+func (m *Manager) openRepository(name string, cfg RepositoryConfig) error {
+	if cfg.Type != "fs" {
+		return fmt.Errorf("unsupported repository type %q", cfg.Type)
+	}
+	if cfg.Location == "" {
+		return fmt.Errorf("repository %s has no location", name)
+	}
+	location, err := filepath.Abs(cfg.Location)
+	if err != nil {
+		return err
+	}
+	base, err := filepath.Abs(m.basePath)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(base, location); err == nil && filepath.IsLocal(rel) {
+		return fmt.Errorf("repository location %s is inside the data directory", cfg.Location)
+	}
+	repo, err := snapshot.OpenRepository(name, location)
+	if err != nil {
+		return err
+	}
+	m.repos[name] = repo
+	m.repoConfigs[name] = cfg
+	return nil
+}
+
+// PutRepository registers a snapshot repository on this node and, when
+// forward is set, on every other node.
+func (m *Manager) PutRepository(name string, cfg RepositoryConfig, forward bool) error {
+	m.mu.Lock()
+	err := m.openRepository(name, cfg)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(m.repoConfigs)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(m.basePath, repositoriesFile), data, 0644)
+		}
+	}
+	m.mu.Unlock()
+	if err != nil || !forward {
+		return err
+	}
+
+	for _, node := range m.Cluster.Nodes {
+		if !m.Cluster.IsLocal(node) {
+			if err := m.Forwarder.ForwardPutRepository(context.Background(), node, name, cfg); err != nil {
+				return fmt.Errorf("failed to register repository on node %s: %w", node.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Repositories returns the configuration of every registered repository.
+func (m *Manager) Repositories() map[string]RepositoryConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	configs := make(map[string]RepositoryConfig, len(m.repoConfigs))
+	for name, cfg := range m.repoConfigs {
+		configs[name] = cfg
+	}
+	return configs
+}
+
+func (m *Manager) Repository(name string) (*snapshot.Repository, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	repo, ok := m.repos[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: [%s]", snapshot.ErrRepositoryMissing, name)
+	}
+	return repo, nil
+}
+
+// ownedShards lists, per node, the shards of idx the node owns.
+func (idx *Index) ownedShards() map[string][]int {
+	owned := make(map[string][]int)
+	for i := 0; i < idx.numShards; i++ {
+		owner := idx.shardOwner(i)
+		owned[owner.ID] = append(owned[owner.ID], i)
+	}
+	return owned
+}
+
+// eachNode runs fn for every node of the cluster in parallel. fn reports
+// one error per shard it handled; when the node itself fails, every shard
+// it owns is reported as failed.
+func (idx *Index) eachNode(fn func(node cluster.Node) (map[int]error, error)) map[int]error {
+	owned := idx.ownedShards()
+	failures := make(map[int]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for nodeID := range owned {
+		node := idx.node(nodeID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := fn(node)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				for _, sID := range owned[node.ID] {
+					failures[sID] = err
+				}
+				return
+			}
+			for sID, err := range res {
+				if err != nil {
+					failures[sID] = err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return failures
+}
+
+// CreateSnapshot takes a snapshot of the named indices, or of every index
+// when indices is empty, and waits for it to complete.
+func (m *Manager) CreateSnapshot(repoName, snap string, indices []string) (snapshot.SnapshotInfo, error) {
+	info := snapshot.SnapshotInfo{Snapshot: snap, Indices: make(map[string]snapshot.IndexMeta)}
+	repo, err := m.Repository(repoName)
+	if err != nil {
+		return info, err
+	}
+
+	if len(indices) == 0 {
+		indices = m.ListIndices()
+	}
+	var targets []*Index
+	for _, name := range indices {
+		idx := m.GetIndex(name)
+		if idx == nil {
+			return info, fmt.Errorf("%w: [%s]", ErrIndexNotFound, name)
+		}
+		if err := idx.checkOpen(); err != nil {
+			return info, err
+		}
+		targets = append(targets, idx)
+	}
+
+	if err := repo.Begin(snap); err != nil {
+		return info, err
+	}
+	info.StartTime = time.Now()
+
+	for _, idx := range targets {
+		meta, err := idx.snapshotMeta()
+		if err != nil {
+			return info, err
+		}
+		info.Indices[idx.Name] = meta
+
+		failures := idx.eachNode(func(node cluster.Node) (map[int]error, error) {
+			if idx.Cluster.IsLocal(node) {
+				return idx.SnapshotShards(repo, snap), nil
+			}
+			return m.Forwarder.ForwardSnapshotShards(context.Background(), node, idx.Name, repoName, snap)
+		})
+		info.Shards.Total += idx.numShards
+		info.Shards.Failed += len(failures)
+		for sID, err := range failures {
+			info.Failures = append(info.Failures, snapshot.ShardFailure{
+				Index:  idx.Name,
+				Shard:  sID,
+				Node:   idx.shardOwner(sID).ID,
+				Reason: err.Error(),
+			})
+		}
+	}
+	info.Shards.Successful = info.Shards.Total - info.Shards.Failed
+	info.EndTime = time.Now()
+
+	switch {
+	case info.Shards.Failed == 0:
+		info.State = snapshot.StateSuccess
+	case info.Shards.Successful == 0:
+		info.State = snapshot.StateFailed
+	default:
+		info.State = snapshot.StatePartial
+	}
+	return info, repo.Finish(info)
+}
+
+func (idx *Index) snapshotMeta() (snapshot.IndexMeta, error) {
+	settings, err := json.Marshal(idx.Settings())
+	if err != nil {
+		return snapshot.IndexMeta{}, err
+	}
+	idx.Mapping.Mu.RLock()
+	fields, err := json.Marshal(idx.Mapping.Fields)
+	idx.Mapping.Mu.RUnlock()
+	if err != nil {
+		return snapshot.IndexMeta{}, err
+	}
+	return snapshot.IndexMeta{Shards: idx.numShards, Settings: settings, Mapping: fields}, nil
+}
+
+// SnapshotShards copies the local shards of the index into repo as part of
+// snap and reports the outcome per shard.
+func (idx *Index) SnapshotShards(repo *snapshot.Repository, snap string) map[int]error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	results := make(map[int]error, len(idx.Shards))
+	for sID, s := range idx.Shards {
+		results[sID] = idx.snapshotShard(repo, snap, sID, s)
+	}
+	return results
+}
+
+func (idx *Index) snapshotShard(repo *snapshot.Repository, snap string, sID int, s *store.Store) error {
+	tmp, err := os.MkdirTemp(idx.path, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "shard")
+	if err := s.Snapshot(dir); err != nil {
+		return err
+	}
+	_, err = repo.PutShard(snap, idx.Name, sID, dir)
+	return err
+}
+
+// RestoreRequest selects what a restore brings back. Indices defaults to
+// every index in the snapshot; RenamePattern and RenameReplacement work as
+// in Elasticsearch, using Go regexp syntax.
+type RestoreRequest struct {
+	Indices           []string
+	RenamePattern     string
+	RenameReplacement string
+}
+
+// RestoreResult reports what RestoreSnapshot restored.
+type RestoreResult struct {
+	Indices  []string
+	Shards   snapshot.ShardCounts
+	Failures []snapshot.ShardFailure
+}
+
+// RestoreSnapshot restores indices from a snapshot. Missing indices are
+// created with the settings they had when the snapshot was taken; existing
+// ones must have the same number of shards and have their shards replaced.
+func (m *Manager) RestoreSnapshot(repoName, snap string, req RestoreRequest) (RestoreResult, error) {
+	var result RestoreResult
+	repo, err := m.Repository(repoName)
+	if err != nil {
+		return result, err
+	}
+	info, err := repo.Snapshot(snap)
+	if err != nil {
+		return result, err
+	}
+
+	sources := req.Indices
+	if len(sources) == 0 {
+		for name := range info.Indices {
+			sources = append(sources, name)
+		}
+	}
+	var rename *regexp.Regexp
+	if req.RenamePattern != "" {
+		if rename, err = regexp.Compile(req.RenamePattern); err != nil {
+			return result, fmt.Errorf("invalid rename_pattern: %w", err)
+		}
+	}
+
+	for _, source := range sources {
+		meta, ok := info.Indices[source]
+		if !ok {
+			return result, fmt.Errorf("%w: index [%s] is not in snapshot [%s:%s]", snapshot.ErrSnapshotNotFound, source, repoName, snap)
+		}
+		target := source
+		if rename != nil {
+			target = rename.ReplaceAllString(source, req.RenameReplacement)
+		}
+
+		idx := m.GetIndex(target)
+		if idx == nil {
+			var settings Settings
+			if err := json.Unmarshal(meta.Settings, &settings); err != nil {
+				return result, fmt.Errorf("invalid settings of index %s in snapshot: %w", source, err)
+			}
+			if idx, err = m.CreateIndex(target, settings, true); err != nil {
+				return result, err
+			}
+		} else if idx.numShards != meta.Shards {
+			return result, fmt.Errorf("cannot restore index [%s] with %d shards into [%s] with %d shards", source, meta.Shards, target, idx.numShards)
+		} else if err := idx.checkWrite(); err != nil {
+			return result, err
+		}
+
+		failures := idx.eachNode(func(node cluster.Node) (map[int]error, error) {
+			if idx.Cluster.IsLocal(node) {
+				return idx.RestoreShards(repo, snap, source), nil
+			}
+			return m.Forwarder.ForwardRestoreShards(context.Background(), node, target, repoName, snap, source)
+		})
+		result.Indices = append(result.Indices, target)
+		result.Shards.Total += idx.numShards
+		result.Shards.Failed += len(failures)
+		for sID, err := range failures {
+			result.Failures = append(result.Failures, snapshot.ShardFailure{
+				Index:  target,
+				Shard:  sID,
+				Node:   idx.shardOwner(sID).ID,
+				Reason: err.Error(),
+			})
+		}
+	}
+	result.Shards.Successful = result.Shards.Total - result.Shards.Failed
+	return result, nil
+}
+
+// RestoreShards replaces the local shards of the index with the shards of
+// source in snap. Each shard is first restored next to the live one, so a
+// failed restore leaves the shard as it was.
+func (idx *Index) RestoreShards(repo *snapshot.Repository, snap, source string) map[int]error {
+	info, err := repo.Snapshot(snap)
+	if err != nil {
+		return idx.failLocal(err)
+	}
+	if meta, ok := info.Indices[source]; ok && len(meta.Mapping) > 0 {
+		fields := make(map[string]mapping.FieldType)
+		if err := json.Unmarshal(meta.Mapping, &fields); err == nil {
+			idx.Mapping.Mu.Lock()
+			idx.Mapping.Fields = fields
+			idx.Mapping.Mu.Unlock()
+			idx.saveMapping()
+		}
+	}
+
+	opts, err := idx.Settings().storeOptions()
+	if err != nil {
+		return idx.failLocal(err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	results := make(map[int]error, len(idx.Shards))
+	for sID := range idx.Shards {
+		results[sID] = idx.restoreShard(repo, snap, source, sID, opts)
+	}
+	return results
+}
+
+// restoreShard swaps in one shard; the caller holds idx.mu.
+func (idx *Index) restoreShard(repo *snapshot.Repository, snap, source string, sID int, opts store.Options) error {
+	shardPath := filepath.Join(idx.path, fmt.Sprintf("shard_%d", sID))
+	tmp, err := os.MkdirTemp(idx.path, ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := repo.RestoreShard(snap, source, sID, tmp); err != nil {
+		return err
+	}
+
+	if err := idx.Shards[sID].Close(); err != nil && !errors.Is(err, store.ErrClosed) {
+		return err
+	}
+	if err := os.RemoveAll(shardPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, shardPath); err != nil {
+		return err
+	}
+	s, err := store.Open(shardPath, opts)
+	if err != nil {
+		return err
+	}
+	if err := s.SetPrimaryTerm(idx.allocation(sID).term()); err != nil {
+		s.Close()
+		return err
+	}
+	// The WAL of the restored copy is not the one checkpoints were taken
+	// on before.
+	if err := s.NewHistory(); err != nil {
+		s.Close()
+		return err
+	}
+	idx.Shards[sID] = s
+	// The replicas hold the documents from before the restore.
+	idx.forgetReplicas(sID, nil)
+	return nil
+}
+
+func (idx *Index) failLocal(err error) map[int]error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	results := make(map[int]error, len(idx.Shards))
+	for sID := range idx.Shards {
+		results[sID] = err
+	}
+	return results
+}
+
+// DeleteSnapshot removes a snapshot from the repository.
+func (m *Manager) DeleteSnapshot(repoName, snap string) error {
+	repo, err := m.Repository(repoName)
+	if err != nil {
+		return err
+	}
+	return repo.Delete(snap)
+}
@@ -0,0 +1,207 @@
+package shard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/ugorji/go/codec"
+)
+
+// Versions of the internal protocol. A connection starts with a handshake,
+// see clientHandshake, that settles on the highest version both nodes
+// speak, so that nodes of different releases keep talking to each other
+// during a rolling upgrade.
+const (
+	// protocolJSON encodes requests and responses as JSON.
+	protocolJSON uint16 = 1
+	// protocolMsgpack encodes them as MessagePack, see msgpackCodec.
+	protocolMsgpack uint16 = 2
+	// protocolCancel adds ReqCancel, which cancels the request with the ID
+	// of its frame, and bounds the time requests are handled for by their
+	// Timeout.
+	protocolCancel uint16 = 3
+
+	minProtocol = protocolJSON
+	maxProtocol = protocolCancel
+)
+
+// handshakeMagic starts the handshake frames, which have ID 0.
+var handshakeMagic = []byte("BRZP")
+
+// wireCodec encodes the requests and responses of a protocol version.
+type wireCodec interface {
+	encode(v interface{}) ([]byte, error)
+	decode(data []byte, v interface{}) error
+}
+
+func codecFor(version uint16) wireCodec {
+	if version >= protocolMsgpack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) decode(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec encodes requests and responses as MessagePack, which is
+// smaller than JSON and much cheaper to produce and parse, notably for the
+// hits of search results. Search requests, whose query is an interface
+// that only the JSON decoder of bleve rebuilds, and the parts of search
+// results other than the hits, which hold such values too, are embedded as
+// JSON, see msgpackRequest and msgpackResponse.
+type msgpackCodec struct{}
+
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	// Decode like encoding/json does into interfaces, except that
+	// integers stay integers.
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	h.RawToString = true
+	h.SignedInteger = true
+	h.WriteExt = true
+	return h
+}()
+
+// msgpackRequest is an InternalRequest in MessagePack. Its SearchReq
+// replaces the one of the request.
+type msgpackRequest struct {
+	InternalRequest
+	SearchReq []byte `codec:"search_req,omitempty"`
+}
+
+// msgpackResponse is an InternalResponse in MessagePack. Its SearchResult
+// replaces the one of the response.
+type msgpackResponse struct {
+	InternalResponse
+	SearchResult *msgpackSearchResult `codec:"search_result,omitempty"`
+}
+
+// msgpackSearchResult is a bleve.SearchResult: its hits, and the rest of
+// it as JSON.
+type msgpackSearchResult struct {
+	Hits search.DocumentMatchCollection `codec:"hits"`
+	Rest []byte                         `codec:"rest"`
+}
+
+func (msgpackCodec) encode(v interface{}) (data []byte, err error) {
+	switch v := v.(type) {
+	case InternalRequest:
+		req := msgpackRequest{InternalRequest: v}
+		if v.SearchReq != nil {
+			if req.SearchReq, err = json.Marshal(v.SearchReq); err != nil {
+				return nil, fmt.Errorf("failed to encode search request: %w", err)
+			}
+		}
+		err = codec.NewEncoderBytes(&data, msgpackHandle).Encode(req)
+	case InternalResponse:
+		resp := msgpackResponse{InternalResponse: v}
+		if v.SearchResult != nil {
+			rest := *v.SearchResult
+			rest.Hits = nil
+			resp.SearchResult = &msgpackSearchResult{Hits: v.SearchResult.Hits}
+			if resp.SearchResult.Rest, err = json.Marshal(rest); err != nil {
+				return nil, fmt.Errorf("failed to encode search result: %w", err)
+			}
+		}
+		err = codec.NewEncoderBytes(&data, msgpackHandle).Encode(resp)
+	default:
+		err = codec.NewEncoderBytes(&data, msgpackHandle).Encode(v)
+	}
+	return data, err
+}
+
+func (msgpackCodec) decode(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *InternalRequest:
+		var req msgpackRequest
+		if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&req); err != nil {
+			return err
+		}
+		*v = req.InternalRequest
+		if req.SearchReq != nil {
+			v.SearchReq = new(bleve.SearchRequest)
+			if err := json.Unmarshal(req.SearchReq, v.SearchReq); err != nil {
+				return fmt.Errorf("failed to decode search request: %w", err)
+			}
+		}
+		return nil
+	case *InternalResponse:
+		var resp msgpackResponse
+		if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&resp); err != nil {
+			return err
+		}
+		*v = resp.InternalResponse
+		if resp.SearchResult != nil {
+			v.SearchResult = new(bleve.SearchResult)
+			if err := json.Unmarshal(resp.SearchResult.Rest, v.SearchResult); err != nil {
+				return fmt.Errorf("failed to decode search result: %w", err)
+			}
+			v.SearchResult.Hits = resp.SearchResult.Hits
+		}
+		return nil
+	}
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+// clientHandshake offers the protocol versions from minVersion to
+// maxVersion on a new connection and returns the one the server picked.
+func clientHandshake(rw io.ReadWriter, minVersion, maxVersion uint16) (uint16, error) {
+	hello := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(bytes.Clone(handshakeMagic), minVersion), maxVersion)
+	if err := writeFrame(rw, 0, hello); err != nil {
+		return 0, err
+	}
+	_, reply, err := readFrame(rw)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) < len(handshakeMagic)+2 || !bytes.HasPrefix(reply, handshakeMagic) {
+		return 0, fmt.Errorf("unexpected handshake reply")
+	}
+	version := binary.BigEndian.Uint16(reply[len(handshakeMagic):])
+	if version == 0 {
+		return 0, fmt.Errorf("no common protocol version: %s", reply[len(handshakeMagic)+2:])
+	}
+	if version < minVersion || version > maxVersion {
+		return 0, fmt.Errorf("server picked protocol version %d, not between %d and %d", version, minVersion, maxVersion)
+	}
+	return version, nil
+}
+
+// serverHandshake reads the protocol versions a client offers and answers
+// with the highest one it speaks too, up to maxVersion, or with 0 and the
+// reason if there is none, in which case it fails.
+func serverHandshake(rw io.ReadWriter, minVersion, maxVersion uint16) (uint16, error) {
+	id, hello, err := readFrame(rw)
+	if err != nil {
+		return 0, err
+	}
+	if id != 0 || len(hello) != len(handshakeMagic)+4 || !bytes.HasPrefix(hello, handshakeMagic) {
+		return 0, fmt.Errorf("connection did not start with a handshake")
+	}
+	clientMin := binary.BigEndian.Uint16(hello[len(handshakeMagic):])
+	clientMax := binary.BigEndian.Uint16(hello[len(handshakeMagic)+2:])
+
+	version := min(clientMax, maxVersion)
+	reply := bytes.Clone(handshakeMagic)
+	if version < minVersion || version < clientMin {
+		reply = binary.BigEndian.AppendUint16(reply, 0)
+		reply = fmt.Appendf(reply, "client speaks versions %d to %d, server %d to %d", clientMin, clientMax, minVersion, maxVersion)
+		err = fmt.Errorf("no common protocol version: %s", reply[len(handshakeMagic)+2:])
+		if werr := writeFrame(rw, 0, reply); werr != nil {
+			err = werr
+		}
+		return 0, err
+	}
+	reply = binary.BigEndian.AppendUint16(reply, version)
+	return version, writeFrame(rw, 0, reply)
+}
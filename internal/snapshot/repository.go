@@ -0,0 +1,337 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A repository is a directory laid out as
+//
+//	blobs/<sha256>                                  file contents
+//	snapshots/<snap>/snapshot.json                  SnapshotInfo
+//	snapshots/<snap>/indices/<index>/shard_<n>.json ShardManifest
+//
+// Files are stored by content hash, so segments that did not change since
+// an earlier snapshot are not copied again. Snapshots of a cluster are only
+// complete if every node writes to the same directory, as with
+// Elasticsearch's shared file system repositories.
+
+var (
+	ErrRepositoryMissing = errors.New("repository missing")
+	ErrSnapshotNotFound  = errors.New("snapshot not found")
+	ErrSnapshotExists    = errors.New("snapshot already exists")
+)
+
+const (
+	StateSuccess = "SUCCESS"
+	StatePartial = "PARTIAL"
+	StateFailed  = "FAILED"
+)
+
+// FileRef is one file of a shard copy.
+type FileRef struct {
+	Name string `json:"name"`
+	Blob string `json:"blob"`
+	Size int64  `json:"size"`
+}
+
+type ShardManifest struct {
+	Index string    `json:"index"`
+	Shard int       `json:"shard"`
+	Files []FileRef `json:"files"`
+}
+
+// IndexMeta is what is needed to recreate an index on restore. Settings and
+// Mapping are kept opaque so the repository does not depend on the shard
+// package.
+type IndexMeta struct {
+	Shards   int             `json:"shards"`
+	Settings json.RawMessage `json:"settings,omitempty"`
+	Mapping  json.RawMessage `json:"mapping,omitempty"`
+}
+
+type ShardFailure struct {
+	Index  string `json:"index"`
+	Shard  int    `json:"shard_id"`
+	Node   string `json:"node_id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type ShardCounts struct {
+	Total      int `json:"total"`
+	Failed     int `json:"failed"`
+	Successful int `json:"successful"`
+}
+
+type SnapshotInfo struct {
+	Snapshot  string               `json:"snapshot"`
+	State     string               `json:"state"`
+	Indices   map[string]IndexMeta `json:"indices"`
+	StartTime time.Time            `json:"start_time"`
+	EndTime   time.Time            `json:"end_time"`
+	Shards    ShardCounts          `json:"shards"`
+	Failures  []ShardFailure       `json:"failures,omitempty"`
+}
+
+type Repository struct {
+	Name     string
+	Location string
+}
+
+func OpenRepository(name, location string) (*Repository, error) {
+	for _, dir := range []string{"blobs", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(location, dir), 0755); err != nil {
+			return nil, fmt.Errorf("failed to open repository %s: %w", name, err)
+		}
+	}
+	return &Repository{Name: name, Location: location}, nil
+}
+
+func (r *Repository) snapshotDir(snap string) string {
+	return filepath.Join(r.Location, "snapshots", snap)
+}
+
+func (r *Repository) manifestPath(snap, index string, shard int) string {
+	return filepath.Join(r.snapshotDir(snap), "indices", index, fmt.Sprintf("shard_%d.json", shard))
+}
+
+func (r *Repository) blobPath(blob string) string {
+	return filepath.Join(r.Location, "blobs", blob)
+}
+
+// PutShard stores the files under dir as shard of index in snap.
+func (r *Repository) PutShard(snap, index string, shard int, dir string) (ShardManifest, error) {
+	manifest := ShardManifest{Index: index, Shard: shard}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		ref, err := r.putBlob(path)
+		if err != nil {
+			return err
+		}
+		ref.Name = filepath.ToSlash(rel)
+		manifest.Files = append(manifest.Files, ref)
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, writeJSON(r.manifestPath(snap, index, shard), manifest)
+}
+
+func (r *Repository) putBlob(path string) (FileRef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileRef{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return FileRef{}, err
+	}
+	ref := FileRef{Blob: hex.EncodeToString(h.Sum(nil)), Size: size}
+
+	dst := r.blobPath(ref.Blob)
+	if _, err := os.Stat(dst); err == nil {
+		return ref, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ref, err
+	}
+	return ref, writeAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+// RestoreShard copies the files of shard of index in snap into dir.
+func (r *Repository) RestoreShard(snap, index string, shard int, dir string) error {
+	var manifest ShardManifest
+	if err := readJSON(r.manifestPath(snap, index, shard), &manifest); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: shard %d of index %s is not in snapshot %s", ErrSnapshotNotFound, shard, index, snap)
+		}
+		return err
+	}
+	for _, ref := range manifest.Files {
+		if err := r.restoreBlob(ref, filepath.Join(dir, filepath.FromSlash(ref.Name))); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", ref.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Repository) restoreBlob(ref FileRef, dst string) error {
+	src, err := os.Open(r.blobPath(ref.Blob))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, h), src)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if size != ref.Size || hex.EncodeToString(h.Sum(nil)) != ref.Blob {
+		return fmt.Errorf("blob %s does not match its checksum", ref.Blob)
+	}
+	return nil
+}
+
+// Begin reserves the name of a new snapshot.
+func (r *Repository) Begin(snap string) error {
+	if err := os.Mkdir(r.snapshotDir(snap), 0755); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: [%s:%s]", ErrSnapshotExists, r.Name, snap)
+		}
+		return err
+	}
+	return nil
+}
+
+// Finish records the outcome of a snapshot. Only snapshots with an info
+// file are listed.
+func (r *Repository) Finish(info SnapshotInfo) error {
+	return writeJSON(filepath.Join(r.snapshotDir(info.Snapshot), "snapshot.json"), info)
+}
+
+func (r *Repository) Snapshot(snap string) (SnapshotInfo, error) {
+	var info SnapshotInfo
+	err := readJSON(filepath.Join(r.snapshotDir(snap), "snapshot.json"), &info)
+	if os.IsNotExist(err) {
+		return info, fmt.Errorf("%w: [%s:%s]", ErrSnapshotNotFound, r.Name, snap)
+	}
+	return info, err
+}
+
+// Snapshots lists the finished snapshots ordered by start time.
+func (r *Repository) Snapshots() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(r.Location, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var infos []SnapshotInfo
+	for _, entry := range entries {
+		info, err := r.Snapshot(entry.Name())
+		if errors.Is(err, ErrSnapshotNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartTime.Before(infos[j].StartTime) })
+	return infos, nil
+}
+
+// Delete removes a snapshot and the blobs no other snapshot refers to. It
+// must not run while another snapshot is being taken in the repository.
+func (r *Repository) Delete(snap string) error {
+	if _, err := os.Stat(r.snapshotDir(snap)); os.IsNotExist(err) {
+		return fmt.Errorf("%w: [%s:%s]", ErrSnapshotNotFound, r.Name, snap)
+	}
+	if err := os.RemoveAll(r.snapshotDir(snap)); err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	err := filepath.WalkDir(filepath.Join(r.Location, "snapshots"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Base(filepath.Dir(filepath.Dir(path))) != "indices" {
+			return err
+		}
+		var manifest ShardManifest
+		if err := readJSON(path, &manifest); err != nil {
+			return err
+		}
+		for _, ref := range manifest.Files {
+			used[ref.Blob] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(r.Location, "blobs"))
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if !used[blob.Name()] {
+			os.Remove(r.blobPath(blob.Name()))
+		}
+	}
+	return nil
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeAtomic writes a file under a temporary name and renames it into
+// place, so readers never see a partial file.
+func writeAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tidwall/wal"
+)
+
+// ErrChangesTruncated is returned when the changes after a checkpoint have
+// already been removed from the WAL.
+var ErrChangesTruncated = errors.New("changes are no longer retained")
+
+// Change is one document operation read back from the WAL. Checkpoint is the
+// WAL index of the record it belongs to; the operations of a batch share it.
+type Change struct {
+	Checkpoint  uint64          `json:"checkpoint"`
+	Op          Operation       `json:"op"`
+	ID          string          `json:"id"`
+	Version     uint64          `json:"version,omitempty"`
+	SeqNo       uint64          `json:"seq_no,omitempty"`
+	PrimaryTerm uint64          `json:"primary_term,omitempty"`
+	Timestamp   int64           `json:"timestamp,omitempty"`
+	ExpiresAt   int64           `json:"expires_at,omitempty"`
+	Routing     string          `json:"routing,omitempty"`
+	Source      json.RawMessage `json:"source,omitempty"`
+}
+
+// Changes returns the operations applied after the checkpoint since, oldest
+// first, reading at most limit WAL records, together with the checkpoint to
+// resume from. Only operations that are visible in the index are returned,
+// and a batch is never split. Changes older than the WAL retention fail with
+// ErrChangesTruncated.
+func (s *Store) Changes(since uint64, limit int) ([]Change, uint64, error) {
+	if s.isClosed() {
+		return nil, since, ErrClosed
+	}
+	cp := s.Checkpoint()
+	if since >= cp {
+		return nil, since, nil
+	}
+	first, err := s.log.FirstIndex()
+	if err != nil {
+		return nil, since, err
+	}
+	if first == 0 || since+1 < first {
+		return nil, since, fmt.Errorf("%w: %s has no changes after checkpoint %d, the oldest retained is %d",
+			ErrChangesTruncated, s.path, since, first)
+	}
+
+	last := cp
+	if limit > 0 && since+uint64(limit) < last {
+		last = since + uint64(limit)
+	}
+	var changes []Change
+	for i := since + 1; i <= last; i++ {
+		entry, err := s.readEntry(i)
+		if errors.Is(err, wal.ErrNotFound) {
+			return nil, since, fmt.Errorf("%w: %s truncated checkpoint %d while it was read", ErrChangesTruncated, s.path, i)
+		}
+		if err != nil {
+			return nil, since, fmt.Errorf("wal record %d: %w", i, err)
+		}
+		changes = appendChanges(changes, entry, i)
+	}
+	return changes, last, nil
+}
+
+// Scan returns the documents of the store with an ID after after, in ID
+// order, at most limit of them, as OpIndex changes carrying their current
+// version and source. Deleted documents are returned as OpDelete changes so
+// their version survives a copy. Scan does not see the writes that are
+// queued but not applied yet; pair it with HoldChanges and Changes to also
+// copy the writes made while scanning.
+func (s *Store) Scan(after string, limit int) ([]Change, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+	return s.docs.scan(after, limit)
+}
+
+func appendChanges(changes []Change, entry LogEntry, walIndex uint64) []Change {
+	if entry.Op == OpBatch {
+		for _, op := range entry.Ops {
+			changes = appendChanges(changes, op, walIndex)
+		}
+		return changes
+	}
+	return append(changes, Change{
+		Checkpoint:  walIndex,
+		Op:          entry.Op,
+		ID:          entry.ID,
+		Version:     entry.Version,
+		SeqNo:       entry.SeqNo,
+		PrimaryTerm: entry.PrimaryTerm,
+		Timestamp:   entry.Timestamp,
+		ExpiresAt:   entry.ExpiresAt,
+		Routing:     entry.Routing,
+		Source:      entry.Source,
+	})
+}
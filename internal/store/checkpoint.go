@@ -0,0 +1,188 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// checkpointKey is the Bleve internal key holding the last WAL index whose
+// effects are contained in the index. It is written in the same batch as the
+// documents it covers, so it is persisted atomically with them.
+var checkpointKey = []byte("_breeze_wal_checkpoint")
+
+// DefaultTruncateInterval is how often a store truncates WAL entries that are
+// already covered by the checkpoint.
+var DefaultTruncateInterval = 30 * time.Second
+
+func encodeCheckpoint(i uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, i)
+	return buf
+}
+
+func (s *Store) loadCheckpoint() (uint64, error) {
+	v, err := s.index.GetInternal(checkpointKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) == 0 {
+		return 0, nil
+	}
+	if len(v) != 8 {
+		return 0, fmt.Errorf("invalid checkpoint length %d", len(v))
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+// Checkpoint returns the last WAL index durably applied to the index.
+func (s *Store) Checkpoint() uint64 {
+	return s.checkpoint.Load()
+}
+
+// historyKey is the document store key holding the history ID of the store.
+const historyKey = "history_uuid"
+
+// History returns the ID of the history of the store. Checkpoints are WAL
+// indexes, so they only mean something for the store they were taken on: a
+// copy of the same documents, made by replicating, relocating or restoring a
+// shard, numbers its WAL on its own and gets a history of its own.
+func (s *Store) History() string {
+	return s.history
+}
+
+func (s *Store) loadHistory() error {
+	v, err := s.docs.getBytes(historyKey)
+	if err != nil {
+		return err
+	}
+	if len(v) > 0 {
+		s.history = string(v)
+		return nil
+	}
+	return s.NewHistory()
+}
+
+// NewHistory gives the store a new history ID, for a store restored from a
+// copy of another one. It must be called before the store is used.
+func (s *Store) NewHistory() error {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b[:])
+	if err := s.docs.setBytes(historyKey, []byte(id)); err != nil {
+		return err
+	}
+	s.history = id
+	return nil
+}
+
+// walHold keeps the WAL records after a checkpoint until it expires.
+type walHold struct {
+	since   uint64
+	expires time.Time
+}
+
+// HoldChanges keeps every WAL record applied after the current checkpoint
+// for ttl, whatever the retention, and returns that checkpoint. Holding a
+// key again extends the hold without moving its checkpoint. The hold ends
+// after ttl or when the key is released.
+func (s *Store) HoldChanges(key string, ttl time.Duration) uint64 {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	if s.holds == nil {
+		s.holds = make(map[string]walHold)
+	}
+	h, ok := s.holds[key]
+	if !ok || time.Now().After(h.expires) {
+		h.since = s.checkpoint.Load()
+	}
+	h.expires = time.Now().Add(ttl)
+	s.holds[key] = h
+	return h.since
+}
+
+// MoveHold keeps the WAL records applied after since for ttl, replacing the
+// hold of key, for a reader that has consumed the changes up to since.
+func (s *Store) MoveHold(key string, since uint64, ttl time.Duration) {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	if s.holds == nil {
+		s.holds = make(map[string]walHold)
+	}
+	s.holds[key] = walHold{since: since, expires: time.Now().Add(ttl)}
+}
+
+// ReleaseChanges ends the hold of key.
+func (s *Store) ReleaseChanges(key string) {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	delete(s.holds, key)
+}
+
+// heldFrom returns the oldest checkpoint a hold still needs the changes
+// after, dropping expired holds.
+func (s *Store) heldFrom() (uint64, bool) {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	var since uint64
+	found := false
+	now := time.Now()
+	for key, h := range s.holds {
+		if now.After(h.expires) {
+			delete(s.holds, key)
+			continue
+		}
+		if !found || h.since < since {
+			since, found = h.since, true
+		}
+	}
+	return since, found
+}
+
+func (s *Store) truncateLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.truncateWAL(); err != nil {
+				fmt.Printf("Failed to truncate wal %s: %v\n", s.path, err)
+			}
+		}
+	}
+}
+
+// truncateWAL drops every WAL entry before the checkpoint, except for the
+// last opts.RetainOperations ones that Changes can still read. The
+// checkpoint entry itself is kept so the log never becomes empty and new
+// writes keep their position in the index sequence. The tombstones of the
+// deletes dropped from the WAL are pruned along with them.
+func (s *Store) truncateWAL() error {
+	cp := s.checkpoint.Load()
+	if cp <= s.opts.RetainOperations {
+		return nil
+	}
+	cp -= s.opts.RetainOperations
+	if held, ok := s.heldFrom(); ok && held+1 < cp {
+		cp = held + 1
+	}
+	first, err := s.log.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if first == 0 || cp <= first {
+		return nil
+	}
+	if err := s.log.TruncateFront(cp); err != nil {
+		return err
+	}
+	_, err = s.docs.pruneTombstones(cp)
+	return err
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/golang/snappy"
+)
+
+// WAL records are encoded as
+//
+//	version (1 byte) | crc32c of body (4 bytes, big endian) | body
+//
+// and the body is a sequence of tagged fields
+//
+//	tag (1 byte) | uvarint length | value
+//
+// Decoders skip tags they do not know, so fields can be added without a new
+// record version. Records written before the binary format are JSON objects
+// and are still accepted on replay.
+const walFormatV1 byte = 1
+
+const (
+	tagOp   byte = 1
+	tagID   byte = 2
+	tagData byte = 3
+	tagSub  byte = 4
+	tagVer  byte = 5
+	tagSeq  byte = 6
+	tagTerm byte = 7
+	// tagSource holds the raw JSON source. It replaced tagData, whose value
+	// embedded a copy of the document in a "_source" key.
+	tagSource byte = 8
+	// tagSnappySource holds the source compressed with snappy.
+	tagSnappySource byte = 9
+	// tagExpires holds the expiry time in Unix milliseconds.
+	tagExpires byte = 10
+	// tagTime holds the operation timestamp in Unix milliseconds.
+	tagTime byte = 11
+	// tagRouting holds the routing key of the document.
+	tagRouting byte = 12
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrChecksum is returned when a WAL record does not match its CRC.
+	ErrChecksum = errors.New("wal record checksum mismatch")
+	// ErrCorruptRecord is returned when a WAL record cannot be decoded.
+	ErrCorruptRecord = errors.New("corrupt wal record")
+)
+
+var opCodes = map[Operation]byte{
+	OpIndex:  1,
+	OpDelete: 2,
+	OpBatch:  3,
+}
+
+func opFromCode(code byte) (Operation, bool) {
+	for op, c := range opCodes {
+		if c == code {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func encodeEntry(entry LogEntry, c Compression) ([]byte, error) {
+	body, err := appendEntryBody(nil, entry, c)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 5, 5+len(body))
+	out[0] = walFormatV1
+	binary.BigEndian.PutUint32(out[1:5], crc32.Checksum(body, crcTable))
+	return append(out, body...), nil
+}
+
+func appendField(dst []byte, tag byte, value []byte) []byte {
+	dst = append(dst, tag)
+	dst = binary.AppendUvarint(dst, uint64(len(value)))
+	return append(dst, value...)
+}
+
+func appendEntryBody(dst []byte, entry LogEntry, c Compression) ([]byte, error) {
+	code, ok := opCodes[entry.Op]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation %q", entry.Op)
+	}
+	dst = appendField(dst, tagOp, []byte{code})
+	if entry.ID != "" {
+		dst = appendField(dst, tagID, []byte(entry.ID))
+	}
+	if entry.Routing != "" {
+		dst = appendField(dst, tagRouting, []byte(entry.Routing))
+	}
+	if entry.Source != nil {
+		if c == CompressionSnappy {
+			dst = appendField(dst, tagSnappySource, snappy.Encode(nil, entry.Source))
+		} else {
+			dst = appendField(dst, tagSource, entry.Source)
+		}
+	}
+	for _, f := range []struct {
+		tag   byte
+		value uint64
+	}{{tagVer, entry.Version}, {tagSeq, entry.SeqNo}, {tagTerm, entry.PrimaryTerm}, {tagExpires, uint64(entry.ExpiresAt)}, {tagTime, uint64(entry.Timestamp)}} {
+		if f.value != 0 {
+			dst = appendField(dst, f.tag, binary.AppendUvarint(nil, f.value))
+		}
+	}
+	for _, op := range entry.Ops {
+		sub, err := appendEntryBody(nil, op, c)
+		if err != nil {
+			return nil, err
+		}
+		dst = appendField(dst, tagSub, sub)
+	}
+	return dst, nil
+}
+
+func decodeEntry(data []byte) (LogEntry, error) {
+	var entry LogEntry
+	if len(data) == 0 {
+		return entry, ErrCorruptRecord
+	}
+	if data[0] == '{' {
+		return decodeJSONEntry(data)
+	}
+	if data[0] != walFormatV1 {
+		return entry, fmt.Errorf("%w: unknown record version %d", ErrCorruptRecord, data[0])
+	}
+	if len(data) < 5 {
+		return entry, ErrCorruptRecord
+	}
+	body := data[5:]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[1:5]) {
+		return entry, ErrChecksum
+	}
+	return decodeEntryBody(body)
+}
+
+func decodeEntryBody(body []byte) (LogEntry, error) {
+	var entry LogEntry
+	for len(body) > 0 {
+		tag := body[0]
+		size, n := binary.Uvarint(body[1:])
+		if n <= 0 || uint64(len(body)-1-n) < size {
+			return entry, ErrCorruptRecord
+		}
+		value := body[1+n : 1+n+int(size)]
+		body = body[1+n+int(size):]
+
+		switch tag {
+		case tagOp:
+			if len(value) != 1 {
+				return entry, ErrCorruptRecord
+			}
+			op, ok := opFromCode(value[0])
+			if !ok {
+				return entry, fmt.Errorf("%w: unknown operation code %d", ErrCorruptRecord, value[0])
+			}
+			entry.Op = op
+		case tagID:
+			entry.ID = string(value)
+		case tagRouting:
+			entry.Routing = string(value)
+		case tagData:
+			entry.Source = legacySource(append([]byte(nil), value...))
+		case tagSource:
+			entry.Source = append([]byte(nil), value...)
+		case tagSnappySource:
+			src, err := snappy.Decode(nil, value)
+			if err != nil {
+				return entry, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+			}
+			entry.Source = src
+		case tagVer, tagSeq, tagTerm, tagExpires, tagTime:
+			v, n := binary.Uvarint(value)
+			if n <= 0 || n != len(value) {
+				return entry, ErrCorruptRecord
+			}
+			switch tag {
+			case tagVer:
+				entry.Version = v
+			case tagSeq:
+				entry.SeqNo = v
+			case tagTerm:
+				entry.PrimaryTerm = v
+			case tagExpires:
+				entry.ExpiresAt = int64(v)
+			case tagTime:
+				entry.Timestamp = int64(v)
+			}
+		case tagSub:
+			sub, err := decodeEntryBody(value)
+			if err != nil {
+				return entry, err
+			}
+			entry.Ops = append(entry.Ops, sub)
+		}
+	}
+	if entry.Op == "" {
+		return entry, fmt.Errorf("%w: missing operation", ErrCorruptRecord)
+	}
+	return entry, nil
+}
+
+// jsonEntry is the record format used before the binary encoding.
+type jsonEntry struct {
+	Op   Operation       `json:"op"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+func decodeJSONEntry(data []byte) (LogEntry, error) {
+	var je jsonEntry
+	if err := json.Unmarshal(data, &je); err != nil {
+		return LogEntry{}, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+	entry := LogEntry{Op: je.Op, ID: je.ID}
+	if len(je.Data) > 0 && string(je.Data) != "null" {
+		entry.Source = legacySource(je.Data)
+	}
+	return entry, nil
+}
+
+// legacySource strips the copy of the document that older versions embedded
+// in its own "_source" key.
+func legacySource(source []byte) []byte {
+	var doc struct {
+		Source *string `json:"_source"`
+	}
+	if json.Unmarshal(source, &doc) == nil && doc.Source != nil {
+		return []byte(*doc.Source)
+	}
+	return source
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/tidwall/wal"
+)
+
+// maxGroupSize bounds how many queued write requests are merged into a
+// single WAL write and fsync.
+const maxGroupSize = 256
+
+var ErrClosed = errors.New("store is closed")
+
+// ErrFailed is returned for the writes to a store that failed to commit a
+// group of writes. The group may be in the WAL without being applied, so
+// the store takes no more writes, which would move the checkpoint past it,
+// until it is reopened and the WAL is replayed.
+var ErrFailed = errors.New("store failed")
+
+// writeRequest is a single WAL record together with the index changes it
+// describes, prepared by the caller.
+type writeRequest struct {
+	entry LogEntry
+	batch *bleve.Batch
+	done  chan error
+}
+
+// enqueue hands a prepared entry to the group-commit writer. The caller must
+// hold s.mu so that entries are logged in sequence number order, and then
+// waits on the returned request's done channel, after releasing s.mu, until
+// the entry is in the WAL (and fsynced, depending on durability) and applied
+// to the index.
+func (s *Store) enqueue(entry LogEntry, batch *bleve.Batch) (*writeRequest, error) {
+	req := &writeRequest{entry: entry, batch: batch, done: make(chan error, 1)}
+
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if err := s.health.stopped(); err != nil {
+		return nil, err
+	}
+	s.writes <- req
+	return req, nil
+}
+
+func (s *Store) isClosed() bool {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	return s.closed
+}
+
+// commitLoop is the single writer of the WAL. It drains whatever requests are
+// queued, writes them in one WAL batch and one fsync, applies them to the
+// index in one Bleve batch and then acknowledges every caller.
+func (s *Store) commitLoop() {
+	defer s.wg.Done()
+	group := make([]*writeRequest, 0, maxGroupSize)
+	for {
+		select {
+		case req := <-s.writes:
+			group = append(group[:0], req)
+		case <-s.done:
+			// Close stops new submissions before closing done, so whatever is
+			// buffered now is the complete remainder.
+			for {
+				select {
+				case req := <-s.writes:
+					s.commitGroup([]*writeRequest{req})
+				default:
+					return
+				}
+			}
+		}
+
+	drain:
+		for len(group) < maxGroupSize {
+			select {
+			case req := <-s.writes:
+				group = append(group, req)
+			default:
+				break drain
+			}
+		}
+		s.commitGroup(group)
+	}
+}
+
+// commitGroup writes and applies a group, unless the store failed before.
+// A group that fails stops the store, see ErrFailed.
+func (s *Store) commitGroup(group []*writeRequest) {
+	s.commitMu.Lock()
+	err := s.health.stopped()
+	if err == nil {
+		if err = s.writeGroup(group); err != nil {
+			fmt.Printf("Failed to commit %d writes to %s, it takes no more writes until it is reopened: %v\n", len(group), s.path, err)
+			s.health.failed(err)
+		}
+	}
+	s.commitMu.Unlock()
+
+	// Either the index reflects the group now or the writes failed; in both
+	// cases the live metadata is no longer needed.
+	s.liveMu.Lock()
+	for _, req := range group {
+		s.forgetApplied(req.entry)
+	}
+	s.liveMu.Unlock()
+
+	for _, req := range group {
+		req.done <- err
+	}
+}
+
+func (s *Store) writeGroup(group []*writeRequest) error {
+	lastIndex, err := s.log.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	var walBatch wal.Batch
+	next := lastIndex
+	for _, req := range group {
+		data, err := encodeEntry(req.entry, s.opts.Compression)
+		if err != nil {
+			return err
+		}
+		next++
+		walBatch.Write(next, data)
+	}
+
+	if err := s.log.WriteBatch(&walBatch); err != nil {
+		return err
+	}
+	if s.opts.Durability == DurabilityRequest {
+		if err := s.log.Sync(); err != nil {
+			return err
+		}
+	}
+
+	batch := group[0].batch
+	entries := make([]LogEntry, len(group))
+	var seqNo uint64
+	for i, req := range group {
+		if i > 0 {
+			batch.Merge(req.batch)
+		}
+		entries[i] = req.entry
+		if seq := maxSeqNo(req.entry); seq > seqNo {
+			seqNo = seq
+		}
+	}
+	return s.commit(batch, entries, next, seqNo)
+}
+
+func (s *Store) syncLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.log.Sync(); err != nil {
+				fmt.Printf("Failed to sync wal %s: %v\n", s.path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/snappy"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	docsBucket = []byte("docs")
+	metaBucket = []byte("meta")
+	statsKey   = []byte("stats")
+	// tombstonesBucket indexes the tombstones in docsBucket by the WAL index
+	// they were written at, see pruneTombstones.
+	tombstonesBucket = []byte("tombstones")
+)
+
+// docStore keeps the source and version metadata of every document keyed by
+// ID, so point reads do not go through the search index. Deleted documents
+// are kept as tombstones without a source until the WAL no longer holds
+// their deletes.
+type docStore struct {
+	db          *bolt.DB
+	compression Compression
+}
+
+// sourceStats are running totals over the live documents of a store. They
+// are kept in the meta bucket and updated in the same transaction as the
+// documents.
+type sourceStats struct {
+	Docs        uint64
+	SourceBytes uint64
+	StoredBytes uint64
+}
+
+func (st sourceStats) encode() []byte {
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, st.Docs)
+	buf = binary.AppendUvarint(buf, st.SourceBytes)
+	return binary.AppendUvarint(buf, st.StoredBytes)
+}
+
+func decodeSourceStats(buf []byte) (sourceStats, error) {
+	var st sourceStats
+	for _, field := range []*uint64{&st.Docs, &st.SourceBytes, &st.StoredBytes} {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return st, fmt.Errorf("invalid document store stats")
+		}
+		*field = v
+		buf = buf[n:]
+	}
+	return st, nil
+}
+
+// add adjusts the totals for a record being written (sign 1) or replaced
+// (sign -1).
+func (st *sourceStats) add(record []byte, sign int) error {
+	meta, source, compressed, err := decodeRecord(record)
+	if err != nil || meta.Deleted {
+		return err
+	}
+	size := len(source)
+	if compressed {
+		if size, err = snappy.DecodedLen(source); err != nil {
+			return err
+		}
+	}
+	if sign > 0 {
+		st.Docs++
+		st.SourceBytes += uint64(size)
+		st.StoredBytes += uint64(len(source))
+	} else {
+		st.Docs--
+		st.SourceBytes -= uint64(size)
+		st.StoredBytes -= uint64(len(source))
+	}
+	return nil
+}
+
+func openDocStore(path string, c Compression) (*docStore, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{docsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(tombstonesBucket) == nil {
+			if err := indexTombstones(tx); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(metaBucket).Get(statsKey) != nil {
+			return nil
+		}
+		// Stores written before the totals were tracked are counted once.
+		var st sourceStats
+		err := tx.Bucket(docsBucket).ForEach(func(_, v []byte) error {
+			return st.add(v, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(statsKey, st.encode())
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &docStore{db: db, compression: c}, nil
+}
+
+// indexTombstones creates tombstonesBucket for a store written before
+// tombstones were indexed. Its tombstones are indexed at the checkpoint, so
+// they are pruned once the WAL is truncated past it.
+func indexTombstones(tx *bolt.Tx) error {
+	tombs, err := tx.CreateBucket(tombstonesBucket)
+	if err != nil {
+		return err
+	}
+	var cp uint64
+	if b := tx.Bucket(metaBucket).Get([]byte("checkpoint")); len(b) == 8 {
+		cp = binary.BigEndian.Uint64(b)
+	}
+	return tx.Bucket(docsBucket).ForEach(func(k, v []byte) error {
+		meta, _, _, err := decodeRecord(v)
+		if err != nil || !meta.Deleted {
+			return err
+		}
+		return tombs.Put(tombstoneKey(cp, k), encodeCheckpoint(meta.SeqNo))
+	})
+}
+
+// tombstoneKey lays out the key of a tombstone in tombstonesBucket as the
+// big-endian WAL index followed by the document ID, so that the oldest come
+// first.
+func tombstoneKey(walIndex uint64, id []byte) []byte {
+	return append(encodeCheckpoint(walIndex), id...)
+}
+
+// pruneTombstones removes the tombstones written before the WAL index
+// before, whose deletes the WAL no longer holds, and returns how many it
+// removed. A document written again since keeps its record.
+func (d *docStore) pruneTombstones(before uint64) (int, error) {
+	pruned := 0
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		docs := tx.Bucket(docsBucket)
+		c := tx.Bucket(tombstonesBucket).Cursor()
+		for k, v := c.First(); k != nil && binary.BigEndian.Uint64(k) < before; k, v = c.First() {
+			id := append([]byte(nil), k[8:]...)
+			seqNo := binary.BigEndian.Uint64(v)
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			record := docs.Get(id)
+			if record == nil {
+				continue
+			}
+			meta, _, _, err := decodeRecord(record)
+			if err != nil {
+				return fmt.Errorf("document [%s]: %w", id, err)
+			}
+			if !meta.Deleted || meta.SeqNo != seqNo {
+				continue
+			}
+			if err := docs.Delete(id); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+func (d *docStore) close() error {
+	return d.db.Close()
+}
+
+// encodeRecord lays a document out as uvarint(len(meta)) | meta | source.
+// Compressed sources are marked with flagSnappy in the metadata flags.
+func encodeRecord(meta docMeta, source []byte, c Compression) []byte {
+	m := meta.encode()
+	if c == CompressionSnappy && source != nil {
+		m[len(m)-1] |= flagSnappy
+		source = snappy.Encode(nil, source)
+	}
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(m)+len(source))
+	buf = binary.AppendUvarint(buf, uint64(len(m)))
+	buf = append(buf, m...)
+	return append(buf, source...)
+}
+
+// decodeRecord returns the stored source as is; compressed reports whether
+// it still has to be decompressed.
+func decodeRecord(buf []byte) (meta docMeta, source []byte, compressed bool, err error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || size == 0 || uint64(len(buf)-n) < size {
+		return docMeta{}, nil, false, fmt.Errorf("invalid document record")
+	}
+	m := buf[n : n+int(size)]
+	meta, err = decodeDocMeta(m)
+	if err != nil {
+		return docMeta{}, nil, false, err
+	}
+	return meta, buf[n+int(size):], m[len(m)-1]&flagSnappy != 0, nil
+}
+
+// get returns the metadata and source of a document. found is false when
+// the ID was never written; tombstones are returned with Deleted set.
+func (d *docStore) get(id string) (meta docMeta, source []byte, found bool, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(docsBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		found = true
+		var src []byte
+		var compressed bool
+		meta, src, compressed, err = decodeRecord(v)
+		if err != nil {
+			return err
+		}
+		if compressed {
+			source, err = snappy.Decode(nil, src)
+			return err
+		}
+		source = append([]byte(nil), src...)
+		return nil
+	})
+	return meta, source, found, err
+}
+
+// scan returns the documents and tombstones with an ID after after, in ID
+// order, at most limit of them.
+func (d *docStore) scan(after string, limit int) ([]Change, error) {
+	var changes []Change
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(docsBucket).Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(changes) < limit; k, v = c.Next() {
+			meta, src, compressed, err := decodeRecord(v)
+			if err != nil {
+				return fmt.Errorf("document [%s]: %w", k, err)
+			}
+			ch := Change{
+				Op:          OpIndex,
+				ID:          string(k),
+				Version:     meta.Version,
+				SeqNo:       meta.SeqNo,
+				PrimaryTerm: meta.PrimaryTerm,
+				ExpiresAt:   meta.ExpiresAt,
+				Routing:     meta.Routing,
+			}
+			switch {
+			case meta.Deleted:
+				ch.Op = OpDelete
+			case compressed:
+				if ch.Source, err = snappy.Decode(nil, src); err != nil {
+					return fmt.Errorf("document [%s]: %w", k, err)
+				}
+			default:
+				ch.Source = append([]byte(nil), src...)
+			}
+			changes = append(changes, ch)
+		}
+		return nil
+	})
+	return changes, err
+}
+
+func (d *docStore) getUint64(key string) (uint64, error) {
+	var v uint64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaBucket).Get([]byte(key)); len(b) == 8 {
+			v = binary.BigEndian.Uint64(b)
+		}
+		return nil
+	})
+	return v, err
+}
+
+func (d *docStore) stats() (sourceStats, error) {
+	var st sourceStats
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		st, err = decodeSourceStats(tx.Bucket(metaBucket).Get(statsKey))
+		return err
+	})
+	return st, err
+}
+
+// copyTo writes a consistent copy of the database to path.
+func (d *docStore) copyTo(path string) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0644)
+	})
+}
+
+func (d *docStore) setUint64(key string, v uint64) error {
+	return d.setBytes(key, encodeCheckpoint(v))
+}
+
+func (d *docStore) getBytes(key string) ([]byte, error) {
+	var v []byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v = append(v, tx.Bucket(metaBucket).Get([]byte(key))...)
+		return nil
+	})
+	return v, err
+}
+
+func (d *docStore) setBytes(key string, v []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(key), v)
+	})
+}
+
+// apply writes the documents of entries together with the WAL checkpoint
+// and the highest sequence number in one transaction.
+func (d *docStore) apply(entries []LogEntry, walIndex, seqNo uint64) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		st, err := decodeSourceStats(meta.Get(statsKey))
+		if err != nil {
+			return err
+		}
+		docs, tombs := tx.Bucket(docsBucket), tx.Bucket(tombstonesBucket)
+		for _, entry := range entries {
+			if err := d.applyDoc(docs, tombs, entry, walIndex, &st); err != nil {
+				return err
+			}
+		}
+		if err := meta.Put(statsKey, st.encode()); err != nil {
+			return err
+		}
+		if err := meta.Put([]byte("checkpoint"), encodeCheckpoint(walIndex)); err != nil {
+			return err
+		}
+		if seqNo > 0 {
+			return meta.Put([]byte("seq_no"), encodeCheckpoint(seqNo))
+		}
+		return nil
+	})
+}
+
+// applyDoc writes the document of entry, indexing a tombstone in tombs at
+// walIndex.
+func (d *docStore) applyDoc(docs, tombs *bolt.Bucket, entry LogEntry, walIndex uint64, st *sourceStats) error {
+	if entry.Op == OpBatch {
+		for _, op := range entry.Ops {
+			if err := d.applyDoc(docs, tombs, op, walIndex, st); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	key := []byte(entry.ID)
+	if old := docs.Get(key); old != nil {
+		if err := st.add(old, -1); err != nil {
+			return err
+		}
+	}
+
+	var record []byte
+	switch entry.Op {
+	case OpDelete:
+		if entry.Version == 0 {
+			return docs.Delete(key)
+		}
+		meta := docMeta{Version: entry.Version, SeqNo: entry.SeqNo, PrimaryTerm: entry.PrimaryTerm, Deleted: true, Routing: entry.Routing}
+		record = encodeRecord(meta, nil, CompressionNone)
+		if err := tombs.Put(tombstoneKey(walIndex, key), encodeCheckpoint(entry.SeqNo)); err != nil {
+			return err
+		}
+	case OpIndex:
+		meta := docMeta{Version: entry.Version, SeqNo: entry.SeqNo, PrimaryTerm: entry.PrimaryTerm, ExpiresAt: entry.ExpiresAt, Routing: entry.Routing}
+		record = encodeRecord(meta, entry.Source, d.compression)
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+	if err := st.add(record, 1); err != nil {
+		return err
+	}
+	return docs.Put(key, record)
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCorrupt is returned by Open when the WAL is corrupt and the store was
+// configured with CorruptionFail.
+var ErrCorrupt = errors.New("wal is corrupt")
+
+// CorruptionPolicy decides what Open does with a corrupt WAL tail.
+type CorruptionPolicy int
+
+const (
+	// CorruptionTruncate drops the WAL from the first corrupt record onwards
+	// and opens the store with a yellow health status.
+	CorruptionTruncate CorruptionPolicy = iota
+	// CorruptionFail refuses to open the store.
+	CorruptionFail
+)
+
+func (p CorruptionPolicy) String() string {
+	switch p {
+	case CorruptionTruncate:
+		return "truncate"
+	case CorruptionFail:
+		return "fail"
+	}
+	return fmt.Sprintf("CorruptionPolicy(%d)", int(p))
+}
+
+func ParseCorruptionPolicy(s string) (CorruptionPolicy, error) {
+	switch s {
+	case "", "truncate":
+		return CorruptionTruncate, nil
+	case "fail":
+		return CorruptionFail, nil
+	}
+	return 0, fmt.Errorf("unknown corruption policy %q", s)
+}
+
+type HealthStatus string
+
+const (
+	HealthGreen  HealthStatus = "green"
+	HealthYellow HealthStatus = "yellow"
+	HealthRed    HealthStatus = "red"
+)
+
+// Worse reports whether h is a worse status than o.
+func (h HealthStatus) Worse(o HealthStatus) bool {
+	rank := map[HealthStatus]int{HealthGreen: 0, HealthYellow: 1, HealthRed: 2}
+	return rank[h] > rank[o]
+}
+
+// CorruptionReport describes WAL data dropped while opening a store.
+type CorruptionReport struct {
+	// WALIndex is the first record that could not be read, zero when the
+	// damage was in the segment framing of the log tail.
+	WALIndex uint64    `json:"wal_index,omitempty"`
+	Dropped  uint64    `json:"dropped_records,omitempty"`
+	Bytes    int64     `json:"dropped_bytes,omitempty"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+}
+
+// Health is the state of a store as seen by operators. A store is yellow when
+// corruption was repaired by dropping data and red when it failed to commit
+// writes. Red lasts until the store is reopened, as it takes no writes
+// meanwhile, see ErrFailed.
+type Health struct {
+	Status     HealthStatus       `json:"status"`
+	Corruption []CorruptionReport `json:"corruption,omitempty"`
+	LastError  string             `json:"last_error,omitempty"`
+}
+
+type healthState struct {
+	mu     sync.Mutex
+	health Health
+	// err is the error the store failed with, see ErrFailed.
+	err error
+}
+
+func (h *healthState) get() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := h.health
+	out.Corruption = append([]CorruptionReport(nil), h.health.Corruption...)
+	if out.Status == "" {
+		out.Status = HealthGreen
+	}
+	return out
+}
+
+func (h *healthState) corrupted(r CorruptionReport) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r.Time = time.Now()
+	h.health.Corruption = append(h.health.Corruption, r)
+	if h.health.Status != HealthRed {
+		h.health.Status = HealthYellow
+	}
+}
+
+func (h *healthState) failed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.health.Status = HealthRed
+	h.health.LastError = err.Error()
+	h.err = fmt.Errorf("%w, reopen it to replay its wal: %w", ErrFailed, err)
+}
+
+// stopped returns the error the store failed with, if it did.
+func (h *healthState) stopped() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Health returns the current health of the store.
+func (s *Store) Health() Health {
+	return s.health.get()
+}
+
+// repairWALTail truncates the last segment file of the WAL at walPath after
+// its last complete frame. It returns the number of bytes removed.
+func repairWALTail(walPath string) (int64, error) {
+	entries, err := os.ReadDir(walPath)
+	if err != nil {
+		return 0, err
+	}
+	var segments []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || len(name) != 20 {
+			continue
+		}
+		if _, err := strconv.ParseUint(name, 10, 64); err == nil {
+			segments = append(segments, name)
+		}
+	}
+	if len(segments) == 0 {
+		return 0, nil
+	}
+	sort.Strings(segments)
+	last := filepath.Join(walPath, segments[len(segments)-1])
+
+	data, err := os.ReadFile(last)
+	if err != nil {
+		return 0, err
+	}
+	pos := 0
+	for pos < len(data) {
+		size, n := binary.Uvarint(data[pos:])
+		if n <= 0 || uint64(len(data)-pos-n) < size {
+			break
+		}
+		pos += n + int(size)
+	}
+	if pos == len(data) {
+		return 0, nil
+	}
+	if err := os.Truncate(last, int64(pos)); err != nil {
+		return 0, err
+	}
+	return int64(len(data) - pos), nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// GetAsOf returns the document as it was at asOf, or nil if it did not
+// exist then. The retained WAL is scanned from the newest record backwards,
+// so reads far into the past are slow. It fails with ErrChangesTruncated if
+// the state at asOf depends on records that were truncated.
+func (s *Store) GetAsOf(id string, asOf time.Time) (*Document, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+	ts := asOf.UnixMilli()
+	first, err := s.log.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	last, err := s.log.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var oldest int64
+	changedLater := false
+	for i := last; i >= first && i > 0; i-- {
+		entry, err := s.readEntry(i)
+		if err != nil {
+			return nil, fmt.Errorf("wal record %d: %w", i, err)
+		}
+		oldest = entryTime(entry)
+		op, found := findOp(entry, id)
+		if !found {
+			continue
+		}
+		if op.Timestamp > ts {
+			changedLater = true
+			continue
+		}
+		if op.Op == OpDelete || (op.ExpiresAt != 0 && op.ExpiresAt <= ts) {
+			return nil, nil
+		}
+		doc := &Document{ID: id, Version: op.Version, SeqNo: op.SeqNo, PrimaryTerm: op.PrimaryTerm, Routing: op.Routing}
+		if err := json.Unmarshal(op.Source, &doc.Source); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	// No retained record of the document is old enough. If the log was
+	// never truncated the document did not exist yet; otherwise only a
+	// document that has not changed since the oldest retained record, which
+	// is itself older than asOf, is known to be unchanged.
+	if first <= 1 {
+		return nil, nil
+	}
+	if !changedLater && oldest <= ts {
+		meta, source, found, err := s.docs.get(id)
+		if err != nil || !meta.exists(found, asOf) {
+			return nil, err
+		}
+		doc := &Document{ID: id, Version: meta.Version, SeqNo: meta.SeqNo, PrimaryTerm: meta.PrimaryTerm, Routing: meta.Routing}
+		if err := json.Unmarshal(source, &doc.Source); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("%w: %s has no history of [%s] before %s", ErrChangesTruncated, s.path, id, asOf.UTC().Format(time.RFC3339))
+}
+
+// entryTime returns the timestamp of a record, which for a batch is the
+// latest of its operations.
+func entryTime(entry LogEntry) int64 {
+	ts := entry.Timestamp
+	for _, op := range entry.Ops {
+		if t := entryTime(op); t > ts {
+			ts = t
+		}
+	}
+	return ts
+}
+
+// findOp returns the last operation on id in entry.
+func findOp(entry LogEntry, id string) (LogEntry, bool) {
+	if entry.Op != OpBatch {
+		return entry, entry.ID == id
+	}
+	for i := len(entry.Ops) - 1; i >= 0; i-- {
+		if op, ok := findOp(entry.Ops[i], id); ok {
+			return op, true
+		}
+	}
+	return LogEntry{}, false
+}
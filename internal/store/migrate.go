@@ -0,0 +1,77 @@
+package store
+
+import (
+	"encoding/binary"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// Bleve internal keys used for version metadata before the document store.
+var (
+	legacyMetaPrefix = "_breeze_doc/"
+	legacySeqNoKey   = []byte("_breeze_seq_no")
+	legacyTermKey    = []byte("_breeze_primary_term")
+)
+
+const migratePageSize = 1000
+
+// migrateSources fills a new document store from an index created before it
+// existed, when sources were kept in a stored "_source" field and version
+// metadata in Bleve internal keys.
+func (s *Store) migrateSources() error {
+	count, err := s.index.DocCount()
+	if err != nil || count == 0 {
+		return err
+	}
+	cp, err := s.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	var seqNo uint64
+	if v, err := s.index.GetInternal(legacySeqNoKey); err == nil && len(v) == 8 {
+		seqNo = binary.BigEndian.Uint64(v)
+	}
+	if v, err := s.index.GetInternal(legacyTermKey); err == nil && len(v) == 8 {
+		if err := s.docs.setUint64("primary_term", binary.BigEndian.Uint64(v)); err != nil {
+			return err
+		}
+	}
+
+	var after []string
+	for {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), migratePageSize, 0, false)
+		req.Fields = []string{SourceField}
+		req.SortBy([]string{"_id"})
+		req.SearchAfter = after
+		res, err := s.index.Search(req)
+		if err != nil {
+			return err
+		}
+		if len(res.Hits) == 0 {
+			break
+		}
+
+		entries := make([]LogEntry, 0, len(res.Hits))
+		for _, hit := range res.Hits {
+			source, ok := hit.Fields[SourceField].(string)
+			if !ok {
+				continue
+			}
+			entry := LogEntry{Op: OpIndex, ID: hit.ID, Source: []byte(source), Version: 1}
+			if v, err := s.index.GetInternal([]byte(legacyMetaPrefix + hit.ID)); err == nil && len(v) > 0 {
+				if meta, err := decodeDocMeta(v); err == nil {
+					entry.Version = meta.Version
+					entry.SeqNo = meta.SeqNo
+					entry.PrimaryTerm = meta.PrimaryTerm
+				}
+			}
+			entries = append(entries, entry)
+		}
+		if err := s.docs.apply(entries, cp, seqNo); err != nil {
+			return err
+		}
+		after = []string{res.Hits[len(res.Hits)-1].ID}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blevesearch/bleve/v2/mapping"
+)
+
+// Durability controls when WAL writes are fsynced.
+type Durability int
+
+const (
+	// DurabilityRequest fsyncs the WAL before any write is acknowledged.
+	// Concurrent writes are grouped so they share a single fsync.
+	DurabilityRequest Durability = iota
+	// DurabilityInterval fsyncs the WAL every SyncInterval. Writes
+	// acknowledged since the last sync may be lost on a crash.
+	DurabilityInterval
+	// DurabilityNone never fsyncs explicitly and leaves flushing to the OS.
+	DurabilityNone
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityRequest:
+		return "request"
+	case DurabilityInterval:
+		return "async"
+	case DurabilityNone:
+		return "none"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// ParseDurability accepts the Elasticsearch translog names ("request",
+// "async") as well as "every-write", "interval" and "none".
+func ParseDurability(s string) (Durability, error) {
+	switch s {
+	case "", "request", "every-write":
+		return DurabilityRequest, nil
+	case "async", "interval":
+		return DurabilityInterval, nil
+	case "none":
+		return DurabilityNone, nil
+	}
+	return 0, fmt.Errorf("unknown durability %q", s)
+}
+
+// Options configure a Store.
+type Options struct {
+	Durability Durability
+	// SyncInterval is the fsync period used with DurabilityInterval.
+	SyncInterval time.Duration
+	// OnCorruption decides whether a corrupt WAL tail is dropped or makes
+	// Open fail.
+	OnCorruption CorruptionPolicy
+	// Compression applies to sources written from now on. Records written
+	// with another setting stay readable.
+	Compression Compression
+	// Mapping is used when the search index is created. Nil selects
+	// GetDefaultMapping; an existing index keeps the mapping it was
+	// created with.
+	Mapping mapping.IndexMapping
+	// DefaultTTL is the time to live of documents written without one; zero
+	// keeps them until they are deleted.
+	DefaultTTL time.Duration
+	// ReapInterval is how often expired documents are deleted. Zero selects
+	// DefaultReapInterval.
+	ReapInterval time.Duration
+	// DisableReaper keeps the store from deleting expired documents on its
+	// own, see SetReaper. Replicas set it and get the deletes from their
+	// primary instead.
+	DisableReaper bool
+	// RetainOperations is how many applied WAL records are kept before the
+	// checkpoint, so that Changes can be resumed from them.
+	RetainOperations uint64
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Durability:   DurabilityRequest,
+		SyncInterval: 5 * time.Second,
+		OnCorruption: CorruptionTruncate,
+	}
+}
+
+// Compression selects how document sources are stored in the WAL and the
+// document store.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// ParseCompression accepts "none" (or "default") and "snappy".
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "none", "default":
+		return CompressionNone, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q", s)
+}
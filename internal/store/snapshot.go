@@ -0,0 +1,43 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// Snapshot writes a consistent copy of the search index and the document
+// store to dir, which must not exist yet. Commits are paused while the files
+// are copied; writes keep queueing and are acknowledged once it returns.
+//
+// The copy has no WAL. Opening it with Open finds the checkpoints ahead of
+// the empty log, rewinds them and starts a new log, so a snapshot can be
+// restored by placing its files in an empty shard directory.
+func (s *Store) Snapshot(dir string) error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	copyable, ok := s.index.(bleve.IndexCopyable)
+	if !ok {
+		return fmt.Errorf("index of %s does not support copies", s.path)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if err := copyable.CopyTo(bleve.FileSystemDirectory(filepath.Join(dir, "bleve"))); err != nil {
+		return fmt.Errorf("failed to copy index: %w", err)
+	}
+	if err := s.docs.copyTo(filepath.Join(dir, "docs.db")); err != nil {
+		return fmt.Errorf("failed to copy document store: %w", err)
+	}
+	return nil
+}
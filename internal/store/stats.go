@@ -0,0 +1,62 @@
+package store
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// Stats describe the size of a store on disk.
+type Stats struct {
+	// Docs is the number of live documents.
+	Docs uint64 `json:"docs"`
+	// SourceBytes is the uncompressed size of the live document sources.
+	SourceBytes uint64 `json:"source_bytes"`
+	// StoredBytes is the size of those sources as kept in the document
+	// store, after compression.
+	StoredBytes uint64 `json:"stored_bytes"`
+	// StoreBytes and WALBytes are the sizes of the shard's files on disk.
+	StoreBytes  uint64      `json:"store_bytes"`
+	WALBytes    uint64      `json:"wal_bytes"`
+	Compression Compression `json:"compression"`
+}
+
+func (s *Store) Stats() (Stats, error) {
+	src, err := s.docs.stats()
+	if err != nil {
+		return Stats{}, err
+	}
+	st := Stats{
+		Docs:        src.Docs,
+		SourceBytes: src.SourceBytes,
+		StoredBytes: src.StoredBytes,
+		Compression: s.opts.Compression,
+	}
+	if st.WALBytes, err = dirSize(filepath.Join(s.path, "wal")); err != nil {
+		return Stats{}, err
+	}
+	if st.StoreBytes, err = dirSize(s.path); err != nil {
+		return Stats{}, err
+	}
+	return st, nil
+}
+
+func dirSize(path string) (uint64, error) {
+	var size uint64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may disappear while a segment is truncated or Bleve
+			// merges.
+			if d != nil {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += uint64(info.Size())
+			}
+		}
+		return nil
+	})
+	return size, err
+}
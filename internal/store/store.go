@@ -1,23 +1,77 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/blevesearch/bleve/v2"
 	"github.com/blevesearch/bleve/v2/mapping"
 	"github.com/tidwall/wal"
 )
 
+// replayBatchSize bounds how many WAL entries are applied per Bleve batch
+// during replay.
+const replayBatchSize = 1024
+
+// SourceField is the hit field Search fills with the stored JSON source of
+// each hit when it is listed in the request's Fields.
+const SourceField = "_source"
+
+// RoutingField is the hit field Search fills with the routing key of each
+// hit that has one when it is listed in the request's Fields.
+const RoutingField = "_routing"
+
+// SeqNoField and PrimaryTermField are the hit fields Search fills with the
+// sequence number and primary term of each hit, as float64, when they are
+// listed in the request's Fields.
+const (
+	SeqNoField       = "_seq_no"
+	PrimaryTermField = "_primary_term"
+)
+
 type Store struct {
 	index bleve.Index
+	docs  *docStore
 	log   *wal.Log
 	path  string
 	mu    sync.Mutex
-	sync  bool
+	opts  Options
+
+	writes  chan *writeRequest
+	closeMu sync.RWMutex
+	closed  bool
+	// commitMu is held while a group is written and applied, so a
+	// snapshot can see the index and the document store at rest.
+	commitMu sync.Mutex
+
+	// seqNo is the last sequence number handed out and primaryTerm the term
+	// stamped on new operations. Both are guarded by mu.
+	seqNo       uint64
+	primaryTerm uint64
+
+	// live holds the writes that are queued but not yet applied to the
+	// index, so version checks and updates see them.
+	liveMu sync.Mutex
+	live   map[string]liveDoc
+
+	checkpoint atomic.Uint64
+	// reaping is set while reapLoop deletes expired documents.
+	reaping atomic.Bool
+	// history is the ID of the history of the store, see History.
+	history string
+	// holds keep WAL records from being truncated, see HoldChanges.
+	holdsMu sync.Mutex
+	holds   map[string]walHold
+	health  healthState
+	done    chan struct{}
+	wg      sync.WaitGroup
 }
 
 type Operation string
@@ -25,15 +79,31 @@ type Operation string
 const (
 	OpIndex  Operation = "INDEX"
 	OpDelete Operation = "DELETE"
+	// OpBatch groups several operations into one WAL record so that they
+	// are logged and applied all-or-nothing.
+	OpBatch Operation = "BATCH"
 )
 
 type LogEntry struct {
-	Op   Operation              `json:"op"`
-	ID   string                 `json:"id"`
-	Data map[string]interface{} `json:"data,omitempty"`
+	Op Operation
+	ID string
+	// Source is the JSON document of an OpIndex entry.
+	Source      []byte
+	Ops         []LogEntry
+	Version     uint64
+	SeqNo       uint64
+	PrimaryTerm uint64
+	// ExpiresAt is the expiry time of an OpIndex document in Unix
+	// milliseconds, 0 if it does not expire.
+	ExpiresAt int64
+	// Timestamp is when the operation was accepted, in Unix milliseconds.
+	// Records written before timestamps were added have none.
+	Timestamp int64
+	// Routing is the routing key the document was written with.
+	Routing string
 }
 
-func Open(path string, syncWrites bool) (*Store, error) {
+func Open(path string, opts Options) (*Store, error) {
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, err
 	}
@@ -45,8 +115,11 @@ func Open(path string, syncWrites bool) (*Store, error) {
 	var err error
 
 	if _, err := os.Stat(blevePath); os.IsNotExist(err) {
-		indexMapping := GetDefaultMapping()
-		index, err = bleve.New(blevePath, indexMapping)
+		indexMapping := opts.Mapping
+		if indexMapping == nil {
+			indexMapping = GetDefaultMapping()
+		}
+		index, err = bleve.New(blevePath, withExpiry(indexMapping))
 	} else {
 		index, err = bleve.Open(blevePath)
 	}
@@ -55,31 +128,130 @@ func Open(path string, syncWrites bool) (*Store, error) {
 		return nil, fmt.Errorf("failed to open bleve index: %w", err)
 	}
 
-	log, err := wal.Open(walPath, nil)
+	docsPath := filepath.Join(path, "docs.db")
+	_, statErr := os.Stat(docsPath)
+	newDocStore := os.IsNotExist(statErr)
+	docs, err := openDocStore(docsPath, opts.Compression)
 	if err != nil {
+		index.Close()
+		return nil, fmt.Errorf("failed to open document store: %w", err)
+	}
+
+	// Syncing is driven by the store according to opts.Durability, so that
+	// one fsync can cover a whole group of writes. Empty logs are allowed so
+	// that a corrupt tail can be dropped entirely.
+	walOpts := *wal.DefaultOptions
+	walOpts.NoSync = true
+	walOpts.AllowEmpty = true
+
+	var repaired *CorruptionReport
+	log, err := wal.Open(walPath, &walOpts)
+	if errors.Is(err, wal.ErrCorrupt) && opts.OnCorruption == CorruptionTruncate {
+		// A torn write at the end of the last segment makes the log
+		// unreadable; cut it off and try again.
+		dropped, rerr := repairWALTail(walPath)
+		if rerr != nil {
+			index.Close()
+			docs.close()
+			return nil, fmt.Errorf("failed to repair wal: %w", rerr)
+		}
+		repaired = &CorruptionReport{Bytes: dropped, Reason: "torn write at the end of the log"}
+		log, err = wal.Open(walPath, &walOpts)
+	}
+	if err != nil {
+		index.Close()
+		docs.close()
+		if errors.Is(err, wal.ErrCorrupt) {
+			err = fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
 		return nil, fmt.Errorf("failed to open wal: %w", err)
 	}
 
 	s := &Store{
-		index: index,
-		log:   log,
-		path:  path,
-		sync:  syncWrites,
+		index:  index,
+		docs:   docs,
+		log:    log,
+		path:   path,
+		opts:   opts,
+		writes: make(chan *writeRequest, maxGroupSize),
+		live:   make(map[string]liveDoc),
+		done:   make(chan struct{}),
+	}
+	if repaired != nil {
+		s.health.corrupted(*repaired)
+	}
+
+	if newDocStore {
+		if err := s.migrateSources(); err != nil {
+			s.closeFiles()
+			return nil, fmt.Errorf("failed to migrate documents: %w", err)
+		}
+	}
+
+	if err := s.loadSequence(); err != nil {
+		s.closeFiles()
+		return nil, fmt.Errorf("failed to load sequence numbers: %w", err)
+	}
+	if err := s.loadHistory(); err != nil {
+		s.closeFiles()
+		return nil, fmt.Errorf("failed to load history: %w", err)
 	}
 
 	if err := s.replay(); err != nil {
+		s.closeFiles()
 		return nil, fmt.Errorf("failed to replay wal: %w", err)
 	}
 
+	reapInterval := opts.ReapInterval
+	if reapInterval <= 0 {
+		reapInterval = DefaultReapInterval
+	}
+	s.reaping.Store(!opts.DisableReaper)
+	s.wg.Add(3)
+	go s.commitLoop()
+	go s.truncateLoop(DefaultTruncateInterval)
+	go s.reapLoop(reapInterval)
+	if opts.Durability == DurabilityInterval && opts.SyncInterval > 0 {
+		s.wg.Add(1)
+		go s.syncLoop(opts.SyncInterval)
+	}
+
 	return s, nil
 }
 
+// replay re-applies the WAL entries written after the checkpoint. The index
+// and the document store are committed separately, so replay starts after the
+// older of their checkpoints; re-applying an entry is idempotent. A record
+// that cannot be read is handled according to opts.OnCorruption.
 func (s *Store) replay() error {
+	cp, err := s.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	docsCP, err := s.docs.getUint64("checkpoint")
+	if err != nil {
+		return err
+	}
+	if docsCP < cp {
+		cp = docsCP
+	}
+
 	lastIndex, err := s.log.LastIndex()
 	if err != nil {
 		return err
 	}
 
+	if lastIndex < cp {
+		// The log lost entries the index already contains (for example the
+		// wal directory was removed). Rewind the checkpoint so new writes,
+		// which continue from lastIndex, are not skipped on the next replay.
+		if err := s.commit(s.index.NewBatch(), nil, lastIndex, 0); err != nil {
+			return err
+		}
+		cp = lastIndex
+	}
+	s.checkpoint.Store(cp)
+
 	if lastIndex == 0 {
 		return nil
 	}
@@ -88,152 +260,378 @@ func (s *Store) replay() error {
 	if err != nil {
 		return err
 	}
+	if firstIndex <= cp {
+		firstIndex = cp + 1
+	}
 
+	batch := s.index.NewBatch()
+	var entries []LogEntry
+	applied := cp
 	for i := firstIndex; i <= lastIndex; i++ {
-		data, err := s.log.Read(i)
+		entry, err := s.readEntry(i)
 		if err != nil {
-			return err
+			if len(entries) > 0 {
+				if err := s.commit(batch, entries, applied, s.seqNo); err != nil {
+					return err
+				}
+			}
+			return s.handleCorruption(i, lastIndex, err)
 		}
-		var entry LogEntry
-		if err := json.Unmarshal(data, &entry); err != nil {
-			continue
+		if err := indexEntry(batch, entry); err != nil {
+			return fmt.Errorf("wal record %d: %w", i, err)
+		}
+		entries = append(entries, entry)
+		if seq := maxSeqNo(entry); seq > s.seqNo {
+			s.seqNo = seq
 		}
+		applied = i
+
+		if batch.Size() >= replayBatchSize || i == lastIndex {
+			if err := s.commit(batch, entries, i, s.seqNo); err != nil {
+				return err
+			}
+			batch = s.index.NewBatch()
+			entries = entries[:0]
+		}
+	}
+	return nil
+}
+
+func (s *Store) readEntry(i uint64) (LogEntry, error) {
+	data, err := s.log.Read(i)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	return decodeEntry(data)
+}
+
+// handleCorruption deals with an unreadable record at index i, where last is
+// the last index in the log.
+func (s *Store) handleCorruption(i, last uint64, cause error) error {
+	if s.opts.OnCorruption == CorruptionFail {
+		return fmt.Errorf("%w: record %d: %v", ErrCorrupt, i, cause)
+	}
+	if err := s.log.TruncateBack(i - 1); err != nil {
+		return fmt.Errorf("failed to truncate corrupt wal tail at %d: %w", i, err)
+	}
+	fmt.Printf("Dropped %d corrupt wal records of %s starting at %d: %v\n", last-i+1, s.path, i, cause)
+	s.health.corrupted(CorruptionReport{
+		WALIndex: i,
+		Dropped:  last - i + 1,
+		Reason:   cause.Error(),
+	})
+	return nil
+}
+
+// commit applies batch to the index and entries to the document store,
+// each together with the checkpoint walIndex.
+func (s *Store) commit(batch *bleve.Batch, entries []LogEntry, walIndex, seqNo uint64) error {
+	batch.SetInternal(checkpointKey, encodeCheckpoint(walIndex))
+	if err := s.index.Batch(batch); err != nil {
+		return err
+	}
+	if err := s.docs.apply(entries, walIndex, seqNo); err != nil {
+		return err
+	}
+	s.checkpoint.Store(walIndex)
+	return nil
+}
 
-		switch entry.Op {
-		case OpIndex:
-			s.index.Index(entry.ID, entry.Data)
-		case OpDelete:
-			s.index.Delete(entry.ID)
+// indexEntry adds the search index changes of entry to batch. This is where
+// documents are analyzed, so it is the step that can fail.
+func indexEntry(batch *bleve.Batch, entry LogEntry) error {
+	switch entry.Op {
+	case OpIndex:
+		var data map[string]interface{}
+		if err := json.Unmarshal(entry.Source, &data); err != nil {
+			return fmt.Errorf("invalid source for document %s: %w", entry.ID, err)
 		}
+		return batch.Index(entry.ID, indexedFields(data, entry.ExpiresAt))
+	case OpDelete:
+		if entry.ID == "" {
+			return fmt.Errorf("document ID cannot be empty")
+		}
+		batch.Delete(entry.ID)
+	case OpBatch:
+		for _, op := range entry.Ops {
+			if err := indexEntry(batch, op); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
 	}
 	return nil
 }
 
+func maxSeqNo(entry LogEntry) uint64 {
+	seq := entry.SeqNo
+	for _, op := range entry.Ops {
+		if s := maxSeqNo(op); s > seq {
+			seq = s
+		}
+	}
+	return seq
+}
+
 func (s *Store) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	
-	if err := s.index.Close(); err != nil {
+
+	if err := s.log.Sync(); err != nil {
 		return err
 	}
-	return s.log.Close()
+	return s.closeFiles()
 }
 
-func (s *Store) Index(id string, data map[string]interface{}) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Add _source field for full document retrieval
-	sourceBytes, _ := json.Marshal(data)
-	data["_source"] = string(sourceBytes)
+func (s *Store) closeFiles() error {
+	var firstErr error
+	for _, closeFn := range []func() error{s.index.Close, s.docs.close, s.log.Close} {
+		if err := closeFn(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
 
-	entry := LogEntry{
-		Op:   OpIndex,
-		ID:   id,
-		Data: data,
+// Index stores the document, checking opts against the current version of
+// the document first. A TTLField in data sets when the document expires.
+func (s *Store) Index(id string, data map[string]interface{}, opts WriteOptions) (WriteResult, error) {
+	if s.isClosed() {
+		return WriteResult{}, ErrClosed
 	}
-	
-	entryBytes, err := json.Marshal(entry)
+	data, expiresAt, err := s.expiry(data, opts)
 	if err != nil {
-		return err
+		return WriteResult{}, err
 	}
-
-	lastIndex, err := s.log.LastIndex()
+	source, err := json.Marshal(data)
 	if err != nil {
-		return err
+		return WriteResult{}, err
 	}
 
-	if err := s.log.Write(lastIndex+1, entryBytes); err != nil {
-		return err
+	entry := LogEntry{Op: OpIndex, ID: id, Source: source, ExpiresAt: expiresAt}
+	batch := s.index.NewBatch()
+	if err := batch.Index(id, indexedFields(data, expiresAt)); err != nil {
+		return WriteResult{}, err
 	}
 
-	return s.index.Index(id, data)
+	s.mu.Lock()
+	res, err := s.assignVersion(&entry, opts)
+	if err != nil {
+		s.mu.Unlock()
+		return res, err
+	}
+	req, err := s.enqueue(entry, batch)
+	s.mu.Unlock()
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return res, <-req.done
 }
 
-func (s *Store) BatchIndex(ids []string, data []map[string]interface{}) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// BatchIndex indexes all documents as a single WAL record. opts may be nil or
+// hold one entry per document. Documents failing their version checks are
+// rejected individually through WriteResult.Err; the others are applied
+// all-or-nothing, and if that fails the returned error is set.
+func (s *Store) BatchIndex(ids []string, data []map[string]interface{}, opts []WriteOptions) ([]WriteResult, error) {
+	if len(ids) != len(data) || (opts != nil && len(opts) != len(ids)) {
+		return nil, fmt.Errorf("batch has %d ids, %d documents and %d options", len(ids), len(data), len(opts))
+	}
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+	results := make([]WriteResult, len(ids))
+	if len(ids) == 0 {
+		return results, nil
+	}
 
-	batch := s.index.NewBatch()
+	// Documents are analyzed one batch each before taking the lock, so that
+	// the ones rejected by their version check can be left out cheaply.
+	ops := make([]LogEntry, len(ids))
+	docBatches := make([]*bleve.Batch, len(ids))
 	for i, id := range ids {
-		d := data[i]
-		sourceBytes, _ := json.Marshal(d)
-		d["_source"] = string(sourceBytes)
+		var o WriteOptions
+		if opts != nil {
+			o = opts[i]
+		}
+		doc, expiresAt, err := s.expiry(data[i], o)
+		if err != nil {
+			return nil, fmt.Errorf("document %s: %w", id, err)
+		}
+		source, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("document %s: %w", id, err)
+		}
+		ops[i] = LogEntry{Op: OpIndex, ID: id, Source: source, ExpiresAt: expiresAt}
+		docBatches[i] = s.index.NewBatch()
+		if err := docBatches[i].Index(id, indexedFields(doc, expiresAt)); err != nil {
+			return nil, fmt.Errorf("document %s: %w", id, err)
+		}
+	}
 
-		entry := LogEntry{
-			Op:   OpIndex,
-			ID:   id,
-			Data: d,
+	s.mu.Lock()
+	batch := s.index.NewBatch()
+	accepted := make([]LogEntry, 0, len(ops))
+	positions := make([]int, 0, len(ops))
+	for i := range ops {
+		var o WriteOptions
+		if opts != nil {
+			o = opts[i]
+		}
+		res, err := s.assignVersion(&ops[i], o)
+		res.Err = err
+		results[i] = res
+		if err == nil {
+			batch.Merge(docBatches[i])
+			accepted = append(accepted, ops[i])
+			positions = append(positions, i)
 		}
-		entryBytes, _ := json.Marshal(entry)
-		lastIndex, _ := s.log.LastIndex()
-		s.log.Write(lastIndex+1, entryBytes)
+	}
+	if len(accepted) == 0 {
+		s.mu.Unlock()
+		return results, nil
+	}
 
-		batch.Index(id, d)
+	entry := LogEntry{Op: OpBatch, Ops: accepted}
+	req, err := s.enqueue(entry, batch)
+	s.mu.Unlock()
+	if err == nil {
+		err = <-req.done
 	}
+	if err != nil {
+		for _, p := range positions {
+			results[p].Err = err
+		}
+		return results, err
+	}
+	return results, nil
+}
 
-	return s.index.Batch(batch)
+// Delete removes the document. Deleting a missing or expired document is not
+// an error and reports ResultNotFound.
+func (s *Store) Delete(id string, opts WriteOptions) (WriteResult, error) {
+	conditional := opts.IfSeqNo != nil || opts.IfPrimaryTerm != nil || opts.Version != nil
+	return s.remove(id, opts, func(cur docMeta, found bool) bool {
+		return conditional || cur.exists(found, time.Now())
+	})
 }
 
-func (s *Store) Delete(id string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// remove deletes the document if shouldDelete, called with its current
+// metadata under s.mu, returns true, and reports ResultNotFound otherwise.
+func (s *Store) remove(id string, opts WriteOptions, shouldDelete func(cur docMeta, found bool) bool) (WriteResult, error) {
+	if s.isClosed() {
+		return WriteResult{}, ErrClosed
+	}
+	if id == "" {
+		return WriteResult{}, fmt.Errorf("document ID cannot be empty")
+	}
+	entry := LogEntry{Op: OpDelete, ID: id}
+	batch := s.index.NewBatch()
+	batch.Delete(id)
 
-	entry := LogEntry{
-		Op: OpDelete,
-		ID: id,
+	s.mu.Lock()
+	cur, found, err := s.meta(id)
+	if err != nil {
+		s.mu.Unlock()
+		return WriteResult{}, err
 	}
-	
-	entryBytes, err := json.Marshal(entry)
+	if !shouldDelete(cur, found) {
+		s.mu.Unlock()
+		return WriteResult{ID: id, Result: ResultNotFound, PrimaryTerm: s.primaryTerm}, nil
+	}
+	res, err := s.assignVersion(&entry, opts)
 	if err != nil {
-		return err
+		s.mu.Unlock()
+		return res, err
 	}
-
-	lastIndex, err := s.log.LastIndex()
+	req, err := s.enqueue(entry, batch)
+	s.mu.Unlock()
 	if err != nil {
-		return err
+		return WriteResult{}, err
 	}
+	return res, <-req.done
+}
 
-	if err := s.log.Write(lastIndex+1, entryBytes); err != nil {
-		return err
+// Get returns the document with the given ID, or nil if it does not exist.
+func (s *Store) Get(id string) (*Document, error) {
+	meta, source, found, err := s.docs.get(id)
+	if err != nil || !meta.exists(found, time.Now()) {
+		return nil, err
 	}
 
-	return s.index.Delete(id)
+	doc := &Document{
+		ID:          id,
+		Version:     meta.Version,
+		SeqNo:       meta.SeqNo,
+		PrimaryTerm: meta.PrimaryTerm,
+		Routing:     meta.Routing,
+	}
+	if err := json.Unmarshal(source, &doc.Source); err != nil {
+		return nil, err
+	}
+	return doc, nil
 }
 
-func (s *Store) Get(id string) (map[string]interface{}, error) {
-    query := bleve.NewDocIDQuery([]string{id})
-    searchRequest := bleve.NewSearchRequest(query)
-    searchRequest.Fields = []string{"_source"}
-    
-    res, err := s.index.Search(searchRequest)
-    if err != nil {
-        return nil, err
-    }
-    
-    if res.Total == 0 {
-        return nil, nil
-    }
-
-    sourceStr, ok := res.Hits[0].Fields["_source"].(string)
-    if !ok {
-        return nil, fmt.Errorf("_source field not found or not a string")
-    }
-
-    var result map[string]interface{}
-    err = json.Unmarshal([]byte(sourceStr), &result)
-    return result, err
+// Search runs req against the index, leaving out expired documents. If
+// req.Fields lists SourceField, the JSON source of every hit is loaded from
+// the document store into that field, and likewise for RoutingField,
+// SeqNoField and PrimaryTermField.
+func (s *Store) Search(req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	return s.SearchContext(context.Background(), req)
 }
 
-func (s *Store) Search(req *bleve.SearchRequest) (*bleve.SearchResult, error) {
-	return s.index.Search(req)
+// SearchContext is Search, given up when ctx is done.
+func (s *Store) SearchContext(ctx context.Context, req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	now := time.Now()
+	res, err := s.index.SearchInContext(ctx, withoutExpired(req, now))
+	if err != nil {
+		return nil, err
+	}
+	var withSource, withRouting, withSeqNo bool
+	for _, f := range req.Fields {
+		withSource = withSource || f == SourceField
+		withRouting = withRouting || f == RoutingField
+		withSeqNo = withSeqNo || f == SeqNoField || f == PrimaryTermField
+	}
+	if !withSource && !withRouting && !withSeqNo {
+		return res, nil
+	}
+	for _, hit := range res.Hits {
+		meta, source, found, err := s.docs.get(hit.ID)
+		if err != nil {
+			return nil, err
+		}
+		if hit.Fields == nil {
+			hit.Fields = make(map[string]interface{})
+		}
+		if !meta.exists(found, now) {
+			continue
+		}
+		if withSource {
+			hit.Fields[SourceField] = string(source)
+		}
+		if withRouting && meta.Routing != "" {
+			hit.Fields[RoutingField] = meta.Routing
+		}
+		if withSeqNo {
+			hit.Fields[SeqNoField] = float64(meta.SeqNo)
+			hit.Fields[PrimaryTermField] = float64(meta.PrimaryTerm)
+		}
+	}
+	return res, nil
 }
 
 func GetDefaultMapping() mapping.IndexMapping {
-    m := bleve.NewIndexMapping()
-    sourceFieldMapping := bleve.NewTextFieldMapping()
-    sourceFieldMapping.Store = true
-    sourceFieldMapping.Index = false
-    m.DefaultMapping.AddFieldMappingsAt("_source", sourceFieldMapping)
-    return m
+	return bleve.NewIndexMapping()
 }
@@ -1,15 +1,26 @@
 package store
 
 import (
+	"breeze/internal/script"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/tidwall/wal"
 )
 
 func TestStore(t *testing.T) {
 	path := "test_db"
 	defer os.RemoveAll(path)
 
-	s, err := Open(path, true)
+	s, err := Open(path, DefaultOptions())
 	if err != nil {
 		t.Fatalf("failed to open store: %v", err)
 	}
@@ -19,14 +30,14 @@ func TestStore(t *testing.T) {
 		"type": "Database",
 	}
 
-	if err := s.Index("1", doc); err != nil {
+	if _, err := s.Index("1", doc, WriteOptions{}); err != nil {
 		t.Fatalf("failed to index doc: %v", err)
 	}
 
 	s.Close()
 
 	// Re-open and check if data persists (WAL replay or Bleve persistence)
-	s, err = Open(path, true)
+	s, err = Open(path, DefaultOptions())
 	if err != nil {
 		t.Fatalf("failed to re-open store: %v", err)
 	}
@@ -41,3 +52,1037 @@ func TestStore(t *testing.T) {
 		t.Errorf("expected 1 doc, got %d", count)
 	}
 }
+
+func TestCheckpointTruncation(t *testing.T) {
+	path := "test_checkpoint"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		id := string(rune('a' + i))
+		if _, err := s.Index(id, map[string]interface{}{"n": i}, WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc: %v", err)
+		}
+	}
+	if _, err := s.Delete("a", WriteOptions{}); err != nil {
+		t.Fatalf("failed to delete doc: %v", err)
+	}
+
+	if cp := s.Checkpoint(); cp != 11 {
+		t.Fatalf("expected checkpoint 11, got %d", cp)
+	}
+	if err := s.truncateWAL(); err != nil {
+		t.Fatalf("failed to truncate wal: %v", err)
+	}
+	first, _ := s.log.FirstIndex()
+	if first != 11 {
+		t.Errorf("expected first wal index 11, got %d", first)
+	}
+	s.Close()
+
+	s, err = Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to re-open store: %v", err)
+	}
+	defer s.Close()
+
+	if cp := s.Checkpoint(); cp != 11 {
+		t.Errorf("expected checkpoint 11 after reopen, got %d", cp)
+	}
+	count, _ := s.index.DocCount()
+	if count != 9 {
+		t.Errorf("expected 9 docs, got %d", count)
+	}
+	if _, err := s.Index("z", map[string]interface{}{"n": 26}, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index after truncation: %v", err)
+	}
+	if cp := s.Checkpoint(); cp != 12 {
+		t.Errorf("expected checkpoint 12, got %d", cp)
+	}
+
+	// The tombstone of doc a goes once its delete is truncated.
+	if _, _, found, _ := s.docs.get("a"); !found {
+		t.Errorf("expected a tombstone for doc a while the wal holds its delete")
+	}
+	if err := s.truncateWAL(); err != nil {
+		t.Fatalf("failed to truncate wal: %v", err)
+	}
+	if meta, _, found, err := s.docs.get("a"); err != nil || found {
+		t.Errorf("expected the tombstone of doc a to be pruned, got %+v, %v", meta, err)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	for _, d := range []Durability{DurabilityRequest, DurabilityInterval, DurabilityNone} {
+		t.Run(d.String(), func(t *testing.T) {
+			path := "test_group_commit"
+			defer os.RemoveAll(path)
+
+			opts := DefaultOptions()
+			opts.Durability = d
+			s, err := Open(path, opts)
+			if err != nil {
+				t.Fatalf("failed to open store: %v", err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 64)
+			for i := 0; i < 64; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, err := s.Index(fmt.Sprintf("doc%d", i), map[string]interface{}{"n": i}, WriteOptions{})
+					errs <- err
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("failed to index doc: %v", err)
+				}
+			}
+
+			if cp := s.Checkpoint(); cp != 64 {
+				t.Errorf("expected checkpoint 64, got %d", cp)
+			}
+			s.Close()
+
+			if _, err := s.Index("late", map[string]interface{}{}, WriteOptions{}); err != ErrClosed {
+				t.Errorf("expected ErrClosed after close, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBatchIndexAtomic(t *testing.T) {
+	path := "test_batch"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+
+	ids := []string{"1", "2", "3"}
+	docs := []map[string]interface{}{{"n": 1}, {"n": 2}, {"n": 3}}
+	if _, err := s.BatchIndex(ids, docs, nil); err != nil {
+		t.Fatalf("failed to index batch: %v", err)
+	}
+	if last, _ := s.log.LastIndex(); last != 1 {
+		t.Errorf("expected a single wal record, got %d", last)
+	}
+
+	// A batch containing an invalid document is rejected as a whole.
+	_, err = s.BatchIndex([]string{"4", ""}, []map[string]interface{}{{"n": 4}, {"n": 5}}, nil)
+	if err == nil {
+		t.Fatalf("expected error for batch with an empty id")
+	}
+	if last, _ := s.log.LastIndex(); last != 1 {
+		t.Errorf("rejected batch must not be logged, wal last index is %d", last)
+	}
+	if doc, _ := s.Get("4"); doc != nil {
+		t.Errorf("document from rejected batch was applied: %v", doc)
+	}
+	count, _ := s.index.DocCount()
+	if count != 3 {
+		t.Errorf("expected 3 docs, got %d", count)
+	}
+}
+
+func TestFailedCommit(t *testing.T) {
+	path := "test_failed_commit"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if _, err := s.Index("1", map[string]interface{}{"n": 1}, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+
+	// The index fails after the write is in the WAL.
+	healthy := s.index
+	broken, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	broken.Close()
+	s.index = broken
+	if _, err := s.Index("2", map[string]interface{}{"n": 2}, WriteOptions{}); err == nil {
+		t.Fatalf("expected the write to fail")
+	}
+	if h := s.Health(); h.Status != HealthRed || h.LastError == "" {
+		t.Errorf("expected red health, got %+v", h)
+	}
+	// No later write moves the checkpoint past the one that failed.
+	if _, err := s.Index("3", map[string]interface{}{"n": 3}, WriteOptions{}); !errors.Is(err, ErrFailed) {
+		t.Errorf("expected ErrFailed, got %v", err)
+	}
+	if cp := s.Checkpoint(); cp != 1 {
+		t.Errorf("expected checkpoint 1, got %d", cp)
+	}
+	s.index = healthy
+	s.Close()
+
+	// Reopening replays the write that was logged.
+	s, err = Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer s.Close()
+	if h := s.Health(); h.Status != HealthGreen {
+		t.Errorf("expected green health after reopening, got %+v", h)
+	}
+	if doc, err := s.Get("2"); err != nil || doc == nil {
+		t.Errorf("expected the logged doc 2 after reopening, got %+v, %v", doc, err)
+	}
+	if doc, _ := s.Get("3"); doc != nil {
+		t.Errorf("expected the rejected doc 3 to be missing, got %+v", doc)
+	}
+	if _, err := s.Index("4", map[string]interface{}{"n": 4}, WriteOptions{}); err != nil {
+		t.Errorf("failed to index after reopening: %v", err)
+	}
+}
+
+func TestEntryCodec(t *testing.T) {
+	entry := LogEntry{Op: OpBatch, Ops: []LogEntry{
+		{Op: OpIndex, ID: "1", Source: []byte(`{"name":"Breeze"}`)},
+		{Op: OpDelete, ID: "2"},
+	}}
+	for _, c := range []Compression{CompressionNone, CompressionSnappy} {
+		data, err := encodeEntry(entry, c)
+		if err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+		decoded, err := decodeEntry(data)
+		if err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+		if !reflect.DeepEqual(entry, decoded) {
+			t.Errorf("%s round trip mismatch: %+v != %+v", c, entry, decoded)
+		}
+
+		data[len(data)-1] ^= 0xff
+		if _, err := decodeEntry(data); !errors.Is(err, ErrChecksum) {
+			t.Errorf("expected checksum error, got %v", err)
+		}
+	}
+}
+
+func TestCorruptWAL(t *testing.T) {
+	path := "test_corrupt"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if _, err := s.Index("1", map[string]interface{}{"n": 1}, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+	s.Close()
+
+	// Append a record with a bad checksum followed by a valid one, as if
+	// they were written after the last checkpoint.
+	log, err := wal.Open(filepath.Join(path, "wal"), nil)
+	if err != nil {
+		t.Fatalf("failed to open wal: %v", err)
+	}
+	bad, _ := encodeEntry(LogEntry{Op: OpIndex, ID: "2", Source: []byte(`{"n":2}`)}, CompressionNone)
+	bad[len(bad)-1] ^= 0xff
+	good, _ := encodeEntry(LogEntry{Op: OpIndex, ID: "3", Source: []byte(`{"n":3}`)}, CompressionNone)
+	log.Write(2, bad)
+	log.Write(3, good)
+	log.Close()
+
+	opts := DefaultOptions()
+	opts.OnCorruption = CorruptionFail
+	if _, err := Open(path, opts); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+
+	s, err = Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store with truncate policy: %v", err)
+	}
+	defer s.Close()
+
+	h := s.Health()
+	if h.Status != HealthYellow || len(h.Corruption) != 1 || h.Corruption[0].Dropped != 2 {
+		t.Errorf("unexpected health: %+v", h)
+	}
+	if last, _ := s.log.LastIndex(); last != 1 {
+		t.Errorf("expected wal truncated to 1, got %d", last)
+	}
+	if _, err := s.Index("4", map[string]interface{}{"n": 4}, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index after repair: %v", err)
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	path := "test_versioning"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	res, err := s.Index("1", map[string]interface{}{"n": 1}, WriteOptions{})
+	if err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+	if res.Result != ResultCreated || res.Version != 1 || res.SeqNo != 1 || res.PrimaryTerm != 1 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	seqNo, term := res.SeqNo, res.PrimaryTerm
+	res, err = s.Index("1", map[string]interface{}{"n": 2}, WriteOptions{IfSeqNo: &seqNo, IfPrimaryTerm: &term})
+	if err != nil {
+		t.Fatalf("conditional write failed: %v", err)
+	}
+	if res.Result != ResultUpdated || res.Version != 2 || res.SeqNo != 2 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	// The same condition is stale now.
+	if _, err := s.Index("1", map[string]interface{}{"n": 3}, WriteOptions{IfSeqNo: &seqNo, IfPrimaryTerm: &term}); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("expected version conflict, got %v", err)
+	}
+	if _, err := s.Index("1", map[string]interface{}{}, WriteOptions{Create: true}); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("expected conflict on create, got %v", err)
+	}
+	external := uint64(10)
+	res, err = s.Index("1", map[string]interface{}{"n": 4}, WriteOptions{Version: &external, VersionType: VersionExternal})
+	if err != nil || res.Version != 10 {
+		t.Errorf("external version write: %+v, %v", res, err)
+	}
+
+	res, err = s.Delete("1", WriteOptions{})
+	if err != nil || res.Result != ResultDeleted || res.Version != 11 {
+		t.Errorf("unexpected delete result: %+v, %v", res, err)
+	}
+	if res, _ := s.Delete("1", WriteOptions{}); res.Result != ResultNotFound {
+		t.Errorf("expected not_found, got %+v", res)
+	}
+
+	results, err := s.BatchIndex([]string{"1", "2"}, []map[string]interface{}{{"n": 5}, {"n": 6}},
+		[]WriteOptions{{}, {IfSeqNo: &seqNo, IfPrimaryTerm: &term}})
+	if err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+	if results[0].Err != nil || results[0].Version != 12 {
+		t.Errorf("unexpected first batch result: %+v", results[0])
+	}
+	if !errors.Is(results[1].Err, ErrVersionConflict) {
+		t.Errorf("expected conflict for second batch item, got %v", results[1].Err)
+	}
+	s.Close()
+
+	s, err = Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to re-open store: %v", err)
+	}
+	defer s.Close()
+
+	doc, err := s.Get("1")
+	if err != nil || doc == nil {
+		t.Fatalf("failed to get doc: %v", err)
+	}
+	if doc.Version != 12 || doc.SeqNo != 5 || doc.PrimaryTerm != 1 {
+		t.Errorf("unexpected metadata after reopen: %+v", doc)
+	}
+	req := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{"1"}))
+	req.Fields = []string{SeqNoField, PrimaryTermField}
+	if sr, err := s.Search(req); err != nil || sr.Total != 1 || sr.Hits[0].Fields[SeqNoField] != 5.0 || sr.Hits[0].Fields[PrimaryTermField] != 1.0 {
+		t.Errorf("expected hits with their seq_no and primary_term, got %v, %v", sr, err)
+	}
+	res, _ = s.Index("3", map[string]interface{}{}, WriteOptions{})
+	if res.SeqNo != 6 {
+		t.Errorf("expected sequence numbers to continue at 6, got %d", res.SeqNo)
+	}
+}
+
+func TestDocumentStore(t *testing.T) {
+	path := "test_docstore"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	doc := map[string]interface{}{"name": "Breeze"}
+	if _, err := s.Index("1", doc, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+	if _, ok := doc["_source"]; ok || len(doc) != 1 {
+		t.Errorf("Index modified the caller's document: %v", doc)
+	}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchQuery("Breeze"))
+	req.Fields = []string{SourceField}
+	res, err := s.Search(req)
+	if err != nil || res.Total != 1 {
+		t.Fatalf("search failed: %v, %v", res, err)
+	}
+	if src, _ := res.Hits[0].Fields[SourceField].(string); src != `{"name":"Breeze"}` {
+		t.Errorf("unexpected hit source %q", src)
+	}
+	s.Close()
+
+	// Records written before the document store embedded the source in a
+	// "_source" key; replay must recover the original document.
+	log, err := wal.Open(filepath.Join(path, "wal"), nil)
+	if err != nil {
+		t.Fatalf("failed to open wal: %v", err)
+	}
+	log.Write(2, []byte(`{"op":"INDEX","id":"2","data":{"name":"Legacy","_source":"{\"name\":\"Legacy\"}"}}`))
+	log.Close()
+
+	s, err = Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to re-open store: %v", err)
+	}
+	defer s.Close()
+
+	got, err := s.Get("2")
+	if err != nil || got == nil {
+		t.Fatalf("failed to get legacy doc: %v", err)
+	}
+	if !reflect.DeepEqual(got.Source, map[string]interface{}{"name": "Legacy"}) {
+		t.Errorf("unexpected legacy source: %v", got.Source)
+	}
+
+	if _, err := s.Delete("1", WriteOptions{}); err != nil {
+		t.Fatalf("failed to delete doc: %v", err)
+	}
+	if got, _ := s.Get("1"); got != nil {
+		t.Errorf("expected deleted doc to be gone, got %v", got)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	path := "test_compression"
+	defer os.RemoveAll(path)
+
+	opts := DefaultOptions()
+	opts.Compression = CompressionSnappy
+	s, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	text := strings.Repeat("breeze ", 200)
+	for i := 0; i < 10; i++ {
+		if _, err := s.Index(fmt.Sprintf("%d", i), map[string]interface{}{"text": text}, WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc: %v", err)
+		}
+	}
+	if _, err := s.Delete("9", WriteOptions{}); err != nil {
+		t.Fatalf("failed to delete doc: %v", err)
+	}
+
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if st.Docs != 9 || st.SourceBytes == 0 || st.StoredBytes*4 > st.SourceBytes {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	s.Close()
+
+	// Reopening without compression keeps the old records readable and
+	// stores new ones uncompressed.
+	s, err = Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to re-open store: %v", err)
+	}
+	defer s.Close()
+
+	doc, err := s.Get("3")
+	if err != nil || doc == nil || doc.Source["text"] != text {
+		t.Fatalf("failed to read compressed doc: %v, %v", doc, err)
+	}
+	if _, err := s.Index("3", map[string]interface{}{"text": text}, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+	after, err := s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if after.Docs != 9 || after.SourceBytes != st.SourceBytes || after.StoredBytes <= st.StoredBytes {
+		t.Errorf("unexpected stats after rewrite %+v (before %+v)", after, st)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	path := "test_snapshot"
+	copyPath := "test_snapshot_copy"
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(copyPath)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := s.Index(fmt.Sprintf("%d", i), map[string]interface{}{"name": "Breeze"}, WriteOptions{}); err != nil {
+			t.Fatalf("failed to index doc: %v", err)
+		}
+	}
+	if err := s.Snapshot(copyPath); err != nil {
+		t.Fatalf("failed to snapshot: %v", err)
+	}
+	if _, err := s.Index("5", map[string]interface{}{"name": "Breeze"}, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+
+	restored, err := Open(copyPath, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open snapshot: %v", err)
+	}
+	if count, _ := restored.index.DocCount(); count != 5 {
+		t.Errorf("expected 5 docs in snapshot, got %d", count)
+	}
+	if doc, _ := restored.Get("5"); doc != nil {
+		t.Errorf("doc written after the snapshot was restored")
+	}
+	res, err := restored.Index("6", map[string]interface{}{"name": "Breeze"}, WriteOptions{})
+	if err != nil || res.SeqNo != 6 {
+		t.Fatalf("failed to write to restored store: %+v, %v", res, err)
+	}
+	restored.Close()
+
+	// The new log starts from scratch, so a reopen must replay the write
+	// made after the restore.
+	restored, err = Open(copyPath, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to re-open snapshot: %v", err)
+	}
+	defer restored.Close()
+	if doc, _ := restored.Get("6"); doc == nil {
+		t.Errorf("write after restore was lost")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	path := "test_ttl"
+	defer os.RemoveAll(path)
+
+	opts := DefaultOptions()
+	opts.DefaultTTL = time.Hour
+	s, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	doc := map[string]interface{}{"name": "Breeze", TTLField: "300ms"}
+	if _, err := s.Index("1", doc, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+	if _, ok := doc[TTLField]; !ok {
+		t.Errorf("Index modified the caller's document: %v", doc)
+	}
+	if _, err := s.Index("2", map[string]interface{}{"name": "Breeze"}, WriteOptions{TTL: 300 * time.Millisecond}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+	if _, err := s.Index("3", map[string]interface{}{"name": "Breeze"}, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+	got, err := s.Get("1")
+	if err != nil || got == nil {
+		t.Fatalf("failed to get doc before expiry: %v", err)
+	}
+	if !reflect.DeepEqual(got.Source, map[string]interface{}{"name": "Breeze"}) {
+		t.Errorf("expected %s to be stripped from the source, got %v", TTLField, got.Source)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	if got, _ := s.Get("1"); got != nil {
+		t.Errorf("expected expired doc to be hidden, got %v", got)
+	}
+	res, err := s.Search(bleve.NewSearchRequest(bleve.NewMatchQuery("Breeze")))
+	if err != nil || res.Total != 1 || res.Hits[0].ID != "3" {
+		t.Fatalf("expected only doc 3 to match, got %v, %v", res, err)
+	}
+	if res, _ := s.Delete("2", WriteOptions{}); res.Result != ResultNotFound {
+		t.Errorf("expected deleting an expired doc to report not_found, got %s", res.Result)
+	}
+
+	n, err := s.ReapExpired()
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 expired docs to be deleted, got %d, %v", n, err)
+	}
+	if n, _ := s.ReapExpired(); n != 0 {
+		t.Errorf("expected nothing left to delete, got %d", n)
+	}
+	meta, _, found, err := s.docs.get("1")
+	if err != nil || !found || !meta.Deleted {
+		t.Errorf("expected a tombstone for doc 1, got %+v, %v", meta, err)
+	}
+
+	wr, err := s.Index("1", map[string]interface{}{"name": "Again"}, WriteOptions{})
+	if err != nil || wr.Result != ResultCreated || wr.Version != 3 {
+		t.Errorf("expected re-created doc at version 3, got %+v, %v", wr, err)
+	}
+	s.Close()
+
+	// The default TTL must survive a restart along with the document.
+	s, err = Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to re-open store: %v", err)
+	}
+	defer s.Close()
+	meta, _, _, err = s.docs.get("3")
+	if err != nil || meta.ExpiresAt == 0 {
+		t.Errorf("expected doc 3 to expire, got %+v, %v", meta, err)
+	}
+}
+
+func TestDisableReaper(t *testing.T) {
+	path := "test_disable_reaper"
+	defer os.RemoveAll(path)
+
+	opts := DefaultOptions()
+	opts.ReapInterval = 10 * time.Millisecond
+	opts.DisableReaper = true
+	s, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Index("1", map[string]interface{}{"n": 1}, WriteOptions{TTL: time.Millisecond}); err != nil {
+		t.Fatalf("failed to index doc: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if meta, _, found, err := s.docs.get("1"); err != nil || !found || meta.Deleted {
+		t.Errorf("expected the disabled reaper to leave doc 1, got %+v, %v", meta, err)
+	}
+
+	s.SetReaper(true)
+	time.Sleep(100 * time.Millisecond)
+	if meta, _, found, err := s.docs.get("1"); err != nil || !found || !meta.Deleted {
+		t.Errorf("expected the reaper to delete doc 1, got %+v, %v", meta, err)
+	}
+}
+
+// TestSharedMapping opens the stores of several shards with one mapping, as
+// the shards of an index are, without dynamic mapping.
+func TestSharedMapping(t *testing.T) {
+	path := "test_shared_mapping"
+	defer os.RemoveAll(path)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping.Dynamic = false
+	opts := DefaultOptions()
+	opts.Mapping = m
+
+	stores := make([]*Store, 3)
+	errs := make([]error, len(stores))
+	var wg sync.WaitGroup
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stores[i], errs[i] = Open(filepath.Join(path, fmt.Sprintf("%d", i)), opts)
+		}(i)
+	}
+	wg.Wait()
+	for i, s := range stores {
+		if errs[i] != nil {
+			t.Fatalf("failed to open store %d: %v", i, errs[i])
+		}
+		defer s.Close()
+	}
+	if _, ok := m.DefaultMapping.Properties[ExpiresField]; ok {
+		t.Errorf("opening a store changed the shared mapping")
+	}
+
+	for i, s := range stores {
+		if _, err := s.Index("1", map[string]interface{}{"n": i}, WriteOptions{TTL: time.Millisecond}); err != nil {
+			t.Fatalf("failed to index into store %d: %v", i, err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i, s := range stores {
+		if n, err := s.ReapExpired(); err != nil || n != 1 {
+			t.Errorf("expected store %d to delete 1 expired doc, got %d, %v", i, n, err)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	path := "test_changes"
+	defer os.RemoveAll(path)
+
+	opts := DefaultOptions()
+	opts.RetainOperations = 1
+	s, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+
+	s.Index("1", map[string]interface{}{"n": 1.0}, WriteOptions{})
+	s.BatchIndex([]string{"2", "3"}, []map[string]interface{}{{"n": 2.0}, {"n": 3.0}}, nil)
+	s.Delete("1", WriteOptions{})
+
+	changes, cp, err := s.Changes(0, 0)
+	if err != nil {
+		t.Fatalf("failed to read changes: %v", err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, fmt.Sprintf("%d %s %s %d", c.Checkpoint, c.Op, c.ID, c.Version))
+	}
+	want := []string{"1 INDEX 1 1", "2 INDEX 2 1", "2 INDEX 3 1", "3 DELETE 1 2"}
+	if !reflect.DeepEqual(got, want) || cp != 3 {
+		t.Fatalf("unexpected changes %q up to %d", got, cp)
+	}
+	if string(changes[1].Source) != `{"n":2}` {
+		t.Errorf("unexpected source %s", changes[1].Source)
+	}
+
+	// A limit never splits a batch, and resuming continues after it.
+	changes, cp, _ = s.Changes(1, 1)
+	if len(changes) != 2 || cp != 2 {
+		t.Errorf("expected the batch alone, got %d changes up to %d", len(changes), cp)
+	}
+	if changes, cp, _ = s.Changes(cp, 0); len(changes) != 1 || cp != 3 {
+		t.Errorf("expected the delete alone, got %d changes up to %d", len(changes), cp)
+	}
+	if changes, cp, _ = s.Changes(3, 0); len(changes) != 0 || cp != 3 {
+		t.Errorf("expected no new changes, got %d up to %d", len(changes), cp)
+	}
+
+	if err := s.truncateWAL(); err != nil {
+		t.Fatalf("failed to truncate wal: %v", err)
+	}
+	if _, _, err := s.Changes(1, 0); err != nil {
+		t.Errorf("expected retained changes to be readable: %v", err)
+	}
+	if _, _, err := s.Changes(0, 0); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("expected ErrChangesTruncated, got %v", err)
+	}
+}
+
+func TestScanAndHoldChanges(t *testing.T) {
+	path := "test_scan"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		s.Index(id, map[string]interface{}{"id": id}, WriteOptions{})
+	}
+	s.Delete("b", WriteOptions{})
+
+	var got []string
+	after := ""
+	for {
+		page, err := s.Scan(after, 3)
+		if err != nil {
+			t.Fatalf("failed to scan: %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, c := range page {
+			got = append(got, fmt.Sprintf("%s %s %d", c.Op, c.ID, c.Version))
+		}
+		after = page[len(page)-1].ID
+	}
+	want := []string{"INDEX a 1", "DELETE b 2", "INDEX c 1", "INDEX d 1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected scan %q", got)
+	}
+
+	// A hold keeps the changes after its checkpoint through truncation.
+	held := s.HoldChanges("copy", time.Minute)
+	if held != s.Checkpoint() {
+		t.Errorf("expected the hold at checkpoint %d, got %d", s.Checkpoint(), held)
+	}
+	for i := 0; i < 5; i++ {
+		s.Index("e", map[string]interface{}{"n": i}, WriteOptions{})
+	}
+	if again := s.HoldChanges("copy", time.Minute); again != held {
+		t.Errorf("expected extending the hold to keep checkpoint %d, got %d", held, again)
+	}
+	if err := s.truncateWAL(); err != nil {
+		t.Fatalf("failed to truncate wal: %v", err)
+	}
+	if changes, _, err := s.Changes(held, 0); err != nil || len(changes) != 5 {
+		t.Errorf("expected the held changes, got %d, %v", len(changes), err)
+	}
+
+	s.ReleaseChanges("copy")
+	if err := s.truncateWAL(); err != nil {
+		t.Fatalf("failed to truncate wal: %v", err)
+	}
+	if _, _, err := s.Changes(held, 0); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("expected ErrChangesTruncated after the release, got %v", err)
+	}
+}
+
+func TestGetAsOf(t *testing.T) {
+	path := "test_as_of"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+
+	before := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	s.Index("1", map[string]interface{}{"v": "one"}, WriteOptions{})
+	time.Sleep(5 * time.Millisecond)
+	first := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	s.Index("1", map[string]interface{}{"v": "two"}, WriteOptions{})
+	time.Sleep(5 * time.Millisecond)
+	second := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	s.Delete("1", WriteOptions{})
+
+	if doc, err := s.GetAsOf("1", before); err != nil || doc != nil {
+		t.Errorf("expected no doc before it was written, got %v, %v", doc, err)
+	}
+	for _, tc := range []struct {
+		at      time.Time
+		value   string
+		version uint64
+	}{{first, "one", 1}, {second, "two", 2}} {
+		doc, err := s.GetAsOf("1", tc.at)
+		if err != nil || doc == nil {
+			t.Fatalf("failed to get doc as of %v: %v", tc.at, err)
+		}
+		if doc.Source["v"] != tc.value || doc.Version != tc.version {
+			t.Errorf("expected %s at version %d, got %v at version %d", tc.value, tc.version, doc.Source, doc.Version)
+		}
+	}
+	if doc, err := s.GetAsOf("1", time.Now()); err != nil || doc != nil {
+		t.Errorf("expected the doc to be deleted now, got %v, %v", doc, err)
+	}
+
+	// Once the history is truncated, only documents that did not change
+	// since the oldest retained record can be read.
+	s.Index("2", map[string]interface{}{"v": "kept"}, WriteOptions{})
+	if err := s.truncateWAL(); err != nil {
+		t.Fatalf("failed to truncate wal: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if doc, err := s.GetAsOf("2", time.Now()); err != nil || doc == nil {
+		t.Errorf("expected unchanged doc to be readable, got %v, %v", doc, err)
+	}
+	if _, err := s.GetAsOf("1", first); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("expected ErrChangesTruncated, got %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	path := "test_update"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.Update("1", UpdateRequest{Doc: map[string]interface{}{"a": 1.0}}, WriteOptions{}); !errors.Is(err, ErrDocumentMissing) {
+		t.Fatalf("expected ErrDocumentMissing, got %v", err)
+	}
+	res, err := s.Update("1", UpdateRequest{
+		Doc:    map[string]interface{}{"a": 1.0},
+		Upsert: map[string]interface{}{"a": 0.0, "nested": map[string]interface{}{"x": 1.0}},
+	}, WriteOptions{})
+	if err != nil || res.Result != ResultCreated {
+		t.Fatalf("expected upsert to create the doc, got %+v, %v", res, err)
+	}
+
+	// Concurrent updates of different fields must all be kept.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doc := map[string]interface{}{fmt.Sprintf("f%d", i): float64(i)}
+			if _, err := s.Update("1", UpdateRequest{Doc: doc}, WriteOptions{}); err != nil {
+				t.Errorf("update %d failed: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	doc, err := s.Get("1")
+	if err != nil || doc == nil {
+		t.Fatalf("failed to get doc: %v", err)
+	}
+	if len(doc.Source) != 22 || doc.Version != 21 {
+		t.Errorf("expected 22 fields at version 21, got %d at version %d", len(doc.Source), doc.Version)
+	}
+
+	req := UpdateRequest{Doc: map[string]interface{}{"nested": map[string]interface{}{"y": 2.0}}, DetectNoop: true}
+	if res, err := s.Update("1", req, WriteOptions{}); err != nil || res.Result != ResultUpdated {
+		t.Fatalf("expected nested merge to update, got %+v, %v", res, err)
+	}
+	doc, _ = s.Get("1")
+	if !reflect.DeepEqual(doc.Source["nested"], map[string]interface{}{"x": 1.0, "y": 2.0}) {
+		t.Errorf("expected objects to be merged, got %v", doc.Source["nested"])
+	}
+	if res, err := s.Update("1", req, WriteOptions{}); err != nil || res.Result != ResultNoop || res.Version != 22 {
+		t.Errorf("expected a noop at version 22, got %+v, %v", res, err)
+	}
+}
+
+func TestScriptedUpdate(t *testing.T) {
+	path := "test_scripted_update"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+
+	incr := UpdateRequest{
+		Script: &Script{
+			Source: "if (ctx._source.counter == null) { ctx._source.counter = 0 } ctx._source.counter += params.n; ctx._source.tags.add(params.tag)",
+			Params: map[string]interface{}{"n": 2, "tag": "t"},
+		},
+		Upsert: map[string]interface{}{"counter": 0.0, "tags": []interface{}{}},
+	}
+	if _, err := s.Update("1", UpdateRequest{Script: incr.Script}, WriteOptions{}); !errors.Is(err, ErrDocumentMissing) {
+		t.Fatalf("expected ErrDocumentMissing, got %v", err)
+	}
+	if res, err := s.Update("1", incr, WriteOptions{}); err != nil || res.Result != ResultCreated {
+		t.Fatalf("expected upsert to create the doc, got %+v, %v", res, err)
+	}
+
+	// Increments run under the store lock, so none of them is lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Update("1", incr, WriteOptions{}); err != nil {
+				t.Errorf("update failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	doc, err := s.Get("1")
+	if err != nil || doc == nil {
+		t.Fatalf("failed to get doc: %v", err)
+	}
+	if doc.Source["counter"] != 40.0 || len(doc.Source["tags"].([]interface{})) != 20 {
+		t.Errorf("expected counter 40 and 20 tags, got %v", doc.Source)
+	}
+
+	cond := UpdateRequest{Script: &Script{
+		Source: "ctx.op = ctx._source.counter > params.max ? 'delete' : 'none'",
+		Params: map[string]interface{}{"max": 100.0},
+	}}
+	if res, err := s.Update("1", cond, WriteOptions{}); err != nil || res.Result != ResultNoop {
+		t.Errorf("expected a noop, got %+v, %v", res, err)
+	}
+	cond.Script.Params["max"] = 10.0
+	if res, err := s.Update("1", cond, WriteOptions{}); err != nil || res.Result != ResultDeleted {
+		t.Errorf("expected the doc to be deleted, got %+v, %v", res, err)
+	}
+	if doc, _ := s.Get("1"); doc != nil {
+		t.Errorf("expected the doc to be gone, got %v", doc.Source)
+	}
+
+	for _, src := range []string{"ctx._source.x = ", "ctx._source.x = missing", "while (true) {}", "ctx.op = 'drop'", "ctx._source = 1"} {
+		if _, err := s.Update("2", UpdateRequest{Script: &Script{Source: src}, ScriptedUpsert: true}, WriteOptions{}); !errors.Is(err, script.ErrScript) {
+			t.Errorf("expected a script error for %q, got %v", src, err)
+		}
+	}
+
+	// A compiled script is reused, and the params it changes are copies.
+	grow := &Script{
+		Source: "params.tags.add('x'); ctx._source.tags = params.tags; ctx.op = ctx._source.tags.size() > 1 ? 'noop' : 'index'",
+		Params: map[string]interface{}{"tags": []interface{}{}},
+	}
+	if err := grow.Compile(); err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		res, err := s.Update("3", UpdateRequest{Script: grow, ScriptedUpsert: true}, WriteOptions{})
+		if err != nil || res.Result != ResultCreated && res.Result != ResultUpdated {
+			t.Fatalf("expected the doc to be written, got %+v, %v", res, err)
+		}
+	}
+	if doc, _ := s.Get("3"); doc == nil || len(doc.Source["tags"].([]interface{})) != 1 || len(grow.Params["tags"].([]interface{})) != 0 {
+		t.Errorf("expected params to be left unchanged, got %v and %v", doc, grow.Params)
+	}
+
+	// A script storing a document in itself stores a copy, and one growing
+	// it without bound fails instead of taking the node down.
+	self := &Script{Source: "ctx._source.self = ctx._source; ctx._source.self.self = ctx._source"}
+	if _, err := s.Update("3", UpdateRequest{Script: self}, WriteOptions{}); err != nil {
+		t.Errorf("expected the document to be stored as a copy, got %v", err)
+	}
+	double := &Script{Source: "def l = [1]; " + strings.Repeat("l.addAll(l); ", 24) + "ctx._source.l = l"}
+	if _, err := s.Update("3", UpdateRequest{Script: double}, WriteOptions{}); !errors.Is(err, script.ErrScript) {
+		t.Errorf("expected a script error, got %v", err)
+	}
+}
+
+func TestRoutingPersists(t *testing.T) {
+	path := "test_routing"
+	defer os.RemoveAll(path)
+
+	s, err := Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if _, err := s.Index("a", map[string]interface{}{"n": 1}, WriteOptions{Routing: "tenant"}); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	if _, err := s.Index("b", map[string]interface{}{"n": 2}, WriteOptions{}); err != nil {
+		t.Fatalf("failed to index: %v", err)
+	}
+	s.Close()
+
+	s, err = Open(path, DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer s.Close()
+
+	if doc, err := s.Get("a"); err != nil || doc == nil || doc.Routing != "tenant" {
+		t.Errorf("expected doc a with its routing, got %+v, %v", doc, err)
+	}
+	changes, _, err := s.Changes(0, 10)
+	if err != nil || len(changes) != 2 || changes[0].Routing != "tenant" || changes[1].Routing != "" {
+		t.Errorf("unexpected changes %+v, %v", changes, err)
+	}
+	scanned, err := s.Scan("", 10)
+	if err != nil || len(scanned) != 2 || scanned[0].Routing != "tenant" {
+		t.Errorf("unexpected scan %+v, %v", scanned, err)
+	}
+
+	req := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{"a"}))
+	req.Fields = []string{RoutingField}
+	res, err := s.Search(req)
+	if err != nil || len(res.Hits) != 1 || res.Hits[0].Fields[RoutingField] != "tenant" {
+		t.Errorf("expected the routing in the hit, got %+v, %v", res, err)
+	}
+}
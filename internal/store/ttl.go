@@ -0,0 +1,218 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const (
+	// TTLField is the document field that sets the time to live of a
+	// single document. It is removed from the stored source.
+	TTLField = "_ttl"
+	// ExpiresField is the numeric field holding the expiry time of a
+	// document, in Unix milliseconds. It is only indexed, not stored.
+	ExpiresField = "_expires_at"
+)
+
+// DefaultReapInterval is how often expired documents are deleted.
+const DefaultReapInterval = time.Minute
+
+// reapBatchSize bounds how many expired documents are looked up per search.
+const reapBatchSize = 1000
+
+// ParseTTL parses a time to live given as a Go duration, an Elasticsearch
+// time unit such as "7d", or a number of milliseconds.
+func ParseTTL(v interface{}) (time.Duration, error) {
+	var ttl time.Duration
+	switch t := v.(type) {
+	case float64:
+		ttl = time.Duration(t * float64(time.Millisecond))
+	case string:
+		if ms, err := strconv.ParseInt(t, 10, 64); err == nil {
+			ttl = time.Duration(ms) * time.Millisecond
+		} else if days, ok := strings.CutSuffix(t, "d"); ok {
+			n, err := strconv.ParseFloat(days, 64)
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse ttl [%s]", t)
+			}
+			ttl = time.Duration(n * float64(24*time.Hour))
+		} else {
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse ttl [%s]", t)
+			}
+			ttl = d
+		}
+	default:
+		return 0, fmt.Errorf("failed to parse ttl [%v]", v)
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be positive, got [%v]", v)
+	}
+	return ttl, nil
+}
+
+// expiry removes TTLField from data and returns the source to store and the
+// expiry time of the document, or 0 if it does not expire. The TTL in the
+// document takes precedence over opts.TTL, which takes precedence over the
+// index default. data is not modified.
+func (s *Store) expiry(data map[string]interface{}, opts WriteOptions) (map[string]interface{}, int64, error) {
+	ttl := opts.TTL
+	if raw, ok := data[TTLField]; ok {
+		d, err := ParseTTL(raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = d
+		source := make(map[string]interface{}, len(data)-1)
+		for k, v := range data {
+			if k != TTLField {
+				source[k] = v
+			}
+		}
+		data = source
+	}
+	if ttl == 0 {
+		ttl = s.opts.DefaultTTL
+	}
+	if ttl <= 0 {
+		return data, 0, nil
+	}
+	return data, time.Now().Add(ttl).UnixMilli(), nil
+}
+
+// indexedFields returns the fields of a document as they are indexed, which
+// adds ExpiresField to the source of expiring documents.
+func indexedFields(source map[string]interface{}, expiresAt int64) map[string]interface{} {
+	if expiresAt == 0 {
+		return source
+	}
+	fields := make(map[string]interface{}, len(source)+1)
+	for k, v := range source {
+		fields[k] = v
+	}
+	fields[ExpiresField] = float64(expiresAt)
+	return fields
+}
+
+// expired reports whether the document is past its expiry time at now.
+func (m docMeta) expired(now time.Time) bool {
+	return m.ExpiresAt != 0 && m.ExpiresAt <= now.UnixMilli()
+}
+
+// withExpiry returns the mapping with the numeric mapping of ExpiresField
+// added, so that expiry works even when dynamic mapping is disabled. The
+// mapping is shared by the shards of an index, so it is copied rather than
+// changed.
+func withExpiry(m mapping.IndexMapping) mapping.IndexMapping {
+	impl, ok := m.(*mapping.IndexMappingImpl)
+	if !ok || impl.DefaultMapping == nil {
+		return m
+	}
+	if prop, ok := impl.DefaultMapping.Properties[ExpiresField]; ok && len(prop.Fields) > 0 {
+		return m
+	}
+
+	field := bleve.NewNumericFieldMapping()
+	field.Store = false
+	prop := bleve.NewDocumentMapping()
+	prop.AddFieldMapping(field)
+
+	defaults := *impl.DefaultMapping
+	defaults.Properties = make(map[string]*mapping.DocumentMapping, len(impl.DefaultMapping.Properties)+1)
+	for name, p := range impl.DefaultMapping.Properties {
+		defaults.Properties[name] = p
+	}
+	defaults.Properties[ExpiresField] = prop
+	copied := *impl
+	copied.DefaultMapping = &defaults
+	return &copied
+}
+
+// expiredQuery matches the documents that expired at or before now.
+func expiredQuery(now time.Time) query.Query {
+	max := float64(now.UnixMilli())
+	inclusive := true
+	q := bleve.NewNumericRangeInclusiveQuery(nil, &max, nil, &inclusive)
+	q.SetField(ExpiresField)
+	return q
+}
+
+// withoutExpired returns a copy of req that leaves out expired documents.
+func withoutExpired(req *bleve.SearchRequest, now time.Time) *bleve.SearchRequest {
+	q := bleve.NewBooleanQuery()
+	q.AddMust(req.Query)
+	q.AddMustNot(expiredQuery(now))
+	filtered := *req
+	filtered.Query = q
+	return &filtered
+}
+
+func (s *Store) reapLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !s.reaping.Load() {
+				continue
+			}
+			if n, err := s.ReapExpired(); err != nil {
+				fmt.Printf("Failed to delete expired documents of %s: %v\n", s.path, err)
+			} else if n > 0 {
+				fmt.Printf("Deleted %d expired documents of %s\n", n, s.path)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// SetReaper turns the periodic deletion of expired documents on or off, as
+// when a replica of the shard becomes its primary or the other way around.
+func (s *Store) SetReaper(enabled bool) {
+	s.reaping.Store(enabled)
+}
+
+// ReapExpired deletes the documents that have expired and returns how many
+// were deleted. Deletes go through the WAL like any other delete.
+func (s *Store) ReapExpired() (int, error) {
+	reaped := 0
+	for {
+		now := time.Now()
+		req := bleve.NewSearchRequestOptions(expiredQuery(now), reapBatchSize, 0, false)
+		res, err := s.index.Search(req)
+		if err != nil {
+			return reaped, err
+		}
+		deleted := 0
+		for _, hit := range res.Hits {
+			wr, err := s.remove(hit.ID, WriteOptions{}, func(cur docMeta, found bool) bool {
+				return found && !cur.Deleted && cur.expired(now)
+			})
+			if err != nil {
+				return reaped, err
+			}
+			if wr.Result == ResultDeleted {
+				deleted++
+			}
+		}
+		reaped += deleted
+		// Hits that were not deleted have been rewritten since the search,
+		// and would be found again until those writes are applied.
+		if len(res.Hits) < reapBatchSize || deleted == 0 {
+			return reaped, nil
+		}
+		if s.isClosed() {
+			return reaped, ErrClosed
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package store
+
+import (
+	"breeze/internal/script"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// ErrDocumentMissing is returned when a document to update does not exist
+// and the update has no upsert.
+var ErrDocumentMissing = errors.New("document missing")
+
+// ResultNoop is the result of an update that did not change the document.
+const ResultNoop = "noop"
+
+// UpdateRequest describes a partial update of a document.
+type UpdateRequest struct {
+	// Doc is merged into the current source; objects are merged
+	// recursively and other values replaced.
+	Doc map[string]interface{} `json:"doc,omitempty"`
+	// Script modifies the current source instead of Doc.
+	Script *Script `json:"script,omitempty"`
+	// Upsert is indexed as is if the document does not exist.
+	Upsert map[string]interface{} `json:"upsert,omitempty"`
+	// DocAsUpsert indexes Doc if the document does not exist.
+	DocAsUpsert bool `json:"doc_as_upsert,omitempty"`
+	// ScriptedUpsert runs Script on Upsert if the document does not exist,
+	// instead of indexing Upsert as is.
+	ScriptedUpsert bool `json:"scripted_upsert,omitempty"`
+	// DetectNoop skips the write if Doc does not change the document.
+	DetectNoop bool `json:"detect_noop,omitempty"`
+}
+
+// Script is an update script, see package script for the language. It can
+// read and modify ctx._source, and set ctx.op to "delete" to delete the
+// document or to "none" to leave it unchanged.
+type Script struct {
+	Source string                 `json:"source"`
+	Params map[string]interface{} `json:"params,omitempty"`
+
+	// prog is the compiled source, see Compile.
+	prog *script.Script
+}
+
+// Compile compiles the source of the script and keeps the result, so that
+// running it on many documents compiles it once. A script that is not
+// compiled is compiled on every run.
+func (sc *Script) Compile() error {
+	prog, err := script.Compile(sc.Source)
+	if err != nil {
+		return err
+	}
+	sc.prog = prog
+	return nil
+}
+
+// apply returns the operation to write and the new source of a document
+// given its current one, which is nil if the document does not exist. An
+// empty operation with a nil error means the update is a noop.
+func (r UpdateRequest) apply(id string, cur docMeta, doc map[string]interface{}) (Operation, map[string]interface{}, error) {
+	if r.Doc != nil && r.Script != nil {
+		return "", nil, fmt.Errorf("validation failed: can't provide both script and doc")
+	}
+	if doc == nil {
+		switch {
+		case r.Script != nil && r.ScriptedUpsert:
+			upsert := r.Upsert
+			if upsert == nil {
+				upsert = map[string]interface{}{}
+			}
+			return r.Script.run(id, cur, upsert, "create")
+		case r.Upsert != nil:
+			return OpIndex, r.Upsert, nil
+		case r.DocAsUpsert && r.Doc != nil:
+			return OpIndex, r.Doc, nil
+		}
+		return "", nil, ErrDocumentMissing
+	}
+	if r.Script != nil {
+		return r.Script.run(id, cur, doc, "index")
+	}
+	if r.Doc == nil {
+		return "", nil, fmt.Errorf("validation failed: script or doc is missing")
+	}
+	if !mergeSource(doc, r.Doc) && r.DetectNoop {
+		return "", nil, nil
+	}
+	return OpIndex, doc, nil
+}
+
+// run executes the script with ctx.op set to op and returns the operation it
+// selects and the source it leaves in ctx._source.
+func (sc *Script) run(id string, cur docMeta, doc map[string]interface{}, op string) (Operation, map[string]interface{}, error) {
+	prog := sc.prog
+	if prog == nil {
+		var err error
+		if prog, err = script.Compile(sc.Source); err != nil {
+			return "", nil, err
+		}
+	}
+	ctx := map[string]interface{}{
+		"_source":  doc,
+		"_id":      id,
+		"_version": float64(cur.Version),
+		"_now":     float64(time.Now().UnixMilli()),
+		"op":       op,
+	}
+	// Params are copied so that a script changing them does not affect the
+	// next run of the same request.
+	params, err := copySource(sc.Params)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := prog.Run(map[string]interface{}{"ctx": ctx, "params": params}); err != nil {
+		return "", nil, err
+	}
+
+	switch ctx["op"] {
+	case "index", "create":
+		source, ok := ctx["_source"].(map[string]interface{})
+		if !ok {
+			return "", nil, fmt.Errorf("%w: ctx._source must be an object", script.ErrScript)
+		}
+		return OpIndex, source, nil
+	case "delete":
+		if op == "create" {
+			return "", nil, nil
+		}
+		return OpDelete, nil, nil
+	case "none", "noop":
+		return "", nil, nil
+	}
+	return "", nil, fmt.Errorf("%w: invalid ctx.op [%v], expected index, delete or none", script.ErrScript, ctx["op"])
+}
+
+// copySource returns a deep copy of a JSON object.
+func copySource(src map[string]interface{}) (map[string]interface{}, error) {
+	if src == nil {
+		return map[string]interface{}{}, nil
+	}
+	data, err := json.Marshal(src)
+	if err != nil {
+		return nil, err
+	}
+	var dst map[string]interface{}
+	return dst, json.Unmarshal(data, &dst)
+}
+
+// mergeSource merges src into dst and reports whether dst changed.
+func mergeSource(dst, src map[string]interface{}) bool {
+	changed := false
+	for k, v := range src {
+		if sub, ok := v.(map[string]interface{}); ok {
+			if cur, ok := dst[k].(map[string]interface{}); ok {
+				if mergeSource(cur, sub) {
+					changed = true
+				}
+				continue
+			}
+		}
+		if old, ok := dst[k]; !ok || !reflect.DeepEqual(old, v) {
+			dst[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Update applies req to the current version of the document. The read, the
+// merge and the write happen under the store lock, so concurrent updates of
+// a document never overwrite each other. The document keeps its expiry
+// unless the update sets a new TTL.
+func (s *Store) Update(id string, req UpdateRequest, opts WriteOptions) (WriteResult, error) {
+	if s.isClosed() {
+		return WriteResult{}, ErrClosed
+	}
+	if id == "" {
+		return WriteResult{}, fmt.Errorf("document ID cannot be empty")
+	}
+
+	s.mu.Lock()
+	entry, batch, noop, err := s.prepareUpdate(id, req, opts)
+	if err != nil {
+		s.mu.Unlock()
+		return WriteResult{ID: id}, err
+	}
+	if noop != nil {
+		s.mu.Unlock()
+		return *noop, nil
+	}
+	res, err := s.assignVersion(&entry, opts)
+	if err != nil {
+		s.mu.Unlock()
+		return res, err
+	}
+	r, err := s.enqueue(entry, batch)
+	s.mu.Unlock()
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return res, <-r.done
+}
+
+// prepareUpdate builds the entry and index batch of an update, or returns
+// the result of a noop. The caller must hold s.mu.
+func (s *Store) prepareUpdate(id string, req UpdateRequest, opts WriteOptions) (LogEntry, *bleve.Batch, *WriteResult, error) {
+	var entry LogEntry
+	cur, source, found, err := s.current(id)
+	if err != nil {
+		return entry, nil, nil, err
+	}
+	if _, err := nextVersion(id, cur, found, opts); err != nil {
+		return entry, nil, nil, err
+	}
+	var doc map[string]interface{}
+	if cur.exists(found, time.Now()) {
+		if err := json.Unmarshal(source, &doc); err != nil {
+			return entry, nil, nil, err
+		}
+	}
+
+	op, updated, err := req.apply(id, cur, doc)
+	if err != nil {
+		return entry, nil, nil, fmt.Errorf("[%s]: %w", id, err)
+	}
+	if op == OpDelete {
+		entry = LogEntry{Op: OpDelete, ID: id}
+		batch := s.index.NewBatch()
+		batch.Delete(id)
+		return entry, batch, nil, nil
+	}
+	if op == "" {
+		return entry, nil, &WriteResult{
+			ID:          id,
+			Result:      ResultNoop,
+			Version:     cur.Version,
+			SeqNo:       cur.SeqNo,
+			PrimaryTerm: cur.PrimaryTerm,
+		}, nil
+	}
+
+	_, explicitTTL := updated[TTLField]
+	updated, expiresAt, err := s.expiry(updated, opts)
+	if err != nil {
+		return entry, nil, nil, err
+	}
+	if doc != nil && !explicitTTL && opts.TTL == 0 {
+		expiresAt = cur.ExpiresAt
+	}
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return entry, nil, nil, err
+	}
+	entry = LogEntry{Op: OpIndex, ID: id, Source: data, ExpiresAt: expiresAt}
+	batch := s.index.NewBatch()
+	if err := batch.Index(id, indexedFields(updated, expiresAt)); err != nil {
+		return entry, nil, nil, err
+	}
+	return entry, batch, nil, nil
+}
@@ -0,0 +1,390 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrVersionConflict is wrapped by every error caused by a failed
+// optimistic concurrency check.
+var ErrVersionConflict = errors.New("version conflict")
+
+// VersionType selects how WriteOptions.Version is compared with the stored
+// version.
+type VersionType int
+
+const (
+	// VersionInternal requires Version to equal the current version.
+	VersionInternal VersionType = iota
+	// VersionExternal requires Version to be greater than the current
+	// version and stores it as the new version.
+	VersionExternal
+	// VersionExternalGTE is like VersionExternal but also accepts an equal
+	// version.
+	VersionExternalGTE
+)
+
+func ParseVersionType(s string) (VersionType, error) {
+	switch s {
+	case "", "internal":
+		return VersionInternal, nil
+	case "external", "external_gt":
+		return VersionExternal, nil
+	case "external_gte":
+		return VersionExternalGTE, nil
+	}
+	return 0, fmt.Errorf("version type [%s] is not supported", s)
+}
+
+// WriteOptions are the concurrency controls of a single write. Nil fields
+// are not checked.
+type WriteOptions struct {
+	IfSeqNo       *uint64     `json:"if_seq_no,omitempty"`
+	IfPrimaryTerm *uint64     `json:"if_primary_term,omitempty"`
+	Version       *uint64     `json:"version,omitempty"`
+	VersionType   VersionType `json:"version_type,omitempty"`
+	// Create fails the write if the document already exists.
+	Create bool `json:"create,omitempty"`
+	// Routing is stored with the document. It is the key the document was
+	// placed on its shard by, if not its ID.
+	Routing string `json:"routing,omitempty"`
+	// TTL sets the time to live of an indexed document unless the document
+	// has its own TTLField. Zero uses the index default.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// WaitForActiveShards is how many copies of the shard, its primary
+	// included, must be active for the write to proceed. It is checked by
+	// the shard layer; zero uses the index setting.
+	WaitForActiveShards int `json:"wait_for_active_shards,omitempty"`
+	// SeqNo and PrimaryTerm, if not zero, are stored with the write instead
+	// of the next sequence number and the term of the store. A replica
+	// applies the writes of its primary with theirs.
+	SeqNo       uint64 `json:"-"`
+	PrimaryTerm uint64 `json:"-"`
+}
+
+// ActiveShardsAll as WaitForActiveShards waits for every copy of the shard.
+const ActiveShardsAll = -1
+
+const (
+	ResultCreated  = "created"
+	ResultUpdated  = "updated"
+	ResultDeleted  = "deleted"
+	ResultNotFound = "not_found"
+)
+
+// WriteResult describes the outcome of a write. Err is only used for the
+// per-document results of a batch.
+type WriteResult struct {
+	ID          string `json:"id"`
+	Result      string `json:"result"`
+	Version     uint64 `json:"version"`
+	SeqNo       uint64 `json:"seq_no"`
+	PrimaryTerm uint64 `json:"primary_term"`
+	// Shards counts the copies of the shard the write reached. It is filled
+	// in by the shard layer and left zero by a store.
+	Shards ShardInfo `json:"shards"`
+	Err    error     `json:"-"`
+}
+
+// ShardInfo counts the copies of a shard a write was sent to.
+type ShardInfo struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Failed     int `json:"failed"`
+}
+
+// Document is a stored document together with its version metadata.
+type Document struct {
+	ID          string                 `json:"id"`
+	Source      map[string]interface{} `json:"source"`
+	Version     uint64                 `json:"version"`
+	SeqNo       uint64                 `json:"seq_no"`
+	PrimaryTerm uint64                 `json:"primary_term"`
+	Routing     string                 `json:"routing,omitempty"`
+}
+
+// docMeta is the version state kept per document. Deleted documents keep a
+// tombstone so that versions keep increasing across a delete.
+type docMeta struct {
+	Version     uint64
+	SeqNo       uint64
+	PrimaryTerm uint64
+	Deleted     bool
+	// ExpiresAt is the expiry time in Unix milliseconds, 0 if the document
+	// does not expire.
+	ExpiresAt int64
+	Routing   string
+}
+
+// Flags stored in the last byte of an encoded docMeta.
+const (
+	flagDeleted byte = 1 << iota
+	// flagSnappy marks a document store record whose source is compressed.
+	flagSnappy
+	// flagExpires marks metadata followed by an expiry time.
+	flagExpires
+	// flagRouting marks metadata followed by a routing key, after the
+	// expiry time.
+	flagRouting
+)
+
+func (m docMeta) encode() []byte {
+	buf := make([]byte, 0, 4*binary.MaxVarintLen64+1)
+	buf = binary.AppendUvarint(buf, m.Version)
+	buf = binary.AppendUvarint(buf, m.SeqNo)
+	buf = binary.AppendUvarint(buf, m.PrimaryTerm)
+	var flags byte
+	if m.Deleted {
+		flags |= flagDeleted
+	}
+	if m.ExpiresAt != 0 {
+		flags |= flagExpires
+		buf = binary.AppendUvarint(buf, uint64(m.ExpiresAt))
+	}
+	if m.Routing != "" {
+		flags |= flagRouting
+		buf = binary.AppendUvarint(buf, uint64(len(m.Routing)))
+		buf = append(buf, m.Routing...)
+	}
+	return append(buf, flags)
+}
+
+func decodeDocMeta(buf []byte) (docMeta, error) {
+	var m docMeta
+	var n int
+	for _, field := range []*uint64{&m.Version, &m.SeqNo, &m.PrimaryTerm} {
+		*field, n = binary.Uvarint(buf)
+		if n <= 0 {
+			return m, fmt.Errorf("invalid document metadata")
+		}
+		buf = buf[n:]
+	}
+	if len(buf) == 0 {
+		return m, fmt.Errorf("invalid document metadata")
+	}
+	flags := buf[len(buf)-1]
+	buf = buf[:len(buf)-1]
+	if flags&flagExpires != 0 {
+		expires, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return m, fmt.Errorf("invalid document metadata")
+		}
+		m.ExpiresAt = int64(expires)
+		buf = buf[n:]
+	}
+	if flags&flagRouting != 0 {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			return m, fmt.Errorf("invalid document metadata")
+		}
+		m.Routing = string(buf[n : n+int(size)])
+		buf = buf[n+int(size):]
+	}
+	if len(buf) != 0 {
+		return m, fmt.Errorf("invalid document metadata")
+	}
+	m.Deleted = flags&flagDeleted != 0
+	return m, nil
+}
+
+// exists reports whether the document is live at now.
+func (m docMeta) exists(found bool, now time.Time) bool {
+	return found && !m.Deleted && !m.expired(now)
+}
+
+func conflictf(id, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: [%s]: version conflict, %s", ErrVersionConflict, id, fmt.Sprintf(format, args...))
+}
+
+// nextVersion checks opts against the current state of a document and
+// returns the version the write should store.
+// An expired document counts as missing, but its version is still
+// continued.
+func nextVersion(id string, cur docMeta, found bool, opts WriteOptions) (uint64, error) {
+	exists := cur.exists(found, time.Now())
+
+	if opts.Create && exists {
+		return 0, conflictf(id, "document already exists (current version [%d])", cur.Version)
+	}
+
+	if opts.IfSeqNo != nil || opts.IfPrimaryTerm != nil {
+		var seqNo, term uint64
+		if opts.IfSeqNo != nil {
+			seqNo = *opts.IfSeqNo
+		}
+		if opts.IfPrimaryTerm != nil {
+			term = *opts.IfPrimaryTerm
+		}
+		if !exists {
+			return 0, conflictf(id, "required seqNo [%d], primary term [%d] but no document was found", seqNo, term)
+		}
+		if (opts.IfSeqNo != nil && cur.SeqNo != seqNo) || (opts.IfPrimaryTerm != nil && cur.PrimaryTerm != term) {
+			return 0, conflictf(id, "required seqNo [%d], primary term [%d]. current document has seqNo [%d] and primary term [%d]",
+				seqNo, term, cur.SeqNo, cur.PrimaryTerm)
+		}
+	}
+
+	if opts.Version != nil {
+		v := *opts.Version
+		switch opts.VersionType {
+		case VersionInternal:
+			if !exists || cur.Version != v {
+				current := uint64(0)
+				if exists {
+					current = cur.Version
+				}
+				return 0, conflictf(id, "current version [%d] is different than the one provided [%d]", current, v)
+			}
+		case VersionExternal:
+			if found && v <= cur.Version {
+				return 0, conflictf(id, "current version [%d] is higher or equal to the one provided [%d]", cur.Version, v)
+			}
+			return v, nil
+		case VersionExternalGTE:
+			if found && v < cur.Version {
+				return 0, conflictf(id, "current version [%d] is higher than the one provided [%d]", cur.Version, v)
+			}
+			return v, nil
+		}
+	}
+
+	if found {
+		return cur.Version + 1, nil
+	}
+	return 1, nil
+}
+
+// loadSequence restores the last sequence number and the primary term.
+func (s *Store) loadSequence() error {
+	seq, err := s.docs.getUint64("seq_no")
+	if err != nil {
+		return err
+	}
+	s.seqNo = seq
+
+	term, err := s.docs.getUint64("primary_term")
+	if err != nil {
+		return err
+	}
+	if term > 0 {
+		s.primaryTerm = term
+		return nil
+	}
+	s.primaryTerm = 1
+	return s.docs.setUint64("primary_term", s.primaryTerm)
+}
+
+// SetPrimaryTerm raises the primary term stamped on new operations to term,
+// when the shard got a new primary. A lower term is ignored.
+func (s *Store) SetPrimaryTerm(term uint64) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if term <= s.primaryTerm {
+		return nil
+	}
+	if err := s.docs.setUint64("primary_term", term); err != nil {
+		return err
+	}
+	s.primaryTerm = term
+	return nil
+}
+
+// liveDoc is a write that is queued but not applied yet.
+type liveDoc struct {
+	docMeta
+	Source []byte
+}
+
+// meta returns the latest metadata of a document, including writes that are
+// queued but not applied yet. The caller must hold s.mu.
+func (s *Store) meta(id string) (docMeta, bool, error) {
+	m, _, found, err := s.current(id)
+	return m, found, err
+}
+
+// current returns the latest metadata and source of a document, including
+// writes that are queued but not applied yet. The caller must hold s.mu.
+func (s *Store) current(id string) (docMeta, []byte, bool, error) {
+	s.liveMu.Lock()
+	d, ok := s.live[id]
+	s.liveMu.Unlock()
+	if ok {
+		return d.docMeta, d.Source, true, nil
+	}
+	return s.docs.get(id)
+}
+
+// assignVersion checks opts against the current state of entry.ID and stamps
+// entry with its new version, sequence number and primary term. The caller
+// must hold s.mu and enqueue the entry before releasing it.
+func (s *Store) assignVersion(entry *LogEntry, opts WriteOptions) (WriteResult, error) {
+	cur, found, err := s.meta(entry.ID)
+	if err != nil {
+		return WriteResult{ID: entry.ID}, err
+	}
+	version, err := nextVersion(entry.ID, cur, found, opts)
+	if err != nil {
+		return WriteResult{ID: entry.ID}, err
+	}
+
+	entry.Routing = opts.Routing
+	entry.Version = version
+	if opts.SeqNo > 0 {
+		entry.SeqNo = opts.SeqNo
+		s.seqNo = max(s.seqNo, opts.SeqNo)
+	} else {
+		s.seqNo++
+		entry.SeqNo = s.seqNo
+	}
+	entry.PrimaryTerm = s.primaryTerm
+	if opts.PrimaryTerm > 0 {
+		entry.PrimaryTerm = opts.PrimaryTerm
+	}
+	entry.Timestamp = time.Now().UnixMilli()
+
+	res := WriteResult{
+		ID:          entry.ID,
+		Result:      ResultCreated,
+		Version:     version,
+		SeqNo:       entry.SeqNo,
+		PrimaryTerm: entry.PrimaryTerm,
+	}
+	if entry.Op == OpDelete {
+		res.Result = ResultDeleted
+	} else if cur.exists(found, time.Now()) {
+		res.Result = ResultUpdated
+	}
+
+	s.liveMu.Lock()
+	s.live[entry.ID] = liveDoc{
+		docMeta: docMeta{
+			Version:     entry.Version,
+			SeqNo:       entry.SeqNo,
+			PrimaryTerm: entry.PrimaryTerm,
+			Deleted:     entry.Op == OpDelete,
+			ExpiresAt:   entry.ExpiresAt,
+			Routing:     entry.Routing,
+		},
+		Source: entry.Source,
+	}
+	s.liveMu.Unlock()
+	return res, nil
+}
+
+// forgetApplied drops live metadata that the index now reflects.
+func (s *Store) forgetApplied(entry LogEntry) {
+	if entry.Op == OpBatch {
+		for _, op := range entry.Ops {
+			s.forgetApplied(op)
+		}
+		return
+	}
+	if m, ok := s.live[entry.ID]; ok && m.SeqNo == entry.SeqNo {
+		delete(s.live, entry.ID)
+	}
+}